@@ -0,0 +1,114 @@
+package captcha
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Well known siteverify endpoints. Both services, like reCAPTCHA, take the
+// same request and answer with the same fields.
+const (
+	HCaptchaURL  = "https://api.hcaptcha.com/siteverify"
+	TurnstileURL = "https://challenges.cloudflare.com/turnstile/v0/siteverify"
+)
+
+// FakePassToken is the only token the fake verifier accepts.
+const FakePassToken = "pass"
+
+var ErrRejected = errors.New("captcha token rejected")
+
+// Verifier checks the tokens the captcha widget hands the browser against
+// the service's siteverify endpoint.
+type Verifier struct {
+	URL    string
+	Secret string
+
+	Client *http.Client
+}
+
+type response struct {
+	Success    bool     `json:"success"`
+	ErrorCodes []string `json:"error-codes"`
+}
+
+// Verify returns nil if the service accepts token, ErrRejected, wrapped with
+// its error codes, if it doesn't, and any other error if it couldn't be
+// asked.
+func (v *Verifier) Verify(ctx context.Context, token, remoteIP string) error {
+	if token == "" {
+		return fmt.Errorf("%w: missing token", ErrRejected)
+	}
+
+	form := url.Values{"secret": {v.Secret}, "response": {token}}
+	if remoteIP != "" {
+		form.Set("remoteip", remoteIP)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := v.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach captcha verifier: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("captcha verifier answered %s", resp.Status)
+	}
+
+	var r response
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&r); err != nil {
+		return fmt.Errorf("failed to decode captcha verifier response: %w", err)
+	}
+
+	if !r.Success {
+		return fmt.Errorf("%w: %s", ErrRejected, strings.Join(r.ErrorCodes, ", "))
+	}
+
+	return nil
+}
+
+// FakeHandler answers like a siteverify endpoint, accepting FakePassToken
+// and rejecting anything else, so the server can be run against it locally.
+func FakeHandler(secret string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var resp response
+		switch {
+		case r.PostForm.Get("secret") != secret:
+			resp.ErrorCodes = []string{"invalid-input-secret"}
+		case r.PostForm.Get("response") == "":
+			resp.ErrorCodes = []string{"missing-input-response"}
+		case r.PostForm.Get("response") != FakePassToken:
+			resp.ErrorCodes = []string{"invalid-input-response"}
+		default:
+			resp.Success = true
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+}
@@ -0,0 +1,23 @@
+// Command fakecaptcha serves a stand-in for a captcha siteverify endpoint,
+// for running the server with -captchaurl pointing at it during development.
+// It accepts the token "pass" and rejects anything else.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"github.com/Carbon-X-DAO/CieloVerde.io/captcha"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:8089", "address to listen on")
+	secret := flag.String("secret", "fake-secret", "secret the server must send")
+	flag.Parse()
+
+	http.Handle("/siteverify", captcha.FakeHandler(*secret))
+
+	log.Printf("fake captcha verifier on http://%s/siteverify accepting %q", *addr, captcha.FakePassToken)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
@@ -0,0 +1,37 @@
+// Command fakeoidc serves a stand-in OpenID Connect provider, for running the
+// server with -oidcissuer pointing at it during development. Every login
+// succeeds as the user given by the flags.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/Carbon-X-DAO/CieloVerde.io/oidc"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:8090", "address to listen on")
+	clientID := flag.String("clientid", "cieloverde", "client ID the server must use")
+	subject := flag.String("sub", "fake-user", "subject of the logged in user")
+	username := flag.String("username", "fake", "preferred_username of the logged in user")
+	email := flag.String("email", "fake@example.com", "email of the logged in user")
+	groups := flag.String("groups", "organizers", "comma separated groups of the logged in user")
+	flag.Parse()
+
+	issuer := "http://" + *addr
+	provider, err := oidc.NewFakeProvider(issuer, *clientID, map[string]interface{}{
+		"sub":                *subject,
+		"preferred_username": *username,
+		"email":              *email,
+		"groups":             strings.Split(*groups, ","),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("fake OIDC provider at %s for client %q, logging everyone in as %s", issuer, *clientID, *subject)
+	log.Fatal(http.ListenAndServe(*addr, provider))
+}
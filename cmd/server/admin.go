@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	fileserver "github.com/Carbon-X-DAO/CieloVerde.io/fileserver"
+)
+
+const adminUsage = `usage:
+	server admin [flags] create <username> <owner|admin|scanner|viewer> [email]
+	server admin [flags] disable <username>
+	server admin [flags] reset <username>
+	server admin [flags] logout <username>
+	server admin [flags] reset2fa <username>
+	server admin [flags] verify-audit
+	server admin [flags] backfill-places
+
+create and reset read the new password from the first line of standard input.
+reset also lifts a lockout caused by failed logins. verify-audit checks the
+hash chain of the audit log. backfill-places gives DIVIPOLA codes to
+registrations made before places were checked.`
+
+// runAdminCommand manages admin accounts from the command line so that no
+// credentials ever need to be passed as flags.
+func runAdminCommand(db *sql.DB, args []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if len(args) == 1 && args[0] == "verify-audit" {
+		checked, broken, err := fileserver.VerifyAudit(ctx, db)
+		if err != nil {
+			return err
+		}
+		if broken != 0 {
+			return fmt.Errorf("audit log is broken at entry %d after %d intact entries", broken, checked)
+		}
+		log.Printf("audit log intact, %d entries checked", checked)
+		return nil
+	}
+
+	if len(args) == 1 && args[0] == "backfill-places" {
+		// every registration may need updating
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		defer cancel()
+
+		n, err := fileserver.BackfillPlaces(ctx, db)
+		if err != nil {
+			return err
+		}
+		log.Printf("gave DIVIPOLA codes to %d registrations", n)
+		if err := fileserver.AuditCommand(ctx, db, "cli", "backfill_places", "form_info", map[string]int{"updated": n}); err != nil {
+			log.Printf("failed to record backfill_places in the audit log: %s", err)
+		}
+		return nil
+	}
+
+	if len(args) < 2 {
+		return errors.New(adminUsage)
+	}
+
+	username := args[1]
+
+	switch {
+	case args[0] == "create" && (len(args) == 3 || len(args) == 4):
+		role, err := fileserver.ParseRole(args[2])
+		if err != nil {
+			return err
+		}
+
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+
+		var email string
+		if len(args) == 4 {
+			email = args[3]
+		}
+
+		if err := fileserver.CreateAdmin(ctx, db, username, password, role, email); err != nil {
+			return err
+		}
+		log.Printf("created %s account %s", role, username)
+		auditCommand(ctx, db, "admin_create", username, map[string]string{"role": string(role)})
+	case args[0] == "disable" && len(args) == 2:
+		if err := fileserver.DisableAdmin(ctx, db, username); err != nil {
+			return fmt.Errorf("failed to disable %s: %w", username, err)
+		}
+		log.Printf("disabled account %s", username)
+		auditCommand(ctx, db, "admin_disable", username, nil)
+	case args[0] == "reset" && len(args) == 2:
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+
+		if err := fileserver.ResetAdminPassword(ctx, db, username, password); err != nil {
+			return fmt.Errorf("failed to reset %s: %w", username, err)
+		}
+		log.Printf("reset password of account %s", username)
+		auditCommand(ctx, db, "admin_reset_password", username, nil)
+	case args[0] == "logout" && len(args) == 2:
+		if err := fileserver.LogoutAdmin(ctx, db, username); err != nil {
+			return err
+		}
+		log.Printf("ended all sessions of account %s", username)
+		auditCommand(ctx, db, "logout", username, map[string]bool{"all": true})
+	case args[0] == "reset2fa" && len(args) == 2:
+		if err := fileserver.ResetTwoFactor(ctx, db, username); err != nil {
+			return fmt.Errorf("failed to reset two factor authentication of %s: %w", username, err)
+		}
+		log.Printf("reset two factor authentication of account %s", username)
+		auditCommand(ctx, db, "2fa_reset", username, nil)
+	default:
+		return errors.New(adminUsage)
+	}
+
+	return nil
+}
+
+// auditCommand records a command in the audit log. The change is already
+// made, so a failure is only reported.
+func auditCommand(ctx context.Context, db *sql.DB, action, username string, after interface{}) {
+	if err := fileserver.AuditCommand(ctx, db, "cli", action, "admin:"+username, after); err != nil {
+		log.Printf("failed to record %s of %s in the audit log: %s", action, username, err)
+	}
+}
+
+func readPassword() (string, error) {
+	fmt.Fprint(os.Stderr, "password: ")
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("failed to read password from stdin: %w", err)
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
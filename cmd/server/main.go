@@ -2,20 +2,30 @@ package main
 
 import (
 	"context"
+	"crypto/rsa"
 	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
 	"time"
 
+	"github.com/Carbon-X-DAO/CieloVerde.io/captcha"
 	fileserver "github.com/Carbon-X-DAO/CieloVerde.io/fileserver"
+	"github.com/Carbon-X-DAO/CieloVerde.io/oidc"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
 	_ "github.com/lib/pq"
+	dsig "github.com/russellhaering/goxmldsig"
 
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/golang-migrate/migrate/v4/database/postgres"
@@ -24,23 +34,54 @@ import (
 )
 
 var (
-	flagAddress        string
-	flagAdminUser      string
-	flagAdminPassword  string
-	flagMailgunAPIKey  string
-	flagFlyerFilename  string
-	flagDBName         string
-	flagRoot           string
-	flagDBRole         string
-	flagCertFile       string
-	flagKeyFile        string
-	flagShibbolethGUID string
+	flagAddress          string
+	flagMailgunAPIKey    string
+	flagFlyerFilename    string
+	flagDBName           string
+	flagRoot             string
+	flagDBRole           string
+	flagCertFile         string
+	flagKeyFile          string
+	flagSessionIdle      time.Duration
+	flagSessionMax       time.Duration
+	flagVerifyFor        time.Duration
+	flagMinAge           int
+	flagInsecureCookies  bool
+	flagAllowedOrigins   string
+	flagTrustedProxies   string
+	flagEnforce2FA       bool
+	flagTrustIdP2FA      bool
+	flagPasswordLogin    bool
+	flagUniqueEmail      bool
+	flagUniquePhone      bool
+	flagOIDCIssuer       string
+	flagOIDCClientID     string
+	flagOIDCClientSecret string
+	flagOIDCRedirectURL  string
+	flagOIDCScopes       string
+	flagOIDCRolesClaim   string
+	flagOIDCRoles        string
+	flagSAMLIDPMetadata  string
+	flagSAMLRootURL      string
+	flagSAMLCertFile     string
+	flagSAMLKeyFile      string
+	flagSAMLUsernameAttr string
+	flagSAMLSubjectAttr  string
+	flagSAMLEmailAttr    string
+	flagSAMLRolesAttr    string
+	flagSAMLRoles        string
+	flagSecret           string
+	flagHoneypot         bool
+	flagMinFillTime      time.Duration
+	flagPoWBits          int
+	flagCaptchaURL       string
+	flagCaptchaSecret    string
+	flagDefaultEvent     string
+	flagFormSchema       string
 )
 
 func init() {
 	flag.StringVar(&flagAddress, "address", "0.0.0.0:80", "address on which to listen")
-	flag.StringVar(&flagAdminUser, "adminuser", "cielo", "username of admin")
-	flag.StringVar(&flagAdminPassword, "adminpassword", "verde", "password of admin")
 
 	flag.StringVar(&flagMailgunAPIKey, "mg", "", "priavte Mailgun API key")
 	flag.StringVar(&flagRoot, "root", "./result/static", "root path to site")
@@ -49,11 +90,54 @@ func init() {
 	flag.StringVar(&flagDBRole, "role", "postgres", "postgres DB user role")
 	flag.StringVar(&flagCertFile, "cert", "example.crt", "TLS certificate file")
 	flag.StringVar(&flagKeyFile, "key", "example.key", "TLS certificate signing key file")
-	flag.StringVar(&flagShibbolethGUID, "guid", "5f9f3021-845e-4a21-a63c-2f7f75262649", "a special token that admins need")
-	flag.Parse()
+	flag.DurationVar(&flagSessionIdle, "sessionidle", 2*time.Hour, "admin sessions end after this long without a request")
+	flag.DurationVar(&flagSessionMax, "sessionmax", 14*time.Hour, "admin sessions end this long after login")
+	flag.DurationVar(&flagVerifyFor, "verifyfor", 48*time.Hour, "registrations whose email isn't confirmed within this long are deleted")
+	flag.IntVar(&flagMinAge, "minage", 18, "minimum age to register for any event; events can ask for more")
+	flag.StringVar(&flagAllowedOrigins, "origins", "https://cieloverde.io", "comma separated scheme://host origins, besides the server's own host, allowed to POST")
+	flag.StringVar(&flagTrustedProxies, "trustedproxies", "", "comma separated CIDRs of proxies, besides Cloudflare's, trusted to pass the client address in CF-Connecting-IP")
+	flag.BoolVar(&flagEnforce2FA, "enforce2fa", false, "require TOTP enrollment for every admin whose role can export data")
+	flag.BoolVar(&flagTrustIdP2FA, "trustidp2fa", false, "exempt admins logging in through OIDC or SAML from TOTP, trusting their identity provider to require a second factor")
+	flag.BoolVar(&flagPasswordLogin, "passwordlogin", true, "allow admins to log in with a username and password")
+	flag.BoolVar(&flagUniqueEmail, "uniqueemail", false, "reject registrations whose email is already registered")
+	flag.BoolVar(&flagUniquePhone, "uniquephone", false, "reject registrations whose phone is already registered")
+	flag.StringVar(&flagOIDCIssuer, "oidcissuer", "", "issuer URL of the OpenID Connect provider for staff login; empty disables OIDC")
+	flag.StringVar(&flagOIDCClientID, "oidcclientid", "", "OIDC client ID")
+	flag.StringVar(&flagOIDCClientSecret, "oidcclientsecret", "", "OIDC client secret, empty for public clients")
+	flag.StringVar(&flagOIDCRedirectURL, "oidcredirect", "https://cieloverde.io/login/oidc/callback", "OIDC redirect URL registered with the provider")
+	flag.StringVar(&flagOIDCScopes, "oidcscopes", "email,profile,groups", "comma separated OIDC scopes to request besides openid")
+	flag.StringVar(&flagOIDCRolesClaim, "oidcrolesclaim", "groups", "ID token claim listing the user's groups")
+	flag.StringVar(&flagOIDCRoles, "oidcroles", "", "comma separated group=role pairs, e.g. organizers=admin,volunteers=scanner")
+	flag.StringVar(&flagSAMLIDPMetadata, "samlidp", "", "URL or path of the SAML identity provider metadata; empty disables SAML")
+	flag.StringVar(&flagSAMLRootURL, "samlroot", "https://cieloverde.io", "public URL of this server, used for the SAML entity ID and endpoints")
+	flag.StringVar(&flagSAMLCertFile, "samlcert", "", "certificate of the SAML service provider")
+	flag.StringVar(&flagSAMLKeyFile, "samlkey", "", "RSA signing key of the SAML service provider")
+	flag.StringVar(&flagSAMLSubjectAttr, "samlsubjectattr", "", "SAML attribute identifying the account, e.g. subject-id; if empty the NameID does and must be persistent")
+	flag.StringVar(&flagSAMLUsernameAttr, "samlusernameattr", "eduPersonPrincipalName", "SAML attribute used as the admin username, instead of the NameID")
+	flag.StringVar(&flagSAMLEmailAttr, "samlemailattr", "mail", "SAML attribute holding the admin email")
+	flag.StringVar(&flagSAMLRolesAttr, "samlrolesattr", "eduPersonAffiliation", "SAML attribute whose values are mapped to roles")
+	flag.StringVar(&flagSAMLRoles, "samlroles", "", "comma separated value=role pairs for -samlrolesattr, e.g. staff=scanner")
+	flag.StringVar(&flagSecret, "secret", "", "key signing the links emailed to attendees, at least 16 bytes; required")
+	flag.BoolVar(&flagHoneypot, "honeypot", true, "reject registrations filling in the hidden \"website\" field")
+	flag.DurationVar(&flagMinFillTime, "minfilltime", 0, "reject registrations submitted sooner than this after fetching /challenge; 0 turns it off")
+	flag.IntVar(&flagPoWBits, "powbits", 0, "leading zero bits of the proof of work registrations must solve; 0 turns it off")
+	flag.StringVar(&flagCaptchaURL, "captchaurl", captcha.HCaptchaURL, "siteverify URL of the captcha service, e.g. "+captcha.TurnstileURL)
+	flag.StringVar(&flagCaptchaSecret, "captchasecret", "", "captcha secret key; setting it requires a captcha token with every registration")
+	flag.StringVar(&flagDefaultEvent, "defaultevent", "marcha-2021", "slug of the event the legacy /submit and /api/registrations URLs register for")
+	flag.StringVar(&flagFormSchema, "formschema", "", "JSON file with custom questions to add to the registration form")
+	flag.BoolVar(&flagInsecureCookies, "insecurecookies", false, "omit the Secure flag on cookies, for local development over plain HTTP")
 }
 
 func main() {
+	// "server admin [flags] <command>" manages accounts instead of serving;
+	// it comes before the flags so it can't be taken for the root path
+	args := os.Args[1:]
+	adminCommand := len(args) > 0 && args[0] == "admin"
+	if adminCommand {
+		args = args[1:]
+	}
+	flag.CommandLine.Parse(args)
+
 	dbHost := "localhost"
 	dbPort := 5432
 	dbName := "postgres"
@@ -105,6 +189,13 @@ func main() {
 		log.Println("DB already up to date :)")
 	}
 
+	if adminCommand {
+		if err := runAdminCommand(db, flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	var root string
 
 	if len(flag.Args()) > 0 {
@@ -136,14 +227,78 @@ func main() {
 		log.Fatal("both cert file and key file must be either non-empty or empty")
 	}
 
-	srv, err := fileserver.New(flagAddress, flagAdminUser, flagAdminPassword, flagShibbolethGUID, flagMailgunAPIKey, flagFlyerFilename, root, tlsConfig, db)
+	oidcConfig, err := oidcConfigFromFlags()
+	if err != nil {
+		log.Fatalf("invalid OIDC configuration: %s", err)
+	}
+
+	samlConfig, err := samlConfigFromFlags()
+	if err != nil {
+		log.Fatalf("invalid SAML configuration: %s", err)
+	}
+
+	var trustedProxies []*net.IPNet
+	for _, cidr := range splitList(flagTrustedProxies) {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Fatalf("invalid -trustedproxies: %s", err)
+		}
+		trustedProxies = append(trustedProxies, n)
+	}
+
+	challenge, err := challengeConfigFromFlags()
+	if err != nil {
+		log.Fatalf("invalid bot protection configuration: %s", err)
+	}
+
+	var schema *fileserver.FormSchema
+	if flagFormSchema != "" {
+		if schema, err = fileserver.LoadFormSchema(flagFormSchema); err != nil {
+			log.Fatalf("failed to load form schema: %s", err)
+		}
+	}
+
+	// a random secret would break the links already emailed on every
+	// restart, and differ between instances
+	secret := []byte(flagSecret)
+	if len(secret) == 0 {
+		log.Fatal("-secret is required")
+	} else if len(secret) < 16 {
+		log.Fatal("-secret must be at least 16 bytes long")
+	}
+
+	srv, err := fileserver.New(fileserver.Config{
+		Addr:            flagAddress,
+		MailgunAPIKey:   flagMailgunAPIKey,
+		FlyerFilename:   flagFlyerFilename,
+		FrontendRoot:    root,
+		TLSConfig:       tlsConfig,
+		SessionIdle:     flagSessionIdle,
+		SessionMax:      flagSessionMax,
+		VerifyFor:       flagVerifyFor,
+		MinAge:          flagMinAge,
+		InsecureCookies: flagInsecureCookies,
+		AllowedOrigins:  splitList(flagAllowedOrigins),
+		TrustedProxies:  trustedProxies,
+		Enforce2FA:      flagEnforce2FA,
+		TrustIdP2FA:     flagTrustIdP2FA,
+		PasswordLogin:   flagPasswordLogin,
+		OIDC:            oidcConfig,
+		SAML:            samlConfig,
+		Challenge:       challenge,
+		Schema:          schema,
+		DefaultEvent:    flagDefaultEvent,
+		UniqueEmail:     flagUniqueEmail,
+		UniquePhone:     flagUniquePhone,
+		Secret:          secret,
+	}, db)
 	if err != nil {
 		log.Fatalf("failed to create a new fileserver instance: %s", err)
 	}
 
 	log.Printf("starting a fileserver for root path: %s", root)
 
-	killed := make(chan os.Signal)
+	killed := make(chan os.Signal, 1)
 	signal.Notify(killed, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
 
 	serverShutdown := make(chan bool)
@@ -168,3 +323,173 @@ func main() {
 	<-serverShutdown
 	log.Printf("server has shut down... Exiting.")
 }
+
+// splitList splits a comma separated flag value, dropping empty elements.
+func splitList(s string) []string {
+	var list []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+
+	return list
+}
+
+// oidcConfigFromFlags returns nil when no OIDC issuer is configured.
+func oidcConfigFromFlags() (*fileserver.OIDCConfig, error) {
+	if flagOIDCIssuer == "" {
+		return nil, nil
+	}
+
+	if flagOIDCClientID == "" || flagOIDCRedirectURL == "" {
+		return nil, errors.New("both -oidcclientid and -oidcredirect are required with -oidcissuer")
+	}
+
+	roleMap, err := parseRoleMap("-oidcroles", flagOIDCRoles)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileserver.OIDCConfig{
+		Provider: &oidc.Provider{
+			Issuer:       flagOIDCIssuer,
+			ClientID:     flagOIDCClientID,
+			ClientSecret: flagOIDCClientSecret,
+			RedirectURL:  flagOIDCRedirectURL,
+			Scopes:       splitList(flagOIDCScopes),
+			Client:       &http.Client{Timeout: 15 * time.Second},
+		},
+		RolesClaim: flagOIDCRolesClaim,
+		RoleMap:    roleMap,
+	}, nil
+}
+
+func challengeConfigFromFlags() (*fileserver.ChallengeConfig, error) {
+	if flagMinFillTime < 0 || flagPoWBits < 0 || flagPoWBits > 32 {
+		return nil, errors.New("-minfilltime must not be negative and -powbits must be between 0 and 32")
+	}
+
+	c := &fileserver.ChallengeConfig{
+		Honeypot:    flagHoneypot,
+		MinFillTime: flagMinFillTime,
+		PoWBits:     flagPoWBits,
+	}
+	if flagCaptchaSecret != "" {
+		c.Captcha = &captcha.Verifier{
+			URL:    flagCaptchaURL,
+			Secret: flagCaptchaSecret,
+			Client: &http.Client{Timeout: 10 * time.Second},
+		}
+	}
+
+	if !c.Honeypot && c.MinFillTime == 0 && c.PoWBits == 0 && c.Captcha == nil {
+		return nil, nil
+	}
+
+	return c, nil
+}
+
+// parseRoleMap parses comma separated value=role pairs.
+func parseRoleMap(name, s string) (map[string]fileserver.Role, error) {
+	roleMap := make(map[string]fileserver.Role)
+	for _, pair := range splitList(s) {
+		i := strings.LastIndex(pair, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("%s entry %q is not value=role", name, pair)
+		}
+
+		role, err := fileserver.ParseRole(pair[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		roleMap[pair[:i]] = role
+	}
+
+	if len(roleMap) == 0 {
+		return nil, fmt.Errorf("%s must map at least one value to a role", name)
+	}
+
+	return roleMap, nil
+}
+
+// samlConfigFromFlags returns nil when no SAML identity provider is configured.
+func samlConfigFromFlags() (*fileserver.SAMLConfig, error) {
+	if flagSAMLIDPMetadata == "" {
+		return nil, nil
+	}
+
+	if flagSAMLCertFile == "" || flagSAMLKeyFile == "" {
+		return nil, errors.New("both -samlcert and -samlkey are required with -samlidp")
+	}
+
+	roleMap, err := parseRoleMap("-samlroles", flagSAMLRoles)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPair, err := tls.LoadX509KeyPair(flagSAMLCertFile, flagSAMLKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load SAML key pair: %w", err)
+	}
+	cert, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SAML certificate: %w", err)
+	}
+	key, ok := keyPair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("the SAML key must be an RSA key")
+	}
+
+	root, err := url.Parse(strings.TrimSuffix(flagSAMLRootURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid -samlroot: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	client := &http.Client{Timeout: 15 * time.Second}
+
+	// the NameID identifies the account unless an attribute does
+	nameIDFormat := saml.PersistentNameIDFormat
+	if flagSAMLSubjectAttr != "" {
+		nameIDFormat = saml.UnspecifiedNameIDFormat
+	}
+
+	var idpMetadata *saml.EntityDescriptor
+	if u, err := url.Parse(flagSAMLIDPMetadata); err == nil && (u.Scheme == "https" || u.Scheme == "http") {
+		idpMetadata, err = samlsp.FetchMetadata(ctx, client, *u)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch identity provider metadata: %w", err)
+		}
+	} else {
+		buf, err := os.ReadFile(flagSAMLIDPMetadata)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read identity provider metadata: %w", err)
+		}
+		idpMetadata, err = samlsp.ParseMetadata(buf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse identity provider metadata: %w", err)
+		}
+	}
+
+	return &fileserver.SAMLConfig{
+		ServiceProvider: &saml.ServiceProvider{
+			EntityID:          root.ResolveReference(&url.URL{Path: "/saml/metadata"}).String(),
+			Key:               key,
+			Certificate:       cert,
+			HTTPClient:        client,
+			MetadataURL:       *root.ResolveReference(&url.URL{Path: "/saml/metadata"}),
+			AcsURL:            *root.ResolveReference(&url.URL{Path: "/saml/acs"}),
+			IDPMetadata:       idpMetadata,
+			AuthnNameIDFormat: nameIDFormat,
+			SignatureMethod:   dsig.RSASHA256SignatureMethod,
+		},
+		SubjectAttribute:  flagSAMLSubjectAttr,
+		UsernameAttribute: flagSAMLUsernameAttr,
+		EmailAttribute:    flagSAMLEmailAttr,
+		RolesAttribute:    flagSAMLRolesAttr,
+		RoleMap:           roleMap,
+	}, nil
+}
@@ -0,0 +1,289 @@
+package fileserver
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	querySelectAdmin = `SELECT id, username, password_hash, role, disabled, totp_secret, totp_enabled, totp_last_step,
+		external_subject IS NOT NULL
+	FROM admins WHERE username=$1`
+
+	queryInsertAdmin = `INSERT INTO
+	admins(username, password_hash, role, email, disabled, ctime, mtime)
+	VALUES( $1, $2, $3, $4, FALSE, $5, $5 )`
+
+	queryDisableAdmin = `UPDATE admins SET disabled = TRUE, mtime = $2 WHERE username=$1`
+
+	queryResetAdminPassword = `UPDATE admins SET password_hash = $2, disabled = FALSE, locked_until = NULL, mtime = $3 WHERE username=$1`
+)
+
+var stmtSelectAdmin *sql.Stmt
+
+// Role is the set of permissions granted to an admin account.
+type Role string
+
+const (
+	RoleOwner   Role = "owner"
+	RoleAdmin   Role = "admin"
+	RoleScanner Role = "scanner"
+	RoleViewer  Role = "viewer"
+
+	// roleDevice is the role of scanner stations authenticated by a device
+	// key. No admin account can have it.
+	roleDevice Role = "device"
+)
+
+type permission int
+
+const (
+	// permViewAttendee allows opening a single attendee's claim page
+	permViewAttendee permission = iota
+	// permLookup allows searching registrations by personal data
+	permLookup
+	// permBrowse allows listing and filtering every registration
+	permBrowse
+	// permClaim allows marking a ticket as claimed
+	permClaim
+	// permExport allows bulk access to registration data, including the
+	// personal data masked in other roles' exports
+	permExport
+	// permSecurity allows reviewing failed logins and other security events
+	permSecurity
+	// permDevices allows issuing and revoking scanner device keys
+	permDevices
+	// permConflicts allows resolving submissions that conflict with an
+	// existing registration
+	permConflicts
+	// permEvents allows creating and editing events
+	permEvents
+	// permConsents allows publishing authorization texts and reporting on
+	// who accepted each
+	permConsents
+)
+
+// Only owners change security settings, scanner devices and events.
+var rolePermissions = map[Role][]permission{
+	RoleOwner:   {permViewAttendee, permLookup, permBrowse, permClaim, permExport, permSecurity, permDevices, permConflicts, permEvents, permConsents},
+	RoleAdmin:   {permViewAttendee, permLookup, permBrowse, permClaim, permExport, permConflicts, permConsents},
+	RoleScanner: {permViewAttendee, permLookup, permClaim},
+	RoleViewer:  {permViewAttendee, permBrowse},
+	roleDevice:  {permViewAttendee, permLookup, permClaim},
+}
+
+// ParseRole validates a role name given on the command line.
+func ParseRole(s string) (Role, error) {
+	r := Role(strings.ToLower(s))
+	if _, ok := rolePermissions[r]; !ok || r == roleDevice {
+		return "", fmt.Errorf("unknown role %q: must be one of owner, admin, scanner, viewer", s)
+	}
+
+	return r, nil
+}
+
+func (r Role) can(p permission) bool {
+	for _, granted := range rolePermissions[r] {
+		if granted == p {
+			return true
+		}
+	}
+
+	return false
+}
+
+type admin struct {
+	ID           int64
+	Username     string
+	PasswordHash string
+	Role         Role
+	Disabled     bool
+	TOTPSecret   string
+	TOTPEnabled  bool
+	// TOTPLastStep is the time step of the last accepted code, which can't
+	// be used again
+	TOTPLastStep int64
+	// External accounts log in through an identity provider, which is
+	// trusted with their second factor with Config.TrustIdP2FA
+	External bool
+}
+
+var errInvalidCredentials = errors.New("invalid username or password")
+
+// ErrNoSuchAdmin is returned by the account management functions when the
+// username does not exist.
+var ErrNoSuchAdmin = errors.New("no such admin")
+
+func selectAdmin(ctx context.Context, username string) (*admin, error) {
+	var a admin
+	var totpSecret sql.NullString
+	err := stmtSelectAdmin.QueryRowContext(ctx, username).Scan(&a.ID, &a.Username, &a.PasswordHash, &a.Role, &a.Disabled,
+		&totpSecret, &a.TOTPEnabled, &a.TOTPLastStep, &a.External)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoSuchAdmin
+	}
+	if err != nil {
+		return nil, err
+	}
+	a.TOTPSecret = totpSecret.String
+
+	return &a, nil
+}
+
+// authenticate checks a username and password against the admins table. The
+// same error is returned for unknown, disabled and wrong-password accounts.
+func authenticate(ctx context.Context, username, password string) (*admin, error) {
+	a, err := selectAdmin(ctx, username)
+	if err == ErrNoSuchAdmin {
+		// spend the same time as a real comparison so usernames can't be probed
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, errInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(a.PasswordHash), []byte(password)); err != nil {
+		return nil, errInvalidCredentials
+	}
+
+	if a.Disabled {
+		return nil, errInvalidCredentials
+	}
+
+	return a, nil
+}
+
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("cieloverde"), bcrypt.DefaultCost)
+
+// minPasswordLen is enforced when an account is created or reset.
+const minPasswordLen = 12
+
+func hashPassword(password string) (string, error) {
+	if len(password) < minPasswordLen {
+		return "", fmt.Errorf("password must be at least %d characters", minPasswordLen)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	return string(hash), nil
+}
+
+// CreateAdmin adds a new enabled admin account. email, which may be empty, is
+// where security notices for the account are sent.
+func CreateAdmin(ctx context.Context, db *sql.DB, username, password string, role Role, email string) error {
+	if username == "" {
+		return errors.New("username must be non-empty")
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	if _, err := db.ExecContext(ctx, queryInsertAdmin, username, hash, role, sql.NullString{String: email, Valid: email != ""}, time.Now()); err != nil {
+		return fmt.Errorf("failed to insert admin %s: %w", username, err)
+	}
+
+	return nil
+}
+
+// DisableAdmin prevents an admin account from logging in and ends its sessions.
+func DisableAdmin(ctx context.Context, db *sql.DB, username string) error {
+	res, err := db.ExecContext(ctx, queryDisableAdmin, username, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to disable admin %s: %w", username, err)
+	}
+
+	if err := expectOneRow(res); err != nil {
+		return err
+	}
+
+	return LogoutAdmin(ctx, db, username)
+}
+
+// ResetAdminPassword sets a new password on an admin account, re-enables and
+// unlocks it and ends its existing sessions.
+func ResetAdminPassword(ctx context.Context, db *sql.DB, username, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	res, err := db.ExecContext(ctx, queryResetAdminPassword, username, hash, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to reset password of admin %s: %w", username, err)
+	}
+
+	if err := expectOneRow(res); err != nil {
+		return err
+	}
+
+	return LogoutAdmin(ctx, db, username)
+}
+
+func expectOneRow(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoSuchAdmin
+	}
+
+	return nil
+}
+
+// requires2FA reports whether the role can reach data in bulk, in which case
+// the account has to enroll in TOTP once enforcement is on.
+func (r Role) requires2FA() bool {
+	return r.can(permExport)
+}
+
+// requirePermission writes an error response and returns nil unless the
+// request comes from an admin or a device key whose role grants p. Admins
+// who have to enroll in TOTP and haven't yet are sent to enroll instead.
+func (server *Server) requirePermission(w http.ResponseWriter, r *http.Request, p permission) *admin {
+	if a, ok := server.deviceAdmin(r); ok {
+		if a == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeUnauthorized(w)
+			return nil
+		}
+		if !a.Role.can(p) {
+			writeForbidden(w)
+			return nil
+		}
+		return a
+	}
+
+	a := server.currentAdmin(r)
+	if a == nil {
+		writeUnauthorized(w)
+		return nil
+	}
+
+	if server.enforce2FA && a.Role.requires2FA() && !a.TOTPEnabled && !(a.External && server.trustIdP2FA) {
+		http.Redirect(w, r, "/admin/2fa", http.StatusSeeOther)
+		return nil
+	}
+
+	if !a.Role.can(p) {
+		w.Header().Add("Content-Type", "text/html")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(tplUnauthorized))
+		return nil
+	}
+
+	return a
+}
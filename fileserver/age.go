@@ -0,0 +1,147 @@
+package fileserver
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// borderlineAgeYears is how far above an event's minimum age the claim page
+// reminds staff to check the cédula
+const borderlineAgeYears = 2
+
+// the layouts a date of birth is accepted in
+var birthDateLayouts = []string{"2006-01-02", "02/01/2006", "2/1/2006"}
+
+// ageOn returns how old someone born on birth is on the day of t, in Bogotá.
+func ageOn(birth, t time.Time) int {
+	t = t.In(bogota)
+	age := t.Year() - birth.Year()
+	if t.Month() < birth.Month() || (t.Month() == birth.Month() && t.Day() < birth.Day()) {
+		age--
+	}
+
+	return age
+}
+
+// eventMinAge is the minimum age to register for e.
+func (server *Server) eventMinAge(e *event) int {
+	return server.effectiveMinAge(e.MinAge)
+}
+
+// effectiveMinAge is the minimum age an event asks for, never below the
+// server's.
+func (server *Server) effectiveMinAge(n int) int {
+	if n > server.minAge {
+		return n
+	}
+
+	return server.minAge
+}
+
+// ageCheckTime is when attendees have to be old enough: when e starts, or
+// now if it has started or has no date.
+func (e *event) ageCheckTime(now time.Time) time.Time {
+	if e.Starts != nil && e.Starts.After(now) {
+		return *e.Starts
+	}
+
+	return now
+}
+
+// validateAge checks the attendee is at least min years old for e. A date
+// of birth, when given, takes precedence over the age typed and is checked
+// against the day the event starts; the age is then derived from it.
+func (fi *formInfo) validateAge(e *event, min int, now time.Time, errs *fieldErrors) {
+	fi.BirthDate = strings.TrimSpace(fi.BirthDate)
+	if fi.BirthDate != "" {
+		var birth time.Time
+		var err error
+		for _, layout := range birthDateLayouts {
+			if birth, err = time.ParseInLocation(layout, fi.BirthDate, bogota); err == nil {
+				break
+			}
+		}
+
+		switch {
+		case err != nil || birth.After(now) || ageOn(birth, now) > maxAge:
+			errs.add("birth_date", "invalid_birth_date", 0)
+		case ageOn(birth, e.ageCheckTime(now)) < min:
+			errs.add("birth_date", "age_range", min)
+		default:
+			fi.BirthDate = birth.Format("2006-01-02")
+			// as of registering, like a typed age
+			fi.Age = uint16(ageOn(birth, now))
+		}
+		return
+	}
+
+	if errs.has("age") {
+		return
+	}
+	switch {
+	case fi.Age > maxAge:
+		errs.add("age", "invalid_age", 0)
+	case int(fi.Age) < min:
+		errs.add("age", "age_range", min)
+	}
+}
+
+// underAge reports whether errs reject the registration for the attendee's
+// age, which no correction to the form should get past.
+func (errs fieldErrors) underAge() bool {
+	for _, fe := range errs {
+		if fe.Code == "age_range" {
+			return true
+		}
+	}
+
+	return false
+}
+
+const tplUnderAge = `<!DOCTYPE html>
+<html>
+	<body>
+		<h1>Lo sentimos, no puedes inscribirte en {{.Name}}.</h1>
+		<p>Hay que tener al menos {{.MinAge}} a&ntilde;os{{if .Starts}} el d&iacute;a del evento{{end}}. No entregamos premios a menores de edad.</p>
+	</body>
+</html>
+`
+
+var tmplUnderAge = template.Must(template.New("underAge").Parse(tplUnderAge))
+
+// writeUnderAge rejects a registration from someone younger than min for e.
+func writeUnderAge(w http.ResponseWriter, e *event, min int) {
+	w.Header().Add("Content-Type", "text/html")
+	w.WriteHeader(http.StatusForbidden)
+	page := struct {
+		Name   string
+		MinAge int
+		Starts *time.Time
+	}{e.Name, min, e.Starts}
+	if err := tmplUnderAge.Execute(w, page); err != nil {
+		log.Printf("failed to execute template for under age: %s", err)
+	}
+}
+
+// ageNote is what the claim page tells staff about the age of an attendee
+// when it's close to the minimum, or unknown; it's empty otherwise.
+func ageNote(age *int, birth *time.Time, min int, now time.Time) string {
+	switch {
+	case birth != nil:
+		if a := ageOn(*birth, now); a < min+borderlineAgeYears {
+			return fmt.Sprintf("nació el %s (%d años)", birth.Format("02/01/2006"), a)
+		}
+	case age != nil:
+		if *age < min+borderlineAgeYears {
+			return fmt.Sprintf("edad declarada: %d años", *age)
+		}
+	default:
+		return "sin edad registrada"
+	}
+
+	return ""
+}
@@ -0,0 +1,166 @@
+package fileserver
+
+import (
+	"testing"
+	"time"
+)
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, bogota)
+}
+
+func TestAgeOn(t *testing.T) {
+	tests := []struct {
+		name  string
+		birth time.Time
+		on    time.Time
+		want  int
+	}{
+		{name: "birthday", birth: date(2006, 6, 15), on: date(2024, 6, 15), want: 18},
+		{name: "day before", birth: date(2006, 6, 15), on: date(2024, 6, 14), want: 17},
+		{name: "day after", birth: date(2006, 6, 15), on: date(2024, 6, 16), want: 18},
+		{name: "earlier month", birth: date(2006, 6, 15), on: date(2024, 5, 30), want: 17},
+		{name: "leap day on a leap year", birth: date(2004, 2, 29), on: date(2024, 2, 29), want: 20},
+		{name: "leap day, Feb 28 of a common year", birth: date(2004, 2, 29), on: date(2023, 2, 28), want: 18},
+		{name: "leap day, Mar 1 of a common year", birth: date(2004, 2, 29), on: date(2023, 3, 1), want: 19},
+		{
+			// 03:00 UTC is still the day before in Bogotá
+			name: "evening before in Bogotá", birth: date(2006, 6, 15),
+			on: time.Date(2024, 6, 15, 3, 0, 0, 0, time.UTC), want: 17,
+		},
+		{
+			name: "birthday starts at midnight in Bogotá", birth: date(2006, 6, 15),
+			on: time.Date(2024, 6, 15, 5, 0, 0, 0, time.UTC), want: 18,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ageOn(tt.birth, tt.on); got != tt.want {
+				t.Errorf("ageOn(%s, %s) = %d, want %d", tt.birth.Format("2006-01-02"), tt.on, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEffectiveMinAge(t *testing.T) {
+	tests := []struct {
+		name          string
+		server, event int
+		want          int
+	}{
+		{name: "event without one", server: 18, want: 18},
+		{name: "event above the server's", server: 18, event: 21, want: 21},
+		{name: "event below the server's", server: 18, event: 16, want: 18},
+		{name: "event equal to the server's", server: 21, event: 21, want: 21},
+		{name: "server raised above the event's", server: 21, event: 19, want: 21},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &Server{minAge: tt.server}
+			if got := server.effectiveMinAge(tt.event); got != tt.want {
+				t.Errorf("effectiveMinAge(%d) = %d, want %d", tt.event, got, tt.want)
+			}
+			if got := server.eventMinAge(&event{MinAge: tt.event}); got != tt.want {
+				t.Errorf("eventMinAge = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateAge(t *testing.T) {
+	// registering at noon in Bogotá, ten days before the event
+	now := time.Date(2024, 6, 5, 17, 0, 0, 0, time.UTC)
+	starts := time.Date(2024, 6, 15, 20, 0, 0, 0, time.UTC)
+	upcoming := &event{Starts: &starts}
+	started := &event{Starts: &now}
+	undated := &event{}
+
+	tests := []struct {
+		name      string
+		e         *event
+		min       int
+		birth     string
+		age       uint16
+		wantCode  string
+		wantAge   uint16
+		wantBirth string
+	}{
+		{name: "of age by the event", e: upcoming, min: 18, birth: "2006-06-15", wantAge: 17, wantBirth: "2006-06-15"},
+		{name: "of age the day after the event", e: upcoming, min: 18, birth: "2006-06-16", wantCode: "age_range"},
+		{name: "of age by now, event started", e: started, min: 18, birth: "2006-06-05", wantAge: 18, wantBirth: "2006-06-05"},
+		{name: "of age tomorrow, event started", e: started, min: 18, birth: "2006-06-06", wantCode: "age_range"},
+		{name: "no event date", e: undated, min: 18, birth: "2006-06-06", wantCode: "age_range"},
+		{name: "day first layout", e: upcoming, min: 18, birth: "15/06/2006", wantAge: 17, wantBirth: "2006-06-15"},
+		{name: "leap day, of age on Mar 1", e: &event{Starts: timePtr(date(2025, 3, 1))}, min: 21, birth: "2004-02-29", wantAge: 20, wantBirth: "2004-02-29"},
+		{name: "leap day, not yet on Feb 28", e: &event{Starts: timePtr(date(2025, 2, 28))}, min: 21, birth: "2004-02-29", wantCode: "age_range"},
+		{name: "event minimum", e: upcoming, min: 21, birth: "2003-06-15", wantAge: 20, wantBirth: "2003-06-15"},
+		{name: "under the event minimum", e: upcoming, min: 21, birth: "2003-06-16", wantCode: "age_range"},
+		{name: "born in the future", e: upcoming, min: 18, birth: "2025-01-01", wantCode: "invalid_birth_date"},
+		{name: "not a date", e: upcoming, min: 18, birth: "2006-02-30", wantCode: "invalid_birth_date"},
+		{name: "typed age", e: upcoming, min: 18, age: 18, wantAge: 18},
+		{name: "typed age too low", e: upcoming, min: 18, age: 17, wantCode: "age_range", wantAge: 17},
+		{name: "typed age too high", e: upcoming, min: 18, age: 200, wantCode: "invalid_age", wantAge: 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fi := formInfo{BirthDate: tt.birth, Age: tt.age}
+			var errs fieldErrors
+			fi.validateAge(tt.e, tt.min, now, &errs)
+
+			var code string
+			if len(errs) > 0 {
+				code = errs[0].Code
+			}
+			if code != tt.wantCode {
+				t.Fatalf("errors = %+v, want %q", errs, tt.wantCode)
+			}
+			if code == "age_range" && errs[0].arg != tt.min {
+				t.Errorf("age_range arg = %d, want %d", errs[0].arg, tt.min)
+			}
+			if code != "" {
+				return
+			}
+			if fi.Age != tt.wantAge || fi.BirthDate != tt.wantBirth {
+				t.Errorf("age, birth date = %d, %q, want %d, %q", fi.Age, fi.BirthDate, tt.wantAge, tt.wantBirth)
+			}
+		})
+	}
+}
+
+func TestAgeNote(t *testing.T) {
+	now := time.Date(2024, 6, 15, 17, 0, 0, 0, time.UTC)
+	age := func(n int) *int { return &n }
+
+	tests := []struct {
+		name  string
+		age   *int
+		birth *time.Time
+		min   int
+		want  string
+	}{
+		{name: "nothing recorded", min: 18, want: "sin edad registrada"},
+		{name: "typed age at the minimum", age: age(18), min: 18, want: "edad declarada: 18 años"},
+		{name: "typed age within the margin", age: age(19), min: 18, want: "edad declarada: 19 años"},
+		{name: "typed age past the margin", age: age(20), min: 18},
+		{name: "birthday today", birth: timePtr(date(2006, 6, 15)), min: 18, want: "nació el 15/06/2006 (18 años)"},
+		{name: "birthday tomorrow", birth: timePtr(date(2006, 6, 16)), min: 18, want: "nació el 16/06/2006 (17 años)"},
+		{name: "well past the minimum", birth: timePtr(date(1990, 1, 1)), min: 18},
+		{name: "date of birth over a typed age", age: age(40), birth: timePtr(date(2005, 6, 15)), min: 18, want: "nació el 15/06/2005 (19 años)"},
+		{name: "event minimum", age: age(22), min: 21, want: "edad declarada: 22 años"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ageNote(tt.age, tt.birth, tt.min, now); got != tt.want {
+				t.Errorf("ageNote = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
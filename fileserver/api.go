@@ -0,0 +1,227 @@
+package fileserver
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// registrations are small; anything bigger isn't one
+const maxAPIBodySize = 64 << 10
+
+// apiError is the body of every API response that isn't a success.
+type apiError struct {
+	Error     string      `json:"error"`
+	Message   string      `json:"message,omitempty"`
+	Errors    fieldErrors `json:"errors,omitempty"`
+	RequestID string      `json:"request_id,omitempty"`
+	// Resend is where to POST to have the existing registration's ticket
+	// sent again
+	Resend string `json:"resend,omitempty"`
+	// OpensAt is when an event that isn't open yet starts taking
+	// registrations
+	OpensAt *time.Time `json:"opens_at,omitempty"`
+}
+
+var apiErrorMessages = map[string]map[string]string{
+	"es": {
+		"invalid_json":          "La solicitud no es un JSON válido.",
+		"challenge_failed":      "No pudimos verificar que eres una persona. Recarga la página e inténtalo de nuevo.",
+		"duplicate_id_no":       "Esta cédula ya está registrada. ¿Quieres que reenviemos la boleta al correo del registro?",
+		"duplicate_email":       "Este correo ya está registrado. ¿Quieres que reenviemos la boleta?",
+		"duplicate_phone":       "Este teléfono ya está registrado. ¿Quieres que reenviemos la boleta al correo del registro?",
+		"internal":              "No pudimos guardar tu registro. Intenta de nuevo más tarde.",
+		"event_not_found":       "Este evento no existe.",
+		"department_not_found":  "Este departamento no existe.",
+		"registration_closed":   "Las inscripciones para este evento están cerradas.",
+		"registration_not_open": "Las inscripciones para este evento aún no están abiertas.",
+		"registration_paused":   "Las inscripciones para este evento están pausadas. Inténtalo de nuevo en un rato.",
+	},
+	"en": {
+		"invalid_json":          "The request is not valid JSON.",
+		"challenge_failed":      "We couldn't verify you're a person. Reload the page and try again.",
+		"duplicate_id_no":       "This ID number is already registered. Should we resend the ticket to the registration's email?",
+		"duplicate_email":       "This email is already registered. Should we resend the ticket?",
+		"duplicate_phone":       "This phone number is already registered. Should we resend the ticket to the registration's email?",
+		"internal":              "We couldn't save your registration. Please try again later.",
+		"event_not_found":       "This event doesn't exist.",
+		"department_not_found":  "This department doesn't exist.",
+		"registration_closed":   "Registration for this event is closed.",
+		"registration_not_open": "Registration for this event isn't open yet.",
+		"registration_paused":   "Registration for this event is paused. Please try again in a while.",
+	},
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("failed to write JSON response: %s", err)
+	}
+}
+
+func newAPIError(r *http.Request, code string) apiError {
+	return apiError{Error: code, Message: apiErrorMessages[preferredLanguage(r)][code]}
+}
+
+// writeAPIError answers with a localized error. Server errors carry the
+// request ID, so a report from an attendee can be matched with the logs.
+func writeAPIError(w http.ResponseWriter, r *http.Request, status int, code string) {
+	e := newAPIError(r, code)
+	if status >= 500 {
+		e.RequestID = requestID(r)
+	}
+
+	writeJSON(w, status, e)
+}
+
+type registrationCreated struct {
+	Reference string `json:"reference"`
+	// Status is pending_verification until the attendee confirms their
+	// email, or waitlisted if the event is full; waitlisted attendees have
+	// to confirm their email too
+	Status string `json:"status"`
+}
+
+// jsonFormValues turns a flat JSON object into form values, so registrations
+// posted as JSON go through the same decoding and validation as the form.
+func jsonFormValues(body []byte) (url.Values, bool) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+
+	var fields map[string]interface{}
+	if err := dec.Decode(&fields); err != nil || dec.More() {
+		return nil, false
+	}
+
+	values := make(url.Values, len(fields))
+	for k, v := range fields {
+		switch v := v.(type) {
+		case nil:
+		case string:
+			values.Set(k, v)
+		case json.Number:
+			values.Set(k, v.String())
+		case bool:
+			values.Set(k, strconv.FormatBool(v))
+		case []interface{}:
+			// the answers to multiselect questions
+			for _, e := range v {
+				s, ok := e.(string)
+				if !ok {
+					return nil, false
+				}
+				values.Add(k, s)
+			}
+		default:
+			return nil, false
+		}
+	}
+
+	return values, true
+}
+
+// handleAPIRegistration registers an attendee for the event with the given
+// slug from a JSON body, for the frontend to show the outcome instead of
+// following a redirect.
+func (server *Server) handleAPIRegistration(w http.ResponseWriter, r *http.Request, slug string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ev, err := selectEventBySlug(ctx, slug)
+	cancel()
+	if err == sql.ErrNoRows {
+		writeAPIError(w, r, http.StatusNotFound, "event_not_found")
+		return
+	}
+	if err != nil {
+		log.Printf("failed to select event %s (request %s): %s", slug, requestID(r), err)
+		writeAPIError(w, r, http.StatusInternalServerError, "internal")
+		return
+	}
+	if status := ev.status(time.Now()); status != eventOpen {
+		writeAPIEventClosed(w, r, ev, status)
+		return
+	}
+
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(http.MaxBytesReader(w, r.Body, maxAPIBodySize)); err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, "invalid_json")
+		return
+	}
+
+	values, ok := jsonFormValues(buf.Bytes())
+	if !ok {
+		writeAPIError(w, r, http.StatusBadRequest, "invalid_json")
+		return
+	}
+
+	if err := server.checkChallenge(r, values); err == errChallengeFailed {
+		writeAPIError(w, r, http.StatusForbidden, "challenge_failed")
+		return
+	} else if err != nil {
+		log.Printf("failed to check challenge (request %s): %s", requestID(r), err)
+		writeAPIError(w, r, http.StatusInternalServerError, "internal")
+		return
+	}
+
+	fi, errs, err := decodeFormInfo(values, server.schema, ev, server.eventMinAge(ev))
+	if err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, "invalid_json")
+		return
+	}
+	if len(errs) > 0 {
+		writeFieldErrorsJSON(w, r, errs)
+		return
+	}
+
+	formID, waitlisted, err := server.register(r, ev, &fi)
+	if err == errEventNotOpen || err == errEventClosed || err == errEventPaused {
+		writeAPIEventClosed(w, r, ev, ev.status(time.Now()))
+		return
+	}
+	if err == errUnknownConsent {
+		writeFieldErrorsJSON(w, r, fieldErrors{{Field: "authorized", Code: "unknown_consent_version"}})
+		return
+	}
+	var dup *duplicateError
+	if errors.As(err, &dup) {
+		e := newAPIError(r, "duplicate_"+dup.Field)
+		e.Resend = server.resendURL(dup)
+		writeJSON(w, http.StatusConflict, e)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to save registration (request %s): %s", requestID(r), err)
+		writeAPIError(w, r, http.StatusInternalServerError, "internal")
+		return
+	}
+
+	status := "pending_verification"
+	if waitlisted {
+		status = "waitlisted"
+	}
+	writeJSON(w, http.StatusCreated, registrationCreated{Reference: server.registrationReference(formID), Status: status})
+}
+
+// writeAPIEventClosed answers a registration for an event that doesn't take
+// them with registration_not_open, registration_closed or
+// registration_paused. A pause is temporary, so it gets a 503.
+func writeAPIEventClosed(w http.ResponseWriter, r *http.Request, ev *event, status string) {
+	code := http.StatusForbidden
+	if status == eventPaused {
+		code = http.StatusServiceUnavailable
+	}
+
+	e := newAPIError(r, "registration_"+status)
+	if status == eventNotOpen {
+		e.OpensAt = ev.Opens
+	}
+	writeJSON(w, code, e)
+}
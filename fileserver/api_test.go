@@ -0,0 +1,66 @@
+package fileserver
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJSONFormValues(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want url.Values
+	}{
+		{name: "strings", body: `{"first_name": "Ana", "email": "ana@example.com"}`, want: url.Values{"first_name": {"Ana"}, "email": {"ana@example.com"}}},
+		{name: "empty object", body: `{}`, want: url.Values{}},
+		{name: "numbers keep their digits", body: `{"id_no": 1020304050, "age": 30, "weekly_qty": 2.5}`, want: url.Values{"id_no": {"1020304050"}, "age": {"30"}, "weekly_qty": {"2.5"}}},
+		{name: "big numbers aren't rounded", body: `{"id_no": 12345678901234567890}`, want: url.Values{"id_no": {"12345678901234567890"}}},
+		{name: "booleans", body: `{"newsletter": true, "gift_box": false}`, want: url.Values{"newsletter": {"true"}, "gift_box": {"false"}}},
+		{name: "nulls are left out", body: `{"neighborhood": null, "city": "Cali"}`, want: url.Values{"city": {"Cali"}}},
+		{name: "lists of strings", body: `{"interests": ["música", "arte"]}`, want: url.Values{"interests": {"música", "arte"}}},
+		{name: "empty list", body: `{"interests": []}`, want: url.Values{}},
+		{name: "surrounding whitespace", body: " \n{\"city\": \"Cali\"}\n ", want: url.Values{"city": {"Cali"}}},
+		{name: "list of numbers", body: `{"interests": [1, 2]}`},
+		{name: "nested object", body: `{"place": {"city": "Cali"}}`},
+		{name: "nested list", body: `{"interests": [["arte"]]}`},
+		{name: "array", body: `[{"city": "Cali"}]`},
+		{name: "string", body: `"Cali"`},
+		{name: "two objects", body: `{"city": "Cali"} {"city": "Pasto"}`},
+		{name: "trailing garbage", body: `{"city": "Cali"} x`},
+		{name: "truncated", body: `{"city": "Ca`},
+		{name: "empty", body: ``},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := jsonFormValues([]byte(tt.body))
+			if ok != (tt.want != nil) {
+				t.Fatalf("jsonFormValues = %v, %t, want ok %t", got, ok, tt.want != nil)
+			}
+			if ok && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("jsonFormValues = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegistrationReference(t *testing.T) {
+	server := &Server{secret: []byte("0123456789abcdef0123456789abcdef")}
+	other := &Server{secret: []byte("fedcba9876543210fedcba9876543210")}
+
+	ref := server.registrationReference(1234)
+	if ref != server.registrationReference(1234) {
+		t.Error("the reference of a registration changes")
+	}
+	if len(ref) != 16 || strings.Contains(ref, "1234") {
+		t.Errorf("reference = %q, want 16 characters not showing the ID", ref)
+	}
+	if ref == server.registrationReference(1235) {
+		t.Error("two registrations have the same reference")
+	}
+	if ref == other.registrationReference(1234) {
+		t.Error("the reference doesn't depend on the secret")
+	}
+}
@@ -0,0 +1,401 @@
+package fileserver
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const auditPageSize = 100
+
+// auditLockKey is the advisory lock serializing appends, so each entry
+// chains onto the one before it
+const auditLockKey = 0x61756469
+
+const (
+	querySelectAuditHead = `SELECT hash FROM audit_log ORDER BY id DESC LIMIT 1`
+
+	queryInsertAudit = `INSERT INTO
+	audit_log(actor, action, target, remote_addr, useragent, request_id, before_value, after_value, ctime, prev_hash, hash)
+	VALUES( $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11 )`
+
+	querySelectAuditChain = `SELECT id, actor, action, target, remote_addr, useragent, request_id, before_value, after_value, ctime, prev_hash, hash
+	FROM audit_log ORDER BY id`
+)
+
+// auditEntry is one audit_log row. Before and After hold JSON, kept as
+// text so that the hashed bytes are the stored bytes.
+type auditEntry struct {
+	ID         int64
+	Actor      string
+	Action     string
+	Target     string
+	RemoteAddr string
+	UserAgent  string
+	RequestID  string
+	Before     string
+	After      string
+	Time       time.Time
+	PrevHash   string
+	Hash       string
+}
+
+// hash chains the entry onto prevHash. Fields are length-prefixed so no
+// two different entries hash the same input.
+func (e *auditEntry) hash(prevHash string) string {
+	h := sha256.New()
+	for _, f := range []string{prevHash, e.Actor, e.Action, e.Target, e.RemoteAddr, e.UserAgent, e.RequestID,
+		e.Before, e.After, e.Time.UTC().Format(time.RFC3339Nano)} {
+		fmt.Fprintf(h, "%d:%s", len(f), f)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// follows reports whether the entry is intact and chained onto prevHash.
+func (e *auditEntry) follows(prevHash string) bool {
+	return e.PrevHash == prevHash && e.hash(e.PrevHash) == e.Hash
+}
+
+func auditJSON(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%q", err.Error())
+	}
+
+	return string(buf)
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// appendAudit adds e to the end of the audit chain.
+func appendAudit(ctx context.Context, db *sql.DB, e *auditEntry) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin audit entry: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, auditLockKey); err != nil {
+		return fmt.Errorf("failed to lock audit log: %w", err)
+	}
+
+	var prev string
+	if err := tx.QueryRowContext(ctx, querySelectAuditHead).Scan(&prev); err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to select audit log head: %w", err)
+	}
+
+	// Postgres keeps microseconds, and the hash has to survive the round trip
+	e.Time = time.Now().Truncate(time.Microsecond)
+	e.PrevHash = prev
+	e.Hash = e.hash(prev)
+
+	if _, err := tx.ExecContext(ctx, queryInsertAudit, e.Actor, e.Action, nullString(e.Target), nullString(e.RemoteAddr), nullString(e.UserAgent),
+		nullString(e.RequestID), nullString(e.Before), nullString(e.After), e.Time, e.PrevHash, e.Hash); err != nil {
+		return fmt.Errorf("failed to insert audit entry: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// audit records an action taken through a request. Failing to record it is
+// logged but doesn't fail the request.
+func (server *Server) audit(r *http.Request, actor, action, target string, before, after interface{}) {
+	e := auditEntry{
+		Actor:      actor,
+		Action:     action,
+		Target:     target,
+		RemoteAddr: clientIP(r),
+		UserAgent:  r.Header.Get("User-Agent"),
+		RequestID:  requestID(r),
+		Before:     auditJSON(before),
+		After:      auditJSON(after),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := appendAudit(ctx, server.db, &e); err != nil {
+		log.Printf("failed to audit %s %s by %s: %s", action, target, actor, err)
+	}
+}
+
+// AuditCommand records an action taken from the command line.
+func AuditCommand(ctx context.Context, db *sql.DB, actor, action, target string, after interface{}) error {
+	return appendAudit(ctx, db, &auditEntry{Actor: actor, Action: action, Target: target, After: auditJSON(after)})
+}
+
+// VerifyAudit recomputes the audit chain. It returns the number of entries
+// checked and the ID of the first entry that doesn't match its hash or its
+// predecessor, or 0 if the chain is intact.
+func VerifyAudit(ctx context.Context, db *sql.DB) (int64, int64, error) {
+	rows, err := db.QueryContext(ctx, querySelectAuditChain)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to select audit log: %w", err)
+	}
+	defer rows.Close()
+
+	var n int64
+	var prev string
+	for rows.Next() {
+		e, err := scanAuditEntry(rows)
+		if err != nil {
+			return n, 0, err
+		}
+		n++
+		if !e.follows(prev) {
+			return n, e.ID, nil
+		}
+		prev = e.Hash
+	}
+
+	return n, 0, rows.Err()
+}
+
+func scanAuditEntry(rows *sql.Rows) (*auditEntry, error) {
+	var e auditEntry
+	var s [6]sql.NullString
+	if err := rows.Scan(&e.ID, &e.Actor, &e.Action, &s[0], &s[1], &s[2], &s[3], &s[4], &s[5], &e.Time, &e.PrevHash, &e.Hash); err != nil {
+		return nil, fmt.Errorf("failed to scan audit entry: %w", err)
+	}
+	e.Target, e.RemoteAddr, e.UserAgent, e.RequestID, e.Before, e.After = s[0].String, s[1].String, s[2].String, s[3].String, s[4].String, s[5].String
+
+	return &e, nil
+}
+
+type requestIDKey struct{}
+
+var reRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// withRequestID tags the request with the ID given by the proxy in front of
+// us, or a new one, and echoes it in the X-Request-ID response header.
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := r.Header.Get("X-Request-ID")
+	if !reRequestID.MatchString(id) {
+		id = r.Header.Get("CF-Ray")
+	}
+	if !reRequestID.MatchString(id) {
+		buf := make([]byte, 8)
+		rand.Read(buf)
+		id = hex.EncodeToString(buf)
+	}
+
+	w.Header().Set("X-Request-ID", id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+const tplAudit = `
+<!DOCTYPE html>
+<html>
+<style>
+   td, th {
+		padding: 4px 10px;
+		text-align: left;
+		vertical-align: top;
+   }
+   code {
+		font-size: 12px;
+   }
+</style>
+<body>
+<h1>Registro de auditor&iacute;a</h1>
+<form action="/admin/audit" method="GET">
+<input name="actor" value="{{.Actor}}" placeholder="usuario" />
+<input name="action" value="{{.Action}}" placeholder="acci&oacute;n" />
+<input name="target" value="{{.Target}}" placeholder="objeto" />
+del <input type="date" name="from" value="{{.From}}" /> al <input type="date" name="to" value="{{.To}}" />
+<input type="submit" value="buscar" />
+<button type="submit" name="verify" value="1">verificar cadena</button>
+</form>
+{{- if .Verified}}
+	{{- if .BrokenID}}
+	<p style="color: red">La cadena est&aacute; rota en la entrada {{.BrokenID}}: fue modificada o borrada.</p>
+	{{- else}}
+	<p>Cadena &iacute;ntegra: {{.Checked}} entradas verificadas.</p>
+	{{- end}}
+{{- end}}
+<table>
+	<tr><th>#</th><th>Fecha</th><th>Usuario</th><th>Acci&oacute;n</th><th>Objeto</th><th>Antes</th><th>Despu&eacute;s</th><th>IP</th><th>Solicitud</th></tr>
+	{{- range .Entries}}
+	<tr>
+		<td>{{.ID}}</td>
+		<td>{{.Time.Format "2006-01-02 15:04:05"}}</td>
+		<td>{{.Actor}}</td>
+		<td>{{.Action}}</td>
+		<td>{{.Target}}</td>
+		<td><code>{{.Before}}</code></td>
+		<td><code>{{.After}}</code></td>
+		<td title="{{.UserAgent}}">{{.RemoteAddr}}</td>
+		<td><code>{{.RequestID}}</code></td>
+	</tr>
+	{{- end}}
+</table>
+<p>
+{{- if .PrevURL}}<a href="{{.PrevURL}}">&laquo; anteriores</a>{{end}}
+{{- if .NextURL}} <a href="{{.NextURL}}">siguientes &raquo;</a>{{end}}
+</p>
+{{- with .Head}}
+<p>&Uacute;ltimo hash: <code>{{.}}</code></p>
+{{- end}}
+</body>
+</html>
+`
+
+var tmplAudit = template.Must(template.New("audit").Parse(tplAudit))
+
+type auditPage struct {
+	Actor    string
+	Action   string
+	Target   string
+	From     string
+	To       string
+	Entries  []*auditEntry
+	Head     string
+	PrevURL  string
+	NextURL  string
+	Verified bool
+	Checked  int64
+	BrokenID int64
+}
+
+// handleAudit searches the audit log, newest first, and on request verifies
+// the whole chain.
+func (server *Server) handleAudit(w http.ResponseWriter, r *http.Request) {
+	a := server.requirePermission(w, r, permSecurity)
+	if a == nil {
+		return
+	}
+
+	q := r.URL.Query()
+	page := auditPage{
+		Actor:  strings.TrimSpace(q.Get("actor")),
+		Action: strings.TrimSpace(q.Get("action")),
+		Target: strings.TrimSpace(q.Get("target")),
+		From:   q.Get("from"),
+		To:     q.Get("to"),
+	}
+	offset, _ := strconv.Atoi(q.Get("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+
+	var conds []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if page.Actor != "" {
+		conds = append(conds, "actor ILIKE "+arg("%"+escapeLike(page.Actor)+"%"))
+	}
+	if page.Action != "" {
+		conds = append(conds, "action = "+arg(page.Action))
+	}
+	if page.Target != "" {
+		conds = append(conds, "target ILIKE "+arg("%"+escapeLike(page.Target)+"%"))
+	}
+	if t, err := time.ParseInLocation("2006-01-02", page.From, bogota); err == nil {
+		conds = append(conds, "ctime >= "+arg(t))
+	}
+	if t, err := time.ParseInLocation("2006-01-02", page.To, bogota); err == nil {
+		conds = append(conds, "ctime < "+arg(t.AddDate(0, 0, 1)))
+	}
+	where := ""
+	if len(conds) > 0 {
+		where = "WHERE " + strings.Join(conds, " AND ")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	rows, err := server.db.QueryContext(ctx, `SELECT id, actor, action, target, remote_addr, useragent, request_id, before_value, after_value, ctime, prev_hash, hash
+	FROM audit_log `+where+fmt.Sprintf(" ORDER BY id DESC LIMIT %d OFFSET %d", auditPageSize+1, offset), args...)
+	if err != nil {
+		log.Printf("failed to select audit log: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		e, err := scanAuditEntry(rows)
+		if err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		e.Time = e.Time.In(bogota)
+		page.Entries = append(page.Entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("failed to iterate audit log: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	link := func(offset int) string {
+		v := url.Values{}
+		for _, k := range []string{"actor", "action", "target", "from", "to"} {
+			if q.Get(k) != "" {
+				v.Set(k, q.Get(k))
+			}
+		}
+		v.Set("offset", strconv.Itoa(offset))
+		return "/admin/audit?" + v.Encode()
+	}
+	if len(page.Entries) > auditPageSize {
+		page.Entries = page.Entries[:auditPageSize]
+		page.NextURL = link(offset + auditPageSize)
+	}
+	if offset > 0 {
+		prev := offset - auditPageSize
+		if prev < 0 {
+			prev = 0
+		}
+		page.PrevURL = link(prev)
+	}
+
+	if err := server.db.QueryRowContext(ctx, querySelectAuditHead).Scan(&page.Head); err != nil && err != sql.ErrNoRows {
+		log.Printf("failed to select audit log head: %s", err)
+	}
+
+	if q.Get("verify") != "" {
+		page.Verified = true
+		if page.Checked, page.BrokenID, err = VerifyAudit(ctx, server.db); err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if page.BrokenID != 0 {
+			log.Printf("audit log chain broken at entry %d", page.BrokenID)
+		}
+	}
+
+	server.audit(r, a.Username, "view_audit", "", nil, map[string]interface{}{"query": q.Encode()})
+
+	w.Header().Add("Content-Type", "text/html")
+	if err := tmplAudit.Execute(w, page); err != nil {
+		log.Printf("failed to execute template for audit log: %s", err)
+	}
+}
@@ -0,0 +1,118 @@
+package fileserver
+
+import (
+	"testing"
+	"time"
+)
+
+// auditChain chains entries like appendAudit does.
+func auditChain(entries ...auditEntry) []auditEntry {
+	prev := ""
+	for i := range entries {
+		entries[i].PrevHash = prev
+		entries[i].Hash = entries[i].hash(prev)
+		prev = entries[i].Hash
+	}
+
+	return entries
+}
+
+// brokenAt returns the index of the first entry not chained onto the one
+// before it, like VerifyAudit, or -1.
+func brokenAt(entries []auditEntry) int {
+	prev := ""
+	for i, e := range entries {
+		if !e.follows(prev) {
+			return i
+		}
+		prev = e.Hash
+	}
+
+	return -1
+}
+
+func testAuditEntries() []auditEntry {
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 123456000, time.UTC)
+
+	return auditChain(
+		auditEntry{Actor: "cli", Action: "admin_create", Target: "admin:alice", After: `{"role":"owner"}`, Time: t0},
+		auditEntry{Actor: "alice", Action: "login", RemoteAddr: "190.0.0.1", UserAgent: "Firefox", RequestID: "r1", After: `{"method":"password"}`, Time: t0.Add(time.Minute)},
+		auditEntry{Actor: "alice", Action: "event_update", Target: "event:1", Before: `{"capacity":100}`, After: `{"capacity":200}`, Time: t0.Add(2 * time.Minute)},
+	)
+}
+
+func TestAuditHash(t *testing.T) {
+	e := auditEntry{Actor: "cli", Action: "admin_create", Target: "admin:alice", After: `{"role":"owner"}`,
+		Time: time.Date(2024, 3, 1, 12, 0, 0, 123456000, time.UTC)}
+
+	// stored hashes must stay verifiable, so the input format can't change
+	if got, want := e.hash(""), "4b24b432b0a6aa3ca82bb273827e9c4c90b81e896ef077be33606b7545c12616"; got != want {
+		t.Errorf("hash = %s, want %s", got, want)
+	}
+
+	bogota := e
+	bogota.Time = e.Time.In(time.FixedZone("America/Bogota", -5*60*60))
+	if bogota.hash("") != e.hash("") {
+		t.Error("the hash depends on the time zone of the timestamp")
+	}
+
+	// the length prefixes keep fields from running into each other
+	shifted := e
+	shifted.Actor, shifted.Action = e.Actor+"a", e.Action[1:]
+	if e.Action[0] != 'a' || shifted.hash("") == e.hash("") {
+		t.Error("moving a character between fields kept the hash")
+	}
+
+	if e.hash("") == e.hash("00") {
+		t.Error("the hash ignores the previous hash")
+	}
+}
+
+func TestAuditChain(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func([]auditEntry) []auditEntry
+		want   int
+	}{
+		{name: "intact", tamper: func(c []auditEntry) []auditEntry { return c }, want: -1},
+		{name: "empty", tamper: func([]auditEntry) []auditEntry { return nil }, want: -1},
+		{name: "actor changed", tamper: func(c []auditEntry) []auditEntry { c[1].Actor = "mallory"; return c }, want: 1},
+		{name: "action changed", tamper: func(c []auditEntry) []auditEntry { c[0].Action = "login"; return c }, want: 0},
+		{name: "target changed", tamper: func(c []auditEntry) []auditEntry { c[2].Target = "event:2"; return c }, want: 2},
+		{name: "remote address changed", tamper: func(c []auditEntry) []auditEntry { c[1].RemoteAddr = "10.0.0.1"; return c }, want: 1},
+		{name: "user agent changed", tamper: func(c []auditEntry) []auditEntry { c[1].UserAgent = "curl"; return c }, want: 1},
+		{name: "request ID changed", tamper: func(c []auditEntry) []auditEntry { c[1].RequestID = "r2"; return c }, want: 1},
+		{name: "before changed", tamper: func(c []auditEntry) []auditEntry { c[2].Before = `{"capacity":50}`; return c }, want: 2},
+		{name: "after changed", tamper: func(c []auditEntry) []auditEntry { c[2].After = `{"capacity":999}`; return c }, want: 2},
+		{name: "time changed", tamper: func(c []auditEntry) []auditEntry { c[0].Time = c[0].Time.Add(time.Microsecond); return c }, want: 0},
+		{
+			name: "entry rehashed",
+			tamper: func(c []auditEntry) []auditEntry {
+				c[1].Actor = "mallory"
+				c[1].Hash = c[1].hash(c[1].PrevHash)
+				return c
+			},
+			want: 2,
+		},
+		{name: "entry deleted", tamper: func(c []auditEntry) []auditEntry { return append(c[:1], c[2:]...) }, want: 1},
+		{name: "first entry deleted", tamper: func(c []auditEntry) []auditEntry { return c[1:] }, want: 0},
+		{name: "entries swapped", tamper: func(c []auditEntry) []auditEntry { c[1], c[2] = c[2], c[1]; return c }, want: 1},
+		{
+			name: "entry appended off the chain",
+			tamper: func(c []auditEntry) []auditEntry {
+				e := auditEntry{Actor: "mallory", Action: "login", Time: c[2].Time}
+				e.Hash = e.hash("")
+				return append(c, e)
+			},
+			want: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := brokenAt(tt.tamper(testAuditEntries())); got != tt.want {
+				t.Errorf("chain broken at %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package fileserver
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// capacityLockKey, with the event ID, is the advisory lock serializing the
+// decision to give a registration a place, so concurrent submissions can't
+// oversell
+const capacityLockKey = 0x63617061
+
+const (
+	// registrations hold a place from submission, even unconfirmed, until
+	// they expire, are deleted or are anonymized; expired ones stop counting
+	// before the sweep deletes them
+	queryCountPlaces = `SELECT count(*), count(*) FILTER (WHERE gift_box)
+	FROM form_info WHERE event_id=$1 AND waitlisted_time IS NULL AND anonymized_time IS NULL
+	AND (verified_time IS NOT NULL OR ctime >= $2)`
+
+	// only confirmed registrations are promoted, so a place never goes to
+	// one that may still expire
+	querySelectWaitlist = `SELECT id, email, id_no, id_hash, gift_box FROM form_info
+	WHERE event_id=$1 AND waitlisted_time IS NOT NULL AND verified_time IS NOT NULL AND anonymized_time IS NULL
+	ORDER BY waitlisted_time, id
+	FOR UPDATE`
+
+	queryPromote = `UPDATE form_info SET waitlisted_time = NULL, promoted_time = $2 WHERE id = ANY($1)`
+)
+
+// capacityLimits limits how many registrations of an event get a ticket.
+// The rest go to a waitlist, and are promoted in order as places free up.
+type capacityLimits struct {
+	// Places is the number of tickets; 0 means no limit
+	Places int
+	// GiftBoxes is the number of those tickets that come with a gift box;
+	// 0 means no limit
+	GiftBoxes int
+}
+
+// hasRoom reports whether a registration fits with places and giftBoxes
+// already taken.
+func (c *capacityLimits) hasRoom(places, giftBoxes int, giftBox bool) bool {
+	if c.Places > 0 && places >= c.Places {
+		return false
+	}
+	if giftBox && c.GiftBoxes > 0 && giftBoxes >= c.GiftBoxes {
+		return false
+	}
+
+	return true
+}
+
+// lockPlaces takes the capacity lock of the event for the rest of tx and
+// returns the places and gift boxes taken, leaving out unconfirmed
+// registrations made before expired.
+func lockPlaces(ctx context.Context, tx *sql.Tx, eventID int64, expired time.Time) (int, int, error) {
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1, $2)`, capacityLockKey, eventID); err != nil {
+		return 0, 0, fmt.Errorf("failed to lock capacity: %w", err)
+	}
+
+	var places, giftBoxes int
+	if err := tx.QueryRowContext(ctx, queryCountPlaces, eventID, expired).Scan(&places, &giftBoxes); err != nil {
+		return 0, 0, fmt.Errorf("failed to count places: %w", err)
+	}
+
+	return places, giftBoxes, nil
+}
+
+// waitlist reports whether a new registration for e has to wait for a
+// place. It must run in the transaction inserting the registration.
+func waitlist(ctx context.Context, tx *sql.Tx, e *event, f *formInfo, expired time.Time) (bool, error) {
+	limits := e.capacity()
+	if limits == nil {
+		return false, nil
+	}
+
+	places, giftBoxes, err := lockPlaces(ctx, tx, e.ID, expired)
+	if err != nil {
+		return false, err
+	}
+
+	return !limits.hasRoom(places, giftBoxes, f.GiftBox), nil
+}
+
+type promotion struct {
+	id      int64
+	email   string
+	idNo    uint64
+	hash    string
+	giftBox bool
+}
+
+// fill picks who on the waitlist, in order, gets the places left with
+// places and giftBoxes taken. Someone without a gift box can go ahead of
+// those waiting for one.
+func (c *capacityLimits) fill(places, giftBoxes int, waiting []promotion) []promotion {
+	var promoted []promotion
+	for _, p := range waiting {
+		if !c.hasRoom(places, giftBoxes, false) {
+			break
+		}
+		if !c.hasRoom(places, giftBoxes, p.giftBox) {
+			continue
+		}
+
+		promoted = append(promoted, p)
+		places++
+		if p.giftBox {
+			giftBoxes++
+		}
+	}
+
+	return promoted
+}
+
+// promoteWaitlist gives the free places of an event to confirmed
+// registrations on its waitlist, oldest first, and emails them their ticket.
+func (server *Server) promoteWaitlist(ctx context.Context, eventID int64) {
+	e, err := selectEvent(ctx, eventID)
+	if err != nil {
+		log.Printf("failed to select event %d to promote its waitlist: %s", eventID, err)
+		return
+	}
+	if e.capacity() == nil {
+		return
+	}
+
+	now := time.Now()
+	promoted, err := takeFreePlaces(ctx, server.db, e, now, server.unverifiedCutoff(now))
+	if err != nil {
+		log.Printf("failed to promote the waitlist of event %s: %s", e.Slug, err)
+		return
+	}
+
+	for _, p := range promoted {
+		log.Printf("registration %d promoted from the waitlist of event %s", p.id, e.Slug)
+		go server.sendTicket(p.id, e.ID, p.email, p.idNo, p.hash)
+	}
+}
+
+func takeFreePlaces(ctx context.Context, db *sql.DB, e *event, now, expired time.Time) ([]promotion, error) {
+	limits := e.capacity()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	places, giftBoxes, err := lockPlaces(ctx, tx, e.ID, expired)
+	if err != nil {
+		return nil, err
+	}
+	if !limits.hasRoom(places, giftBoxes, false) {
+		return nil, nil
+	}
+
+	rows, err := tx.QueryContext(ctx, querySelectWaitlist, e.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select the waitlist: %w", err)
+	}
+	defer rows.Close()
+
+	var waiting []promotion
+	for rows.Next() {
+		var p promotion
+		var email, hash sql.NullString
+		var idNo sql.NullInt64
+		var giftBox sql.NullBool
+		if err := rows.Scan(&p.id, &email, &idNo, &hash, &giftBox); err != nil {
+			return nil, fmt.Errorf("failed to scan the waitlist: %w", err)
+		}
+		p.email, p.idNo, p.hash, p.giftBox = email.String, uint64(idNo.Int64), hash.String, giftBox.Bool
+		waiting = append(waiting, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate the waitlist: %w", err)
+	}
+	rows.Close()
+
+	promoted := limits.fill(places, giftBoxes, waiting)
+	var ids []int64
+	for _, p := range promoted {
+		ids = append(ids, p.id)
+	}
+
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, queryPromote, pq.Array(ids), now); err != nil {
+		return nil, fmt.Errorf("failed to promote registrations: %w", err)
+	}
+
+	return promoted, tx.Commit()
+}
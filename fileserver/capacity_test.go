@@ -0,0 +1,112 @@
+package fileserver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHasRoom(t *testing.T) {
+	tests := []struct {
+		name              string
+		limits            capacityLimits
+		places, giftBoxes int
+		giftBox           bool
+		want              bool
+	}{
+		{"no limits", capacityLimits{}, 1000, 1000, true, true},
+		{"places left", capacityLimits{Places: 10}, 9, 0, false, true},
+		{"full", capacityLimits{Places: 10}, 10, 0, false, false},
+		{"over full", capacityLimits{Places: 10}, 12, 0, false, false},
+		{"gift boxes left", capacityLimits{Places: 10, GiftBoxes: 3}, 5, 2, true, true},
+		{"out of gift boxes", capacityLimits{Places: 10, GiftBoxes: 3}, 5, 3, true, false},
+		{"out of gift boxes, none wanted", capacityLimits{Places: 10, GiftBoxes: 3}, 5, 3, false, true},
+		{"full with gift boxes left", capacityLimits{Places: 10, GiftBoxes: 3}, 10, 1, true, false},
+		{"only gift boxes limited", capacityLimits{GiftBoxes: 3}, 500, 3, false, true},
+		{"only gift boxes limited, out", capacityLimits{GiftBoxes: 3}, 500, 3, true, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.limits.hasRoom(tt.places, tt.giftBoxes, tt.giftBox); got != tt.want {
+			t.Errorf("%s: hasRoom(%d, %d, %t) = %t, want %t", tt.name, tt.places, tt.giftBoxes, tt.giftBox, got, tt.want)
+		}
+	}
+}
+
+func TestFill(t *testing.T) {
+	plain := func(id int64) promotion { return promotion{id: id} }
+	boxed := func(id int64) promotion { return promotion{id: id, giftBox: true} }
+
+	tests := []struct {
+		name              string
+		limits            capacityLimits
+		places, giftBoxes int
+		waiting           []promotion
+		want              []int64
+	}{
+		{name: "nobody waiting", limits: capacityLimits{Places: 10}, places: 5},
+		{name: "full", limits: capacityLimits{Places: 10}, places: 10, waiting: []promotion{plain(1)}},
+		{name: "room for all", limits: capacityLimits{Places: 10}, places: 5, waiting: []promotion{plain(1), plain(2)}, want: []int64{1, 2}},
+		{name: "oldest first", limits: capacityLimits{Places: 10}, places: 8, waiting: []promotion{plain(1), plain(2), plain(3)}, want: []int64{1, 2}},
+		{
+			name:      "no gift box goes ahead",
+			limits:    capacityLimits{Places: 10, GiftBoxes: 2},
+			places:    5,
+			giftBoxes: 2,
+			waiting:   []promotion{boxed(1), plain(2), boxed(3), plain(4)},
+			want:      []int64{2, 4},
+		},
+		{
+			name:      "gift boxes until they run out",
+			limits:    capacityLimits{Places: 10, GiftBoxes: 3},
+			places:    5,
+			giftBoxes: 1,
+			waiting:   []promotion{boxed(1), boxed(2), boxed(3), plain(4)},
+			want:      []int64{1, 2, 4},
+		},
+		{
+			name:    "places run out before gift boxes",
+			limits:  capacityLimits{Places: 10, GiftBoxes: 5},
+			places:  8,
+			waiting: []promotion{boxed(1), plain(2), boxed(3)},
+			want:    []int64{1, 2},
+		},
+		{
+			name:      "only gift boxes limited",
+			limits:    capacityLimits{GiftBoxes: 1},
+			places:    100,
+			giftBoxes: 1,
+			waiting:   []promotion{boxed(1), plain(2)},
+			want:      []int64{2},
+		},
+		{
+			name:    "over capacity after it was lowered",
+			limits:  capacityLimits{Places: 10},
+			places:  12,
+			waiting: []promotion{plain(1)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []int64
+			for _, p := range tt.limits.fill(tt.places, tt.giftBoxes, tt.waiting) {
+				got = append(got, p.id)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("promoted %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEventCapacity(t *testing.T) {
+	if (&event{}).capacity() != nil {
+		t.Error("an event without limits has a capacity")
+	}
+	if c := (&event{Capacity: 100}).capacity(); c == nil || c.Places != 100 || c.GiftBoxes != 0 {
+		t.Errorf("capacity = %+v, want 100 places", c)
+	}
+	if c := (&event{GiftBoxCapacity: 20}).capacity(); c == nil || c.Places != 0 || c.GiftBoxes != 20 {
+		t.Errorf("capacity = %+v, want 20 gift boxes", c)
+	}
+}
@@ -0,0 +1,215 @@
+package fileserver
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Carbon-X-DAO/CieloVerde.io/captcha"
+	"github.com/lib/pq"
+)
+
+const challengePurpose = "form-challenge"
+
+// a form has to be submitted within this long of fetching its challenge
+const challengeLifetime = 2 * time.Hour
+
+// form fields the challenges read
+const (
+	honeypotField  = "website"
+	challengeField = "challenge"
+	powField       = "pow"
+	captchaField   = "captcha_token"
+)
+
+// captchaWidgetFields are where the hCaptcha and Turnstile widgets put their
+// token when they're dropped into a form as is
+var captchaWidgetFields = []string{"h-captcha-response", "cf-turnstile-response"}
+
+const (
+	queryInsertChallengeUse = `INSERT INTO challenge_uses(nonce, ctime) VALUES( $1, $2 )`
+
+	queryDeleteExpiredChallengeUses = `DELETE FROM challenge_uses WHERE ctime < $1`
+)
+
+var stmtInsertChallengeUse *sql.Stmt
+var stmtDeleteExpiredChallengeUses *sql.Stmt
+
+var errChallengeFailed = errors.New("challenge failed")
+
+const tplChallengeFailed = `<!DOCTYPE html>
+<html>
+	<body>
+		<h1>No pudimos verificar que eres una persona.</h1>
+		<p><a href="/form">Vuelve al formulario</a> e int&eacute;ntalo de nuevo.</p>
+	</body>
+</html>
+`
+
+// ChallengeConfig picks the checks a registration has to pass to show it
+// came from a person.
+type ChallengeConfig struct {
+	// Honeypot rejects forms filling in a field hidden from people
+	Honeypot bool
+	// MinFillTime rejects forms submitted sooner than this after fetching
+	// their challenge from /challenge
+	MinFillTime time.Duration
+	// PoWBits is the number of leading zero bits the proof of work must
+	// reach; 0 turns it off
+	PoWBits int
+	// Captcha, when non-nil, verifies an hCaptcha or Turnstile token
+	Captcha *captcha.Verifier
+}
+
+// needsToken reports whether forms must carry a token from /challenge.
+func (c *ChallengeConfig) needsToken() bool {
+	return c != nil && (c.MinFillTime > 0 || c.PoWBits > 0)
+}
+
+type challengeResponse struct {
+	Token   string `json:"token"`
+	PoWBits int    `json:"pow_bits"`
+	// the fields the frontend has to fill in
+	TokenField    string `json:"token_field"`
+	PoWField      string `json:"pow_field"`
+	HoneypotField string `json:"honeypot_field,omitempty"`
+	CaptchaField  string `json:"captcha_field,omitempty"`
+}
+
+// handleChallenge hands the frontend a fresh challenge token when the
+// registration form is shown.
+func (server *Server) handleChallenge(w http.ResponseWriter, r *http.Request) {
+	c := server.challenge
+	resp := challengeResponse{TokenField: challengeField, PoWField: powField}
+
+	if c.needsToken() {
+		nonce := make([]byte, 16)
+		if _, err := rand.Read(nonce); err != nil {
+			log.Printf("failed to generate challenge: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		now := time.Now()
+		subject := strconv.FormatInt(now.UnixMilli(), 10) + "." + hex.EncodeToString(nonce)
+		resp.Token = server.signToken(challengePurpose, subject, now.Add(challengeLifetime))
+		resp.PoWBits = c.PoWBits
+	}
+	if c != nil && c.Honeypot {
+		resp.HoneypotField = honeypotField
+	}
+	if c != nil && c.Captcha != nil {
+		resp.CaptchaField = captchaField
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// powSolved reports whether sha256(token ":" solution) starts with at least
+// n zero bits.
+func powSolved(token, solution string, n int) bool {
+	sum := sha256.Sum256([]byte(token + ":" + solution))
+
+	zeros := 0
+	for _, b := range sum {
+		if b != 0 {
+			zeros += bits.LeadingZeros8(b)
+			break
+		}
+		zeros += 8
+	}
+
+	return zeros >= n
+}
+
+// checkChallenge runs the configured checks on a registration. Failures
+// are logged with the reason and reported as errChallengeFailed, so the
+// response doesn't tell a script which check it failed.
+func (server *Server) checkChallenge(r *http.Request, values url.Values) error {
+	c := server.challenge
+	if c == nil {
+		return nil
+	}
+
+	fail := func(format string, args ...interface{}) error {
+		log.Printf("rejected registration from %s: %s", clientIP(r), fmt.Sprintf(format, args...))
+		return errChallengeFailed
+	}
+
+	if c.Honeypot && values.Get(honeypotField) != "" {
+		return fail("honeypot filled in")
+	}
+
+	now := time.Now()
+	if c.needsToken() {
+		token := values.Get(challengeField)
+		subject, err := server.verifyToken(challengePurpose, token, now)
+		if err != nil {
+			return fail("missing or expired challenge token")
+		}
+
+		issuedMilli, nonce, _ := strings.Cut(subject, ".")
+		issued, err := strconv.ParseInt(issuedMilli, 10, 64)
+		if err != nil {
+			return fail("malformed challenge token")
+		}
+		if now.Sub(time.UnixMilli(issued)) < c.MinFillTime {
+			return fail("form filled in %s", now.Sub(time.UnixMilli(issued)))
+		}
+
+		if c.PoWBits > 0 {
+			solution := values.Get(powField)
+			if len(solution) > 64 || !powSolved(token, solution, c.PoWBits) {
+				return fail("proof of work not solved")
+			}
+		}
+
+		// checked last, so a token is only spent by a submission that
+		// passed everything else
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := stmtDeleteExpiredChallengeUses.ExecContext(ctx, now.Add(-challengeLifetime)); err != nil {
+			log.Printf("failed to delete expired challenge uses: %s", err)
+		}
+		_, err = stmtInsertChallengeUse.ExecContext(ctx, nonce, now)
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == pqUniqueViolation {
+			return fail("challenge token reused")
+		}
+		if err != nil {
+			return fmt.Errorf("failed to store challenge use: %w", err)
+		}
+	}
+
+	if c.Captcha != nil {
+		token := values.Get(captchaField)
+		for _, f := range captchaWidgetFields {
+			if token == "" {
+				token = values.Get(f)
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		err := c.Captcha.Verify(ctx, token, clientIP(r))
+		if errors.Is(err, captcha.ErrRejected) {
+			return fail("%s", err)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
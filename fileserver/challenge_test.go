@@ -0,0 +1,162 @@
+package fileserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Carbon-X-DAO/CieloVerde.io/captcha"
+)
+
+// solvePoW finds a solution to token with the given prefix.
+func solvePoW(t *testing.T, token, prefix string, n int) string {
+	t.Helper()
+
+	for i := 0; i < 1<<24; i++ {
+		solution := prefix + strconv.Itoa(i)
+		if powSolved(token, solution, n) {
+			return solution
+		}
+	}
+	t.Fatalf("no solution to %d bits", n)
+	return ""
+}
+
+func TestPoWSolved(t *testing.T) {
+	const token = "dGVzdA.c2ln"
+	solution := solvePoW(t, token, "", 12)
+
+	tests := []struct {
+		name            string
+		token, solution string
+		n               int
+		want            bool
+	}{
+		{name: "no bits required", token: token, solution: "anything", n: 0, want: true},
+		{name: "solved", token: token, solution: solution, n: 12, want: true},
+		{name: "solved for fewer bits", token: token, solution: solution, n: 8, want: true},
+		{name: "another token", token: token + "x", solution: solution, n: 12},
+		{name: "empty solution", token: token, solution: "", n: 12},
+		{name: "more bits than a hash has", token: token, solution: solution, n: 257},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := powSolved(tt.token, tt.solution, tt.n); got != tt.want {
+				t.Errorf("powSolved(%q, %q, %d) = %v, want %v", tt.token, tt.solution, tt.n, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckChallenge(t *testing.T) {
+	server := &Server{
+		secret:    []byte("0123456789abcdef0123456789abcdef"),
+		challenge: &ChallengeConfig{Honeypot: true, MinFillTime: 5 * time.Second, PoWBits: 12},
+	}
+	now := time.Now()
+	issue := func(issued time.Time, exp time.Time) string {
+		subject := strconv.FormatInt(issued.UnixMilli(), 10) + ".00112233445566778899aabbccddeeff"
+		return server.signToken(challengePurpose, subject, exp)
+	}
+
+	// issued long enough ago to pass MinFillTime, so the proof of work is
+	// checked next
+	settled := issue(now.Add(-time.Minute), now.Add(time.Hour))
+	fresh := issue(now, now.Add(time.Hour))
+	expired := issue(now.Add(-3*time.Hour), now.Add(-time.Hour))
+	otherPurpose := server.signToken(searchPurpose, strconv.FormatInt(now.Add(-time.Minute).UnixMilli(), 10)+".00", now.Add(time.Hour))
+	malformed := server.signToken(challengePurpose, "yesterday.00", now.Add(time.Hour))
+
+	tests := []struct {
+		name   string
+		values url.Values
+	}{
+		{name: "honeypot filled in", values: url.Values{honeypotField: {"https://spam.example"}, challengeField: {settled}}},
+		{name: "no token", values: url.Values{}},
+		{name: "token for another purpose", values: url.Values{challengeField: {otherPurpose}}},
+		{name: "tampered token", values: url.Values{challengeField: {settled + "x"}}},
+		{name: "expired token", values: url.Values{challengeField: {expired}}},
+		{name: "malformed token", values: url.Values{challengeField: {malformed}}},
+		{name: "filled in too fast", values: url.Values{challengeField: {fresh}, powField: {solvePoW(t, fresh, "", 12)}}},
+		{name: "no proof of work", values: url.Values{challengeField: {settled}}},
+		{name: "proof of work for another token", values: url.Values{challengeField: {settled}, powField: {solvePoW(t, fresh, "", 12)}}},
+		{name: "proof of work too long", values: url.Values{challengeField: {settled}, powField: {solvePoW(t, settled, strings.Repeat("0", 64), 12)}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/submit", nil)
+			if err := server.checkChallenge(r, tt.values); err != errChallengeFailed {
+				t.Errorf("checkChallenge = %v, want %v", err, errChallengeFailed)
+			}
+		})
+	}
+}
+
+func TestCheckChallengeCaptcha(t *testing.T) {
+	siteverify := httptest.NewServer(captcha.FakeHandler("secret"))
+	defer siteverify.Close()
+
+	server := &Server{
+		secret: []byte("0123456789abcdef0123456789abcdef"),
+		challenge: &ChallengeConfig{
+			Honeypot: true,
+			Captcha:  &captcha.Verifier{URL: siteverify.URL, Secret: "secret", Client: siteverify.Client()},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		values url.Values
+		want   error
+	}{
+		{name: "no challenge token needed", values: url.Values{captchaField: {captcha.FakePassToken}}},
+		{name: "widget field", values: url.Values{"cf-turnstile-response": {captcha.FakePassToken}}},
+		{name: "empty honeypot", values: url.Values{honeypotField: {""}, "h-captcha-response": {captcha.FakePassToken}}},
+		{name: "rejected", values: url.Values{captchaField: {"not-a-pass"}}, want: errChallengeFailed},
+		{name: "missing", values: url.Values{}, want: errChallengeFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/submit", nil)
+			if err := server.checkChallenge(r, tt.values); err != tt.want {
+				t.Errorf("checkChallenge = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleChallenge(t *testing.T) {
+	server := &Server{
+		secret:    []byte("0123456789abcdef0123456789abcdef"),
+		challenge: &ChallengeConfig{Honeypot: true, MinFillTime: 5 * time.Second, PoWBits: 12},
+	}
+
+	w := httptest.NewRecorder()
+	server.handleChallenge(w, httptest.NewRequest(http.MethodGet, "/challenge", nil))
+
+	var resp challengeResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.PoWBits != 12 || resp.HoneypotField != honeypotField || resp.CaptchaField != "" {
+		t.Errorf("challenge = %+v", resp)
+	}
+
+	subject, err := server.verifyToken(challengePurpose, resp.Token, time.Now())
+	if err != nil {
+		t.Fatalf("verifyToken: %v", err)
+	}
+	issuedMilli, nonce, _ := strings.Cut(subject, ".")
+	issued, err := strconv.ParseInt(issuedMilli, 10, 64)
+	if err != nil || time.Since(time.UnixMilli(issued)) > time.Minute || len(nonce) != 32 {
+		t.Errorf("challenge subject = %q", subject)
+	}
+}
@@ -0,0 +1,617 @@
+package fileserver
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ajg/form"
+	"github.com/lib/pq"
+)
+
+const (
+	resendPurpose = "resend"
+	// how long the resend button on the duplicate page works
+	resendLinkLifetime = time.Hour
+	// a registration's ticket can't be resent more often than this
+	resendInterval = 10 * time.Minute
+)
+
+// pqUniqueViolation is the Postgres error code for a unique constraint
+// violation
+const pqUniqueViolation = "23505"
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == pqUniqueViolation
+}
+
+const (
+	// registrations are unique per event
+	querySelectRegistrationByIDNo = `SELECT id FROM form_info WHERE event_id=$1 AND id_no=$2`
+
+	querySelectRegistrationByEmail = `SELECT id FROM form_info
+	WHERE event_id=$1 AND lower(email) = lower($2) AND anonymized_time IS NULL LIMIT 1`
+
+	// phones from before validation are stored as typed
+	querySelectRegistrationByPhone = `SELECT id FROM form_info
+	WHERE event_id=$1 AND regexp_replace(phone, '\D', '', 'g') IN ($2, $3) AND anonymized_time IS NULL LIMIT 1`
+
+	querySelectIdentity = `SELECT first_name, last_name, id_no, email FROM form_info WHERE id=$1`
+
+	queryInsertConflict = `INSERT INTO
+	registration_conflicts(form_id, field, submission, remote_addr, useragent, ctime)
+	VALUES( $1, $2, $3, $4, $5, $6 )`
+
+	querySelectConflicts = `SELECT c.id, c.form_id, c.field, c.submission, c.remote_addr, c.ctime,
+		f.first_name, f.last_name, f.id_no, f.email, f.phone, f.verified_time IS NOT NULL, e.name
+	FROM registration_conflicts c JOIN form_info f ON f.id = c.form_id JOIN events e ON e.id = f.event_id
+	WHERE c.resolution IS NULL
+	ORDER BY c.ctime`
+
+	// the submission is for the event of the registration it conflicts with
+	queryTakeConflict = `SELECT c.form_id, c.field, c.submission, f.event_id
+	FROM registration_conflicts c JOIN form_info f ON f.id = c.form_id
+	WHERE c.id=$1 AND c.resolution IS NULL FOR UPDATE OF c`
+
+	queryResolveConflict = `UPDATE registration_conflicts
+	SET resolution = $2, resolved_by = $3, resolved_time = $4, submission = NULL
+	WHERE id=$1`
+
+	// a new email has to be confirmed like a new registration's, and holds
+	// the place for as long
+	queryReplaceIdentity = `UPDATE form_info f
+	SET first_name = $2, last_name = $3, email = $4, phone = $5,
+		verified_time = CASE WHEN old.changed THEN NULL ELSE f.verified_time END,
+		ctime = CASE WHEN old.changed THEN $6 ELSE f.ctime END
+	FROM (SELECT lower(email) IS DISTINCT FROM lower($4) AS changed FROM form_info WHERE id=$1) old
+	WHERE f.id=$1 AND f.anonymized_time IS NULL
+	RETURNING f.email, f.id_no, f.id_hash, f.event_id, f.waitlisted_time IS NOT NULL, f.verified_time IS NOT NULL, f.ctime, old.changed`
+
+	queryTakeResend = `UPDATE form_info SET resent_time = $2
+	WHERE id=$1 AND anonymized_time IS NULL AND (resent_time IS NULL OR resent_time < $3)
+	RETURNING email, id_no, id_hash, event_id, verified_time IS NOT NULL, waitlisted_time IS NOT NULL, ctime`
+)
+
+var stmtSelectRegistrationByIDNo *sql.Stmt
+var stmtSelectRegistrationByEmail *sql.Stmt
+var stmtSelectRegistrationByPhone *sql.Stmt
+var stmtSelectIdentity *sql.Stmt
+var stmtInsertConflict *sql.Stmt
+var stmtSelectConflicts *sql.Stmt
+var stmtTakeResend *sql.Stmt
+
+// duplicateError reports that a registration matches an existing one on
+// Field: id_no, or email or phone when those must be unique.
+type duplicateError struct {
+	Field    string
+	Existing int64
+}
+
+func (e *duplicateError) Error() string {
+	return fmt.Sprintf("%s already registered by registration %d", e.Field, e.Existing)
+}
+
+// uniqueLock returns the advisory lock key serializing registrations that
+// share a value which must be unique within an event.
+func uniqueLock(eventID int64, field, value string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(fmt.Sprintf("%d:%s:%s", eventID, field, value)))
+	return int64(h.Sum64())
+}
+
+// phoneDigits returns the forms a normalized phone may have been stored in
+// before validation: with and without the Colombian country code.
+func phoneDigits(phone string) (string, string) {
+	d := digitsOnly(phone)
+	if strings.HasPrefix(d, "57") && len(d) == 12 {
+		return d, d[2:]
+	}
+
+	return d, d
+}
+
+// saveFormInfo stores a registration for e, unless its ID number is
+// registered for e already, or its email or phone when those are configured
+// to be unique. Those cases return a *duplicateError. It reports whether the
+// registration went to the waitlist.
+func (server *Server) saveFormInfo(ctx context.Context, e *event, f *formInfo, hash [16]byte) (int64, bool, error) {
+	tx, err := server.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	type check struct {
+		field string
+		value string
+		find  func() *sql.Row
+	}
+	var checks []check
+	if server.uniqueEmail {
+		checks = append(checks, check{"email", strings.ToLower(f.Email), func() *sql.Row {
+			return tx.StmtContext(ctx, stmtSelectRegistrationByEmail).QueryRowContext(ctx, e.ID, f.Email)
+		}})
+	}
+	if server.uniquePhone {
+		withCode, national := phoneDigits(f.Phone)
+		checks = append(checks, check{"phone", withCode, func() *sql.Row {
+			return tx.StmtContext(ctx, stmtSelectRegistrationByPhone).QueryRowContext(ctx, e.ID, withCode, national)
+		}})
+	}
+
+	for _, c := range checks {
+		if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, uniqueLock(e.ID, c.field, c.value)); err != nil {
+			return 0, false, err
+		}
+
+		var existing int64
+		err := c.find().Scan(&existing)
+		if err == nil {
+			return 0, false, &duplicateError{Field: c.field, Existing: existing}
+		}
+		if err != sql.ErrNoRows {
+			return 0, false, err
+		}
+	}
+
+	waitlisted, err := waitlist(ctx, tx, e, f, server.unverifiedCutoff(time.Now()))
+	if err != nil {
+		return 0, false, err
+	}
+
+	id, err := insertFormInfo(ctx, tx, f, hash, waitlisted)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == pqUniqueViolation && pqErr.Constraint == "form_info_event_id_id_no_key" {
+		tx.Rollback()
+
+		var existing int64
+		if err := stmtSelectRegistrationByIDNo.QueryRowContext(ctx, e.ID, f.ID).Scan(&existing); err != nil {
+			return 0, false, fmt.Errorf("failed to select registration of duplicate ID number: %w", err)
+		}
+		return 0, false, &duplicateError{Field: "id_no", Existing: existing}
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	if c := f.consent; c != nil {
+		if _, err := tx.StmtContext(ctx, stmtInsertConsent).ExecContext(ctx, id, c.textID, c.when, c.addr, c.userAgent); err != nil {
+			return 0, false, fmt.Errorf("failed to store consent: %w", err)
+		}
+	}
+
+	return id, waitlisted, tx.Commit()
+}
+
+func insertFormInfo(ctx context.Context, tx *sql.Tx, f *formInfo, hash [16]byte, waitlisted bool) (int64, error) {
+	now := time.Now()
+	waitlistedTime := sql.NullTime{Time: now, Valid: waitlisted}
+
+	var answers sql.NullString
+	if len(f.Answers) > 0 {
+		b, err := json.Marshal(f.Answers)
+		if err != nil {
+			return 0, err
+		}
+		answers = sql.NullString{String: string(b), Valid: true}
+	}
+
+	var id int64
+	err := tx.StmtContext(ctx, stmtInsertFormRow).QueryRowContext(ctx, f.FirstName, f.LastName,
+		f.Country, f.Department, f.City, f.Neighborhood, f.Street,
+		f.ID, f.Phone, f.Email, f.Gender, f.Age,
+		f.DailyQty, f.WeeklyQty, f.MonthlyQty,
+		f.Newsletter, f.GiftBox, f.Authorized, false, fmt.Sprintf("%x", hash), now, waitlistedTime, answers, f.EventID,
+		nullString(f.DepartmentCode), nullString(f.CityCode), nullString(f.BirthDate)).Scan(&id)
+
+	return id, err
+}
+
+// recordConflict queues a duplicate submission for an admin to review,
+// unless it's the same person registering twice: same ID number, name and
+// email.
+func recordConflict(ctx context.Context, r *http.Request, f *formInfo, dup *duplicateError) {
+	var first, last, email sql.NullString
+	var idNo sql.NullInt64
+	if err := stmtSelectIdentity.QueryRowContext(ctx, dup.Existing).Scan(&first, &last, &idNo, &email); err != nil {
+		log.Printf("failed to select registration %d: %s", dup.Existing, err)
+		return
+	}
+
+	fold := func(s string) string {
+		return foldAccents(strings.ToLower(strings.Join(strings.Fields(s), " ")))
+	}
+	if uint64(idNo.Int64) == f.ID && fold(first.String+" "+last.String) == fold(f.FirstName+" "+f.LastName) &&
+		strings.EqualFold(email.String, f.Email) {
+		return
+	}
+
+	submission, err := json.Marshal(f)
+	if err != nil {
+		log.Printf("failed to encode conflicting submission: %s", err)
+		return
+	}
+
+	if _, err := stmtInsertConflict.ExecContext(ctx, dup.Existing, dup.Field, string(submission),
+		clientIP(r), r.Header.Get("User-Agent"), time.Now()); err != nil {
+		log.Printf("failed to store conflict with registration %d: %s", dup.Existing, err)
+		return
+	}
+	log.Printf("queued submission conflicting with registration %d on %s", dup.Existing, dup.Field)
+}
+
+// resendURL is where the registrant of a duplicate can ask for the ticket of
+// the existing registration.
+func (server *Server) resendURL(dup *duplicateError) string {
+	return "/resend/" + server.signToken(resendPurpose, strconv.FormatInt(dup.Existing, 10), time.Now().Add(resendLinkLifetime))
+}
+
+const tplAlreadyRegistered = `<!DOCTYPE html>
+<html>
+	<body>
+		<h1>{{if eq .Field "id_no"}}Esta c&eacute;dula{{else if eq .Field "email"}}Este correo{{else}}Este tel&eacute;fono{{end}} ya est&aacute; registrado.</h1>
+		<p>&iquest;Quieres que reenviemos la boleta al correo con el que se hizo el registro?
+		Si a&uacute;n no lo confirmaste, te reenviaremos el enlace para confirmarlo.</p>
+		<form action="{{.ResendURL}}" method="POST">
+		<input type="hidden" name="csrf_token" value="{{.CSRFToken}}" />
+		<input type="submit" value="reenviar" />
+		</form>
+		<p>Si no te registraste o tus datos est&aacute;n mal, escr&iacute;benos: revisaremos tu caso.</p>
+	</body>
+</html>
+`
+
+const tplResent = `<!DOCTYPE html>
+<html>
+	<body>
+		<h1>Listo. Si el registro existe, reenviamos el correo.</h1>
+		<p>Revisa tu bandeja de entrada y la carpeta de spam.</p>
+	</body>
+</html>
+`
+
+var tmplAlreadyRegistered = template.Must(template.New("alreadyRegistered").Parse(tplAlreadyRegistered))
+
+type alreadyRegisteredPage struct {
+	Field     string
+	ResendURL string
+	CSRFToken string
+}
+
+func (server *Server) writeAlreadyRegistered(w http.ResponseWriter, r *http.Request, dup *duplicateError) {
+	csrf, err := server.csrfToken(w, r)
+	if err != nil {
+		log.Printf("failed to issue CSRF token: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/html")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.WriteHeader(http.StatusConflict)
+	if err := tmplAlreadyRegistered.Execute(w, alreadyRegisteredPage{dup.Field, server.resendURL(dup), csrf}); err != nil {
+		log.Printf("failed to execute template for duplicate registration: %s", err)
+	}
+}
+
+// handleResend sends the ticket of a registration again, or its
+// verification link if it isn't confirmed, always to the address on file.
+// The answer is the same whether or not anything was sent.
+func (server *Server) handleResend(w http.ResponseWriter, r *http.Request) {
+	subject, err := server.verifyToken(resendPurpose, strings.TrimPrefix(r.URL.Path, "/resend/"), time.Now())
+	if err != nil {
+		writeVerifyInvalid(w)
+		return
+	}
+	formID, err := strconv.ParseInt(subject, 10, 64)
+	if err != nil {
+		writeVerifyInvalid(w)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	var email, hash string
+	var idNo uint64
+	var eventID int64
+	var verified, waitlisted bool
+	var created time.Time
+	err = stmtTakeResend.QueryRowContext(ctx, formID, now, now.Add(-resendInterval)).Scan(&email, &idNo, &hash, &eventID, &verified, &waitlisted, &created)
+	switch {
+	case err == sql.ErrNoRows:
+		log.Printf("not resending registration %d: sent recently or gone", formID)
+	case err != nil:
+		log.Printf("failed to select registration %d to resend: %s", formID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	case verified && waitlisted:
+		// the ticket goes out when a place frees up
+		log.Printf("not resending registration %d: on the waitlist", formID)
+	case verified:
+		go server.sendTicket(formID, eventID, email, idNo, hash)
+	default:
+		go server.sendVerification(formID, email, idNo, created)
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "sent"})
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/html")
+	w.Write([]byte(tplResent))
+}
+
+const tplConflicts = `
+<!DOCTYPE html>
+<html>
+<style>
+   td, th {
+		padding: 4px 10px;
+		text-align: left;
+		vertical-align: top;
+   }
+</style>
+<body>
+<h1>Registros en conflicto</h1>
+<p>Env&iacute;os rechazados por coincidir con un registro existente en la c&eacute;dula, el correo o el tel&eacute;fono.</p>
+<table>
+	<tr><th>Fecha</th><th>Evento</th><th>Coincide en</th><th>Registro existente</th><th>Env&iacute;o rechazado</th><th></th></tr>
+	{{- range .Conflicts}}
+	<tr>
+		<td>{{.Created.Format "2006-01-02 15:04"}}<br/>desde {{.RemoteAddr}}</td>
+		<td>{{.Event}}</td>
+		<td>{{if eq .Field "id_no"}}c&eacute;dula{{else if eq .Field "email"}}correo{{else}}tel&eacute;fono{{end}}</td>
+		<td>
+			<a href="/admin/registrations/{{.FormID}}">{{.Existing.FirstName}} {{.Existing.LastName}}</a><br/>
+			{{.Existing.ID}}<br/>{{.Existing.Email}}<br/>{{.Existing.Phone}}
+			{{- if not .Verified}}<br/><i>sin confirmar</i>{{end}}
+		</td>
+		<td>{{.Submission.FirstName}} {{.Submission.LastName}}<br/>{{.Submission.ID}}<br/>{{.Submission.Email}}<br/>{{.Submission.Phone}}</td>
+		<td>
+			<form action="/admin/conflicts/{{.ID}}/resolve" method="POST">
+			<input type="hidden" name="csrf_token" value="{{$.CSRFToken}}" />
+			{{- if eq .Field "id_no"}}
+			<button name="action" value="replace">reemplazar nombre y contacto del registro</button>
+			{{- else}}
+			<button name="action" value="accept">registrar de todos modos</button>
+			{{- end}}
+			<button name="action" value="dismiss">descartar env&iacute;o</button>
+			</form>
+		</td>
+	</tr>
+	{{- else}}
+	<tr><td colspan="6">No hay conflictos pendientes.</td></tr>
+	{{- end}}
+</table>
+</body>
+</html>
+`
+
+var tmplConflicts = template.Must(template.New("conflicts").Parse(tplConflicts))
+
+type conflict struct {
+	ID         int64
+	FormID     int64
+	Field      string
+	RemoteAddr string
+	Created    time.Time
+	Event      string
+	Existing   formInfo
+	Verified   bool
+	Submission formInfo
+}
+
+type conflictsPage struct {
+	CSRFToken string
+	Conflicts []conflict
+}
+
+type conflictResolution struct {
+	Action string `form:"action"`
+}
+
+// handleConflicts lists the submissions waiting for an admin to resolve them.
+func (server *Server) handleConflicts(w http.ResponseWriter, r *http.Request) {
+	a := server.requirePermission(w, r, permConflicts)
+	if a == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	rows, err := stmtSelectConflicts.QueryContext(ctx)
+	if err != nil {
+		log.Printf("failed to select conflicts: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var page conflictsPage
+	for rows.Next() {
+		var c conflict
+		var submission string
+		var remoteAddr, first, last, email, phone sql.NullString
+		var idNo sql.NullInt64
+		if err := rows.Scan(&c.ID, &c.FormID, &c.Field, &submission, &remoteAddr, &c.Created,
+			&first, &last, &idNo, &email, &phone, &c.Verified, &c.Event); err != nil {
+			log.Printf("failed to scan conflict: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if err := json.Unmarshal([]byte(submission), &c.Submission); err != nil {
+			log.Printf("failed to decode submission of conflict %d: %s", c.ID, err)
+		}
+		c.RemoteAddr, c.Created = remoteAddr.String, c.Created.In(bogota)
+		c.Existing = formInfo{FirstName: first.String, LastName: last.String, ID: uint64(idNo.Int64), Email: email.String, Phone: phone.String}
+		page.Conflicts = append(page.Conflicts, c)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("failed to iterate conflicts: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	server.audit(r, a.Username, "view_conflicts", "", nil, map[string]int{"conflicts": len(page.Conflicts)})
+
+	if page.CSRFToken, err = server.csrfToken(w, r); err != nil {
+		log.Printf("failed to issue CSRF token: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/html")
+	if err := tmplConflicts.Execute(w, page); err != nil {
+		log.Printf("failed to execute template for conflicts: %s", err)
+	}
+}
+
+// handleResolveConflict applies an admin's decision on a conflict:
+// dismiss drops the submission, replace moves its name and contact into the
+// registration with the same ID number, and accept registers it despite the
+// shared email or phone. The submission is erased either way.
+func (server *Server) handleResolveConflict(w http.ResponseWriter, r *http.Request) {
+	a := server.requirePermission(w, r, permConflicts)
+	if a == nil {
+		return
+	}
+
+	id, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/admin/conflicts/"), "/resolve"), 10, 64)
+	if err != nil {
+		server.serveNotFound(w)
+		return
+	}
+
+	var res conflictResolution
+	dec := form.NewDecoder(nil)
+	dec.IgnoreUnknownKeys(true)
+	if err := dec.DecodeValues(&res, r.PostForm); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	tx, err := server.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("failed to begin resolving conflict %d: %s", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var formID, eventID int64
+	var field, submission string
+	err = tx.QueryRowContext(ctx, queryTakeConflict, id).Scan(&formID, &field, &submission, &eventID)
+	if err == sql.ErrNoRows {
+		// resolved already
+		http.Redirect(w, r, "/admin/conflicts", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to select conflict %d: %s", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var f formInfo
+	if err := json.Unmarshal([]byte(submission), &f); err != nil {
+		log.Printf("failed to decode submission of conflict %d: %s", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	var after func()
+	switch {
+	case res.Action == "dismiss":
+	case res.Action == "replace" && field == "id_no":
+		var email, hash string
+		var idNo uint64
+		var waitlisted, verified, changed bool
+		var created time.Time
+		err := tx.QueryRowContext(ctx, queryReplaceIdentity, formID, f.FirstName, f.LastName, f.Email, f.Phone, now).
+			Scan(&email, &idNo, &hash, &eventID, &waitlisted, &verified, &created, &changed)
+		if err != nil {
+			log.Printf("failed to replace identity of registration %d: %s", formID, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		switch {
+		case changed:
+			// the ticket follows once the new address is confirmed
+			after = func() { server.sendVerification(formID, email, idNo, created) }
+		case !verified:
+			// the link already sent still confirms it
+		case waitlisted:
+			after = func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+				defer cancel()
+				server.promoteWaitlist(ctx, eventID)
+			}
+		default:
+			after = func() { server.sendTicket(formID, eventID, email, idNo, hash) }
+		}
+	case res.Action == "accept" && field != "id_no":
+		e, err := selectEvent(ctx, eventID)
+		if err != nil {
+			log.Printf("failed to select event of conflict %d: %s", id, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		waitlisted, err := waitlist(ctx, tx, e, &f, server.unverifiedCutoff(now))
+		if err != nil {
+			log.Printf("failed to check capacity for conflict %d: %s", id, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		f.EventID = e.ID
+		newID, err := insertFormInfo(ctx, tx, &f, ticketHash(e.ID, f.ID), waitlisted)
+		if err != nil {
+			log.Printf("failed to register submission of conflict %d: %s", id, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		formID = newID
+		after = func() { server.sendVerification(newID, f.Email, f.ID, now) }
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if _, err := tx.ExecContext(ctx, queryResolveConflict, id, res.Action, a.Username, now); err != nil {
+		log.Printf("failed to resolve conflict %d: %s", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("failed to commit resolving conflict %d: %s", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if after != nil {
+		go after()
+	}
+
+	log.Printf("admin %s resolved conflict %d: %s", a.Username, id, res.Action)
+	server.audit(r, a.Username, "conflict_"+res.Action, fmt.Sprintf("conflict:%d", id), nil,
+		map[string]interface{}{"registration": formID, "field": field})
+
+	http.Redirect(w, r, "/admin/conflicts", http.StatusSeeOther)
+}
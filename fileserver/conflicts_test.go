@@ -0,0 +1,68 @@
+package fileserver
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestPhoneDigits(t *testing.T) {
+	tests := []struct {
+		phone          string
+		intl, national string
+	}{
+		{"+573001234567", "573001234567", "3001234567"},
+		{"+576012345678", "576012345678", "6012345678"},
+		{"+14155550100", "14155550100", "14155550100"},
+		// a foreign number that happens to start with 57 isn't Colombian
+		{"+5712345678901", "5712345678901", "5712345678901"},
+		{"+57 300 123 4567", "573001234567", "3001234567"},
+		{"3001234567", "3001234567", "3001234567"},
+		{"", "", ""},
+	}
+
+	for _, tt := range tests {
+		intl, national := phoneDigits(tt.phone)
+		if intl != tt.intl || national != tt.national {
+			t.Errorf("phoneDigits(%q) = %q, %q, want %q, %q", tt.phone, intl, national, tt.intl, tt.national)
+		}
+	}
+}
+
+func TestUniqueLock(t *testing.T) {
+	a := uniqueLock(1, "email", "ana@example.com")
+	if a != uniqueLock(1, "email", "ana@example.com") {
+		t.Error("the lock of a value changes")
+	}
+	for _, other := range []int64{
+		uniqueLock(2, "email", "ana@example.com"),
+		uniqueLock(1, "phone", "ana@example.com"),
+		uniqueLock(1, "email", "luis@example.com"),
+	} {
+		if other == a {
+			t.Error("different values share a lock")
+		}
+	}
+}
+
+func TestIsUniqueViolation(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"unique violation", &pq.Error{Code: pqUniqueViolation}, true},
+		{"wrapped", fmt.Errorf("insert: %w", &pq.Error{Code: pqUniqueViolation}), true},
+		{"other constraint", &pq.Error{Code: "23503"}, false},
+		{"not from Postgres", errors.New("duplicate key"), false},
+		{"nil", nil, false},
+	}
+
+	for _, tt := range tests {
+		if got := isUniqueViolation(tt.err); got != tt.want {
+			t.Errorf("%s: isUniqueViolation = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
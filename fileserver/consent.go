@@ -0,0 +1,300 @@
+package fileserver
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// the current text is the last one published
+	querySelectConsentText = `SELECT id, version, body, ctime FROM consent_texts
+	WHERE version=$1 OR ($1 = '' AND id = (SELECT max(id) FROM consent_texts))`
+
+	queryInsertConsentText = `INSERT INTO consent_texts(version, body, created_by, ctime) VALUES ($1, $2, $3, $4)`
+
+	queryInsertConsent = `INSERT INTO
+	consents(form_id, consent_text_id, accepted_time, remote_addr, useragent)
+	VALUES( $1, $2, $3, $4, $5 )`
+
+	querySelectConsent = `SELECT t.version, t.body, c.accepted_time, c.remote_addr, c.useragent, c.withdrawn_time
+	FROM consents c JOIN consent_texts t ON t.id = c.consent_text_id
+	WHERE c.form_id=$1`
+
+	queryWithdrawConsent = `UPDATE consents SET withdrawn_time = $2, withdrawn_addr = $3, withdrawn_useragent = $4
+	WHERE form_id=$1 AND withdrawn_time IS NULL`
+
+	// without the authorization there's no newsletter either
+	queryUnauthorize = `UPDATE form_info SET authorized = FALSE, newsletter = FALSE WHERE id=$1`
+
+	querySelectConsentReport = `SELECT t.version, t.body, t.created_by, t.ctime, count(c.id), count(c.withdrawn_time)
+	FROM consent_texts t LEFT JOIN consents c ON c.consent_text_id = t.id
+	GROUP BY t.id ORDER BY t.id DESC`
+)
+
+var stmtSelectConsentText *sql.Stmt
+var stmtInsertConsentText *sql.Stmt
+var stmtInsertConsent *sql.Stmt
+var stmtSelectConsent *sql.Stmt
+
+// errUnknownConsent is returned by register for a consent version that was
+// never published.
+var errUnknownConsent = errors.New("unknown consent version")
+
+// consentText is a published version of the data processing authorization.
+// Texts are never edited: a change is a new version.
+type consentText struct {
+	ID        int64
+	Version   string
+	Body      string
+	Published time.Time
+}
+
+// consentAcceptance is what register records when a registration is
+// authorized.
+type consentAcceptance struct {
+	textID    int64
+	when      time.Time
+	addr      string
+	userAgent string
+}
+
+// consentRecord is the authorization of a registration, as shown to admins
+// and to the attendee.
+type consentRecord struct {
+	Version    string     `json:"version"`
+	Text       string     `json:"text"`
+	Accepted   time.Time  `json:"accepted_time"`
+	RemoteAddr string     `json:"remote_addr"`
+	UserAgent  string     `json:"user_agent"`
+	Withdrawn  *time.Time `json:"withdrawn_time,omitempty"`
+}
+
+// selectConsentText returns the text of version, or the current one if
+// version is empty.
+func selectConsentText(ctx context.Context, version string) (*consentText, error) {
+	var t consentText
+	if err := stmtSelectConsentText.QueryRowContext(ctx, version).Scan(&t.ID, &t.Version, &t.Body, &t.Published); err != nil {
+		return nil, err
+	}
+	t.Published = t.Published.In(bogota)
+
+	return &t, nil
+}
+
+// acceptConsent records, for register, the version of the authorization a
+// registration agreed to. Clients that don't send one saw the current text.
+func acceptConsent(ctx context.Context, r *http.Request, fi *formInfo, now time.Time) error {
+	t, err := selectConsentText(ctx, fi.ConsentVersion)
+	if err == sql.ErrNoRows {
+		return errUnknownConsent
+	}
+	if err != nil {
+		return fmt.Errorf("failed to select consent text: %w", err)
+	}
+
+	fi.ConsentVersion = t.Version
+	fi.consent = &consentAcceptance{textID: t.ID, when: now, addr: clientIP(r), userAgent: r.Header.Get("User-Agent")}
+
+	return nil
+}
+
+func selectConsent(ctx context.Context, formID int64) (*consentRecord, error) {
+	var c consentRecord
+	var addr, ua sql.NullString
+	var withdrawn sql.NullTime
+	err := stmtSelectConsent.QueryRowContext(ctx, formID).Scan(&c.Version, &c.Text, &c.Accepted, &addr, &ua, &withdrawn)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.RemoteAddr, c.UserAgent = addr.String, ua.String
+	c.Accepted = c.Accepted.In(bogota)
+	if withdrawn.Valid {
+		t := withdrawn.Time.In(bogota)
+		c.Withdrawn = &t
+	}
+
+	return &c, nil
+}
+
+// withdrawConsent records that the attendee took back the authorization of
+// registration id, keeping the record of what they had accepted.
+func withdrawConsent(ctx context.Context, db *sql.DB, id int64, r *http.Request, now time.Time) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin withdrawing consent of registration %d: %w", id, err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, queryWithdrawConsent, id, now, clientIP(r), r.Header.Get("User-Agent")); err != nil {
+		return fmt.Errorf("failed to withdraw consent of registration %d: %w", id, err)
+	}
+	if _, err := tx.ExecContext(ctx, queryUnauthorize, id); err != nil {
+		return fmt.Errorf("failed to unauthorize registration %d: %w", id, err)
+	}
+
+	return tx.Commit()
+}
+
+// handleConsentText hands the frontend the current authorization text, whose
+// version goes back in consent_version.
+func (server *Server) handleConsentText(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t, err := selectConsentText(ctx, "")
+	if err != nil {
+		log.Printf("failed to select current consent text: %s", err)
+		writeAPIError(w, r, http.StatusInternalServerError, "internal")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"version": t.Version, "text": t.Body, "published_at": t.Published})
+}
+
+const tplConsents = `
+<!DOCTYPE html>
+<html>
+<style>
+   td, th {
+		padding: 4px 10px;
+		text-align: left;
+		vertical-align: top;
+   }
+</style>
+<body>
+<h1>Autorizaciones de tratamiento de datos</h1>
+<table>
+	<tr><th>Versi&oacute;n</th><th>Publicada</th><th>Aceptada</th><th>Retirada</th><th>Vigente</th><th></th></tr>
+	{{- range $i, $v := .Versions}}
+	<tr>
+		<td>{{.Version}}{{if eq $i 0}} <b>(actual)</b>{{end}}</td>
+		<td>{{.Published.Format "2006-01-02 15:04"}}{{if .CreatedBy}}<br/>por {{.CreatedBy}}{{end}}</td>
+		<td>{{.Accepted}}</td>
+		<td>{{.Withdrawn}}</td>
+		<td>{{.Active}}</td>
+		<td><a href="/admin/registrations?consent={{.Version}}">ver registros</a><br/>
+		<details><summary>texto</summary><pre style="white-space: pre-wrap">{{.Body}}</pre></details></td>
+	</tr>
+	{{- end}}
+</table>
+<h2>Publicar nueva versi&oacute;n</h2>
+<p>Los registros nuevos aceptan la &uacute;ltima versi&oacute;n publicada. Las versiones no se pueden editar.</p>
+{{- if .Error}}<p style="color: #c00">{{.Error}}</p>{{end}}
+<form action="/admin/consents" method="POST">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}" />
+<p><input name="version" value="{{.Version}}" placeholder="2024-1" required /></p>
+<p><textarea name="body" rows="12" cols="80" required>{{.Body}}</textarea></p>
+<input type="submit" value="publicar" />
+</form>
+</body>
+</html>
+`
+
+var tmplConsents = template.Must(template.New("consents").Parse(tplConsents))
+
+type consentVersionRow struct {
+	Version   string
+	Body      string
+	CreatedBy string
+	Published time.Time
+	Accepted  int
+	Withdrawn int
+	Active    int
+}
+
+type consentsPage struct {
+	CSRFToken string
+	Versions  []consentVersionRow
+	Version   string
+	Body      string
+	Error     string
+}
+
+// handleConsents reports how many registrations accepted each version of
+// the authorization, and publishes new versions.
+func (server *Server) handleConsents(w http.ResponseWriter, r *http.Request) {
+	a := server.requirePermission(w, r, permConsents)
+	if a == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	csrf, err := server.csrfToken(w, r)
+	if err != nil {
+		log.Printf("failed to issue CSRF token: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	page := consentsPage{CSRFToken: csrf}
+	status := http.StatusOK
+	if r.Method == http.MethodPost {
+		page.Version = strings.TrimSpace(r.PostForm.Get("version"))
+		page.Body = strings.TrimSpace(r.PostForm.Get("body"))
+		switch {
+		case page.Version == "" || page.Body == "":
+			page.Error = "La versión y el texto son obligatorios."
+		case len(page.Version) > 50:
+			page.Error = "La versión debe tener máximo 50 caracteres."
+		default:
+			_, err := stmtInsertConsentText.ExecContext(ctx, page.Version, page.Body, a.Username, time.Now())
+			if isUniqueViolation(err) {
+				page.Error = "Ya existe una versión con ese nombre."
+			} else if err != nil {
+				log.Printf("failed to store consent text %s: %s", page.Version, err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		if page.Error != "" {
+			status = http.StatusBadRequest
+		} else {
+			log.Printf("admin %s published consent text %s", a.Username, page.Version)
+			server.audit(r, a.Username, "consent_publish", "consent:"+page.Version, nil, map[string]string{"version": page.Version, "body": page.Body})
+			http.Redirect(w, r, "/admin/consents", http.StatusSeeOther)
+			return
+		}
+	}
+
+	rows, err := server.db.QueryContext(ctx, querySelectConsentReport)
+	if err != nil {
+		log.Printf("failed to select consent report: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v consentVersionRow
+		var createdBy sql.NullString
+		if err := rows.Scan(&v.Version, &v.Body, &createdBy, &v.Published, &v.Accepted, &v.Withdrawn); err != nil {
+			log.Printf("failed to scan consent report: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		v.CreatedBy, v.Published, v.Active = createdBy.String, v.Published.In(bogota), v.Accepted-v.Withdrawn
+		page.Versions = append(page.Versions, v)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("failed to iterate consent report: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/html")
+	w.WriteHeader(status)
+	if err := tmplConsents.Execute(w, page); err != nil {
+		log.Printf("failed to execute template for consents: %s", err)
+	}
+}
@@ -0,0 +1,334 @@
+package fileserver
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// consentStore answers the consent queries from memory, standing in for
+// the consent_texts, consents and form_info tables.
+type consentStore struct {
+	mu    sync.Mutex
+	texts []consentText
+	// consents and authorized are keyed by registration
+	consents   map[int64]*consentRow
+	authorized map[int64]bool
+	// failUnauthorize makes queryUnauthorize fail, to check withdrawing
+	// rolls back
+	failUnauthorize bool
+}
+
+type consentRow struct {
+	textID      int64
+	accepted    time.Time
+	addr, ua    string
+	withdrawn   *time.Time
+	withdrawnBy string
+	withdrawnUA string
+}
+
+func (s *consentStore) snapshot() *consentStore {
+	c := &consentStore{texts: s.texts, consents: make(map[int64]*consentRow), authorized: make(map[int64]bool)}
+	for id, row := range s.consents {
+		r := *row
+		c.consents[id] = &r
+	}
+	for id, ok := range s.authorized {
+		c.authorized[id] = ok
+	}
+	return c
+}
+
+func (s *consentStore) Connect(context.Context) (driver.Conn, error) { return &consentConn{s: s}, nil }
+func (s *consentStore) Driver() driver.Driver                        { return nil }
+
+type consentConn struct {
+	s    *consentStore
+	undo *consentStore
+}
+
+func (c *consentConn) Prepare(query string) (driver.Stmt, error) { return &consentStmt{c, query}, nil }
+func (c *consentConn) Close() error                              { return nil }
+
+func (c *consentConn) Begin() (driver.Tx, error) {
+	c.s.mu.Lock()
+	c.undo = c.s.snapshot()
+	c.s.mu.Unlock()
+	return c, nil
+}
+
+func (c *consentConn) Commit() error {
+	c.undo = nil
+	return nil
+}
+
+func (c *consentConn) Rollback() error {
+	if c.undo == nil {
+		return nil
+	}
+	c.s.mu.Lock()
+	c.s.consents, c.s.authorized = c.undo.consents, c.undo.authorized
+	c.s.mu.Unlock()
+	c.undo = nil
+	return nil
+}
+
+type consentStmt struct {
+	c     *consentConn
+	query string
+}
+
+func (st *consentStmt) Close() error  { return nil }
+func (st *consentStmt) NumInput() int { return -1 }
+
+func (st *consentStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s := st.c.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := args[0].(int64)
+	switch st.query {
+	case queryWithdrawConsent:
+		row := s.consents[id]
+		if row == nil || row.withdrawn != nil {
+			return driver.RowsAffected(0), nil
+		}
+		when := args[1].(time.Time)
+		row.withdrawn, row.withdrawnBy, row.withdrawnUA = &when, args[2].(string), args[3].(string)
+		return driver.RowsAffected(1), nil
+	case queryUnauthorize:
+		if s.failUnauthorize {
+			return nil, errors.New("connection reset")
+		}
+		s.authorized[id] = false
+		return driver.RowsAffected(1), nil
+	}
+
+	return nil, fmt.Errorf("unexpected exec %q", st.query)
+}
+
+func (st *consentStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s := st.c.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch st.query {
+	case querySelectConsentText:
+		version := args[0].(string)
+		for i := len(s.texts) - 1; i >= 0; i-- {
+			if t := s.texts[i]; version == "" || t.Version == version {
+				return &consentRows{columns: 4, values: [][]driver.Value{{t.ID, t.Version, t.Body, t.Published}}}, nil
+			}
+		}
+		return &consentRows{columns: 4}, nil
+	case querySelectConsent:
+		row := s.consents[args[0].(int64)]
+		if row == nil {
+			return &consentRows{columns: 6}, nil
+		}
+		for _, t := range s.texts {
+			if t.ID == row.textID {
+				var withdrawn driver.Value
+				if row.withdrawn != nil {
+					withdrawn = *row.withdrawn
+				}
+				return &consentRows{columns: 6, values: [][]driver.Value{{t.Version, t.Body, row.accepted, row.addr, row.ua, withdrawn}}}, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("unexpected query %q", st.query)
+}
+
+type consentRows struct {
+	columns int
+	values  [][]driver.Value
+}
+
+func (r *consentRows) Columns() []string { return make([]string, r.columns) }
+func (r *consentRows) Close() error      { return nil }
+
+func (r *consentRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+// openConsentStore prepares the consent statements against an in-memory
+// store holding texts, for the duration of the test.
+func openConsentStore(t *testing.T, texts ...consentText) (*sql.DB, *consentStore) {
+	t.Helper()
+
+	s := &consentStore{texts: texts, consents: make(map[int64]*consentRow), authorized: make(map[int64]bool)}
+	db := sql.OpenDB(s)
+	t.Cleanup(func() { db.Close() })
+
+	prevText, prevConsent := stmtSelectConsentText, stmtSelectConsent
+	t.Cleanup(func() { stmtSelectConsentText, stmtSelectConsent = prevText, prevConsent })
+	var err error
+	if stmtSelectConsentText, err = db.Prepare(querySelectConsentText); err != nil {
+		t.Fatal(err)
+	}
+	if stmtSelectConsent, err = db.Prepare(querySelectConsent); err != nil {
+		t.Fatal(err)
+	}
+
+	return db, s
+}
+
+var testConsentTexts = []consentText{
+	{ID: 1, Version: "2023-01", Body: "Autorizo el tratamiento de mis datos.", Published: time.Date(2023, 1, 10, 15, 0, 0, 0, time.UTC)},
+	{ID: 2, Version: "2024-03", Body: "Autorizo el tratamiento de mis datos personales según la política de 2024.", Published: time.Date(2024, 3, 1, 15, 0, 0, 0, time.UTC)},
+}
+
+func TestAcceptConsent(t *testing.T) {
+	openConsentStore(t, testConsentTexts...)
+	now := time.Date(2024, 6, 15, 17, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		version     string
+		wantVersion string
+		wantTextID  int64
+		wantErr     error
+	}{
+		{name: "no version means the current one", wantVersion: "2024-03", wantTextID: 2},
+		{name: "current version", version: "2024-03", wantVersion: "2024-03", wantTextID: 2},
+		{name: "earlier version still accepted", version: "2023-01", wantVersion: "2023-01", wantTextID: 1},
+		{name: "never published", version: "2025-01", wantErr: errUnknownConsent},
+		{name: "versions are exact", version: "2024-3", wantErr: errUnknownConsent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/submit", nil)
+			r.Header.Set("User-Agent", "Mozilla/5.0")
+			fi := formInfo{ConsentVersion: tt.version, Authorized: true}
+
+			err := acceptConsent(context.Background(), r, &fi, now)
+			if err != tt.wantErr {
+				t.Fatalf("acceptConsent = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if fi.consent != nil {
+					t.Errorf("consent = %+v, want none", fi.consent)
+				}
+				return
+			}
+
+			want := consentAcceptance{textID: tt.wantTextID, when: now, addr: "192.0.2.1", userAgent: "Mozilla/5.0"}
+			if fi.ConsentVersion != tt.wantVersion || fi.consent == nil || *fi.consent != want {
+				t.Errorf("version, consent = %q, %+v, want %q, %+v", fi.ConsentVersion, fi.consent, tt.wantVersion, want)
+			}
+		})
+	}
+}
+
+func TestWithdrawConsent(t *testing.T) {
+	accepted := time.Date(2024, 3, 5, 14, 0, 0, 0, time.UTC)
+	first := time.Date(2024, 6, 15, 17, 0, 0, 0, time.UTC)
+	second := first.Add(24 * time.Hour)
+
+	tests := []struct {
+		name string
+		// consent is what registration 7 accepted, if anything
+		consent *consentRow
+		// withdrawals are the times it's withdrawn at, in order
+		withdrawals     []time.Time
+		failUnauthorize bool
+		wantErr         bool
+		wantWithdrawn   *time.Time
+		wantAuthorized  bool
+	}{
+		{
+			name:          "withdrawn",
+			consent:       &consentRow{textID: 1, accepted: accepted, addr: "198.51.100.4", ua: "Firefox"},
+			withdrawals:   []time.Time{first},
+			wantWithdrawn: &first,
+		},
+		{
+			name:          "withdrawing again keeps the first time",
+			consent:       &consentRow{textID: 2, accepted: accepted, addr: "198.51.100.4", ua: "Firefox"},
+			withdrawals:   []time.Time{first, second},
+			wantWithdrawn: &first,
+		},
+		{
+			name:        "no consent on record",
+			withdrawals: []time.Time{first},
+		},
+		{
+			name:            "rolled back when unauthorizing fails",
+			consent:         &consentRow{textID: 1, accepted: accepted, addr: "198.51.100.4", ua: "Firefox"},
+			withdrawals:     []time.Time{first},
+			failUnauthorize: true,
+			wantErr:         true,
+			wantAuthorized:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, s := openConsentStore(t, testConsentTexts...)
+			const id = 7
+			s.authorized[id] = true
+			if tt.consent != nil {
+				s.consents[id] = tt.consent
+			}
+			s.failUnauthorize = tt.failUnauthorize
+
+			for _, when := range tt.withdrawals {
+				r := httptest.NewRequest(http.MethodPost, "/datos", nil)
+				r.Header.Set("User-Agent", "Safari")
+				err := withdrawConsent(context.Background(), db, id, r, when)
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("withdrawConsent = %v, want error %v", err, tt.wantErr)
+				}
+			}
+
+			if s.authorized[id] != tt.wantAuthorized {
+				t.Errorf("authorized = %v, want %v", s.authorized[id], tt.wantAuthorized)
+			}
+
+			c, err := selectConsent(context.Background(), id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.consent == nil {
+				if c != nil {
+					t.Errorf("consent = %+v, want none", c)
+				}
+				return
+			}
+
+			// what was accepted is kept as it was
+			text := testConsentTexts[tt.consent.textID-1]
+			if c.Version != text.Version || c.Text != text.Body || !c.Accepted.Equal(accepted) || c.RemoteAddr != "198.51.100.4" || c.UserAgent != "Firefox" {
+				t.Errorf("consent = %+v, want version %s accepted at %s", c, text.Version, accepted)
+			}
+			if c.Accepted.Location() != bogota {
+				t.Errorf("accepted in %s, want Bogotá", c.Accepted.Location())
+			}
+
+			switch {
+			case tt.wantWithdrawn == nil && c.Withdrawn != nil:
+				t.Errorf("withdrawn = %s, want active", c.Withdrawn)
+			case tt.wantWithdrawn != nil && (c.Withdrawn == nil || !c.Withdrawn.Equal(*tt.wantWithdrawn)):
+				t.Errorf("withdrawn = %v, want %s", c.Withdrawn, tt.wantWithdrawn)
+			case tt.wantWithdrawn != nil && s.consents[id].withdrawnBy != "192.0.2.1":
+				t.Errorf("withdrawn from %q, want the client's address", s.consents[id].withdrawnBy)
+			}
+		})
+	}
+}
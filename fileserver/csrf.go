@@ -0,0 +1,158 @@
+package fileserver
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// csrfCookieName holds the double-submit token for visitors without an
+	// admin session; admin sessions carry their own token server-side
+	csrfCookieName = "cieloverde_csrf"
+	csrfFieldName  = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+const tplForbidden = `<!DOCTYPE html>
+<html>
+	<body>
+		<h1>Solicitud rechazada</h1>
+	</body>
+</html>
+`
+
+var (
+	errCSRFOrigin = errors.New("cross-origin request")
+	errCSRFToken  = errors.New("missing or invalid CSRF token")
+)
+
+// csrfToken returns the token that state-changing requests from this client
+// must echo back: the session's synchronizer token for logged in admins, or
+// else a double-submit cookie, which is set on w if the client has none.
+func (server *Server) csrfToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	if s := server.currentSession(r); s != nil {
+		return s.csrfToken, nil
+	}
+
+	if cook, err := r.Cookie(csrfCookieName); err == nil && cook.Value != "" {
+		return cook.Value, nil
+	}
+
+	token, err := newSessionToken()
+	if err != nil {
+		return "", err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   !server.insecureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return token, nil
+}
+
+// checkCSRF rejects POSTs whose Origin or Referer is foreign, or that don't
+// echo the client's CSRF token in the csrf_token field or X-CSRF-Token header.
+func (server *Server) checkCSRF(r *http.Request) error {
+	// browsers never add an Authorization header on their own, so a request
+	// with one wasn't forged by another site, and requirePermission won't
+	// fall back to its cookies
+	if _, ok := bearerToken(r); ok {
+		if err := r.ParseForm(); err != nil {
+			return errCSRFToken
+		}
+		return nil
+	}
+
+	if !server.sameOrigin(r) {
+		return errCSRFOrigin
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return errCSRFToken
+	}
+
+	sent := r.Header.Get(csrfHeaderName)
+	if sent == "" {
+		sent = r.PostForm.Get(csrfFieldName)
+	}
+	if sent == "" {
+		return errCSRFToken
+	}
+
+	var expected string
+	if s := server.currentSession(r); s != nil {
+		expected = s.csrfToken
+	} else if cook, err := r.Cookie(csrfCookieName); err == nil {
+		expected = cook.Value
+	}
+
+	if expected == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(expected)) != 1 {
+		return errCSRFToken
+	}
+
+	return nil
+}
+
+// sameOrigin checks the Origin header, falling back to Referer, against the
+// request's own host and the configured allowed origins. Requests carrying
+// neither header still have to pass the token check.
+func (server *Server) sameOrigin(r *http.Request) bool {
+	source := r.Header.Get("Origin")
+	if source == "" || source == "null" {
+		source = r.Header.Get("Referer")
+	}
+	if source == "" {
+		return r.Header.Get("Origin") == ""
+	}
+
+	u, err := url.Parse(source)
+	if err != nil || u.Host == "" {
+		return false
+	}
+
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	for _, allowed := range server.allowedOrigins {
+		if strings.EqualFold(u.Scheme+"://"+u.Host, allowed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func writeForbidden(w http.ResponseWriter) {
+	w.Header().Add("Content-Type", "text/html")
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte(tplForbidden))
+}
+
+// handleCSRFToken hands the React frontend the token to send with /submit.
+func (server *Server) handleCSRFToken(w http.ResponseWriter, r *http.Request) {
+	token, err := server.csrfToken(w, r)
+	if err != nil {
+		log.Printf("failed to issue CSRF token: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(struct {
+		Token  string `json:"token"`
+		Field  string `json:"field"`
+		Header string `json:"header"`
+	}{token, csrfFieldName, csrfHeaderName})
+}
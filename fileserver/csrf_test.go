@@ -0,0 +1,104 @@
+package fileserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSameOrigin(t *testing.T) {
+	server := &Server{allowedOrigins: []string{"https://cieloverde.io"}}
+
+	tests := []struct {
+		name            string
+		origin, referer string
+		want            bool
+	}{
+		{name: "neither header", want: true},
+		{name: "same origin", origin: "https://registro.example.com", want: true},
+		{name: "host differs in case", origin: "https://Registro.Example.com", want: true},
+		{name: "allowed origin", origin: "https://cieloverde.io", want: true},
+		{name: "allowed host, other scheme", origin: "http://cieloverde.io"},
+		{name: "foreign origin", origin: "https://evil.example.net"},
+		{name: "same origin, other port", origin: "https://registro.example.com:8443"},
+		{name: "referer without origin", referer: "https://registro.example.com/admin/registrations?q=x", want: true},
+		{name: "foreign referer", referer: "https://evil.example.net/registro.example.com"},
+		{name: "null origin, same referer", origin: "null", referer: "https://registro.example.com/", want: true},
+		{name: "null origin, foreign referer", origin: "null", referer: "https://evil.example.net/"},
+		{name: "null origin, no referer", origin: "null"},
+		{name: "origin wins over referer", origin: "https://evil.example.net", referer: "https://registro.example.com/"},
+		{name: "relative referer", referer: "/admin"},
+		{name: "unparsable origin", origin: "https://%zz"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "https://registro.example.com/submit", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.referer != "" {
+				r.Header.Set("Referer", tt.referer)
+			}
+			if got := server.sameOrigin(r); got != tt.want {
+				t.Errorf("sameOrigin(Origin %q, Referer %q) = %v, want %v", tt.origin, tt.referer, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckCSRF(t *testing.T) {
+	server := &Server{}
+	const token = "Zm9vYmFyYmF6cXV4"
+
+	tests := []struct {
+		name   string
+		origin string
+		cookie string
+		header string
+		field  string
+		bearer bool
+		want   error
+	}{
+		{name: "field matches cookie", cookie: token, field: token},
+		{name: "header matches cookie", cookie: token, header: token},
+		{name: "header over field", cookie: token, header: token, field: "other"},
+		{name: "neither Origin nor Referer, valid token", cookie: token, field: token},
+		{name: "neither Origin nor Referer, no token", cookie: token, want: errCSRFToken},
+		{name: "same origin, valid token", origin: "https://registro.example.com", cookie: token, field: token},
+		{name: "foreign origin, valid token", origin: "https://evil.example.net", cookie: token, field: token, want: errCSRFOrigin},
+		{name: "token mismatch", cookie: token, field: token + "x", want: errCSRFToken},
+		{name: "no cookie", field: token, want: errCSRFToken},
+		{name: "empty cookie and token", want: errCSRFToken},
+		{name: "bearer token skips the checks", origin: "https://evil.example.net", bearer: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{}
+			if tt.field != "" {
+				form.Set(csrfFieldName, tt.field)
+			}
+			r := httptest.NewRequest(http.MethodPost, "https://registro.example.com/submit", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: tt.cookie})
+			}
+			if tt.header != "" {
+				r.Header.Set(csrfHeaderName, tt.header)
+			}
+			if tt.bearer {
+				r.Header.Set("Authorization", "Bearer device-token")
+			}
+
+			if err := server.checkCSRF(r); err != tt.want {
+				t.Errorf("checkCSRF = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
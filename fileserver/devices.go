@@ -0,0 +1,306 @@
+package fileserver
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ajg/form"
+)
+
+// deviceKeyPrefix makes keys recognizable in logs and secret scanners
+const deviceKeyPrefix = "cvk_"
+
+// device keys can't be issued for longer than this
+const maxDeviceKeyLifetime = 365 * 24 * time.Hour
+
+const (
+	queryInsertDeviceKey = `INSERT INTO
+	device_keys(station, key_hash, key_hint, created_by, expires_at, ctime)
+	VALUES( $1, $2, $3, $4, $5, $6 )`
+
+	querySelectDeviceKey = `SELECT id, station, expires_at, revoked_at, last_used_at FROM device_keys WHERE key_hash=$1`
+
+	queryTouchDeviceKey = `UPDATE device_keys SET last_used_at = $2, last_used_addr = $3 WHERE id=$1`
+
+	querySelectDeviceKeys = `SELECT id, station, key_hint, created_by, expires_at, revoked_at, revoked_by, last_used_at, last_used_addr, ctime
+	FROM device_keys ORDER BY revoked_at IS NOT NULL, ctime DESC`
+
+	queryRevokeDeviceKey = `UPDATE device_keys SET revoked_at = $2, revoked_by = $3 WHERE id=$1 AND revoked_at IS NULL`
+)
+
+var stmtInsertDeviceKey *sql.Stmt
+var stmtSelectDeviceKey *sql.Stmt
+var stmtTouchDeviceKey *sql.Stmt
+var stmtSelectDeviceKeys *sql.Stmt
+var stmtRevokeDeviceKey *sql.Stmt
+
+const tplDevices = `
+<!DOCTYPE html>
+<html>
+<style>
+   td, th {
+		padding: 4px 10px;
+		text-align: left;
+   }
+   .key {
+		font-family: monospace;
+		font-size: 20px;
+		background-color: #C8F5C6;
+		padding: 10px;
+   }
+</style>
+<body>
+<h1>Llaves de estaciones de escaneo</h1>
+{{- if .NewKey}}
+<p>Llave para <b>{{.NewStation}}</b>. C&oacute;piela ahora, no se volver&aacute; a mostrar:</p>
+<p class="key">{{.NewKey}}</p>
+{{- end}}
+<form action="/admin/devices" method="POST">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}" />
+<input name="station" placeholder="estaci&oacute;n, p. ej. Puerta 1" required />
+vence en <input name="days" value="30" size="3" /> d&iacute;as
+<input type="submit" value="crear llave" />
+</form>
+<table>
+	<tr><th>Estaci&oacute;n</th><th>Llave</th><th>Creada</th><th>Vence</th><th>&Uacute;ltimo uso</th><th></th></tr>
+	{{- range .Keys}}
+	<tr>
+		<td>{{.Station}}</td>
+		<td>{{.Hint}}&hellip;</td>
+		<td>{{.Created.Format "2006-01-02 15:04"}} por {{.CreatedBy}}</td>
+		<td>{{.Expires.Format "2006-01-02 15:04"}}</td>
+		<td>{{if .LastUsed}}{{.LastUsed.Format "2006-01-02 15:04"}} desde {{.LastUsedAddr}}{{end}}</td>
+		<td>
+		{{- if .Revoked}}
+			revocada {{.Revoked.Format "2006-01-02 15:04"}} por {{.RevokedBy}}
+		{{- else}}
+			<form action="/admin/devices/{{.ID}}/revoke" method="POST">
+			<input type="hidden" name="csrf_token" value="{{$.CSRFToken}}" />
+			<input type="submit" value="revocar" />
+			</form>
+		{{- end}}
+		</td>
+	</tr>
+	{{- end}}
+</table>
+</body>
+</html>
+`
+
+var tmplDevices = template.Must(template.New("devices").Parse(tplDevices))
+
+type deviceKey struct {
+	ID           int64
+	Station      string
+	Hint         string
+	CreatedBy    string
+	Expires      time.Time
+	Revoked      *time.Time
+	RevokedBy    string
+	LastUsed     *time.Time
+	LastUsedAddr string
+	Created      time.Time
+}
+
+type devicesPage struct {
+	CSRFToken  string
+	NewKey     string
+	NewStation string
+	Keys       []deviceKey
+}
+
+type newDeviceKey struct {
+	Station string `form:"station"`
+	Days    int    `form:"days"`
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header, and
+// whether the request has an Authorization header at all.
+func bearerToken(r *http.Request) (string, bool) {
+	h := r.Header.Get("Authorization")
+	if h == "" {
+		return "", false
+	}
+
+	scheme, token, _ := strings.Cut(h, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return "", true
+	}
+
+	return strings.TrimSpace(token), true
+}
+
+// deviceAdmin authenticates a request carrying a device key. The second
+// result reports whether the request tried to; if it did, a nil admin means
+// the key is unknown, expired or revoked, and cookies must not be tried
+// instead.
+func (server *Server) deviceAdmin(r *http.Request) (*admin, bool) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return nil, false
+	}
+	if !strings.HasPrefix(token, deviceKeyPrefix) {
+		return nil, true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var id int64
+	var station string
+	var expires time.Time
+	var revoked, lastUsed sql.NullTime
+	err := stmtSelectDeviceKey.QueryRowContext(ctx, hashSessionToken(token)).Scan(&id, &station, &expires, &revoked, &lastUsed)
+	if err == sql.ErrNoRows {
+		log.Printf("rejected unknown device key from %s", clientIP(r))
+		return nil, true
+	}
+	if err != nil {
+		log.Printf("failed to select device key: %s", err)
+		return nil, true
+	}
+
+	now := time.Now()
+	if revoked.Valid || now.After(expires) {
+		log.Printf("rejected expired or revoked key of station %s from %s", station, clientIP(r))
+		return nil, true
+	}
+
+	if !lastUsed.Valid || now.Sub(lastUsed.Time) > sessionTouchInterval {
+		if _, err := stmtTouchDeviceKey.ExecContext(ctx, id, now, clientIP(r)); err != nil {
+			log.Printf("failed to touch key of station %s: %s", station, err)
+		}
+	}
+
+	return &admin{ID: -id, Username: "device:" + station, Role: roleDevice}, true
+}
+
+// handleDevices lists the device keys and issues new ones.
+func (server *Server) handleDevices(w http.ResponseWriter, r *http.Request) {
+	a := server.requirePermission(w, r, permDevices)
+	if a == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	var page devicesPage
+	if r.Method == http.MethodPost {
+		var nk newDeviceKey
+		dec := form.NewDecoder(nil)
+		dec.IgnoreUnknownKeys(true)
+		if err := dec.DecodeValues(&nk, r.PostForm); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		nk.Station = strings.TrimSpace(nk.Station)
+		lifetime := time.Duration(nk.Days) * 24 * time.Hour
+		if nk.Station == "" || lifetime <= 0 || lifetime > maxDeviceKeyLifetime {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		token, err := newSessionToken()
+		if err != nil {
+			writeErr(err, w)
+			return
+		}
+		key := deviceKeyPrefix + token
+
+		now := time.Now()
+		if _, err := stmtInsertDeviceKey.ExecContext(ctx, nk.Station, hashSessionToken(key), key[:len(deviceKeyPrefix)+6], a.Username, now.Add(lifetime), now); err != nil {
+			log.Printf("failed to store device key: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log.Printf("admin %s created a device key for station %s", a.Username, nk.Station)
+		server.audit(r, a.Username, "device_key_create", "station:"+nk.Station, nil, map[string]interface{}{
+			"hint": key[:len(deviceKeyPrefix)+6], "expires_at": now.Add(lifetime),
+		})
+
+		page.NewKey, page.NewStation = key, nk.Station
+		w.Header().Set("Cache-Control", "no-store")
+	}
+
+	rows, err := stmtSelectDeviceKeys.QueryContext(ctx)
+	if err != nil {
+		log.Printf("failed to select device keys: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var k deviceKey
+		var revoked, lastUsed sql.NullTime
+		var revokedBy, lastUsedAddr sql.NullString
+		if err := rows.Scan(&k.ID, &k.Station, &k.Hint, &k.CreatedBy, &k.Expires, &revoked, &revokedBy, &lastUsed, &lastUsedAddr, &k.Created); err != nil {
+			log.Printf("failed to scan device key: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if revoked.Valid {
+			t := revoked.Time.In(bogota)
+			k.Revoked = &t
+		}
+		if lastUsed.Valid {
+			t := lastUsed.Time.In(bogota)
+			k.LastUsed = &t
+		}
+		k.RevokedBy, k.LastUsedAddr = revokedBy.String, lastUsedAddr.String
+		k.Expires, k.Created = k.Expires.In(bogota), k.Created.In(bogota)
+		page.Keys = append(page.Keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("failed to iterate device keys: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if page.CSRFToken, err = server.csrfToken(w, r); err != nil {
+		log.Printf("failed to issue CSRF token: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/html")
+	if err := tmplDevices.Execute(w, page); err != nil {
+		log.Printf("failed to execute template for device keys: %s", err)
+	}
+}
+
+// handleRevokeDevice revokes a device key with immediate effect.
+func (server *Server) handleRevokeDevice(w http.ResponseWriter, r *http.Request) {
+	a := server.requirePermission(w, r, permDevices)
+	if a == nil {
+		return
+	}
+
+	id, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/admin/devices/"), "/revoke"), 10, 64)
+	if err != nil {
+		server.serveNotFound(w)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	if _, err := stmtRevokeDeviceKey.ExecContext(ctx, id, time.Now(), a.Username); err != nil {
+		log.Printf("failed to revoke device key %d: %s", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("admin %s revoked device key %d", a.Username, id)
+	server.audit(r, a.Username, "device_key_revoke", fmt.Sprintf("device_key:%d", id), nil, nil)
+
+	http.Redirect(w, r, "/admin/devices", http.StatusSeeOther)
+}
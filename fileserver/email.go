@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"html"
 	"image/jpeg"
 	"io/ioutil"
 	"net/url"
@@ -16,38 +17,32 @@ import (
 	"github.com/boombuler/barcode/qr"
 )
 
-var body string = `
-<html>
-<body>
-<h1>Gracias por participar.</h1>
-
-	Te has ganado un premio.
-
-	Que puedes reclamar
-	<ol>
-	<li> En la Carroza durante marcha. </li>
-	<li> En la tarima de el evento después de la marcha en el parque luces. </li>
-	</ol>
-
-	Movimiento Cannabico Colombiano.
-</body>
-</html>
-`
+// siteURL is where links in emails point
+const siteURL = "https://CieloVerde.io"
 
-// TOOD: send the email
-func (server *Server) sendEmail(email string, hash [16]byte) (string, string, error) {
+// sendEmail emails the ticket of an event, its QR code drawn on the event's
+// flyer.
+func (server *Server) sendEmail(e *event, email, hash string) (string, string, error) {
 	code, err := generateQRCode(hash)
 	if err != nil {
 		return "", "", fmt.Errorf("failed to generate QR code: %w", err)
 	}
 
-	attachment := generateAttachment(server.flyer, code)
+	flyer, err := server.flyerFor(e)
+	if err != nil {
+		return "", "", err
+	}
+	subject, body, err := e.ticketEmail()
+	if err != nil {
+		return "", "", err
+	}
+
+	attachment := generateAttachment(flyer, code)
 	var buf bytes.Buffer
 	if err := jpeg.Encode(&buf, attachment, &jpeg.Options{Quality: 100}); err != nil {
 		return "", "", fmt.Errorf("failed to encode JPEG: %w", err)
 	}
 
-	subject := `Movimiento Cannabico Colombiano Premio 11 de Diciembre 2021`
 	msg := server.mg.NewMessage("noreply@CieloVerde.io", subject, "", email)
 	msg.SetHtml(body)
 
@@ -64,12 +59,12 @@ func (server *Server) sendEmail(email string, hash [16]byte) (string, string, er
 	return resp, id, err
 }
 
-func generateQRCode(hash [16]byte) (goimage.Image, error) {
-	hashString := string(fmt.Sprintf("https://CieloVerde.io/users/%x", hash))
+func generateQRCode(hash string) (goimage.Image, error) {
+	hashString := siteURL + "/users/" + hash
 
 	code, err := qr.Encode(hashString, qr.L, qr.Auto)
 	if err != nil {
-		return nil, fmt.Errorf("failed to encode hash %x as QR code: %w", hash, err)
+		return nil, fmt.Errorf("failed to encode hash %s as QR code: %w", hash, err)
 	}
 
 	intsize := 180
@@ -84,3 +79,89 @@ func generateQRCode(hash [16]byte) (goimage.Image, error) {
 func generateAttachment(bottom, top goimage.Image) goimage.Image {
 	return image.Layer(bottom, top, 587, -103)
 }
+
+var lockoutBody = `
+<html>
+<body>
+<h1>Cuenta bloqueada temporalmente</h1>
+
+	<p>Tu cuenta de administrador <b>%s</b> fue bloqueada hasta %s por demasiados
+	intentos fallidos de ingreso.</p>
+
+	<p>El &uacute;ltimo intento vino de la IP %s (%s).</p>
+
+	<p>Si no fuiste t&uacute;, avisa a los dem&aacute;s administradores.</p>
+</body>
+</html>
+`
+
+// sendLockoutNotice tells an admin that their account has been locked.
+func (server *Server) sendLockoutNotice(email, username, ip, userAgent string, until time.Time) (string, string, error) {
+	subject := `CieloVerde.io: cuenta de administrador bloqueada`
+	msg := server.mg.NewMessage("noreply@CieloVerde.io", subject, "", email)
+	msg.SetHtml(fmt.Sprintf(lockoutBody,
+		html.EscapeString(username), until.Format("2006-01-02 15:04 MST"),
+		html.EscapeString(ip), html.EscapeString(userAgent)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	return server.mg.Send(ctx, msg)
+}
+
+var dataRequestBody = `
+<html>
+<body>
+<h1>Tus datos personales</h1>
+
+	<p>Recibimos una solicitud para consultar, corregir o eliminar los datos
+	personales de tu registro. Puedes hacerlo en este enlace durante las
+	pr&oacute;ximas 24 horas:</p>
+
+	<p><a href="%s">%s</a></p>
+
+	<p>Si no fuiste t&uacute;, ignora este correo.</p>
+</body>
+</html>
+`
+
+var verificationBody = `
+<html>
+<body>
+<h1>Confirma tu correo</h1>
+
+	<p>Gracias por registrarte. Para recibir tu boleta, confirma tu correo en
+	este enlace:</p>
+
+	<p><a href="%s">%s</a></p>
+
+	<p>Si no lo confirmas a tiempo, borraremos tu registro. Si no fuiste
+	t&uacute;, ignora este correo.</p>
+</body>
+</html>
+`
+
+// sendVerificationLink emails a new attendee the link confirming their
+// address.
+func (server *Server) sendVerificationLink(email, link string) (string, string, error) {
+	subject := `CieloVerde.io: confirma tu correo`
+	msg := server.mg.NewMessage("noreply@CieloVerde.io", subject, "", email)
+	msg.SetHtml(fmt.Sprintf(verificationBody, html.EscapeString(link), html.EscapeString(link)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	return server.mg.Send(ctx, msg)
+}
+
+// sendDataRequestLink emails an attendee the link to their data.
+func (server *Server) sendDataRequestLink(email, link string) (string, string, error) {
+	subject := `CieloVerde.io: tus datos personales`
+	msg := server.mg.NewMessage("noreply@CieloVerde.io", subject, "", email)
+	msg.SetHtml(fmt.Sprintf(dataRequestBody, html.EscapeString(link), html.EscapeString(link)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	return server.mg.Send(ctx, msg)
+}
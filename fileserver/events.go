@@ -0,0 +1,804 @@
+package fileserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"image"
+	"image/jpeg"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// event slugs go in URLs
+var reEventSlug = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,62}$`)
+
+// the public URLs of an event: /events/{slug}/submit, /api/events/{slug}
+// and /api/events/{slug}/registrations
+var reEventPath = regexp.MustCompile(`^(/api)?/events/([a-z0-9][a-z0-9-]*)(/[a-z]+)?$`)
+
+// the datetime-local inputs of the events form, in Bogotá time
+const eventTimeLayout = "2006-01-02T15:04"
+
+const eventColumns = `id, slug, name, starts_at, ends_at, venue, flyer, email_subject, email_body,
+	capacity, gift_box_capacity, opens_at, closes_at, paused_time, paused_by, min_age, ctime`
+
+const (
+	querySelectEvent = `SELECT ` + eventColumns + ` FROM events WHERE id=$1`
+
+	querySelectEventBySlug = `SELECT ` + eventColumns + ` FROM events WHERE slug=$1`
+
+	querySelectEvents = `SELECT ` + eventColumns + `,
+		(SELECT count(*) FROM form_info f WHERE f.event_id = events.id AND f.anonymized_time IS NULL),
+		(SELECT count(*) FROM form_info f WHERE f.event_id = events.id AND f.anonymized_time IS NULL AND f.waitlisted_time IS NOT NULL)
+	FROM events ORDER BY starts_at DESC NULLS LAST, id DESC`
+
+	queryInsertEvent = `INSERT INTO
+	events(slug, name, starts_at, ends_at, venue, flyer, email_subject, email_body, capacity, gift_box_capacity, opens_at, closes_at, min_age, ctime)
+	VALUES( $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14 )
+	RETURNING id`
+
+	queryUpdateEvent = `UPDATE events SET
+		name = $2, starts_at = $3, ends_at = $4, venue = $5, flyer = $6, email_subject = $7, email_body = $8,
+		capacity = $9, gift_box_capacity = $10, opens_at = $11, closes_at = $12, min_age = $13
+	WHERE id=$1`
+
+	queryPauseEvent = `UPDATE events SET paused_time = $2, paused_by = $3 WHERE id=$1`
+)
+
+var stmtSelectEvent *sql.Stmt
+var stmtSelectEventBySlug *sql.Stmt
+var stmtSelectEvents *sql.Stmt
+var stmtInsertEvent *sql.Stmt
+var stmtUpdateEvent *sql.Stmt
+var stmtPauseEvent *sql.Stmt
+
+// whether an event takes registrations
+const (
+	eventOpen    = "open"
+	eventNotOpen = "not_open"
+	eventClosed  = "closed"
+	eventPaused  = "paused"
+)
+
+var (
+	errEventNotOpen = errors.New("registration for the event hasn't opened")
+	errEventClosed  = errors.New("registration for the event is closed")
+	errEventPaused  = errors.New("registration for the event is paused")
+)
+
+// event is an event people register for. Zero capacities mean no limit, and
+// an empty flyer, subject or body means the default one.
+type event struct {
+	ID              int64
+	Slug            string
+	Name            string
+	Starts          *time.Time
+	Ends            *time.Time
+	Venue           string
+	Flyer           string
+	EmailSubject    string
+	EmailBody       string
+	Capacity        int
+	GiftBoxCapacity int
+	Opens           *time.Time
+	Closes          *time.Time
+	// Paused, when set, stops registrations whatever the window
+	Paused   *time.Time
+	PausedBy string
+	// MinAge is the minimum age to register; 0 means the legal age
+	MinAge  int
+	Created time.Time
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanEvent(row rowScanner, extra ...interface{}) (*event, error) {
+	var e event
+	var starts, ends, opens, closes, paused sql.NullTime
+	var venue, flyer, subject, body, pausedBy sql.NullString
+	var capacity, giftBoxes, minAge sql.NullInt64
+	dest := append([]interface{}{&e.ID, &e.Slug, &e.Name, &starts, &ends, &venue, &flyer, &subject, &body,
+		&capacity, &giftBoxes, &opens, &closes, &paused, &pausedBy, &minAge, &e.Created}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	inBogota := func(t sql.NullTime) *time.Time {
+		if !t.Valid {
+			return nil
+		}
+		b := t.Time.In(bogota)
+		return &b
+	}
+	e.Starts, e.Ends, e.Opens, e.Closes = inBogota(starts), inBogota(ends), inBogota(opens), inBogota(closes)
+	e.Paused, e.PausedBy = inBogota(paused), pausedBy.String
+	e.Venue, e.Flyer, e.EmailSubject, e.EmailBody = venue.String, flyer.String, subject.String, body.String
+	e.Capacity, e.GiftBoxCapacity, e.MinAge = int(capacity.Int64), int(giftBoxes.Int64), int(minAge.Int64)
+	e.Created = e.Created.In(bogota)
+
+	return &e, nil
+}
+
+func selectEvent(ctx context.Context, id int64) (*event, error) {
+	return scanEvent(stmtSelectEvent.QueryRowContext(ctx, id))
+}
+
+func selectEventBySlug(ctx context.Context, slug string) (*event, error) {
+	return scanEvent(stmtSelectEventBySlug.QueryRowContext(ctx, slug))
+}
+
+// ticketHash identifies the ticket of ID number idNo for an event; it's in
+// the URL of the ticket's QR code. Registrations from before events keep
+// the hash of the ID number alone.
+func ticketHash(eventID int64, idNo uint64) [16]byte {
+	return md5.Sum([]byte(fmt.Sprintf("%d:%d", eventID, idNo)))
+}
+
+// status reports whether the event takes registrations at now: one of
+// eventOpen, eventNotOpen, eventClosed and eventPaused.
+func (e *event) status(now time.Time) string {
+	switch {
+	case e.Paused != nil:
+		return eventPaused
+	case e.Opens != nil && now.Before(*e.Opens):
+		return eventNotOpen
+	case e.Closes != nil && !now.Before(*e.Closes):
+		return eventClosed
+	}
+
+	return eventOpen
+}
+
+// checkOpen returns errEventNotOpen, errEventClosed or errEventPaused when
+// the event doesn't take registrations at now.
+func (e *event) checkOpen(now time.Time) error {
+	switch e.status(now) {
+	case eventNotOpen:
+		return errEventNotOpen
+	case eventClosed:
+		return errEventClosed
+	case eventPaused:
+		return errEventPaused
+	}
+
+	return nil
+}
+
+// capacity returns the event's limits, or nil if it has none.
+func (e *event) capacity() *capacityLimits {
+	if e.Capacity == 0 && e.GiftBoxCapacity == 0 {
+		return nil
+	}
+
+	return &capacityLimits{Places: e.Capacity, GiftBoxes: e.GiftBoxCapacity}
+}
+
+// requestEvent looks up the event of a public URL, answering 404 itself if
+// there's none.
+func (server *Server) requestEvent(w http.ResponseWriter, slug string) *event {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	e, err := selectEventBySlug(ctx, slug)
+	if err == sql.ErrNoRows {
+		server.serveNotFound(w)
+		return nil
+	}
+	if err != nil {
+		log.Printf("failed to select event %s: %s", slug, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil
+	}
+
+	return e
+}
+
+type cachedFlyer struct {
+	modTime time.Time
+	img     image.Image
+}
+
+// flyerFor returns the image the QR code of the event's tickets is drawn
+// on. Flyers are read from disk once, and again when the file changes.
+func (server *Server) flyerFor(e *event) (image.Image, error) {
+	if e.Flyer == "" {
+		return server.flyer, nil
+	}
+
+	info, err := os.Stat(e.Flyer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat flyer of event %s: %w", e.Slug, err)
+	}
+
+	server.flyersMu.Lock()
+	defer server.flyersMu.Unlock()
+	if c, ok := server.flyers[e.Flyer]; ok && c.modTime.Equal(info.ModTime()) {
+		return c.img, nil
+	}
+
+	f, err := os.Open(e.Flyer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open flyer of event %s: %w", e.Slug, err)
+	}
+	defer f.Close()
+
+	img, err := jpeg.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to JPEG decode flyer of event %s: %w", e.Slug, err)
+	}
+	server.flyers[e.Flyer] = cachedFlyer{info.ModTime(), img}
+
+	return img, nil
+}
+
+const defaultTicketBody = `
+<html>
+<body>
+<h1>Gracias por registrarte en {{.Name}}.</h1>
+
+	<p>Tu boleta va adjunta. Mu&eacute;strala en la entrada{{if .Venue}} de {{.Venue}}{{end}}
+	{{- if .Starts}} el {{.Starts.Format "02/01/2006"}}{{end}}.</p>
+</body>
+</html>
+`
+
+// ticketEmail renders the subject and body of the event's ticket email.
+// The body is an html/template executed with the event.
+func (e *event) ticketEmail() (string, string, error) {
+	subject := e.EmailSubject
+	if subject == "" {
+		subject = "CieloVerde.io: tu boleta para " + e.Name
+	}
+
+	body := e.EmailBody
+	if body == "" {
+		body = defaultTicketBody
+	}
+	tmpl, err := template.New("ticket").Parse(body)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse ticket email of event %s: %w", e.Slug, err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, e); err != nil {
+		return "", "", fmt.Errorf("failed to execute ticket email of event %s: %w", e.Slug, err)
+	}
+
+	return subject, buf.String(), nil
+}
+
+// handleEventPath routes the public URLs of an event. Anything else under
+// /events/ is left to the frontend.
+func (server *Server) handleEventPath(w http.ResponseWriter, r *http.Request) {
+	m := reEventPath.FindStringSubmatch(r.URL.Path)
+	api, slug, action := m[1] != "", m[2], m[3]
+
+	switch {
+	case !api && action == "/submit" && r.Method == http.MethodPost:
+		server.handleForm(w, r, slug)
+	case api && action == "/registrations" && r.Method == http.MethodPost:
+		server.handleAPIRegistration(w, r, slug)
+	case api && action == "" && r.Method == http.MethodGet:
+		server.handleEventInfo(w, r, slug)
+	default:
+		server.handleFrontendPath(w, r)
+	}
+}
+
+// eventInfo is what the frontend gets to know about an event. Status is
+// open, not_open, closed or paused.
+type eventInfo struct {
+	Slug   string     `json:"slug"`
+	Name   string     `json:"name"`
+	Venue  string     `json:"venue,omitempty"`
+	Starts *time.Time `json:"starts_at,omitempty"`
+	Ends   *time.Time `json:"ends_at,omitempty"`
+	Opens  *time.Time `json:"opens_at,omitempty"`
+	Closes *time.Time `json:"closes_at,omitempty"`
+	Open   bool       `json:"open"`
+	Status string     `json:"status"`
+	MinAge int        `json:"min_age"`
+}
+
+// handleEventInfo serves GET /api/events/{slug}.
+func (server *Server) handleEventInfo(w http.ResponseWriter, r *http.Request, slug string) {
+	e := server.requestEvent(w, slug)
+	if e == nil {
+		return
+	}
+
+	status := e.status(time.Now())
+	// writeJSON sets no-store; a pause has to show up right away
+	writeJSON(w, http.StatusOK, eventInfo{e.Slug, e.Name, e.Venue, e.Starts, e.Ends, e.Opens, e.Closes, status == eventOpen, status, server.eventMinAge(e)})
+}
+
+const tplEventClosed = `<!DOCTYPE html>
+<html>
+	<body>
+		{{- if eq .Status "not_open"}}
+		<h1>Las inscripciones para {{.Name}} a&uacute;n no est&aacute;n abiertas.</h1>
+		<p>Abren el {{.Opens.Format "02/01/2006"}} a las {{.Opens.Format "15:04"}}, hora de Colombia.</p>
+		{{- else if eq .Status "paused"}}
+		<h1>Las inscripciones para {{.Name}} est&aacute;n pausadas.</h1>
+		<p>Estamos resolviendo un problema. Int&eacute;ntalo de nuevo en un rato.</p>
+		{{- else}}
+		<h1>Las inscripciones para {{.Name}} est&aacute;n cerradas.</h1>
+		{{- end}}
+	</body>
+</html>
+`
+
+var tmplEventClosed = template.Must(template.New("eventClosed").Parse(tplEventClosed))
+
+// writeEventClosed answers a registration for an event that doesn't take
+// them. A pause is temporary, so it gets a 503.
+func writeEventClosed(w http.ResponseWriter, e *event, status string) {
+	code := http.StatusForbidden
+	if status == eventPaused {
+		code = http.StatusServiceUnavailable
+	}
+
+	w.Header().Add("Content-Type", "text/html")
+	w.WriteHeader(code)
+	page := struct {
+		*event
+		Status string
+	}{e, status}
+	if err := tmplEventClosed.Execute(w, page); err != nil {
+		log.Printf("failed to execute template for closed event: %s", err)
+	}
+}
+
+const tplEvents = `
+<!DOCTYPE html>
+<html>
+<style>
+   td, th {
+		padding: 4px 10px;
+		text-align: left;
+   }
+</style>
+<body>
+<h1>Eventos</h1>
+<table>
+	<tr><th>Evento</th><th>Fecha</th><th>Lugar</th><th>Inscripciones</th><th>Registros</th><th>Cupo</th><th></th></tr>
+	{{- range .Events}}
+	<tr>
+		<td><a href="/admin/events/{{.Slug}}">{{.Name}}</a><br/>/{{.Slug}}</td>
+		<td>{{if .Starts}}{{.Starts.Format "2006-01-02 15:04"}}{{end}}</td>
+		<td>{{.Venue}}</td>
+		<td>{{template "eventStatus" .Status}}</td>
+		<td>{{.Registrations}}{{if .Waitlisted}} ({{.Waitlisted}} en espera){{end}}</td>
+		<td>{{if .Capacity}}{{.Capacity}}{{else}}sin l&iacute;mite{{end}}</td>
+		<td><a href="/admin/registrations?event={{.Slug}}">ver registros</a></td>
+	</tr>
+	{{- else}}
+	<tr><td colspan="7">No hay eventos.</td></tr>
+	{{- end}}
+</table>
+<h2>Nuevo evento</h2>
+{{template "eventForm" .New}}
+</body>
+</html>
+`
+
+const tplEventForm = `
+{{- define "eventStatus"}}
+{{- if eq . "open"}}abiertas{{else if eq . "not_open"}}a&uacute;n no abren{{else if eq . "paused"}}<b>pausadas</b>{{else}}cerradas{{end}}
+{{- end}}
+{{- define "eventForm"}}
+{{- if .Error}}<p style="color: #c00">{{.Error}}</p>{{end}}
+<form action="{{if .ID}}/admin/events/{{.Slug}}{{else}}/admin/events{{end}}" method="POST">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}" />
+<table>
+	<tr><th>Identificador</th><td>{{if .ID}}{{.Slug}}{{else}}<input name="slug" value="{{.Slug}}" placeholder="marcha-2024" required />{{end}}</td></tr>
+	<tr><th>Nombre</th><td><input name="name" value="{{.Name}}" size="50" required /></td></tr>
+	<tr><th>Empieza</th><td><input type="datetime-local" name="starts_at" value="{{.StartsAt}}" /></td></tr>
+	<tr><th>Termina</th><td><input type="datetime-local" name="ends_at" value="{{.EndsAt}}" /></td></tr>
+	<tr><th>Lugar</th><td><input name="venue" value="{{.Venue}}" size="50" /></td></tr>
+	<tr><th>Inscripciones abren</th><td><input type="datetime-local" name="opens_at" value="{{.OpensAt}}" /> hora de Bogot&aacute;, vac&iacute;o para ya</td></tr>
+	<tr><th>Inscripciones cierran</th><td><input type="datetime-local" name="closes_at" value="{{.ClosesAt}}" /> vac&iacute;o para nunca</td></tr>
+	<tr><th>Cupo</th><td><input name="capacity" value="{{.Capacity}}" size="6" /> boletas, 0 sin l&iacute;mite</td></tr>
+	<tr><th>Cupo con caja de regalo</th><td><input name="gift_box_capacity" value="{{.GiftBoxCapacity}}" size="6" /> 0 sin l&iacute;mite</td></tr>
+	<tr><th>Edad m&iacute;nima</th><td><input name="min_age" value="{{.MinAge}}" size="6" /> a&ntilde;os el d&iacute;a del evento, vac&iacute;o para {{.DefaultMinAge}}</td></tr>
+	<tr><th>Volante</th><td><input name="flyer" value="{{.Flyer}}" size="50" placeholder="ruta de un JPEG en el servidor, vac&iacute;o para el de -flyer" /></td></tr>
+	<tr><th>Asunto del correo</th><td><input name="email_subject" value="{{.EmailSubject}}" size="50" /></td></tr>
+	<tr><th>Cuerpo del correo</th><td><textarea name="email_body" rows="12" cols="80" placeholder="HTML; puede usar {{"{{"}}.Name{{"}}"}}, {{"{{"}}.Venue{{"}}"}} y {{"{{"}}.Starts{{"}}"}}">{{.EmailBody}}</textarea></td></tr>
+</table>
+<input type="submit" value="{{if .ID}}guardar{{else}}crear evento{{end}}" />
+</form>
+{{- end}}
+`
+
+const tplEvent = `
+<!DOCTYPE html>
+<html>
+<style>
+   td, th {
+		padding: 4px 10px;
+		text-align: left;
+		vertical-align: top;
+   }
+</style>
+<body>
+<p><a href="/admin/events">&laquo; eventos</a></p>
+<h1>{{.Name}}</h1>
+<p><a href="/admin/registrations?event={{.Slug}}">ver registros</a></p>
+<form action="/admin/events/{{.Slug}}/pause" method="POST">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}" />
+Inscripciones: {{template "eventStatus" .Status}}
+{{- if .Paused}} desde {{.Paused.Format "2006-01-02 15:04"}} por {{.PausedBy}}
+<button name="action" value="resume">reanudar inscripciones</button>
+{{- else}}
+<button name="action" value="pause">pausar inscripciones ya</button>
+{{- end}}
+</form>
+{{template "eventForm" .}}
+</body>
+</html>
+`
+
+var (
+	tmplEvents = template.Must(template.Must(template.New("events").Parse(tplEventForm)).Parse(tplEvents))
+	tmplEvent  = template.Must(template.Must(template.New("event").Parse(tplEventForm)).Parse(tplEvent))
+)
+
+// eventForm is the create and edit form, holding what was typed so it can
+// be shown again with an error.
+type eventForm struct {
+	CSRFToken       string
+	Error           string
+	Status          string
+	Paused          *time.Time
+	PausedBy        string
+	ID              int64
+	Slug            string
+	Name            string
+	StartsAt        string
+	EndsAt          string
+	Venue           string
+	OpensAt         string
+	ClosesAt        string
+	Capacity        string
+	GiftBoxCapacity string
+	MinAge          string
+	Flyer           string
+	EmailSubject    string
+	EmailBody       string
+	// DefaultMinAge is the server's minimum age, which events can't go below
+	DefaultMinAge int
+}
+
+// minAgeField leaves the server's minimum age, the default, out of the form.
+func minAgeField(n, defaultMinAge int) string {
+	if n <= defaultMinAge {
+		return ""
+	}
+
+	return strconv.Itoa(n)
+}
+
+func formatEventTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+
+	return t.In(bogota).Format(eventTimeLayout)
+}
+
+func (server *Server) newEventForm(e *event) eventForm {
+	return eventForm{
+		ID: e.ID, Slug: e.Slug, Name: e.Name,
+		StartsAt: formatEventTime(e.Starts), EndsAt: formatEventTime(e.Ends), Venue: e.Venue,
+		OpensAt: formatEventTime(e.Opens), ClosesAt: formatEventTime(e.Closes),
+		Capacity: strconv.Itoa(e.Capacity), GiftBoxCapacity: strconv.Itoa(e.GiftBoxCapacity),
+		MinAge: minAgeField(e.MinAge, server.minAge), Flyer: e.Flyer, EmailSubject: e.EmailSubject, EmailBody: e.EmailBody,
+		DefaultMinAge: server.minAge,
+	}
+}
+
+func (server *Server) readEventForm(r *http.Request) eventForm {
+	get := func(k string) string { return strings.TrimSpace(r.PostForm.Get(k)) }
+	return eventForm{
+		Slug: strings.ToLower(get("slug")), Name: get("name"),
+		StartsAt: get("starts_at"), EndsAt: get("ends_at"), Venue: get("venue"),
+		OpensAt: get("opens_at"), ClosesAt: get("closes_at"),
+		Capacity: get("capacity"), GiftBoxCapacity: get("gift_box_capacity"),
+		MinAge: get("min_age"), Flyer: get("flyer"), EmailSubject: get("email_subject"), EmailBody: r.PostForm.Get("email_body"),
+		DefaultMinAge: server.minAge,
+	}
+}
+
+// event validates the form into an event, returning the error to show.
+func (f eventForm) event() (*event, string) {
+	e := event{ID: f.ID, Slug: f.Slug, Name: f.Name, Venue: f.Venue, Flyer: f.Flyer,
+		EmailSubject: f.EmailSubject, EmailBody: f.EmailBody}
+
+	if !reEventSlug.MatchString(e.Slug) {
+		return nil, "El identificador debe tener entre 2 y 63 letras minúsculas, números o guiones."
+	}
+	if e.Name == "" {
+		return nil, "El nombre es obligatorio."
+	}
+
+	times := []struct {
+		v   string
+		dst **time.Time
+	}{{f.StartsAt, &e.Starts}, {f.EndsAt, &e.Ends}, {f.OpensAt, &e.Opens}, {f.ClosesAt, &e.Closes}}
+	for _, t := range times {
+		if t.v == "" {
+			continue
+		}
+		parsed, err := time.ParseInLocation(eventTimeLayout, t.v, bogota)
+		if err != nil {
+			return nil, "Una de las fechas no es válida."
+		}
+		*t.dst = &parsed
+	}
+	if e.Opens != nil && e.Closes != nil && !e.Opens.Before(*e.Closes) {
+		return nil, "Las inscripciones deben abrir antes de cerrar."
+	}
+
+	for _, c := range []struct {
+		v   string
+		dst *int
+	}{{f.Capacity, &e.Capacity}, {f.GiftBoxCapacity, &e.GiftBoxCapacity}} {
+		if c.v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(c.v)
+		if err != nil || n < 0 {
+			return nil, "Los cupos deben ser números enteros, 0 para no tener límite."
+		}
+		*c.dst = n
+	}
+
+	if f.MinAge != "" {
+		n, err := strconv.Atoi(f.MinAge)
+		if err != nil || n < f.DefaultMinAge || n > maxAge {
+			return nil, fmt.Sprintf("La edad mínima debe estar entre %d y %d años.", f.DefaultMinAge, maxAge)
+		}
+		e.MinAge = n
+	}
+
+	if e.Flyer != "" {
+		if _, err := os.Stat(e.Flyer); err != nil {
+			return nil, "No se encontró el volante en el servidor."
+		}
+	}
+	if _, _, err := e.ticketEmail(); err != nil {
+		return nil, "El cuerpo del correo no es una plantilla válida: " + err.Error()
+	}
+
+	return &e, ""
+}
+
+// args are the columns of queryInsertEvent and queryUpdateEvent after the
+// slug or ID.
+func (e *event) args() []interface{} {
+	null := func(s string) sql.NullString { return sql.NullString{String: s, Valid: s != ""} }
+	limit := func(n int) sql.NullInt64 { return sql.NullInt64{Int64: int64(n), Valid: n > 0} }
+	return []interface{}{e.Name, e.Starts, e.Ends, null(e.Venue), null(e.Flyer), null(e.EmailSubject), null(e.EmailBody),
+		limit(e.Capacity), limit(e.GiftBoxCapacity), e.Opens, e.Closes, limit(e.MinAge)}
+}
+
+type eventRow struct {
+	*event
+	Registrations int
+	Waitlisted    int
+	Status        string
+}
+
+type eventsPage struct {
+	Events []eventRow
+	New    eventForm
+}
+
+// handleEvents lists the events and creates new ones.
+func (server *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	a := server.requirePermission(w, r, permEvents)
+	if a == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	csrf, err := server.csrfToken(w, r)
+	if err != nil {
+		log.Printf("failed to issue CSRF token: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	page := eventsPage{New: eventForm{CSRFToken: csrf, DefaultMinAge: server.minAge}}
+	status := http.StatusOK
+	if r.Method == http.MethodPost {
+		f := server.readEventForm(r)
+		f.CSRFToken = csrf
+		e, msg := f.event()
+		if e != nil {
+			err := stmtInsertEvent.QueryRowContext(ctx, append([]interface{}{e.Slug}, append(e.args(), time.Now())...)...).Scan(&e.ID)
+			if isUniqueViolation(err) {
+				msg = "Ya existe un evento con ese identificador."
+			} else if err != nil {
+				log.Printf("failed to store event %s: %s", e.Slug, err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		if msg != "" {
+			f.Error = msg
+			page.New = f
+			status = http.StatusBadRequest
+		} else {
+			log.Printf("admin %s created event %s", a.Username, e.Slug)
+			server.audit(r, a.Username, "event_create", "event:"+e.Slug, nil, server.newEventForm(e))
+			http.Redirect(w, r, "/admin/events/"+e.Slug, http.StatusSeeOther)
+			return
+		}
+	}
+
+	if page.Events, err = selectEvents(ctx); err != nil {
+		log.Printf("failed to select events: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/html")
+	w.WriteHeader(status)
+	if err := tmplEvents.Execute(w, page); err != nil {
+		log.Printf("failed to execute template for events: %s", err)
+	}
+}
+
+// handleEvent shows and updates an event. The slug can't change, since it's
+// in links already shared.
+func (server *Server) handleEvent(w http.ResponseWriter, r *http.Request) {
+	a := server.requirePermission(w, r, permEvents)
+	if a == nil {
+		return
+	}
+
+	slug := strings.TrimPrefix(r.URL.Path, "/admin/events/")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	e, err := selectEventBySlug(ctx, slug)
+	if err == sql.ErrNoRows {
+		server.serveNotFound(w)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to select event %s: %s", slug, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	csrf, err := server.csrfToken(w, r)
+	if err != nil {
+		log.Printf("failed to issue CSRF token: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	f := server.newEventForm(e)
+	status := http.StatusOK
+	if r.Method == http.MethodPost {
+		before := f
+		f = server.readEventForm(r)
+		f.ID, f.Slug = e.ID, e.Slug
+
+		updated, msg := f.event()
+		if msg != "" {
+			f.Error = msg
+			status = http.StatusBadRequest
+		} else {
+			if _, err := stmtUpdateEvent.ExecContext(ctx, append([]interface{}{e.ID}, updated.args()...)...); err != nil {
+				log.Printf("failed to update event %s: %s", slug, err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			log.Printf("admin %s updated event %s", a.Username, slug)
+			server.audit(r, a.Username, "event_update", "event:"+slug, before, server.newEventForm(updated))
+
+			// a larger capacity frees places for the waitlist
+			server.promoteWaitlist(ctx, e.ID)
+
+			http.Redirect(w, r, "/admin/events/"+slug, http.StatusSeeOther)
+			return
+		}
+	}
+
+	f.CSRFToken = csrf
+	f.Status, f.Paused, f.PausedBy = e.status(time.Now()), e.Paused, e.PausedBy
+	w.Header().Add("Content-Type", "text/html")
+	w.WriteHeader(status)
+	if err := tmplEvent.Execute(w, f); err != nil {
+		log.Printf("failed to execute template for event: %s", err)
+	}
+}
+
+// handleEventPause pauses or resumes the registrations of an event at once,
+// whatever its window, for when something goes wrong during registration.
+func (server *Server) handleEventPause(w http.ResponseWriter, r *http.Request) {
+	a := server.requirePermission(w, r, permEvents)
+	if a == nil {
+		return
+	}
+
+	slug := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/admin/events/"), "/pause")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	e, err := selectEventBySlug(ctx, slug)
+	if err == sql.ErrNoRows {
+		server.serveNotFound(w)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to select event %s: %s", slug, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var paused sql.NullTime
+	var pausedBy sql.NullString
+	switch r.PostForm.Get("action") {
+	case "pause":
+		paused = sql.NullTime{Time: time.Now(), Valid: true}
+		pausedBy = sql.NullString{String: a.Username, Valid: true}
+	case "resume":
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if _, err := stmtPauseEvent.ExecContext(ctx, e.ID, paused, pausedBy); err != nil {
+		log.Printf("failed to pause event %s: %s", slug, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	action := "event_" + r.PostForm.Get("action")
+	log.Printf("admin %s: %s %s", a.Username, action, slug)
+	server.audit(r, a.Username, action, "event:"+slug, map[string]bool{"paused": e.Paused != nil}, map[string]bool{"paused": paused.Valid})
+
+	http.Redirect(w, r, "/admin/events/"+slug, http.StatusSeeOther)
+}
+
+// selectEvents lists the events, newest first, with their registrations.
+func selectEvents(ctx context.Context) ([]eventRow, error) {
+	rows, err := stmtSelectEvents.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	var events []eventRow
+	for rows.Next() {
+		var row eventRow
+		if row.event, err = scanEvent(rows, &row.Registrations, &row.Waitlisted); err != nil {
+			return nil, err
+		}
+		row.Status = row.status(now)
+		events = append(events, row)
+	}
+
+	return events, rows.Err()
+}
@@ -0,0 +1,109 @@
+package fileserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEventStatus(t *testing.T) {
+	// registration opens at midnight and closes at 18:00 on June 15 in
+	// Bogotá, 05:00 and 23:00 UTC
+	opens := time.Date(2024, 6, 15, 0, 0, 0, 0, bogota)
+	closes := time.Date(2024, 6, 15, 18, 0, 0, 0, bogota)
+	paused := time.Date(2024, 6, 15, 12, 0, 0, 0, bogota)
+	utc := func(day, hour, min int) time.Time {
+		return time.Date(2024, 6, day, hour, min, 0, 0, time.UTC)
+	}
+
+	window := &event{Opens: &opens, Closes: &closes}
+	tests := []struct {
+		name    string
+		e       *event
+		now     time.Time
+		want    string
+		wantErr error
+	}{
+		{name: "evening before in Bogotá", e: window, now: utc(15, 4, 59), want: eventNotOpen, wantErr: errEventNotOpen},
+		{name: "just before opening", e: window, now: opens.Add(-time.Nanosecond), want: eventNotOpen, wantErr: errEventNotOpen},
+		{name: "at opening", e: window, now: utc(15, 5, 0), want: eventOpen},
+		{name: "midday", e: window, now: utc(15, 17, 0), want: eventOpen},
+		{name: "just before closing", e: window, now: closes.Add(-time.Nanosecond), want: eventOpen},
+		{name: "at closing", e: window, now: utc(15, 23, 0), want: eventClosed, wantErr: errEventClosed},
+		{name: "next day in UTC, same day in Bogotá", e: window, now: utc(16, 1, 0), want: eventClosed, wantErr: errEventClosed},
+		{name: "no window", e: &event{}, now: utc(15, 12, 0), want: eventOpen},
+		{name: "opens only, before", e: &event{Opens: &opens}, now: utc(15, 4, 0), want: eventNotOpen, wantErr: errEventNotOpen},
+		{name: "opens only, long after", e: &event{Opens: &opens}, now: utc(30, 0, 0), want: eventOpen},
+		{name: "closes only, long before", e: &event{Closes: &closes}, now: utc(1, 0, 0), want: eventOpen},
+		{name: "closes only, at closing", e: &event{Closes: &closes}, now: closes, want: eventClosed, wantErr: errEventClosed},
+		{name: "paused inside the window", e: &event{Opens: &opens, Closes: &closes, Paused: &paused}, now: utc(15, 17, 0), want: eventPaused, wantErr: errEventPaused},
+		{name: "paused before opening", e: &event{Opens: &opens, Paused: &paused}, now: utc(14, 12, 0), want: eventPaused, wantErr: errEventPaused},
+		{name: "paused after closing", e: &event{Closes: &closes, Paused: &paused}, now: utc(16, 12, 0), want: eventPaused, wantErr: errEventPaused},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.e.status(tt.now); got != tt.want {
+				t.Errorf("status(%s) = %q, want %q", tt.now, got, tt.want)
+			}
+			if err := tt.e.checkOpen(tt.now); err != tt.wantErr {
+				t.Errorf("checkOpen(%s) = %v, want %v", tt.now, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEventFormWindow(t *testing.T) {
+	tests := []struct {
+		name          string
+		opens, closes string
+		wantOpens     time.Time
+		wantCloses    time.Time
+		wantErr       bool
+	}{
+		{
+			name: "times are in Bogotá", opens: "2024-06-15T00:00", closes: "2024-06-15T18:00",
+			wantOpens: time.Date(2024, 6, 15, 5, 0, 0, 0, time.UTC), wantCloses: time.Date(2024, 6, 15, 23, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "closing past midnight UTC", opens: "2024-06-15T08:00", closes: "2024-06-15T21:30",
+			wantOpens: time.Date(2024, 6, 15, 13, 0, 0, 0, time.UTC), wantCloses: time.Date(2024, 6, 16, 2, 30, 0, 0, time.UTC),
+		},
+		{name: "opens when it closes", opens: "2024-06-15T18:00", closes: "2024-06-15T18:00", wantErr: true},
+		{name: "opens after it closes", opens: "2024-06-16T00:00", closes: "2024-06-15T23:59", wantErr: true},
+		{name: "not a time", opens: "15/06/2024 00:00", wantErr: true},
+		{name: "open ended", opens: "2024-06-15T00:00", wantOpens: time.Date(2024, 6, 15, 5, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := eventForm{Slug: "festival", Name: "Festival", OpensAt: tt.opens, ClosesAt: tt.closes, DefaultMinAge: defaultMinAge}
+			e, msg := f.event()
+			if tt.wantErr {
+				if msg == "" {
+					t.Errorf("event() accepted opens %q, closes %q", tt.opens, tt.closes)
+				}
+				return
+			}
+			if msg != "" {
+				t.Fatalf("event() = %q", msg)
+			}
+
+			if e.Opens == nil || !e.Opens.Equal(tt.wantOpens) {
+				t.Errorf("opens = %v, want %s", e.Opens, tt.wantOpens)
+			}
+			if tt.closes == "" {
+				if e.Closes != nil {
+					t.Errorf("closes = %s, want none", e.Closes)
+				}
+			} else if e.Closes == nil || !e.Closes.Equal(tt.wantCloses) {
+				t.Errorf("closes = %v, want %s", e.Closes, tt.wantCloses)
+			}
+
+			// shown back in Bogotá however it was stored
+			opensUTC := e.Opens.UTC()
+			if got := formatEventTime(&opensUTC); got != tt.opens {
+				t.Errorf("formatEventTime(%s) = %q, want %q", opensUTC, got, tt.opens)
+			}
+		})
+	}
+}
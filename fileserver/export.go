@@ -0,0 +1,317 @@
+package fileserver
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Carbon-X-DAO/CieloVerde.io/xlsx"
+)
+
+// exports can take a while over a slow connection, but not forever
+const exportTimeout = 10 * time.Minute
+
+const (
+	queryInsertExport = `INSERT INTO
+	export_log(admin, format, filter, columns, masked, remote_addr, useragent, ctime)
+	VALUES( $1, $2, $3, $4, $5, $6, $7, $8 )
+	RETURNING id`
+
+	queryUpdateExportRows = `UPDATE export_log SET rows = $2 WHERE id=$1`
+)
+
+var stmtInsertExport *sql.Stmt
+var stmtUpdateExportRows *sql.Stmt
+
+// exportColumn is a column that can be picked for an export. Columns with
+// personal data are masked for roles that can't export it.
+type exportColumn struct {
+	Key    string
+	Header string
+	expr   string
+	mask   func(string) string
+}
+
+func boolExpr(col string) string {
+	return "CASE WHEN " + col + " THEN 'sí' ELSE 'no' END"
+}
+
+var exportColumns = []exportColumn{
+	{Key: "ctime", Header: "Fecha", expr: `to_char(ctime AT TIME ZONE 'America/Bogota', 'YYYY-MM-DD HH24:MI:SS')`},
+	{Key: "event", Header: "Evento", expr: "(SELECT name FROM events WHERE events.id = event_id)"},
+	{Key: "first_name", Header: "Nombre", expr: "first_name"},
+	{Key: "last_name", Header: "Apellido", expr: "last_name"},
+	{Key: "id_no", Header: "Cédula", expr: "id_no::text", mask: maskTail},
+	{Key: "email", Header: "Correo", expr: "email", mask: maskEmail},
+	{Key: "phone", Header: "Teléfono", expr: "phone", mask: maskTail},
+	{Key: "country", Header: "País", expr: "country"},
+	{Key: "department", Header: "Departamento", expr: "department"},
+	{Key: "department_code", Header: "Código departamento", expr: "department_code"},
+	{Key: "city", Header: "Ciudad", expr: "city"},
+	{Key: "city_code", Header: "Código municipio", expr: "city_code"},
+	{Key: "neighborhood", Header: "Barrio", expr: "neighborhood", mask: maskAll},
+	{Key: "street_address", Header: "Dirección", expr: "street_address", mask: maskAll},
+	{Key: "gender", Header: "Género", expr: "gender"},
+	{Key: "age", Header: "Edad", expr: "age::text"},
+	{Key: "birth_date", Header: "Fecha de nacimiento", expr: "to_char(birth_date, 'YYYY-MM-DD')", mask: maskAll},
+	{Key: "daily_qty", Header: "Consumo diario", expr: "daily_qty"},
+	{Key: "weekly_qty", Header: "Consumo semanal", expr: "weekly_qty"},
+	{Key: "monthly_qty", Header: "Consumo mensual", expr: "monthly_qty"},
+	{Key: "newsletter", Header: "Boletín", expr: boolExpr("newsletter")},
+	{Key: "gift_box", Header: "Caja de regalo", expr: boolExpr("gift_box")},
+	{Key: "authorized", Header: "Autoriza datos", expr: boolExpr("authorized")},
+	{Key: "consent_version", Header: "Versión autorización", expr: "(SELECT t.version FROM consents c JOIN consent_texts t ON t.id = c.consent_text_id WHERE c.form_id = form_info.id AND c.withdrawn_time IS NULL)"},
+	{Key: "claimed", Header: "Reclamado", expr: boolExpr("claimed")},
+}
+
+// maskTail keeps the last four characters.
+func maskTail(s string) string {
+	r := []rune(s)
+	for i := 0; i < len(r)-4; i++ {
+		r[i] = '*'
+	}
+
+	return string(r)
+}
+
+// maskEmail keeps the first character and the domain.
+func maskEmail(s string) string {
+	at := strings.LastIndex(s, "@")
+	if at < 1 {
+		return maskAll(s)
+	}
+
+	return s[:1] + "***" + s[at:]
+}
+
+func maskAll(s string) string {
+	if s == "" {
+		return ""
+	}
+
+	return "***"
+}
+
+// selectExportColumns returns the requested columns of all in their usual
+// order, or all of them if none are requested.
+func selectExportColumns(all []exportColumn, keys []string) []exportColumn {
+	wanted := make(map[string]bool)
+	for _, k := range keys {
+		wanted[k] = true
+	}
+
+	var cols []exportColumn
+	for _, c := range all {
+		if len(wanted) == 0 || wanted[c.Key] {
+			cols = append(cols, c)
+		}
+	}
+
+	if len(cols) == 0 {
+		return all
+	}
+
+	return cols
+}
+
+// escapeFormula keeps spreadsheet programs from evaluating attendee input
+// in a CSV file as a formula. Phone numbers in E.164 are left alone: they
+// were normalized on registration and can't hold a formula.
+func escapeFormula(s string) string {
+	if s == "" || !strings.ContainsRune("=+-@\t\r", rune(s[0])) || isE164(s) {
+		return s
+	}
+
+	return "'" + s
+}
+
+func isE164(s string) bool {
+	if len(s) < 9 || len(s) > 16 || s[0] != '+' || s[1] == '0' {
+		return false
+	}
+	for _, r := range s[1:] {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+type rowWriter interface {
+	WriteRow([]string) error
+	Flush() error
+	Close() error
+}
+
+// csvRowWriter escapes formulas; XLSX cells are written as inline strings,
+// which spreadsheet programs never evaluate.
+type csvRowWriter struct {
+	w *csv.Writer
+}
+
+func (c csvRowWriter) WriteRow(row []string) error {
+	escaped := make([]string, len(row))
+	for i, v := range row {
+		escaped[i] = escapeFormula(v)
+	}
+
+	return c.w.Write(escaped)
+}
+
+func (c csvRowWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c csvRowWriter) Close() error {
+	return c.Flush()
+}
+
+func newRowWriter(format string, w io.Writer) (rowWriter, error) {
+	switch format {
+	case "csv":
+		// the BOM makes Excel read the file as UTF-8
+		if _, err := io.WriteString(w, "\ufeff"); err != nil {
+			return nil, err
+		}
+		return csvRowWriter{csv.NewWriter(w)}, nil
+	case "xlsx":
+		return xlsx.NewWriter(w, "Registros")
+	}
+
+	return nil, fmt.Errorf("unknown export format %q", format)
+}
+
+var exportContentTypes = map[string]string{
+	"csv":  "text/csv; charset=utf-8",
+	"xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+// handleExport streams the registrations matching the console's filters as
+// CSV or XLSX, and records who exported what.
+func (server *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	a := server.requirePermission(w, r, permBrowse)
+	if a == nil {
+		return
+	}
+
+	q := r.URL.Query()
+	format := q.Get("format")
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f := parseRegistrationFilter(q)
+	f.Page = 1
+	f.Masked = !a.Role.can(permExport)
+	cols := selectExportColumns(server.schema.exportColumns(), q["col"])
+	masked := f.Masked
+
+	var exprs, keys, headers []string
+	for _, c := range cols {
+		exprs = append(exprs, "COALESCE("+c.expr+", '')")
+		keys = append(keys, c.Key)
+		headers = append(headers, c.Header)
+	}
+
+	var args []interface{}
+	query := "SELECT " + strings.Join(exprs, ", ") + " FROM form_info " + f.where(&args) + " " + f.orderBy()
+
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+
+	// recorded before any data leaves, so aborted exports show up too
+	var exportID int64
+	filter := server.auditFilter(f)
+	if err := stmtInsertExport.QueryRowContext(ctx, a.Username, format, filter, strings.Join(keys, ","), masked,
+		clientIP(r), r.Header.Get("User-Agent"), time.Now()).Scan(&exportID); err != nil {
+		log.Printf("failed to store export: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	server.audit(r, a.Username, "export", fmt.Sprintf("export:%d", exportID), nil, map[string]interface{}{
+		"format": format, "filter": filter, "columns": keys, "masked": masked,
+	})
+
+	rows, err := server.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		log.Printf("failed to select registrations for export: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	filename := fmt.Sprintf("registros-%s.%s", time.Now().In(bogota).Format("20060102-1504"), format)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("Cache-Control", "no-store")
+
+	out, err := newRowWriter(format, w)
+	if err != nil {
+		log.Printf("failed to start export: %s", err)
+		return
+	}
+
+	if err := out.WriteRow(headers); err != nil {
+		log.Printf("failed to write export: %s", err)
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	values := make([]string, len(cols))
+	dest := make([]interface{}, len(cols))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+
+	n := 0
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			log.Printf("failed to scan registration for export: %s", err)
+			return
+		}
+		for i, c := range cols {
+			if masked && c.mask != nil {
+				values[i] = c.mask(values[i])
+			}
+		}
+		if err := out.WriteRow(values); err != nil {
+			log.Printf("failed to write export: %s", err)
+			return
+		}
+
+		n++
+		if n%1000 == 0 && flusher != nil {
+			if err := out.Flush(); err != nil {
+				log.Printf("failed to write export: %s", err)
+				return
+			}
+			flusher.Flush()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("failed to iterate registrations for export: %s", err)
+		return
+	}
+
+	if err := out.Close(); err != nil {
+		log.Printf("failed to finish export: %s", err)
+		return
+	}
+
+	if _, err := stmtUpdateExportRows.ExecContext(ctx, exportID, n); err != nil {
+		log.Printf("failed to update export %d: %s", exportID, err)
+	}
+
+	log.Printf("admin %s exported %d registrations as %s", a.Username, n, format)
+}
@@ -0,0 +1,147 @@
+package fileserver
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestEscapeFormula(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"Ana", "Ana"},
+		{"=1+1", "'=1+1"},
+		{"+1+1", "'+1+1"},
+		{"-2", "'-2"},
+		{"@SUM(A1)", "'@SUM(A1)"},
+		{"\tx", "'\tx"},
+		{"\rx", "'\rx"},
+		{"a=1", "a=1"},
+		{"+573001234567", "+573001234567"},
+		{"+14155550100", "+14155550100"},
+		{"+0573001234567", "'+0573001234567"},
+		{"+57 300 1234567", "'+57 300 1234567"},
+		{"+57300123456789012", "'+57300123456789012"},
+		{"+1234567", "'+1234567"},
+	}
+
+	for _, tt := range tests {
+		if got := escapeFormula(tt.in); got != tt.want {
+			t.Errorf("escapeFormula(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRowWriterEscapesCSVOnly(t *testing.T) {
+	row := []string{"=cmd", "+573001234567"}
+
+	var csv bytes.Buffer
+	w, err := newRowWriter("csv", &csv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteRow(row); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := csv.String(), "\ufeff'=cmd,+573001234567\n"; got != want {
+		t.Errorf("CSV = %q, want %q", got, want)
+	}
+	if row[0] != "=cmd" {
+		t.Errorf("WriteRow changed the row to %q", row)
+	}
+
+	var xlsx bytes.Buffer
+	w, err = newRowWriter("xlsx", &xlsx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteRow(row); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(xlsx.Bytes(), []byte("'=cmd")) {
+		t.Error("XLSX cell was escaped")
+	}
+
+	if _, err := newRowWriter("pdf", &xlsx); err == nil {
+		t.Error("newRowWriter accepted an unknown format")
+	}
+}
+
+func TestMasks(t *testing.T) {
+	tests := []struct {
+		name string
+		mask func(string) string
+		in   string
+		want string
+	}{
+		{"tail", maskTail, "1020304050", "******4050"},
+		{"tail of a phone", maskTail, "+573001234567", "*********4567"},
+		{"tail of a short value", maskTail, "123", "123"},
+		{"tail of nothing", maskTail, "", ""},
+		{"tail of accents", maskTail, "ñañañaña", "****ñaña"},
+		{"email", maskEmail, "ana.maria@example.com", "a***@example.com"},
+		{"email without local part", maskEmail, "@example.com", "***"},
+		{"not an email", maskEmail, "ana", "***"},
+		{"all", maskAll, "Calle 1 # 2-3", "***"},
+		{"all of nothing", maskAll, "", ""},
+	}
+
+	for _, tt := range tests {
+		if got := tt.mask(tt.in); got != tt.want {
+			t.Errorf("%s: mask(%q) = %q, want %q", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSelectExportColumns(t *testing.T) {
+	keys := func(cols []exportColumn) string {
+		var k []string
+		for _, c := range cols {
+			k = append(k, c.Key)
+		}
+		return strings.Join(k, ",")
+	}
+	all := []exportColumn{{Key: "a"}, {Key: "b"}, {Key: "c"}}
+
+	tests := []struct {
+		name string
+		keys []string
+		want string
+	}{
+		{"none picks all", nil, "a,b,c"},
+		{"kept in order", []string{"c", "a"}, "a,c"},
+		{"unknown ones ignored", []string{"b", "z"}, "b"},
+		{"only unknown picks all", []string{"z"}, "a,b,c"},
+	}
+
+	for _, tt := range tests {
+		if got := keys(selectExportColumns(all, tt.keys)); got != tt.want {
+			t.Errorf("%s: columns = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCustomAnswersAreMasked(t *testing.T) {
+	s := &FormSchema{Questions: []Question{
+		{Name: "referral", Type: questionSelect, Labels: map[string]string{"es": "Referido"}},
+		{Name: "notes", Type: questionText, Labels: map[string]string{"es": "Notas"}},
+		{Name: "card", Type: questionText, Labels: map[string]string{"es": "Carné"}, Personal: true},
+	}}
+
+	for _, c := range s.exportColumns() {
+		if !strings.HasPrefix(c.Key, "answers.") {
+			continue
+		}
+		if c.mask == nil || c.mask("Ana Pérez, 1020304050") != "***" {
+			t.Errorf("answers of %s aren't masked", c.Key)
+		}
+	}
+}
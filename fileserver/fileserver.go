@@ -15,11 +15,13 @@ import (
 	"image/jpeg"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Carbon-X-DAO/CieloVerde.io/fsutil"
@@ -38,7 +40,9 @@ const (
 		daily_qty, weekly_qty, monthly_qty,
 		newsletter, gift_box, authorized, claimed,
 		id_hash,
-		ctime
+		ctime, waitlisted_time,
+		answers, event_id,
+		department_code, city_code, birth_date
 	)
 	VALUES (
 		$1, $2,
@@ -47,19 +51,26 @@ const (
 		$13, $14, $15,
 		$16, $17, $18, $19,
 		$20,
-		$21
-	);`
+		$21, $22,
+		$23, $24,
+		$25, $26, $27
+	)
+	RETURNING id`
 
 	queryInsertQRIncomingHeaders = `INSERT INTO
-	request_info(acceptlanguage, cookie, useragent, cfconnectingip, xforwardedfor, cfray, cfipcountry, cfvisitor, url_value, ctime)
-	VALUES( $1, $2, $3, $4, $5, $6, $7, $8, $9, $10 )`
+	request_info(acceptlanguage, cookie, useragent, cfconnectingip, xforwardedfor, cfray, cfipcountry, cfvisitor, url_value, form_id, ctime)
+	VALUES( $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11 )`
 
 	queryInsertEmailStatus = `INSERT INTO
-	email_status(email_address, gov_id, mailgun_msg, mailgun_id, error, ctime)
-	VALUES( $1, $2, $3, $4, $5, $6)`
-
-	querySelectUser  = `SELECT first_name, last_name, id_no, claimed FROM form_info WHERE id_hash=$1`
-	queryupdateClaim = `UPDATE form_info SET claimed = TRUE WHERE id_hash=$1`
+	email_status(email_address, gov_id, mailgun_msg, mailgun_id, error, ctime, kind, form_id)
+	VALUES( $1, $2, $3, $4, $5, $6, $7, $8)`
+
+	// tickets of unconfirmed or waitlisted registrations don't exist yet
+	querySelectUser = `SELECT id, first_name, last_name, id_no, claimed, (SELECT name FROM events WHERE id = event_id),
+		age, birth_date, (SELECT min_age FROM events WHERE id = event_id)
+	FROM form_info WHERE id_hash=$1 AND verified_time IS NOT NULL AND waitlisted_time IS NULL`
+	queryupdateClaim = `UPDATE form_info SET claimed = TRUE WHERE id_hash=$1 AND claimed IS NOT TRUE AND verified_time IS NOT NULL AND waitlisted_time IS NULL
+	RETURNING id`
 )
 
 var stmtInsertQRIncomingHeaders *sql.Stmt
@@ -71,19 +82,123 @@ var stmtUpdateClaim *sql.Stmt
 type Server struct {
 	frontendRoot string
 	*http.Server
-	db            *sql.DB
-	flyer         image.Image
-	mg            *mailgun.MailgunImpl
-	shibboleth    string
-	adminUser     string
-	adminPassword string
+	db *sql.DB
+	// flyer is the default ticket flyer, for events without their own
+	flyer image.Image
+	// flyers caches the flyers of events by path
+	flyers   map[string]cachedFlyer
+	flyersMu sync.Mutex
+	mg       *mailgun.MailgunImpl
+	// sessions end after sessionIdle without a request, and sessionMax after
+	// login regardless of activity
+	sessionIdle time.Duration
+	sessionMax  time.Duration
+	// verifyFor is how long attendees have to confirm their email before
+	// their registration is deleted
+	verifyFor       time.Duration
+	insecureCookies bool
+	// allowedOrigins are the scheme://host pairs, besides the request's own
+	// host, that may POST to the server
+	allowedOrigins []string
+	// enforce2FA keeps admins whose role requires2FA out until they enroll
+	enforce2FA bool
+	// trustIdP2FA leaves the second factor of external accounts to their
+	// identity provider
+	trustIdP2FA bool
+	// oidc, when non-nil, enables login through an OpenID Connect provider
+	oidc *OIDCConfig
+	// saml, when non-nil, enables login through a SAML identity provider
+	saml         *SAMLConfig
+	samlRequests samlRequestStore
+	// challenge, when non-nil, holds the bot checks registrations must pass
+	challenge *ChallengeConfig
+	// defaultEvent is the slug of the event the URLs predating events
+	// register for
+	defaultEvent string
+	// schema, when non-nil, adds custom questions to the registration form
+	schema *FormSchema
+	// passwordLogin can be turned off once everyone logs in through SSO
+	passwordLogin bool
+	// uniqueEmail and uniquePhone reject registrations reusing the email or
+	// phone of another one, as is always done for ID numbers
+	uniqueEmail bool
+	uniquePhone bool
+	// secret signs the links emailed to attendees
+	secret []byte
+	// minAge is the minimum age to register for any event; events can ask
+	// for more
+	minAge int
+	// trustedProxies are the networks whose CF-Connecting-IP header is
+	// believed: Cloudflare's and Config.TrustedProxies
+	trustedProxies []*net.IPNet
+	// stopSweep stops deleting expired registrations on Shutdown
+	stopSweep chan struct{}
 }
 
-// tlsConfig may be nil, in which case an HTTP server will serve without TLS
-func New(addr, adminUser, adminPassword, shibboleth, mailgunAPIKey, flyerFilename, frontendRoot string, tlsConfig *tls.Config, db *sql.DB) (*Server, error) {
+// Config is what New needs to know besides the database.
+type Config struct {
+	Addr          string
+	MailgunAPIKey string
+	// FlyerFilename is the JPEG tickets are drawn on for events without a
+	// flyer of their own
+	FlyerFilename string
+	FrontendRoot  string
+	// TLSConfig may be nil, in which case an HTTP server will serve without
+	// TLS
+	TLSConfig *tls.Config
+	// sessions end after SessionIdle without a request, and SessionMax after
+	// login regardless of activity
+	SessionIdle time.Duration
+	SessionMax  time.Duration
+	// VerifyFor is how long attendees have to confirm their email before
+	// their registration is deleted
+	VerifyFor       time.Duration
+	InsecureCookies bool
+	// AllowedOrigins are the scheme://host pairs, besides the request's own
+	// host, that may POST to the server
+	AllowedOrigins []string
+	// TrustedProxies are the networks, besides Cloudflare's, whose
+	// CF-Connecting-IP header is taken as the client's address
+	TrustedProxies []*net.IPNet
+	// Enforce2FA keeps admins whose role requires2FA out until they enroll
+	Enforce2FA bool
+	// TrustIdP2FA exempts accounts logging in through OIDC or SAML from
+	// TOTP, for identity providers known to require a second factor; their
+	// amr or authentication context isn't checked
+	TrustIdP2FA bool
+	// PasswordLogin can be turned off once everyone logs in through SSO
+	PasswordLogin bool
+	// OIDC, SAML, Challenge and Schema are optional
+	OIDC      *OIDCConfig
+	SAML      *SAMLConfig
+	Challenge *ChallengeConfig
+	Schema    *FormSchema
+	// DefaultEvent is the slug of the event the URLs predating events
+	// register for
+	DefaultEvent string
+	// UniqueEmail and UniquePhone reject registrations reusing the email or
+	// phone of another one, as is always done for ID numbers
+	UniqueEmail bool
+	UniquePhone bool
+	// MinAge is the minimum age to register for any event; events can ask
+	// for more. 0 means 18, the legal age in Colombia.
+	MinAge int
+	// Secret signs the links emailed to attendees. It's required, so the
+	// links keep working across restarts and instances.
+	Secret []byte
+}
+
+func New(config Config, db *sql.DB) (*Server, error) {
 	var err error
 
-	flyerHandle, err := os.Open(flyerFilename)
+	if len(config.Secret) < 16 {
+		return nil, fmt.Errorf("the secret must be at least 16 bytes long")
+	}
+	if config.MinAge < 0 || config.MinAge > maxAge {
+		return nil, fmt.Errorf("the minimum age must be between 0 and %d", maxAge)
+	}
+
+	flyerHandle, err := os.Open(config.FlyerFilename)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open flyer image file: %s", err)
 	}
@@ -93,7 +208,7 @@ func New(addr, adminUser, adminPassword, shibboleth, mailgunAPIKey, flyerFilenam
 		return nil, fmt.Errorf("failed to JPEG decode flyer image file: %s", err)
 	}
 
-	mgClient := mailgun.NewMailgun("CieloVerde.io", mailgunAPIKey)
+	mgClient := mailgun.NewMailgun("CieloVerde.io", config.MailgunAPIKey)
 	ds := mgClient.ListDomains(&mailgun.ListOptions{Limit: 20})
 
 	var domains = []mailgun.Domain{}
@@ -107,17 +222,46 @@ func New(addr, adminUser, adminPassword, shibboleth, mailgunAPIKey, flyerFilenam
 	}
 
 	server := &Server{
-		frontendRoot:  frontendRoot,
-		db:            db,
-		flyer:         flyerImg,
-		mg:            mgClient,
-		shibboleth:    shibboleth,
-		adminUser:     adminUser,
-		adminPassword: adminPassword,
+		frontendRoot:    config.FrontendRoot,
+		db:              db,
+		flyer:           flyerImg,
+		flyers:          make(map[string]cachedFlyer),
+		mg:              mgClient,
+		sessionIdle:     config.SessionIdle,
+		sessionMax:      config.SessionMax,
+		verifyFor:       config.VerifyFor,
+		insecureCookies: config.InsecureCookies,
+		allowedOrigins:  config.AllowedOrigins,
+		enforce2FA:      config.Enforce2FA,
+		trustIdP2FA:     config.TrustIdP2FA,
+		oidc:            config.OIDC,
+		saml:            config.SAML,
+		samlRequests:    dbSAMLRequests{},
+		challenge:       config.Challenge,
+		defaultEvent:    config.DefaultEvent,
+		schema:          config.Schema,
+		passwordLogin:   config.PasswordLogin,
+		uniqueEmail:     config.UniqueEmail,
+		uniquePhone:     config.UniquePhone,
+		secret:          config.Secret,
+		minAge:          defaultMinAge,
+		trustedProxies:  append(append([]*net.IPNet(nil), cloudflareNets...), config.TrustedProxies...),
+		stopSweep:       make(chan struct{}),
+	}
+	if config.MinAge > 0 {
+		server.minAge = config.MinAge
+	}
+
+	if !server.passwordLogin && server.oidc == nil && server.saml == nil {
+		return nil, errors.New("password login can only be disabled when another login method is configured")
 	}
 
-	if server.adminPassword == "" || server.adminUser == "" {
-		return nil, errors.New("both adminUser and adminPassword must be non-ompty")
+	if server.sessionIdle <= 0 || server.sessionMax <= 0 {
+		return nil, errors.New("both sessionIdle and sessionMax must be positive")
+	}
+
+	if server.verifyFor <= 0 {
+		return nil, errors.New("verifyFor must be positive")
 	}
 
 	if stmtInsertQRIncomingHeaders, err = db.Prepare(queryInsertQRIncomingHeaders); err != nil {
@@ -140,17 +284,299 @@ func New(addr, adminUser, adminPassword, shibboleth, mailgunAPIKey, flyerFilenam
 		return nil, fmt.Errorf("failed to prepare statement for selecting users from form_info: %w", err)
 	}
 
+	if stmtInsertClaim, err = db.Prepare(queryInsertClaim); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for inserting into claims: %w", err)
+	}
+
+	if stmtSelectClaims, err = db.Prepare(querySelectClaims); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for selecting from claims: %w", err)
+	}
+
+	if stmtSelectRegistration, err = db.Prepare(querySelectRegistration); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for selecting a registration from form_info: %w", err)
+	}
+
+	if stmtSelectEmailStatuses, err = db.Prepare(querySelectEmailStatuses); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for selecting from email_status: %w", err)
+	}
+
+	if stmtInsertExport, err = db.Prepare(queryInsertExport); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for inserting into export_log: %w", err)
+	}
+
+	if stmtUpdateExportRows, err = db.Prepare(queryUpdateExportRows); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for updating export_log: %w", err)
+	}
+
+	if stmtSelectDataSubject, err = db.Prepare(querySelectDataSubject); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for selecting a data subject from form_info: %w", err)
+	}
+
+	if stmtInsertDataRequest, err = db.Prepare(queryInsertDataRequest); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for inserting into data_requests: %w", err)
+	}
+
+	if stmtSelectDataRequests, err = db.Prepare(querySelectDataRequests); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for selecting from data_requests: %w", err)
+	}
+
+	if stmtSelectRequestInfos, err = db.Prepare(querySelectRequestInfos); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for selecting from request_info: %w", err)
+	}
+
+	if stmtCorrectRegistration, err = db.Prepare(queryCorrectRegistration); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for correcting form_info: %w", err)
+	}
+
+	if stmtInsertDeviceKey, err = db.Prepare(queryInsertDeviceKey); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for inserting into device_keys: %w", err)
+	}
+
+	if stmtSelectDeviceKey, err = db.Prepare(querySelectDeviceKey); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for selecting a device key: %w", err)
+	}
+
+	if stmtTouchDeviceKey, err = db.Prepare(queryTouchDeviceKey); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for touching device keys: %w", err)
+	}
+
+	if stmtSelectDeviceKeys, err = db.Prepare(querySelectDeviceKeys); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for selecting device keys: %w", err)
+	}
+
+	if stmtRevokeDeviceKey, err = db.Prepare(queryRevokeDeviceKey); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for revoking device keys: %w", err)
+	}
+
+	if stmtDeleteUnverified, err = db.Prepare(queryDeleteUnverified); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for deleting unverified registrations: %w", err)
+	}
+
+	if stmtVerifyRegistration, err = db.Prepare(queryVerifyRegistration); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for verifying registrations: %w", err)
+	}
+
+	if stmtSelectVerified, err = db.Prepare(querySelectVerified); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for selecting verified registrations: %w", err)
+	}
+
+	if stmtSelectRegistrationByIDNo, err = db.Prepare(querySelectRegistrationByIDNo); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for selecting registrations by ID number: %w", err)
+	}
+
+	if stmtSelectRegistrationByEmail, err = db.Prepare(querySelectRegistrationByEmail); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for selecting registrations by email: %w", err)
+	}
+
+	if stmtSelectRegistrationByPhone, err = db.Prepare(querySelectRegistrationByPhone); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for selecting registrations by phone: %w", err)
+	}
+
+	if stmtSelectIdentity, err = db.Prepare(querySelectIdentity); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for selecting identities: %w", err)
+	}
+
+	if stmtInsertConflict, err = db.Prepare(queryInsertConflict); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for storing conflicts: %w", err)
+	}
+
+	if stmtSelectConflicts, err = db.Prepare(querySelectConflicts); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for selecting conflicts: %w", err)
+	}
+
+	if stmtTakeResend, err = db.Prepare(queryTakeResend); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for resending tickets: %w", err)
+	}
+
+	if stmtInsertChallengeUse, err = db.Prepare(queryInsertChallengeUse); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for storing challenge uses: %w", err)
+	}
+
+	if stmtDeleteExpiredChallengeUses, err = db.Prepare(queryDeleteExpiredChallengeUses); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for deleting expired challenge uses: %w", err)
+	}
+
+	if stmtSelectAdmin, err = db.Prepare(querySelectAdmin); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for selecting admins: %w", err)
+	}
+
+	if stmtInsertSession, err = db.Prepare(queryInsertSession); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for storing sessions: %w", err)
+	}
+
+	if stmtSelectSession, err = db.Prepare(querySelectSession); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for selecting sessions: %w", err)
+	}
+
+	if stmtTouchSession, err = db.Prepare(queryTouchSession); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for touching sessions: %w", err)
+	}
+
+	if stmtDeleteSession, err = db.Prepare(queryDeleteSession); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for deleting sessions: %w", err)
+	}
+
+	if stmtDeleteAdminSessions, err = db.Prepare(queryDeleteAdminSessions); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for deleting all sessions of an admin: %w", err)
+	}
+
+	if stmtDeleteExpiredSessions, err = db.Prepare(queryDeleteExpiredSessions); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for deleting expired sessions: %w", err)
+	}
+
+	if stmtCompleteSecondFactor, err = db.Prepare(queryCompleteSecondFactor); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for completing second factor of sessions: %w", err)
+	}
+
+	if stmtSetTOTPSecret, err = db.Prepare(querySetTOTPSecret); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for storing TOTP secrets: %w", err)
+	}
+
+	if stmtEnableTOTP, err = db.Prepare(queryEnableTOTP); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for enabling TOTP: %w", err)
+	}
+
+	if stmtAdvanceTOTPStep, err = db.Prepare(queryAdvanceTOTPStep); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for advancing TOTP steps: %w", err)
+	}
+
+	if stmtDeleteRecoveryCodes, err = db.Prepare(queryDeleteRecoveryCodes); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for deleting recovery codes: %w", err)
+	}
+
+	if stmtInsertRecoveryCode, err = db.Prepare(queryInsertRecoveryCode); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for storing recovery codes: %w", err)
+	}
+
+	if stmtUseRecoveryCode, err = db.Prepare(queryUseRecoveryCode); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for using recovery codes: %w", err)
+	}
+
+	if stmtInsertOIDCLogin, err = db.Prepare(queryInsertOIDCLogin); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for storing OIDC logins: %w", err)
+	}
+
+	if stmtTakeOIDCLogin, err = db.Prepare(queryTakeOIDCLogin); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for taking OIDC logins: %w", err)
+	}
+
+	if stmtDeleteExpiredOIDCLogins, err = db.Prepare(queryDeleteExpiredOIDCLogins); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for deleting expired OIDC logins: %w", err)
+	}
+
+	if stmtSelectExternalAdmin, err = db.Prepare(querySelectExternalAdmin); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for selecting external admins: %w", err)
+	}
+
+	if stmtInsertExternalAdmin, err = db.Prepare(queryInsertExternalAdmin); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for storing external admins: %w", err)
+	}
+
+	if stmtUpdateExternalAdmin, err = db.Prepare(queryUpdateExternalAdmin); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for updating external admins: %w", err)
+	}
+
+	if stmtInsertSAMLRequest, err = db.Prepare(queryInsertSAMLRequest); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for storing SAML requests: %w", err)
+	}
+
+	if stmtTakeSAMLRequest, err = db.Prepare(queryTakeSAMLRequest); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for taking SAML requests: %w", err)
+	}
+
+	if stmtDeleteExpiredSAMLRequests, err = db.Prepare(queryDeleteExpiredSAMLRequests); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for deleting expired SAML requests: %w", err)
+	}
+
+	if stmtInsertLoginAttempt, err = db.Prepare(queryInsertLoginAttempt); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for storing login attempts: %w", err)
+	}
+
+	if stmtCountUserFailures, err = db.Prepare(queryCountUserFailures); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for counting login failures per user: %w", err)
+	}
+
+	if stmtCountIPFailures, err = db.Prepare(queryCountIPFailures); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for counting login failures per IP: %w", err)
+	}
+
+	if stmtSelectAdminLock, err = db.Prepare(querySelectAdminLock); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for selecting admin locks: %w", err)
+	}
+
+	if stmtLockAdmin, err = db.Prepare(queryLockAdmin); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for locking admins: %w", err)
+	}
+
+	if stmtSelectFailedLogins, err = db.Prepare(querySelectFailedLogins); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for selecting failed logins: %w", err)
+	}
+
+	if stmtSearchUsers, err = db.Prepare(querySearchUsers); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for searching users in form_info: %w", err)
+	}
+
+	if stmtInsertLookupLog, err = db.Prepare(queryInsertLookupLog); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for storing lookup log: %w", err)
+	}
+
+	if stmtSelectEvent, err = db.Prepare(querySelectEvent); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for selecting events: %w", err)
+	}
+
+	if stmtSelectEventBySlug, err = db.Prepare(querySelectEventBySlug); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for selecting events by slug: %w", err)
+	}
+
+	if stmtSelectEvents, err = db.Prepare(querySelectEvents); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for listing events: %w", err)
+	}
+
+	if stmtInsertEvent, err = db.Prepare(queryInsertEvent); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for storing events: %w", err)
+	}
+
+	if stmtUpdateEvent, err = db.Prepare(queryUpdateEvent); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for updating events: %w", err)
+	}
+
+	if stmtPauseEvent, err = db.Prepare(queryPauseEvent); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for pausing events: %w", err)
+	}
+
+	if stmtSelectConsentText, err = db.Prepare(querySelectConsentText); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for selecting consent texts: %w", err)
+	}
+
+	if stmtInsertConsentText, err = db.Prepare(queryInsertConsentText); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for storing consent texts: %w", err)
+	}
+
+	if stmtInsertConsent, err = db.Prepare(queryInsertConsent); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for storing consents: %w", err)
+	}
+
+	if stmtSelectConsent, err = db.Prepare(querySelectConsent); err != nil {
+		return nil, fmt.Errorf("failed to prepare statement for selecting consents: %w", err)
+	}
+
+	if _, err := selectEventBySlug(ctx, server.defaultEvent); err != nil {
+		return nil, fmt.Errorf("failed to select default event %q: %w", server.defaultEvent, err)
+	}
+
 	mux := http.NewServeMux()
 	mux.Handle("/", server)
 
 	httpServer := http.Server{
-		Addr:      addr,
-		TLSConfig: tlsConfig,
+		Addr:      config.Addr,
+		TLSConfig: config.TLSConfig,
 		Handler:   mux,
 	}
 
 	server.Server = &httpServer
 
+	go server.sweepUnverified(server.stopSweep)
+
 	return server, nil
 }
 
@@ -169,6 +595,7 @@ func (server *Server) Listen() error {
 }
 
 func (server *Server) Shutdown(ctx context.Context) error {
+	close(server.stopSweep)
 	if err := server.Server.Shutdown(ctx); err != nil && err != http.ErrServerClosed {
 		return fmt.Errorf("failed to shut shut down HTTP server: %s", err)
 	}
@@ -180,16 +607,101 @@ func (server *Server) Shutdown(ctx context.Context) error {
 }
 
 func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r = withRequestID(w, r)
+	r = server.withClientIP(r)
+
+	if r.Method == http.MethodPost && r.URL.Path != samlACSPath {
+		if err := server.checkCSRF(r); err != nil {
+			log.Printf("rejected POST %s from %s: %s", r.URL.Path, r.RemoteAddr, err)
+			writeForbidden(w)
+			return
+		}
+	}
+
 	switch {
+	case r.URL.Path == "/csrf" && r.Method == http.MethodGet:
+		server.handleCSRFToken(w, r)
+	case r.URL.Path == "/challenge" && r.Method == http.MethodGet:
+		server.handleChallenge(w, r)
 	case reInboundQR.MatchString(r.URL.Path) && r.Method == http.MethodGet:
 		server.handleQRInbound(w, r)
 	case r.URL.Path == "/submit" && r.Method == http.MethodPost:
-		server.handleForm(w, r)
+		server.handleForm(w, r, server.defaultEvent)
+	case r.URL.Path == "/api/form" && r.Method == http.MethodGet:
+		server.handleFormSchema(w, r)
+	case r.URL.Path == "/api/consent" && r.Method == http.MethodGet:
+		server.handleConsentText(w, r)
+	case r.URL.Path == "/api/registrations" && r.Method == http.MethodPost:
+		server.handleAPIRegistration(w, r, server.defaultEvent)
+	case reGeoPath.MatchString(r.URL.Path) && r.Method == http.MethodGet:
+		server.handleGeo(w, r)
+	case reEventPath.MatchString(r.URL.Path):
+		server.handleEventPath(w, r)
 	case r.URL.Path == "/login" && r.Method == http.MethodGet:
 		server.handleLogin(w, r)
 	case r.URL.Path == "/login" && r.Method == http.MethodPost:
 		server.handleLoginRequest(w, r)
-	case strings.HasPrefix(r.URL.Path, "/claim/"):
+	case r.URL.Path == "/login/oidc" && r.Method == http.MethodGet:
+		server.handleOIDCLogin(w, r)
+	case r.URL.Path == "/login/oidc/callback" && r.Method == http.MethodGet:
+		server.handleOIDCCallback(w, r)
+	case r.URL.Path == "/saml/metadata" && r.Method == http.MethodGet:
+		server.handleSAMLMetadata(w, r)
+	case r.URL.Path == "/login/saml" && r.Method == http.MethodGet:
+		server.handleSAMLLogin(w, r)
+	case r.URL.Path == samlACSPath && r.Method == http.MethodPost:
+		server.handleSAMLACS(w, r)
+	case r.URL.Path == "/login/totp" && r.Method == http.MethodGet:
+		server.handleLoginTOTP(w, r)
+	case r.URL.Path == "/login/totp" && r.Method == http.MethodPost:
+		server.handleLoginTOTPRequest(w, r)
+	case r.URL.Path == "/admin/2fa" && r.Method == http.MethodGet:
+		server.handleTwoFactor(w, r)
+	case r.URL.Path == "/admin/2fa/enroll" && r.Method == http.MethodPost:
+		server.handleTwoFactorEnroll(w, r)
+	case r.URL.Path == "/admin/2fa/confirm" && r.Method == http.MethodPost:
+		server.handleTwoFactorConfirm(w, r)
+	case r.URL.Path == "/admin/logins" && r.Method == http.MethodGet:
+		server.handleFailedLogins(w, r)
+	case r.URL.Path == "/logout" && r.Method == http.MethodPost:
+		server.handleLogout(w, r)
+	case r.URL.Path == "/admin/registrations" && r.Method == http.MethodGet:
+		server.handleRegistrations(w, r)
+	case r.URL.Path == "/datos" && r.Method == http.MethodGet:
+		server.handleDataRequestForm(w, r)
+	case r.URL.Path == "/datos" && r.Method == http.MethodPost:
+		server.handleDataRequest(w, r)
+	case strings.HasPrefix(r.URL.Path, "/verify/") && (r.Method == http.MethodGet || r.Method == http.MethodPost):
+		server.handleVerify(w, r)
+	case strings.HasPrefix(r.URL.Path, "/resend/") && r.Method == http.MethodPost:
+		server.handleResend(w, r)
+	case strings.HasPrefix(r.URL.Path, "/datos/"):
+		server.handleDataSubject(w, r)
+	case r.URL.Path == "/admin/conflicts" && r.Method == http.MethodGet:
+		server.handleConflicts(w, r)
+	case strings.HasPrefix(r.URL.Path, "/admin/conflicts/") && strings.HasSuffix(r.URL.Path, "/resolve") && r.Method == http.MethodPost:
+		server.handleResolveConflict(w, r)
+	case r.URL.Path == "/admin/events" && (r.Method == http.MethodGet || r.Method == http.MethodPost):
+		server.handleEvents(w, r)
+	case strings.HasPrefix(r.URL.Path, "/admin/events/") && strings.HasSuffix(r.URL.Path, "/pause") && r.Method == http.MethodPost:
+		server.handleEventPause(w, r)
+	case strings.HasPrefix(r.URL.Path, "/admin/events/") && (r.Method == http.MethodGet || r.Method == http.MethodPost):
+		server.handleEvent(w, r)
+	case r.URL.Path == "/admin/consents" && (r.Method == http.MethodGet || r.Method == http.MethodPost):
+		server.handleConsents(w, r)
+	case r.URL.Path == "/admin/audit" && r.Method == http.MethodGet:
+		server.handleAudit(w, r)
+	case r.URL.Path == "/admin/devices" && (r.Method == http.MethodGet || r.Method == http.MethodPost):
+		server.handleDevices(w, r)
+	case strings.HasPrefix(r.URL.Path, "/admin/devices/") && strings.HasSuffix(r.URL.Path, "/revoke") && r.Method == http.MethodPost:
+		server.handleRevokeDevice(w, r)
+	case r.URL.Path == "/admin/registrations/export" && r.Method == http.MethodGet:
+		server.handleExport(w, r)
+	case strings.HasPrefix(r.URL.Path, "/admin/registrations/") && r.Method == http.MethodGet:
+		server.handleRegistration(w, r)
+	case r.URL.Path == "/claim/search" && r.Method == http.MethodGet:
+		server.handleLookup(w, r)
+	case strings.HasPrefix(r.URL.Path, "/claim/") && r.Method == http.MethodPost:
 		server.updateClaim(w, r)
 	case strings.HasPrefix(r.URL.Path, "/users/"):
 		server.handleGetUserInfo(w, r)
@@ -0,0 +1,305 @@
+package fileserver
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const (
+	querySelectUncodedPlaces = `SELECT id, country, department, city FROM form_info
+	WHERE department_code IS NULL AND department IS NOT NULL AND city IS NOT NULL`
+
+	queryUpdatePlace = `UPDATE form_info SET country = $2, department = $3, department_code = $4, city = $5, city_code = $6
+	WHERE id=$1 AND department_code IS NULL`
+)
+
+// divipolaSource is DANE's DIVIPOLA: departments, with two-digit codes, and
+// municipalities, with five-digit codes starting with their department's.
+//
+//go:embed divipola.csv
+var divipolaSource string
+
+type department struct {
+	Code   string          `json:"code"`
+	Name   string          `json:"name"`
+	Cities []*municipality `json:"-"`
+}
+
+type municipality struct {
+	Code string `json:"code"`
+	Name string `json:"name"`
+}
+
+var (
+	departments []*department
+	// departmentsByCode and municipalitiesByCode are keyed by DANE code
+	departmentsByCode    = make(map[string]*department)
+	municipalitiesByCode = make(map[string]*municipality)
+	// departmentsByName and municipalitiesByName are keyed by placeKey;
+	// municipality names repeat across departments
+	departmentsByName    = make(map[string]*department)
+	municipalitiesByName = make(map[string][]*municipality)
+)
+
+// departmentAliases and municipalityAliases are what people write instead
+// of the official names, keyed by placeKey.
+var departmentAliases = map[string]string{
+	"distrito capital": "11", "santafe de bogota": "11", "santa fe de bogota": "11",
+	"valle":           "76",
+	"guajira":         "44",
+	"norte santander": "54",
+	"san andres":      "88", "san andres y providencia": "88", "san andres providencia y santa catalina": "88",
+}
+
+var municipalityAliases = map[string]string{
+	"santafe de bogota": "11001", "santa fe de bogota": "11001",
+	"santa fe de antioquia": "05042",
+	"carmen de viboral":     "05148",
+	"santuario":             "05697",
+	"cartagena":             "13001",
+	"mompox":                "13468", "mompos": "13468",
+	"guican":           "15332",
+	"villa de leiva":   "15407",
+	"piendamo":         "19548",
+	"manaure":          "20443",
+	"lorica":           "23417",
+	"purisima":         "23586",
+	"ubate":            "25843",
+	"cucuta":           "54001",
+	"tumaco":           "52835",
+	"tolu":             "70820",
+	"since":            "70742",
+	"toluviejo":        "70823",
+	"mariquita":        "73443",
+	"santiago de cali": "76001",
+	"buga":             "76111",
+}
+
+var reNotAlnum = regexp.MustCompile(`[^a-z0-9]+`)
+
+// placeKey folds a place name for matching: lower case, no accents or
+// punctuation, and without the "D.C." of Bogotá.
+func placeKey(s string) string {
+	k := strings.TrimSpace(reNotAlnum.ReplaceAllString(foldAccents(strings.ToLower(s)), " "))
+	return strings.TrimSuffix(strings.TrimSuffix(k, " d c"), " dc")
+}
+
+func init() {
+	records, err := csv.NewReader(strings.NewReader(divipolaSource)).ReadAll()
+	if err != nil {
+		log.Fatalf("failed to read DIVIPOLA: %s", err)
+	}
+
+	for _, rec := range records[1:] {
+		code, name := rec[0], rec[1]
+		switch len(code) {
+		case 2:
+			d := &department{Code: code, Name: name}
+			departments = append(departments, d)
+			departmentsByCode[code] = d
+			departmentsByName[placeKey(name)] = d
+		case 5:
+			d := departmentsByCode[code[:2]]
+			if d == nil {
+				log.Fatalf("DIVIPOLA municipality %s comes before its department", code)
+			}
+			m := &municipality{Code: code, Name: name}
+			d.Cities = append(d.Cities, m)
+			municipalitiesByCode[code] = m
+			k := placeKey(name)
+			municipalitiesByName[k] = append(municipalitiesByName[k], m)
+		default:
+			log.Fatalf("bad DIVIPOLA code %q", code)
+		}
+	}
+
+	for k, code := range departmentAliases {
+		departmentsByName[k] = departmentsByCode[code]
+	}
+	for k, code := range municipalityAliases {
+		municipalitiesByName[k] = append(municipalitiesByName[k], municipalitiesByCode[code])
+	}
+}
+
+// findDepartment looks a department up by code or name.
+func findDepartment(s string) *department {
+	if d := departmentsByCode[s]; d != nil {
+		return d
+	}
+
+	return departmentsByName[placeKey(s)]
+}
+
+// findMunicipalities looks municipalities up by code or name; a name may
+// match several, in different departments.
+func findMunicipalities(s string) []*municipality {
+	if m := municipalitiesByCode[s]; m != nil {
+		return []*municipality{m}
+	}
+
+	return municipalitiesByName[placeKey(s)]
+}
+
+func isColombia(country string) bool {
+	switch placeKey(country) {
+	case "colombia", "co", "col":
+		return true
+	}
+
+	return false
+}
+
+// validatePlace checks a Colombian department and city against DIVIPOLA,
+// given by code or by name, and sets the official names and codes. Places
+// abroad are kept as written, without codes.
+func (fi *formInfo) validatePlace(errs *fieldErrors) {
+	fi.DepartmentCode, fi.CityCode = strings.TrimSpace(fi.DepartmentCode), strings.TrimSpace(fi.CityCode)
+	if errs.has("country") || !isColombia(fi.Country) {
+		if fi.Department == "" {
+			errs.add("department", "required", 0)
+		}
+		if fi.City == "" {
+			errs.add("city", "required", 0)
+		}
+		fi.DepartmentCode, fi.CityCode = "", ""
+		return
+	}
+	fi.Country = "Colombia"
+
+	dept := fi.DepartmentCode
+	if dept == "" {
+		dept = fi.Department
+	}
+	city := fi.CityCode
+	if city == "" {
+		city = fi.City
+	}
+
+	var d *department
+	if !errs.has("department") {
+		if d = findDepartment(dept); d == nil {
+			errs.add("department", "invalid_choice", 0)
+		}
+	}
+	if errs.has("city") {
+		return
+	}
+
+	candidates := findMunicipalities(city)
+	if len(candidates) == 0 {
+		errs.add("city", "invalid_choice", 0)
+		return
+	}
+	if d == nil {
+		return
+	}
+
+	var m *municipality
+	for _, c := range candidates {
+		if strings.HasPrefix(c.Code, d.Code) {
+			m = c
+			break
+		}
+	}
+	// Bogotá is its own department, but is often put in Cundinamarca
+	if m == nil && d.Code == "25" && candidates[0].Code == "11001" {
+		d, m = departmentsByCode["11"], candidates[0]
+	}
+	if m == nil {
+		errs.add("city", "city_not_in_department", 0)
+		return
+	}
+
+	fi.Department, fi.DepartmentCode = d.Name, d.Code
+	fi.City, fi.CityCode = m.Name, m.Code
+}
+
+// BackfillPlaces gives DIVIPOLA codes and official names to registrations
+// made before places were checked, whose department and city match the way
+// the form would take them. The rest are left as they were. It returns the
+// number of registrations updated, and can be run again safely.
+func BackfillPlaces(ctx context.Context, db *sql.DB) (int, error) {
+	type place struct {
+		id int64
+		fi formInfo
+	}
+
+	rows, err := db.QueryContext(ctx, querySelectUncodedPlaces)
+	if err != nil {
+		return 0, fmt.Errorf("failed to select registrations without place codes: %w", err)
+	}
+	defer rows.Close()
+
+	var places []place
+	for rows.Next() {
+		var p place
+		var country sql.NullString
+		if err := rows.Scan(&p.id, &country, &p.fi.Department, &p.fi.City); err != nil {
+			return 0, fmt.Errorf("failed to scan registration: %w", err)
+		}
+		p.fi.Country = country.String
+		if !isColombia(p.fi.Country) {
+			continue
+		}
+
+		var errs fieldErrors
+		p.fi.validatePlace(&errs)
+		if len(errs) == 0 {
+			places = append(places, p)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to iterate registrations: %w", err)
+	}
+	rows.Close()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	n := 0
+	for _, p := range places {
+		res, err := tx.ExecContext(ctx, queryUpdatePlace, p.id, p.fi.Country, p.fi.Department, p.fi.DepartmentCode, p.fi.City, p.fi.CityCode)
+		if err != nil {
+			return 0, fmt.Errorf("failed to update place of registration %d: %w", p.id, err)
+		}
+		if updated, err := res.RowsAffected(); err == nil {
+			n += int(updated)
+		}
+	}
+
+	return n, tx.Commit()
+}
+
+var reGeoPath = regexp.MustCompile(`^/api/departments(?:/([0-9]{2})/cities)?$`)
+
+// handleGeo serves DIVIPOLA to the frontend's department and city selects:
+// GET /api/departments and GET /api/departments/{code}/cities.
+func (server *Server) handleGeo(w http.ResponseWriter, r *http.Request) {
+	var v interface{} = departments
+	if code := reGeoPath.FindStringSubmatch(r.URL.Path)[1]; code != "" {
+		d := departmentsByCode[code]
+		if d == nil {
+			writeJSON(w, http.StatusNotFound, newAPIError(r, "department_not_found"))
+			return
+		}
+		v = d.Cities
+	}
+
+	// the list only changes with a new release
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "max-age=86400")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("failed to write JSON response: %s", err)
+	}
+}
@@ -0,0 +1,133 @@
+package fileserver
+
+import "testing"
+
+func TestPlaceKey(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{in: "Medellín", want: "medellin"},
+		{in: "  MEDELLIN ", want: "medellin"},
+		{in: "Bogotá, D.C.", want: "bogota"},
+		{in: "Bogota DC", want: "bogota"},
+		{in: "bogotá d.c", want: "bogota"},
+		{in: "San José de Cúcuta", want: "san jose de cucuta"},
+		{in: "Archipiélago de San Andrés, Providencia y Santa Catalina", want: "archipielago de san andres providencia y santa catalina"},
+		{in: "Norte-de-Santander", want: "norte de santander"},
+		{in: "El Carmen de Viboral", want: "el carmen de viboral"},
+		{in: "Ñuñoa", want: "nunoa"},
+		{in: "05001", want: "05001"},
+		{in: "...", want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := placeKey(tt.in); got != tt.want {
+			t.Errorf("placeKey(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestValidatePlace(t *testing.T) {
+	tests := []struct {
+		name                       string
+		fi                         formInfo
+		wantField, wantCode        string
+		wantDept, wantCity         string
+		wantDeptCode, wantCityCode string
+	}{
+		{
+			name:     "by name",
+			fi:       formInfo{Country: "Colombia", Department: "antioquia", City: "medellin"},
+			wantDept: "Antioquia", wantDeptCode: "05", wantCity: "Medellín", wantCityCode: "05001",
+		},
+		{
+			name:     "by code",
+			fi:       formInfo{Country: "CO", DepartmentCode: "76", CityCode: "76001"},
+			wantDept: "Valle del Cauca", wantDeptCode: "76", wantCity: "Cali", wantCityCode: "76001",
+		},
+		{
+			name:     "codes over names",
+			fi:       formInfo{Country: "colombia", Department: "Antioquia", DepartmentCode: "76", City: "Medellín", CityCode: "76001"},
+			wantDept: "Valle del Cauca", wantDeptCode: "76", wantCity: "Cali", wantCityCode: "76001",
+		},
+		{
+			name:     "aliases",
+			fi:       formInfo{Country: "Colombia", Department: "Valle", City: "Santiago de Cali"},
+			wantDept: "Valle del Cauca", wantDeptCode: "76", wantCity: "Cali", wantCityCode: "76001",
+		},
+		{
+			name:     "name repeated across departments",
+			fi:       formInfo{Country: "Colombia", Department: "Quindío", City: "Armenia"},
+			wantDept: "Quindío", wantDeptCode: "63", wantCity: "Armenia", wantCityCode: "63001",
+		},
+		{
+			name:     "same name, other department",
+			fi:       formInfo{Country: "Colombia", Department: "Antioquia", City: "Armenia"},
+			wantDept: "Antioquia", wantDeptCode: "05", wantCity: "Armenia", wantCityCode: "05059",
+		},
+		{
+			name:     "Bogotá put in Cundinamarca",
+			fi:       formInfo{Country: "Colombia", Department: "Cundinamarca", City: "Bogotá D.C."},
+			wantDept: "Bogotá, D.C.", wantDeptCode: "11", wantCity: "Bogotá, D.C.", wantCityCode: "11001",
+		},
+		{
+			name:      "municipality in the wrong department",
+			fi:        formInfo{Country: "Colombia", Department: "Antioquia", City: "Cali"},
+			wantField: "city", wantCode: "city_not_in_department",
+		},
+		{
+			name:      "municipality code in the wrong department",
+			fi:        formInfo{Country: "Colombia", DepartmentCode: "25", CityCode: "76001"},
+			wantField: "city", wantCode: "city_not_in_department",
+		},
+		{
+			name:      "Soacha isn't Bogotá's",
+			fi:        formInfo{Country: "Colombia", Department: "Bogotá", City: "Soacha"},
+			wantField: "city", wantCode: "city_not_in_department",
+		},
+		{
+			name:      "unknown department",
+			fi:        formInfo{Country: "Colombia", Department: "Gondor", City: "Medellín"},
+			wantField: "department", wantCode: "invalid_choice",
+		},
+		{
+			name:      "unknown municipality",
+			fi:        formInfo{Country: "Colombia", Department: "Antioquia", City: "Minas Tirith"},
+			wantField: "city", wantCode: "invalid_choice",
+		},
+		{
+			name:     "abroad, kept as written",
+			fi:       formInfo{Country: "Perú", Department: "Lima", City: "Miraflores", DepartmentCode: "05", CityCode: "05001"},
+			wantDept: "Lima", wantCity: "Miraflores",
+		},
+		{
+			name:      "abroad, no city",
+			fi:        formInfo{Country: "Perú", Department: "Lima"},
+			wantField: "city", wantCode: "required",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fi := tt.fi
+			var errs fieldErrors
+			fi.validatePlace(&errs)
+
+			if tt.wantCode != "" {
+				if len(errs) != 1 || errs[0].Field != tt.wantField || errs[0].Code != tt.wantCode {
+					t.Errorf("errors = %+v, want %s %s", errs, tt.wantField, tt.wantCode)
+				}
+				return
+			}
+			if len(errs) > 0 {
+				t.Fatalf("errors = %+v", errs)
+			}
+
+			if fi.Department != tt.wantDept || fi.DepartmentCode != tt.wantDeptCode || fi.City != tt.wantCity || fi.CityCode != tt.wantCityCode {
+				t.Errorf("place = %q (%q), %q (%q), want %q (%q), %q (%q)",
+					fi.Department, fi.DepartmentCode, fi.City, fi.CityCode,
+					tt.wantDept, tt.wantDeptCode, tt.wantCity, tt.wantCityCode)
+			}
+		})
+	}
+}
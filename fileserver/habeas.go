@@ -0,0 +1,629 @@
+package fileserver
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ajg/form"
+)
+
+// data request links are valid for this long after they're emailed
+const dataRequestLinkTTL = 24 * time.Hour
+
+const dataRequestPurpose = "habeas-data"
+
+// kinds of data_requests rows
+const (
+	dataRequestLink       = "link"
+	dataRequestAccess     = "access"
+	dataRequestCorrection = "correction"
+	dataRequestDeletion   = "deletion"
+	dataRequestWithdrawal = "withdrawal"
+)
+
+const (
+	// one registration per event
+	querySelectDataSubject = `SELECT id, email FROM form_info WHERE id_no=$1 AND lower(email)=lower($2) AND anonymized_time IS NULL`
+
+	queryInsertDataRequest = `INSERT INTO
+	data_requests(form_id, kind, remote_addr, useragent, ctime)
+	VALUES( $1, $2, $3, $4, $5 )`
+
+	querySelectDataRequests = `SELECT kind, ctime FROM data_requests WHERE form_id=$1 ORDER BY ctime`
+
+	querySelectRequestInfos = `SELECT acceptlanguage, cookie, useragent, cfconnectingip, xforwardedfor, cfray, cfipcountry, cfvisitor, url_value, ctime
+	FROM request_info WHERE form_id=$1 ORDER BY ctime`
+
+	queryCorrectRegistration = `UPDATE form_info SET
+		first_name = $2, last_name = $3,
+		country = $4, department = $5, city = $6, neighborhood = $7, street_address = $8,
+		phone = $9, email = $10, newsletter = $11,
+		department_code = $12, city_code = $13
+	WHERE id=$1 AND anonymized_time IS NULL`
+)
+
+var stmtSelectDataSubject *sql.Stmt
+var stmtInsertDataRequest *sql.Stmt
+var stmtSelectDataRequests *sql.Stmt
+var stmtSelectRequestInfos *sql.Stmt
+var stmtCorrectRegistration *sql.Stmt
+
+const tplDataRequest = `
+<!DOCTYPE html>
+<html>
+<style>
+   body {
+		font-size: 24px;
+		max-width: 40em;
+		margin: 20px auto;
+   }
+   input {
+		font-size: 24px;
+		display: block;
+		margin: 10px 0;
+   }
+</style>
+<body>
+<h1>Tus datos personales</h1>
+{{- if .Sent}}
+<p>Si los datos coinciden con un registro, te enviamos un correo con un enlace
+para consultar, corregir o eliminar tu informaci&oacute;n. El enlace vence en 24 horas.</p>
+{{- else}}
+<p>De acuerdo con la Ley 1581 de 2012 puedes conocer, actualizar, rectificar y
+suprimir los datos personales que tenemos sobre ti. Escribe la c&eacute;dula y el
+correo con que te registraste y te enviaremos un enlace.</p>
+<form action="/datos" method="POST">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}" />
+<input name="id_no" placeholder="c&eacute;dula" inputmode="numeric" />
+<input name="email" type="email" placeholder="correo" />
+<input type="submit" value="enviar enlace" />
+</form>
+{{- end}}
+</body>
+</html>
+`
+
+const tplDataSubject = `
+<!DOCTYPE html>
+<html>
+<style>
+   body {
+		font-size: 24px;
+		max-width: 40em;
+		margin: 20px auto;
+   }
+   input {
+		font-size: 24px;
+		margin: 6px 0;
+   }
+   label {
+		display: block;
+   }
+</style>
+<body>
+<h1>Tus datos personales</h1>
+<p>Registro para {{.R.Event}}.</p>
+<p><a href="/datos/{{.Token}}/export">Descargar todos mis datos (JSON)</a></p>
+
+<h2>Corregir</h2>
+<form action="/datos/{{.Token}}/correct" method="POST">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}" />
+<label>Nombre <input name="fname" value="{{.R.FirstName}}" /></label>
+<label>Apellido <input name="lname" value="{{.R.LastName}}" /></label>
+<label>Pa&iacute;s <input name="country" value="{{.R.Country}}" /></label>
+<label>Departamento <input name="department" value="{{.R.Department}}" /></label>
+<label>Ciudad <input name="city" value="{{.R.City}}" /></label>
+<label>Barrio <input name="neighborhood" value="{{.R.Neighborhood}}" /></label>
+<label>Direcci&oacute;n <input name="street_address" value="{{.R.Street}}" /></label>
+<label>Tel&eacute;fono <input name="phone" value="{{.R.Phone}}" /></label>
+<label>Correo <input name="email" type="email" value="{{.R.Email}}" /></label>
+<label><input type="checkbox" name="newsletter" value="true" {{if .R.Newsletter}}checked{{end}} /> Recibir el bolet&iacute;n</label>
+<p>La c&eacute;dula no se puede cambiar aqu&iacute; porque identifica tu boleta; escr&iacute;benos si est&aacute; mal.</p>
+<input type="submit" value="guardar" />
+</form>
+
+<h2>Autorizaci&oacute;n de tratamiento de datos</h2>
+{{- with .R.Consent}}
+<p>Aceptaste la versi&oacute;n {{.Version}} el {{.Accepted.Format "02/01/2006"}} a las {{.Accepted.Format "15:04"}}.</p>
+<details><summary>Ver el texto</summary><p style="white-space: pre-wrap">{{.Text}}</p></details>
+{{- if .Withdrawn}}
+<p>La retiraste el {{.Withdrawn.Format "02/01/2006"}} a las {{.Withdrawn.Format "15:04"}}.</p>
+{{- else}}
+<p>Si la retiras dejaremos de enviarte el bolet&iacute;n y tu registro quedar&aacute; sin autorizaci&oacute;n.
+Para que borremos tus datos, usa Eliminar.</p>
+<form action="/datos/{{$.Token}}/withdraw" method="POST">
+<input type="hidden" name="csrf_token" value="{{$.CSRFToken}}" />
+<input type="submit" value="retirar autorizaci&oacute;n" />
+</form>
+{{- end}}
+{{- else}}
+<p>No tenemos registro de que hayas autorizado el tratamiento de tus datos.</p>
+{{- end}}
+
+<h2>Eliminar</h2>
+<p>Borraremos tu nombre, c&eacute;dula, contacto y direcci&oacute;n de todos nuestros registros.
+Solo conservamos datos estad&iacute;sticos que ya no te identifican. Tu boleta dejar&aacute; de funcionar.</p>
+<form action="/datos/{{.Token}}/delete" method="POST">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}" />
+<label><input type="checkbox" name="confirm" value="yes" required /> Entiendo, eliminar mis datos</label>
+<input type="submit" value="eliminar" />
+</form>
+</body>
+</html>
+`
+
+const tplDataDeleted = `<!DOCTYPE html>
+<html>
+	<body>
+		<h1>Tus datos personales fueron eliminados.</h1>
+	</body>
+</html>
+`
+
+const tplInvalidLink = `<!DOCTYPE html>
+<html>
+	<body>
+		<h1>El enlace no es v&aacute;lido o ya venci&oacute;.</h1>
+		<p><a href="/datos">Solicitar uno nuevo</a></p>
+	</body>
+</html>
+`
+
+var (
+	tmplDataRequest = template.Must(template.New("dataRequest").Parse(tplDataRequest))
+	tmplDataSubject = template.Must(template.New("dataSubject").Parse(tplDataSubject))
+)
+
+type dataRequestPage struct {
+	CSRFToken string
+	Sent      bool
+}
+
+type dataSubjectPage struct {
+	CSRFToken string
+	Token     string
+	R         *registrationDetail
+}
+
+type dataRequestForm struct {
+	ID    uint64 `form:"id_no"`
+	Email string `form:"email"`
+}
+
+// correctionForm holds the fields an attendee can correct themselves, named
+// as in formInfo.
+type correctionForm struct {
+	FirstName    string `form:"fname"`
+	LastName     string `form:"lname"`
+	Country      string `form:"country"`
+	Department   string `form:"department"`
+	City         string `form:"city"`
+	Neighborhood string `form:"neighborhood"`
+	Street       string `form:"street_address"`
+	// DepartmentCode and CityCode come from validate
+	DepartmentCode string `form:"-"`
+	CityCode       string `form:"-"`
+	Phone          string `form:"phone"`
+	Email          string `form:"email"`
+	Newsletter     bool   `form:"newsletter"`
+}
+
+// validate normalizes the correction with the same rules as a new
+// registration. Only the fields the attendee can correct are checked, so
+// rows from before validation existed can still be corrected.
+func (c *correctionForm) validate() fieldErrors {
+	fi := formInfo{
+		FirstName: c.FirstName, LastName: c.LastName, Country: c.Country,
+		Department: c.Department, City: c.City, Neighborhood: c.Neighborhood,
+		Street: c.Street, Phone: c.Phone, Email: c.Email,
+	}
+
+	var all fieldErrors
+	fi.validate(&all)
+
+	c.FirstName, c.LastName, c.Country = fi.FirstName, fi.LastName, fi.Country
+	c.Department, c.City, c.Neighborhood = fi.Department, fi.City, fi.Neighborhood
+	c.DepartmentCode, c.CityCode = fi.DepartmentCode, fi.CityCode
+	c.Street, c.Phone, c.Email = fi.Street, fi.Phone, fi.Email
+
+	var errs fieldErrors
+	for _, fe := range all {
+		switch fe.Field {
+		case "fname", "lname", "country", "department", "city", "neighborhood", "street_address", "phone", "email":
+			errs = append(errs, fe)
+		}
+	}
+
+	return errs
+}
+
+// changed lists the fields the correction changes.
+func (c *correctionForm) changed(d *registrationDetail) []string {
+	fields := []string{}
+	for _, f := range []struct {
+		name     string
+		old, new string
+	}{
+		{"first_name", d.FirstName, c.FirstName},
+		{"last_name", d.LastName, c.LastName},
+		{"country", d.Country, c.Country},
+		{"department", d.Department, c.Department},
+		{"city", d.City, c.City},
+		{"neighborhood", d.Neighborhood, c.Neighborhood},
+		{"street_address", d.Street, c.Street},
+		{"phone", d.Phone, c.Phone},
+		{"email", d.Email, c.Email},
+	} {
+		if strings.TrimSpace(f.new) != f.old {
+			fields = append(fields, f.name)
+		}
+	}
+	if c.Newsletter != d.Newsletter {
+		fields = append(fields, "newsletter")
+	}
+
+	return fields
+}
+
+// requestInfo is a request_info row, as handed to the attendee.
+type requestInfo struct {
+	AcceptLanguage string    `json:"accept_language"`
+	Cookie         string    `json:"cookie"`
+	UserAgent      string    `json:"user_agent"`
+	IP             string    `json:"ip"`
+	ForwardedFor   string    `json:"forwarded_for"`
+	CFRay          string    `json:"cf_ray"`
+	CFCountry      string    `json:"cf_country"`
+	CFVisitor      string    `json:"cf_visitor"`
+	URL            string    `json:"url"`
+	When           time.Time `json:"time"`
+}
+
+type dataRequestEvent struct {
+	Kind string    `json:"kind"`
+	When time.Time `json:"time"`
+}
+
+// subjectData is everything we hold about one attendee.
+type subjectData struct {
+	Registration *registrationDetail `json:"registration"`
+	Requests     []requestInfo       `json:"requests"`
+	DataRequests []dataRequestEvent  `json:"data_requests"`
+}
+
+func writeInvalidLink(w http.ResponseWriter) {
+	w.Header().Add("Content-Type", "text/html")
+	w.WriteHeader(http.StatusNotFound)
+	w.Write([]byte(tplInvalidLink))
+}
+
+func recordDataRequest(ctx context.Context, formID int64, kind string, r *http.Request) {
+	if _, err := stmtInsertDataRequest.ExecContext(ctx, formID, kind, clientIP(r), r.Header.Get("User-Agent"), time.Now()); err != nil {
+		log.Printf("failed to store %s data request for registration %d: %s", kind, formID, err)
+	}
+}
+
+// handleDataRequestForm asks for the ID number and email to send a data
+// request link to.
+func (server *Server) handleDataRequestForm(w http.ResponseWriter, r *http.Request) {
+	token, err := server.csrfToken(w, r)
+	if err != nil {
+		log.Printf("failed to issue CSRF token: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/html")
+	if err := tmplDataRequest.Execute(w, dataRequestPage{CSRFToken: token}); err != nil {
+		log.Printf("failed to execute template for data request: %s", err)
+	}
+}
+
+// handleDataRequest emails a signed link to each registration, one per
+// event, matching both the ID number and email. The answer is the same
+// whether or not one matches, so the form can't be used to find out who
+// registered.
+func (server *Server) handleDataRequest(w http.ResponseWriter, r *http.Request) {
+	var req dataRequestForm
+	dec := form.NewDecoder(nil)
+	dec.IgnoreUnknownKeys(true)
+	if err := dec.DecodeValues(&req, r.PostForm); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	type subject struct {
+		id    int64
+		email string
+	}
+	var subjects []subject
+	rows, err := stmtSelectDataSubject.QueryContext(ctx, req.ID, strings.TrimSpace(req.Email))
+	if err != nil {
+		log.Printf("failed to select registrations for data request: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s subject
+		if err := rows.Scan(&s.id, &s.email); err != nil {
+			log.Printf("failed to scan registration for data request: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		subjects = append(subjects, s)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("failed to iterate registrations for data request: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rows.Close()
+
+	if len(subjects) == 0 {
+		log.Printf("no registration matches data request from %s", clientIP(r))
+	}
+	for _, s := range subjects {
+		id, email := s.id, s.email
+		recordDataRequest(ctx, id, dataRequestLink, r)
+		server.audit(r, "attendee", "data_link", fmt.Sprintf("registration:%d", id), nil, nil)
+		link := siteURL + "/datos/" + server.signToken(dataRequestPurpose, fmt.Sprint(id), time.Now().Add(dataRequestLinkTTL))
+		go func() {
+			if _, _, err := server.sendDataRequestLink(email, link); err != nil {
+				log.Printf("failed to send data request link for registration %d: %s", id, err)
+			}
+		}()
+	}
+
+	w.Header().Add("Content-Type", "text/html")
+	if err := tmplDataRequest.Execute(w, dataRequestPage{Sent: true}); err != nil {
+		log.Printf("failed to execute template for data request: %s", err)
+	}
+}
+
+// handleDataSubject serves the pages behind a data request link:
+// /datos/{token}, and its export, correct and delete actions.
+func (server *Server) handleDataSubject(w http.ResponseWriter, r *http.Request) {
+	token, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/datos/"), "/")
+	// keep the token out of the Referer of any link followed from these pages
+	w.Header().Set("Referrer-Policy", "no-referrer")
+
+	subject, err := server.verifyToken(dataRequestPurpose, token, time.Now())
+	if err != nil {
+		writeInvalidLink(w)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var id int64
+	if _, err := fmt.Sscan(subject, &id); err != nil {
+		writeInvalidLink(w)
+		return
+	}
+	d, err := selectRegistration(ctx, id)
+	if err == sql.ErrNoRows || (err == nil && d.Anonymized) {
+		writeInvalidLink(w)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to select registration %d: %s", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		csrf, err := server.csrfToken(w, r)
+		if err != nil {
+			log.Printf("failed to issue CSRF token: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Add("Content-Type", "text/html")
+		if err := tmplDataSubject.Execute(w, dataSubjectPage{CSRFToken: csrf, Token: token, R: d}); err != nil {
+			log.Printf("failed to execute template for data subject: %s", err)
+		}
+	case action == "export" && r.Method == http.MethodGet:
+		server.exportSubjectData(ctx, w, r, d)
+	case action == "correct" && r.Method == http.MethodPost:
+		server.correctSubjectData(ctx, w, r, d, token)
+	case action == "withdraw" && r.Method == http.MethodPost:
+		if err := withdrawConsent(ctx, server.db, d.ID, r, time.Now()); err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		recordDataRequest(ctx, d.ID, dataRequestWithdrawal, r)
+		server.audit(r, "attendee", "consent_withdrawal", fmt.Sprintf("registration:%d", d.ID), nil, nil)
+		log.Printf("registration %d withdrew its consent", d.ID)
+		http.Redirect(w, r, "/datos/"+token, http.StatusSeeOther)
+	case action == "delete" && r.Method == http.MethodPost:
+		if r.PostForm.Get("confirm") != "yes" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := anonymizeRegistration(ctx, server.db, d.ID, time.Now()); err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		recordDataRequest(ctx, d.ID, dataRequestDeletion, r)
+		server.audit(r, "attendee", "data_deletion", fmt.Sprintf("registration:%d", d.ID), nil, nil)
+		log.Printf("anonymized registration %d at the attendee's request", d.ID)
+		// the place the registration held goes to the waitlist
+		server.promoteWaitlist(ctx, d.EventID)
+		w.Header().Add("Content-Type", "text/html")
+		w.Write([]byte(tplDataDeleted))
+	default:
+		server.serveNotFound(w)
+	}
+}
+
+func (server *Server) exportSubjectData(ctx context.Context, w http.ResponseWriter, r *http.Request, d *registrationDetail) {
+	data := subjectData{Registration: d, Requests: []requestInfo{}, DataRequests: []dataRequestEvent{}}
+
+	rows, err := stmtSelectRequestInfos.QueryContext(ctx, d.ID)
+	if err != nil {
+		log.Printf("failed to select request infos of registration %d: %s", d.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ri requestInfo
+		var s [9]sql.NullString
+		if err := rows.Scan(&s[0], &s[1], &s[2], &s[3], &s[4], &s[5], &s[6], &s[7], &s[8], &ri.When); err != nil {
+			log.Printf("failed to scan request info: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		ri.AcceptLanguage, ri.Cookie, ri.UserAgent, ri.IP, ri.ForwardedFor = s[0].String, s[1].String, s[2].String, s[3].String, s[4].String
+		ri.CFRay, ri.CFCountry, ri.CFVisitor, ri.URL = s[5].String, s[6].String, s[7].String, s[8].String
+		data.Requests = append(data.Requests, ri)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("failed to iterate request infos: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// this request is part of the history it returns
+	recordDataRequest(ctx, d.ID, dataRequestAccess, r)
+	server.audit(r, "attendee", "data_access", fmt.Sprintf("registration:%d", d.ID), nil, nil)
+
+	events, err := stmtSelectDataRequests.QueryContext(ctx, d.ID)
+	if err != nil {
+		log.Printf("failed to select data requests of registration %d: %s", d.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer events.Close()
+	for events.Next() {
+		var e dataRequestEvent
+		if err := events.Scan(&e.Kind, &e.When); err != nil {
+			log.Printf("failed to scan data request: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		data.DataRequests = append(data.DataRequests, e)
+	}
+	if err := events.Err(); err != nil {
+		log.Printf("failed to iterate data requests: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="mis-datos.json"`)
+	w.Header().Set("Cache-Control", "no-store")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(data); err != nil {
+		log.Printf("failed to encode data of registration %d: %s", d.ID, err)
+	}
+}
+
+func (server *Server) correctSubjectData(ctx context.Context, w http.ResponseWriter, r *http.Request, d *registrationDetail, token string) {
+	var c correctionForm
+	dec := form.NewDecoder(nil)
+	dec.IgnoreUnknownKeys(true)
+	if err := dec.DecodeValues(&c, r.PostForm); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if errs := c.validate(); len(errs) > 0 {
+		server.writeFieldErrors(w, r, errs, "/datos/"+token)
+		return
+	}
+
+	if _, err := stmtCorrectRegistration.ExecContext(ctx, d.ID,
+		c.FirstName, c.LastName, c.Country, c.Department, c.City,
+		c.Neighborhood, c.Street, c.Phone, c.Email, c.Newsletter,
+		nullString(c.DepartmentCode), nullString(c.CityCode)); err != nil {
+		log.Printf("failed to correct registration %d: %s", d.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	recordDataRequest(ctx, d.ID, dataRequestCorrection, r)
+	// only the names of the fields: personal data in the append-only log
+	// couldn't be deleted later
+	server.audit(r, "attendee", "data_correction", fmt.Sprintf("registration:%d", d.ID), nil, map[string][]string{"fields": c.changed(d)})
+	log.Printf("registration %d corrected by the attendee", d.ID)
+
+	http.Redirect(w, r, "/datos/"+token, http.StatusSeeOther)
+}
+
+// anonymizeRegistration erases everything identifying about a registration
+// across all tables, keeping what the aggregate statistics need: place,
+// gender, age, consumption, gift box, claimed and registration time.
+func anonymizeRegistration(ctx context.Context, db *sql.DB, id int64, now time.Time) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin anonymizing registration %d: %w", id, err)
+	}
+	defer tx.Rollback()
+
+	var idNo sql.NullInt64
+	var hash, first, last, email, phone sql.NullString
+	if err := tx.QueryRowContext(ctx, `SELECT id_no, id_hash, first_name, last_name, email, phone FROM form_info WHERE id=$1 FOR UPDATE`, id).
+		Scan(&idNo, &hash, &first, &last, &email, &phone); err != nil {
+		return fmt.Errorf("failed to select registration %d to anonymize: %w", id, err)
+	}
+	var idText string
+	if idNo.Valid {
+		idText = strconv.FormatInt(idNo.Int64, 10)
+	}
+
+	steps := []struct {
+		query string
+		args  []interface{}
+	}{
+		{`UPDATE form_info SET
+			first_name = NULL, last_name = NULL, neighborhood = NULL, street_address = NULL,
+			id_no = NULL, phone = NULL, email = NULL, id_hash = NULL, newsletter = FALSE, answers = NULL, birth_date = NULL,
+			anonymized_time = $2
+		WHERE id=$1`, []interface{}{id, now}},
+		{`UPDATE email_status SET email_address = NULL, gov_id = NULL WHERE form_id=$1`, []interface{}{id}},
+		// the staff's searches that would have found the registration; how
+		// many results they had is kept
+		{`UPDATE lookup_log SET query = NULL WHERE query IS NOT NULL AND (
+			trim(query) = $1
+			OR ($2 <> '' AND strpos($2, lower(trim(query))) > 0)
+			OR ($3 <> '' AND regexp_replace(query, '\D', '', 'g') <> '' AND strpos($3, regexp_replace(query, '\D', '', 'g')) > 0)
+			OR ($4 <> '' AND strpos($4, ` + foldSQL("trim(query)") + `) > 0))`, []interface{}{
+			idText, strings.ToLower(email.String), digitsOnly(phone.String),
+			foldAccents(strings.ToLower(strings.TrimSpace(first.String + " " + last.String))),
+		}},
+		{`UPDATE claims SET id_hash = NULL WHERE id_hash=$1`, []interface{}{hash.String}},
+		{`DELETE FROM request_info WHERE form_id=$1`, []interface{}{id}},
+		{`DELETE FROM registration_conflicts WHERE form_id=$1`, []interface{}{id}},
+		// which version was accepted, and when, is kept as proof
+		{`UPDATE consents SET remote_addr = NULL, useragent = NULL, withdrawn_addr = NULL, withdrawn_useragent = NULL WHERE form_id=$1`, []interface{}{id}},
+	}
+	for _, s := range steps {
+		if _, err := tx.ExecContext(ctx, s.query, s.args...); err != nil {
+			return fmt.Errorf("failed to anonymize registration %d: %w", id, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit anonymizing registration %d: %w", id, err)
+	}
+
+	return nil
+}
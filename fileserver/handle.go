@@ -2,7 +2,8 @@ package fileserver
 
 import (
 	"context"
-	"crypto/md5"
+	"database/sql"
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
@@ -22,30 +23,63 @@ type Login struct {
 }
 
 type formInfo struct {
-	FirstName    string `form:"fname"`
-	LastName     string `form:"lname"`
-	Country      string `form:"country"`
-	Department   string `form:"department"`
-	City         string `form:"city"`
-	Neighborhood string `form:"neighborhood"`
-	Street       string `form:"street_address"`
-	ID           uint64 `form:"id_no"`
-	Phone        string `form:"phone"`
-	Email        string `form:"email"`
-	Gender       string `form:"gender"`
-	Age          uint16 `form:"age"`
-	DailyQty     string `form:"daily_qty"`
-	WeeklyQty    string `form:"weekly_qty"`
-	MonthlyQty   string `form:"monthly_qty"`
-	Newsletter   bool   `form:"newsletter"`
-	GiftBox      bool   `form:"gift_box"`
-	Authorized   bool   `form:"authorized"`
+	FirstName  string `form:"fname"`
+	LastName   string `form:"lname"`
+	Country    string `form:"country"`
+	Department string `form:"department"`
+	City       string `form:"city"`
+	// DepartmentCode and CityCode are DANE DIVIPOLA codes, set for places in
+	// Colombia
+	DepartmentCode string `form:"department_code"`
+	CityCode       string `form:"city_code"`
+	Neighborhood   string `form:"neighborhood"`
+	Street         string `form:"street_address"`
+	ID             uint64 `form:"id_no"`
+	Phone          string `form:"phone"`
+	Email          string `form:"email"`
+	Gender         string `form:"gender"`
+	Age            uint16 `form:"age"`
+	// BirthDate, when given, is checked and stored as YYYY-MM-DD
+	BirthDate  string `form:"birth_date"`
+	DailyQty   string `form:"daily_qty"`
+	WeeklyQty  string `form:"weekly_qty"`
+	MonthlyQty string `form:"monthly_qty"`
+	Newsletter bool   `form:"newsletter"`
+	GiftBox    bool   `form:"gift_box"`
+	Authorized bool   `form:"authorized"`
+	// ConsentVersion is the version of the authorization text shown; empty
+	// means the current one
+	ConsentVersion string `form:"consent_version"`
+	// Answers holds the answers to the custom questions of the form schema
+	Answers map[string]interface{} `form:"-" json:",omitempty"`
+	// EventID is the event registered for
+	EventID int64 `form:"-"`
+	// consent is set by register
+	consent *consentAcceptance
 }
 
 const tplLoggedIn = `<!DOCTYPE html>
 <html>
 	<body>
 		<h1>Conectado ... Puede salir de esta p&aacute;gina ahora.</h1>
+		<p><a href="/claim/search">Buscar asistente sin QR</a></p>
+		<p><a href="/admin/registrations">Registros</a></p>
+		<p><a href="/admin/events">Eventos</a></p>
+		<p><a href="/admin/consents">Autorizaciones de datos</a></p>
+		<p><a href="/admin/conflicts">Registros en conflicto</a></p>
+		<p><a href="/admin/logins">Intentos fallidos de ingreso</a></p>
+		<p><a href="/admin/audit">Registro de auditor&iacute;a</a></p>
+		<p><a href="/admin/devices">Llaves de estaciones de escaneo</a></p>
+		<p><a href="/admin/2fa">Verificaci&oacute;n en dos pasos</a></p>
+		<form method="POST" action="/logout">
+		<input type="hidden" name="csrf_token" value="{{.CSRFToken}}" />
+		<input type="submit" value="salir" />
+		</form>
+		<form method="POST" action="/logout">
+		<input type="hidden" name="csrf_token" value="{{.CSRFToken}}" />
+		<input type="hidden" name="all" value="1" />
+		<input type="submit" value="cerrar todas las sesiones" />
+		</form>
 	</body>
 </html>`
 
@@ -76,11 +110,20 @@ const loginForm = `
    }
 </style>
 <body>
+{{- if .Password}}
 <form action="/login" method="POST">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}" />
 <input name="username" placeholder="username" />
-<input name="password" placeholder="password" />
+<input name="password" type="password" placeholder="password" />
 <input type="submit" />
 </form>
+{{- end}}
+{{- if .OIDC}}
+<p style="font-size: 54px; margin: 40px"><a href="/login/oidc">Ingresar con SSO</a></p>
+{{- end}}
+{{- if .SAML}}
+<p style="font-size: 54px; margin: 40px"><a href="/login/saml">Ingresar con su instituci&oacute;n</a></p>
+{{- end}}
 </body>
 </html>
 `
@@ -94,6 +137,7 @@ const tplAlreadyClaimed = `
 </style>
 <html>
 	<body style="background-color: #F88685">
+		<h1> {{.Event}} </h1>
 		<p> {{.First}} {{.Last}} </p>
 		<p> {{.ID}} </p>
 	</body>
@@ -109,67 +153,147 @@ const tplClaim = `
 </style>
 <html>
 	<body style="background-color: #C8F5C6">
+		<h1> {{.Event}} </h1>
+		{{- if .AgeNote}}
+		<h1 style="background-color: #FFD54F"> Verificar edad en la c&eacute;dula: {{.AgeNote}} </h1>
+		{{- end}}
 		<p> {{.First}} {{.Last}} </p>
 		<p> {{.ID}} </p>
 		<form  method="POST" action="/claim/{{.Hash}}">
+		<input type="hidden" name="csrf_token" value="{{.CSRFToken}}" />
 		<input type="submit" value="reclamar" />
 		</form>
 	</body>
 </html>
 `
 
+var (
+	tmplLoggedIn = template.Must(template.New("loggedIn").Parse(tplLoggedIn))
+	tmplLogin    = template.Must(template.New("login").Parse(loginForm))
+)
+
 type user struct {
-	First string
-	Last  string
-	ID    uint64
-	Hash  string
+	First     string
+	Last      string
+	ID        uint64
+	Hash      string
+	CSRFToken string
+	Event     string
+	// AgeNote asks staff to check the cédula when the age is borderline
+	AgeNote string
 }
 
-func (server *Server) handleForm(w http.ResponseWriter, r *http.Request) {
-	var fi formInfo
-	dec := form.NewDecoder(r.Body)
-	dec.IgnoreUnknownKeys(true)
-	if err := dec.Decode(&fi); err != nil {
+type loginPage struct {
+	CSRFToken string
+	Password  bool
+	OIDC      bool
+	SAML      bool
+}
+
+// handleForm registers an attendee for the event with the given slug from
+// the HTML form.
+func (server *Server) handleForm(w http.ResponseWriter, r *http.Request, slug string) {
+	ev := server.requestEvent(w, slug)
+	if ev == nil {
+		return
+	}
+	// before the challenge, which a closed event shouldn't spend
+	if status := ev.status(time.Now()); status != eventOpen {
+		writeEventClosed(w, ev, status)
+		return
+	}
+
+	// the body has already been parsed into r.PostForm by checkCSRF
+	if err := server.checkChallenge(r, r.PostForm); err == errChallengeFailed {
+		w.Header().Add("Content-Type", "text/html")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(tplChallengeFailed))
+		return
+	} else if err != nil {
+		log.Printf("failed to check challenge: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	fi, errs, err := decodeFormInfo(r.PostForm, server.schema, ev, server.eventMinAge(ev))
+	if err != nil {
 		log.Printf("failed to decode form: %s", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	if errs.underAge() && !strings.Contains(r.Header.Get("Accept"), "application/json") {
+		writeUnderAge(w, ev, server.eventMinAge(ev))
+		return
+	}
+	if len(errs) > 0 {
+		server.writeFieldErrors(w, r, errs, "/form")
+		return
+	}
 
-	hash := md5.Sum([]byte(fmt.Sprintf("%d", fi.ID)))
-
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
-	defer cancel()
-	if err := saveFormInfo(ctx, &fi, hash); err != nil {
-		// has this ID already submitted an ID?
-		if strings.Contains(err.Error(), "duplicate") {
-			http.Redirect(w, r, "/", http.StatusSeeOther)
-			return
-		}
+	_, _, err = server.register(r, ev, &fi)
+	var dup *duplicateError
+	if errors.As(err, &dup) {
+		server.writeAlreadyRegistered(w, r, dup)
+		return
+	}
+	if err == errEventNotOpen || err == errEventClosed || err == errEventPaused {
+		// it closed while the form was being checked
+		writeEventClosed(w, ev, ev.status(time.Now()))
+		return
+	}
+	if err == errUnknownConsent {
+		server.writeFieldErrors(w, r, fieldErrors{{Field: "authorized", Code: "unknown_consent_version"}}, "/form")
+		return
+	}
+	if err != nil {
 		log.Printf("failed to save form: %+v: %s", fi, err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	if fi.Authorized {
-		go saveRequestInfo(r.Header, r.URL)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
 
-		go func() {
-			msg, id, err := server.sendEmail(fi.Email, hash)
+// register stores a validated registration for ev and emails the link
+// confirming it; the ticket follows once it's confirmed. It returns the
+// registration's ID and whether it went to the waitlist, the error of
+// ev.checkOpen if ev doesn't take registrations, errUnknownConsent if the
+// authorization version isn't known, or a *duplicateError if it
+// matches an existing one, in which case the submission may be queued for an
+// admin to review.
+func (server *Server) register(r *http.Request, ev *event, fi *formInfo) (int64, bool, error) {
+	now := time.Now()
+	if err := ev.checkOpen(now); err != nil {
+		return 0, false, err
+	}
+	fi.EventID = ev.ID
 
-			var errString string
-			if err != nil {
-				errString = err.Error()
-			}
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
 
-			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-			defer cancel()
-			if _, err := stmtInsertEmailStatus.ExecContext(ctx, fi.Email, fi.ID, msg, id, errString, time.Now()); err != nil {
-				log.Printf("failed to store email status info in DB (%s, %d): %s", fi.Email, fi.ID, err)
-			}
-		}()
+	if err := acceptConsent(ctx, r, fi, now); err != nil {
+		return 0, false, err
 	}
 
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	// an unconfirmed registration mustn't hold on to the ID number for good,
+	// and the places the expired ones held go to the waitlist first
+	server.deleteUnverified(ctx, now)
+
+	formID, waitlisted, err := server.saveFormInfo(ctx, ev, fi, ticketHash(ev.ID, fi.ID))
+	var dup *duplicateError
+	if errors.As(err, &dup) {
+		recordConflict(ctx, r, fi, dup)
+		return 0, false, dup
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	go saveRequestInfo(r.Header, r.URL, sql.NullInt64{Int64: formID, Valid: true})
+
+	go server.sendVerification(formID, fi.Email, fi.ID, now)
+
+	return formID, waitlisted, nil
 }
 
 func (server *Server) handleFrontendPath(w http.ResponseWriter, r *http.Request) {
@@ -224,14 +348,29 @@ func (server *Server) handleFrontendPath(w http.ResponseWriter, r *http.Request)
 }
 
 func (server *Server) handleQRInbound(w http.ResponseWriter, r *http.Request) {
-	go saveRequestInfo(r.Header, r.URL)
+	go saveRequestInfo(r.Header, r.URL, sql.NullInt64{})
 
 	http.Redirect(w, r, "/form", http.StatusSeeOther)
 }
 
+// handleLogin serves the login form, or the logged in page when the request
+// already has a session.
 func (server *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	token, err := server.csrfToken(w, r)
+	if err != nil {
+		log.Printf("failed to issue CSRF token: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	tmpl := tmplLogin
+	if server.currentSession(r) != nil {
+		tmpl = tmplLoggedIn
+	}
+
 	w.Header().Add("Content-Type", "text/html")
-	if _, err := w.Write([]byte(loginForm)); err != nil {
+	page := loginPage{token, server.passwordLogin, server.oidc != nil, server.saml != nil}
+	if err := tmpl.Execute(w, page); err != nil {
 		log.Printf("failed to serve login form: %s", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -239,53 +378,83 @@ func (server *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 }
 
 func (server *Server) handleLoginRequest(w http.ResponseWriter, r *http.Request) {
+	if !server.passwordLogin {
+		writeForbidden(w)
+		return
+	}
+
 	var li Login
-	if err := form.NewDecoder(r.Body).Decode(&li); err != nil {
+	dec := form.NewDecoder(nil)
+	dec.IgnoreUnknownKeys(true)
+	if err := dec.DecodeValues(&li, r.PostForm); err != nil {
 		log.Printf("failed to decode form from body: %s", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	if !(li.Username == server.adminUser && li.Password == server.adminPassword) {
-		log.Println("rejected invalid login attempt")
-		w.Header().Add("Content-Type", "text/html")
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte(tplUnauthorized))
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	ip := clientIP(r)
+	now := time.Now()
+	tx, wait, err := beginLoginAttempt(ctx, server.db, li.Username, ip, now)
+	if err != nil {
+		log.Printf("failed to check login throttling: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if wait > 0 {
+		log.Printf("throttled login attempt for %s from %s", li.Username, ip)
+		writeTooManyAttempts(w, wait)
 		return
 	}
 
-	now := time.Now()
-	until := now.Add(24 * time.Hour)
+	a, err := authenticate(ctx, li.Username, li.Password)
+	if err == errInvalidCredentials {
+		log.Printf("rejected invalid login attempt for %s from %s", li.Username, ip)
+		if err := server.recordLoginFailure(ctx, tx, li.Username, ip, r.Header.Get("User-Agent"), now); err != nil {
+			log.Print(err)
+		}
+		server.audit(r, li.Username, "login_failed", "", nil, map[string]string{"method": "password"})
+		writeUnauthorized(w)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to authenticate admin %s: %s", li.Username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:    "Shibboleth",
-		Value:   server.shibboleth,
-		Expires: until,
-	})
+	if server.needsSecondFactor(a) {
+		if err := server.startSession(ctx, w, r, a, true); err != nil {
+			log.Printf("failed to start session: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
 
-	w.Header().Add("Content-Type", "text/html")
-	w.Write([]byte(tplLoggedIn))
-}
+		http.Redirect(w, r, "/login/totp", http.StatusSeeOther)
+		return
+	}
 
-func (server *Server) handleGetUserInfo(w http.ResponseWriter, r *http.Request) {
-	if len(r.Cookies()) == 0 {
-		w.Header().Add("Content-Type", "text/html")
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte(tplUnauthorized))
+	if err := recordLoginSuccess(ctx, tx, a.Username, ip, r.Header.Get("User-Agent"), now); err != nil {
+		log.Print(err)
+	}
+	server.audit(r, a.Username, "login", "", nil, map[string]string{"method": "password"})
+
+	if err := server.startSession(ctx, w, r, a, false); err != nil {
+		log.Printf("failed to start session: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	for i, cook := range r.Cookies() {
-		if cook.Name == "Shibboleth" && cook.Value == server.shibboleth {
-			break
-		}
-		// we're on the last cookie and we didn't see what we need to see
-		if i == len(r.Cookies())-1 {
-			w.Header().Add("Content-Type", "text/html")
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte(tplUnauthorized))
-			return
-		}
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+func (server *Server) handleGetUserInfo(w http.ResponseWriter, r *http.Request) {
+	a := server.requirePermission(w, r, permViewAttendee)
+	if a == nil {
+		return
 	}
 
 	hash := strings.TrimPrefix(r.URL.Path, "/users/")
@@ -299,14 +468,18 @@ func (server *Server) handleGetUserInfo(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	var id int64
 	var first string
 	var last string
 	var gov_id uint64
 	var claimed bool
+	var event string
+	var age, eventMinAge sql.NullInt64
+	var birth sql.NullTime
 
 	var cnt int
 	for rows.Next() {
-		if err := rows.Scan(&first, &last, &gov_id, &claimed); err != nil {
+		if err := rows.Scan(&id, &first, &last, &gov_id, &claimed, &event, &age, &birth, &eventMinAge); err != nil {
 			log.Printf("failed to scan user: %s", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
@@ -320,6 +493,13 @@ func (server *Server) handleGetUserInfo(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
+	// the hash is derived from the ID number, so it stays out of the log
+	target := ""
+	if cnt > 0 {
+		target = fmt.Sprintf("registration:%d", id)
+	}
+	server.audit(r, a.Username, "view_attendee", target, nil, map[string]bool{"found": cnt > 0})
+
 	if cnt == 0 {
 		w.Header().Add("Content-Type", "text/html")
 		w.WriteHeader(http.StatusNotFound)
@@ -327,7 +507,25 @@ func (server *Server) handleGetUserInfo(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	u := user{first, last, gov_id, hash}
+	token, err := server.csrfToken(w, r)
+	if err != nil {
+		log.Printf("failed to issue CSRF token: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var declared *int
+	if age.Valid {
+		a := int(age.Int64)
+		declared = &a
+	}
+	var born *time.Time
+	if birth.Valid {
+		born = &birth.Time
+	}
+	note := ageNote(declared, born, server.effectiveMinAge(int(eventMinAge.Int64)), time.Now())
+
+	u := user{first, last, gov_id, hash, token, event, note}
 
 	if claimed {
 		t, err := template.New("alreadyClaimed").Parse(tplAlreadyClaimed)
@@ -353,24 +551,47 @@ func (server *Server) handleGetUserInfo(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+func writeUnauthorized(w http.ResponseWriter) {
+	w.Header().Add("Content-Type", "text/html")
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write([]byte(tplUnauthorized))
+}
+
 func (server *Server) updateClaim(w http.ResponseWriter, r *http.Request) {
+	a := server.requirePermission(w, r, permClaim)
+	if a == nil {
+		return
+	}
+
 	hash := strings.TrimPrefix(r.URL.Path, "/claim/")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
-	_, err := stmtUpdateClaim.QueryContext(ctx, hash)
-	if err != nil {
+	// only the claim that flips the flag goes into the history
+	var id int64
+	err := stmtUpdateClaim.QueryRowContext(ctx, hash).Scan(&id)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
 		log.Printf("failed to select from form_info for hash %s: %s", hash, err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
+	default:
+		if _, err := stmtInsertClaim.ExecContext(ctx, hash, a.Username, clientIP(r), r.Header.Get("User-Agent"), time.Now()); err != nil {
+			log.Printf("failed to store claim of ticket %s: %s", hash, err)
+		}
+		log.Printf("admin %s claimed ticket %s", a.Username, hash)
+		server.audit(r, a.Username, "claim", fmt.Sprintf("registration:%d", id), map[string]bool{"claimed": false}, map[string]bool{"claimed": true})
 	}
 
 	http.Redirect(w, r, fmt.Sprintf("/users/%s", hash), http.StatusSeeOther)
 }
 
-func saveRequestInfo(hdrs http.Header, url *url.URL) {
+// saveRequestInfo stores the headers of a request, tied to the registration
+// it made, if any.
+func saveRequestInfo(hdrs http.Header, url *url.URL, formID sql.NullInt64) {
 	acceptlanguage := hdrs.Get("Accept-Language")
-	cookie := hdrs.Get("Cookie")
+	cookie := cookieNames(hdrs.Get("Cookie"))
 	useragent := hdrs.Get("User-Agent")
 	cfconnectingip := hdrs.Get("CF-Connecting-IP")
 	xforwardedfor := hdrs.Get("X-Forwarded-For")
@@ -384,18 +605,22 @@ func saveRequestInfo(hdrs http.Header, url *url.URL) {
 	if _, err := stmtInsertQRIncomingHeaders.ExecContext(ctx,
 		acceptlanguage, cookie, useragent,
 		cfconnectingip, xforwardedfor, cfray, cfipcountry, cfvisitor,
-		u,
+		u, formID,
 		time.Now()); err != nil {
 		log.Printf("failed to save request infos: %s", err)
 	}
 }
 
-func saveFormInfo(ctx context.Context, f *formInfo, hash [16]byte) error {
-	_, err := stmtInsertFormRow.ExecContext(ctx, f.FirstName, f.LastName,
-		f.Country, f.Department, f.City, f.Neighborhood, f.Street,
-		f.ID, f.Phone, f.Email, f.Gender, f.Age,
-		f.DailyQty, f.WeeklyQty, f.MonthlyQty,
-		f.Newsletter, f.GiftBox, f.Authorized, false, fmt.Sprintf("%x", hash), time.Now())
+// cookieNames strips the values from a Cookie header, which carry session
+// and CSRF tokens, keeping the names.
+func cookieNames(header string) string {
+	var names []string
+	for _, c := range strings.Split(header, ";") {
+		name, _, _ := strings.Cut(c, "=")
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
 
-	return err
+	return strings.Join(names, "; ")
 }
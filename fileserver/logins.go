@@ -0,0 +1,375 @@
+package fileserver
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// failures are only counted inside loginWindow, and only since the last
+	// successful login
+	loginWindow = 15 * time.Minute
+	// after loginFreeAttempts failures each further attempt has to wait twice
+	// as long as the previous one, up to loginMaxDelay
+	loginFreeAttempts = 3
+	loginMaxDelay     = time.Minute
+	// accountLockThreshold failures lock the account for accountLockDuration
+	// and notify its owner
+	accountLockThreshold = 10
+	accountLockDuration  = 30 * time.Minute
+	// ipBlockThreshold failures from one address block it for the rest of the
+	// window, whichever usernames were tried
+	ipBlockThreshold = 30
+)
+
+const (
+	queryInsertLoginAttempt = `INSERT INTO
+	login_attempts(username, remote_addr, useragent, success, ctime)
+	VALUES( $1, $2, $3, $4, $5 )`
+
+	queryCountUserFailures = `SELECT count(*), max(ctime) FROM login_attempts
+	WHERE username=$1 AND NOT success AND ctime > $2
+		AND ctime > COALESCE((SELECT max(ctime) FROM login_attempts WHERE username=$1 AND success), '-infinity')`
+
+	queryCountIPFailures = `SELECT count(*), max(ctime) FROM login_attempts
+	WHERE remote_addr=$1 AND NOT success AND ctime > $2`
+
+	querySelectAdminLock = `SELECT locked_until, email FROM admins WHERE username=$1`
+
+	queryLockAdmin = `UPDATE admins SET locked_until = $2 WHERE username=$1`
+
+	querySelectFailedLogins = `SELECT username, remote_addr, useragent, ctime FROM login_attempts
+	WHERE NOT success ORDER BY ctime DESC LIMIT 200`
+
+	// held until the end of the transaction
+	queryLockLoginAttempts = `SELECT pg_advisory_xact_lock(hashtext($1))`
+)
+
+var stmtInsertLoginAttempt *sql.Stmt
+var stmtCountUserFailures *sql.Stmt
+var stmtCountIPFailures *sql.Stmt
+var stmtSelectAdminLock *sql.Stmt
+var stmtLockAdmin *sql.Stmt
+var stmtSelectFailedLogins *sql.Stmt
+
+const tplTooManyAttempts = `<!DOCTYPE html>
+<html>
+	<body>
+		<h1>Demasiados intentos. Intente de nuevo en {{.}}.</h1>
+	</body>
+</html>
+`
+
+const tplFailedLogins = `
+<!DOCTYPE html>
+<html>
+<style>
+   td, th {
+		padding: 4px 12px;
+		text-align: left;
+   }
+</style>
+<body>
+<h1>Intentos fallidos de ingreso</h1>
+<table>
+	<tr><th>Fecha</th><th>Usuario</th><th>IP</th><th>Navegador</th></tr>
+	{{- range .}}
+	<tr>
+		<td>{{.When.Format "2006-01-02 15:04:05"}}</td>
+		<td>{{.Username}}</td>
+		<td>{{.RemoteAddr}}</td>
+		<td>{{.UserAgent}}</td>
+	</tr>
+	{{- end}}
+</table>
+</body>
+</html>
+`
+
+var (
+	tmplTooManyAttempts = template.Must(template.New("tooManyAttempts").Parse(tplTooManyAttempts))
+	tmplFailedLogins    = template.Must(template.New("failedLogins").Parse(tplFailedLogins))
+)
+
+type loginAttempt struct {
+	Username   string
+	RemoteAddr string
+	UserAgent  string
+	When       time.Time
+}
+
+// cloudflareRanges are the networks Cloudflare connects from, as published at
+// https://www.cloudflare.com/ips/.
+var cloudflareRanges = []string{
+	"173.245.48.0/20", "103.21.244.0/22", "103.22.200.0/22", "103.31.4.0/22",
+	"141.101.64.0/18", "108.162.192.0/18", "190.93.240.0/20", "188.114.96.0/20",
+	"197.234.240.0/22", "198.41.128.0/17", "162.158.0.0/15", "104.16.0.0/13",
+	"104.24.0.0/14", "172.64.0.0/13", "131.0.72.0/22",
+	"2400:cb00::/32", "2606:4700::/32", "2803:f800::/32", "2405:b500::/32",
+	"2405:8100::/32", "2a06:98c0::/29", "2c0f:f248::/32",
+}
+
+var cloudflareNets = mustParseCIDRs(cloudflareRanges)
+
+func mustParseCIDRs(cidrs []string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+
+	return nets
+}
+
+type clientIPKey struct{}
+
+// withClientIP tags the request with the client's address. It prefers the
+// address Cloudflare saw, as saveRequestInfo does, over the address of the
+// proxy that connected to us. Anyone can send the header, so it's only
+// believed from a trusted proxy.
+func (server *Server) withClientIP(r *http.Request) *http.Request {
+	host := remoteHost(r)
+	if ip := strings.TrimSpace(r.Header.Get("CF-Connecting-IP")); ip != "" && net.ParseIP(ip) != nil && server.isTrustedProxy(host) {
+		host = ip
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), clientIPKey{}, host))
+}
+
+// clientIP is the address withClientIP found, or the peer's for requests
+// it didn't see.
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+
+	return remoteHost(r)
+}
+
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+func (server *Server) isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range server.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// progressiveDelay is how long to wait after the last of n failures.
+func progressiveDelay(n int) time.Duration {
+	if n < loginFreeAttempts {
+		return 0
+	}
+
+	delay := time.Second << uint(n-loginFreeAttempts)
+	if delay > loginMaxDelay || delay <= 0 {
+		return loginMaxDelay
+	}
+
+	return delay
+}
+
+// beginLoginAttempt starts the transaction in which a login attempt for
+// username from ip is judged and recorded, and returns how long the client
+// has to wait before the attempt is considered, or zero. The transaction
+// locks the username and the address until it ends, so that concurrent
+// attempts are judged one after another, each counting the failures of those
+// before it.
+func beginLoginAttempt(ctx context.Context, db *sql.DB, username, ip string, now time.Time) (*sql.Tx, time.Duration, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to begin login attempt: %w", err)
+	}
+
+	// always the address first, so that attempts can't deadlock
+	for _, key := range []string{"login_ip:" + ip, "login_user:" + username} {
+		if _, err := tx.ExecContext(ctx, queryLockLoginAttempts, key); err != nil {
+			tx.Rollback()
+			return nil, 0, fmt.Errorf("failed to lock login attempts: %w", err)
+		}
+	}
+
+	wait, err := loginWait(ctx, tx, username, ip, now)
+	if err != nil {
+		tx.Rollback()
+		return nil, 0, err
+	}
+
+	return tx, wait, nil
+}
+
+// loginWait returns how long the client has to wait before another login
+// attempt for username is considered, or zero.
+func loginWait(ctx context.Context, tx *sql.Tx, username, ip string, now time.Time) (time.Duration, error) {
+	var wait time.Duration
+
+	var lockedUntil sql.NullTime
+	var email sql.NullString
+	err := tx.StmtContext(ctx, stmtSelectAdminLock).QueryRowContext(ctx, username).Scan(&lockedUntil, &email)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, fmt.Errorf("failed to select lock of admin %s: %w", username, err)
+	}
+	if lockedUntil.Valid && lockedUntil.Time.After(now) {
+		wait = lockedUntil.Time.Sub(now)
+	}
+
+	var n int
+	var last sql.NullTime
+	if err := tx.StmtContext(ctx, stmtCountUserFailures).QueryRowContext(ctx, username, now.Add(-loginWindow)).Scan(&n, &last); err != nil {
+		return 0, fmt.Errorf("failed to count login failures of %s: %w", username, err)
+	}
+	if d := last.Time.Add(progressiveDelay(n)).Sub(now); last.Valid && d > wait {
+		wait = d
+	}
+
+	if err := tx.StmtContext(ctx, stmtCountIPFailures).QueryRowContext(ctx, ip, now.Add(-loginWindow)).Scan(&n, &last); err != nil {
+		return 0, fmt.Errorf("failed to count login failures from %s: %w", ip, err)
+	}
+	if n >= ipBlockThreshold {
+		if d := last.Time.Add(loginWindow).Sub(now); d > wait {
+			wait = d
+		}
+	} else if d := last.Time.Add(progressiveDelay(n)).Sub(now); last.Valid && d > wait {
+		wait = d
+	}
+
+	return wait, nil
+}
+
+// recordLoginFailure stores a failed attempt in the transaction of
+// beginLoginAttempt, and locks the account once it has failed
+// accountLockThreshold times in the window. It ends the transaction.
+func (server *Server) recordLoginFailure(ctx context.Context, tx *sql.Tx, username, ip, userAgent string, now time.Time) error {
+	defer tx.Rollback()
+
+	if _, err := tx.StmtContext(ctx, stmtInsertLoginAttempt).ExecContext(ctx, username, ip, userAgent, false, now); err != nil {
+		return fmt.Errorf("failed to store login attempt: %w", err)
+	}
+
+	var n int
+	var last sql.NullTime
+	if err := tx.StmtContext(ctx, stmtCountUserFailures).QueryRowContext(ctx, username, now.Add(-loginWindow)).Scan(&n, &last); err != nil {
+		return fmt.Errorf("failed to count login failures of %s: %w", username, err)
+	}
+	if n < accountLockThreshold {
+		return tx.Commit()
+	}
+
+	until := now.Add(accountLockDuration)
+	res, err := tx.StmtContext(ctx, stmtLockAdmin).ExecContext(ctx, username, until)
+	if err != nil {
+		return fmt.Errorf("failed to lock admin %s: %w", username, err)
+	}
+	if locked, _ := res.RowsAffected(); locked == 0 {
+		// nobody to notify about attempts on a username that doesn't exist
+		return tx.Commit()
+	}
+
+	var lockedUntil sql.NullTime
+	var email sql.NullString
+	if err := tx.StmtContext(ctx, stmtSelectAdminLock).QueryRowContext(ctx, username).Scan(&lockedUntil, &email); err != nil {
+		return fmt.Errorf("failed to select email of admin %s: %w", username, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to store login attempt: %w", err)
+	}
+
+	log.Printf("locked admin %s until %s after %d failed logins, the last from %s", username, until.Format(time.RFC3339), n, ip)
+	if email.String == "" {
+		return nil
+	}
+
+	go func() {
+		if _, _, err := server.sendLockoutNotice(email.String, username, ip, userAgent, until); err != nil {
+			log.Printf("failed to notify admin %s of lockout: %s", username, err)
+		}
+	}()
+
+	return nil
+}
+
+// recordLoginSuccess stores a successful attempt, which resets the count of
+// failures, in the transaction of beginLoginAttempt, and ends it.
+func recordLoginSuccess(ctx context.Context, tx *sql.Tx, username, ip, userAgent string, now time.Time) error {
+	defer tx.Rollback()
+
+	if _, err := tx.StmtContext(ctx, stmtInsertLoginAttempt).ExecContext(ctx, username, ip, userAgent, true, now); err != nil {
+		return fmt.Errorf("failed to store login attempt: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+func writeTooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	wait = wait.Round(time.Second)
+	if wait < time.Second {
+		wait = time.Second
+	}
+
+	w.Header().Add("Content-Type", "text/html")
+	w.Header().Set("Retry-After", fmt.Sprintf("%.0f", wait.Seconds()))
+	w.WriteHeader(http.StatusTooManyRequests)
+	tmplTooManyAttempts.Execute(w, wait.String())
+}
+
+// handleFailedLogins lists the most recent failed login attempts.
+func (server *Server) handleFailedLogins(w http.ResponseWriter, r *http.Request) {
+	a := server.requirePermission(w, r, permSecurity)
+	if a == nil {
+		return
+	}
+	server.audit(r, a.Username, "view_failed_logins", "", nil, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	rows, err := stmtSelectFailedLogins.QueryContext(ctx)
+	if err != nil {
+		log.Printf("failed to select failed logins: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var attempts []loginAttempt
+	for rows.Next() {
+		var a loginAttempt
+		var ua sql.NullString
+		if err := rows.Scan(&a.Username, &a.RemoteAddr, &ua, &a.When); err != nil {
+			log.Printf("failed to scan login attempt: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		a.UserAgent = ua.String
+		attempts = append(attempts, a)
+	}
+
+	w.Header().Add("Content-Type", "text/html")
+	if err := tmplFailedLogins.Execute(w, attempts); err != nil {
+		log.Printf("failed to execute template for failed logins: %s", err)
+	}
+}
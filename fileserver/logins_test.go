@@ -0,0 +1,71 @@
+package fileserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProgressiveDelay(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{failures: 0, want: 0},
+		{failures: 1, want: 0},
+		{failures: 2, want: 0},
+		{failures: 3, want: time.Second},
+		{failures: 4, want: 2 * time.Second},
+		{failures: 5, want: 4 * time.Second},
+		{failures: 8, want: 32 * time.Second},
+		{failures: 9, want: loginMaxDelay},
+		{failures: accountLockThreshold, want: loginMaxDelay},
+		{failures: ipBlockThreshold, want: loginMaxDelay},
+		// the shift overflows
+		{failures: 64, want: loginMaxDelay},
+		{failures: 100, want: loginMaxDelay},
+	}
+
+	for _, tt := range tests {
+		if got := progressiveDelay(tt.failures); got != tt.want {
+			t.Errorf("progressiveDelay(%d) = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestLoginThresholds(t *testing.T) {
+	tests := []struct {
+		name      string
+		got, want int
+	}{
+		{name: "free attempts", got: loginFreeAttempts, want: 3},
+		{name: "account lock", got: accountLockThreshold, want: 10},
+		{name: "address block", got: ipBlockThreshold, want: 30},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s threshold = %d, want %d", tt.name, tt.got, tt.want)
+		}
+	}
+
+	// an account is delayed before it is locked, and one address can try a
+	// few accounts to their lock before it is blocked itself
+	if loginFreeAttempts >= accountLockThreshold {
+		t.Errorf("loginFreeAttempts %d doesn't come before accountLockThreshold %d", loginFreeAttempts, accountLockThreshold)
+	}
+	if accountLockThreshold >= ipBlockThreshold {
+		t.Errorf("accountLockThreshold %d doesn't come before ipBlockThreshold %d", accountLockThreshold, ipBlockThreshold)
+	}
+
+	// the delays alone must let the lock be reached inside the window, or
+	// failures would age out before an account ever locks
+	var total time.Duration
+	for n := 1; n < accountLockThreshold; n++ {
+		total += progressiveDelay(n)
+	}
+	if total >= loginWindow {
+		t.Errorf("reaching accountLockThreshold takes at least %s, past loginWindow %s", total, loginWindow)
+	}
+	if accountLockDuration < loginWindow {
+		t.Errorf("accountLockDuration %s is shorter than loginWindow %s", accountLockDuration, loginWindow)
+	}
+}
@@ -0,0 +1,215 @@
+package fileserver
+
+import (
+	"context"
+	"database/sql"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// names are compared after lowercasing and folding the accented letters
+	// used in Spanish, so "Muñoz" matches "munoz" and "MUNOZ"
+	querySearchUsers = `SELECT first_name, last_name, id_no, email, phone, claimed, id_hash,
+		(SELECT name FROM events WHERE events.id = event_id)
+	FROM form_info
+	WHERE verified_time IS NOT NULL AND waitlisted_time IS NULL
+		AND ($5 = '' OR event_id = (SELECT id FROM events WHERE slug = $5))
+		AND (CAST(id_no AS TEXT) = $1
+		OR lower(email) LIKE '%' || $2 || '%'
+		OR ($3 <> '' AND regexp_replace(phone, '\D', '', 'g') LIKE '%' || $3 || '%')
+		OR translate(lower(first_name || ' ' || last_name), 'áàäéèëíìïóòöúùüñ', 'aaaeeeiiiooouuun') LIKE '%' || $4 || '%')
+	ORDER BY last_name, first_name
+	LIMIT 50`
+
+	queryInsertLookupLog = `INSERT INTO
+	lookup_log(admin, query, results, remote_addr, useragent, ctime)
+	VALUES( $1, $2, $3, $4, $5, $6 )`
+)
+
+// minLookupLen keeps a staff member from listing every registration by
+// searching for a single letter.
+const minLookupLen = 3
+
+var stmtSearchUsers *sql.Stmt
+var stmtInsertLookupLog *sql.Stmt
+
+const tplLookup = `
+<!DOCTYPE html>
+<html>
+<style>
+   body {
+		font-size: 40px;
+   }
+   input {
+		font-size: 54px;
+		margin: 20px 0;
+   }
+   td {
+		padding: 10px 20px;
+   }
+</style>
+<body>
+<form action="/claim/search" method="GET">
+<input name="q" value="{{.Query}}" placeholder="c&eacute;dula, nombre, correo o tel&eacute;fono" autofocus />
+<select name="event" style="font-size: 40px">
+<option value="">todos los eventos</option>
+{{- range .Events}}
+<option value="{{.Slug}}" {{if eq .Slug $.Event}}selected{{end}}>{{.Name}}</option>
+{{- end}}
+</select>
+<input type="submit" value="buscar" />
+</form>
+{{- if .Searched}}
+	{{- if .Results}}
+	<table>
+		{{- range .Results}}
+		<tr>
+			<td><a href="/users/{{.Hash}}">{{.First}} {{.Last}}</a></td>
+			<td>{{.ID}}</td>
+			<td>{{.Event}}</td>
+			<td>{{.Email}}</td>
+			<td>{{.Phone}}</td>
+			<td>{{if .Claimed}}reclamado{{end}}</td>
+		</tr>
+		{{- end}}
+	</table>
+	{{- else}}
+	<p>Sin resultados</p>
+	{{- end}}
+{{- end}}
+</body>
+</html>
+`
+
+var tmplLookup = template.Must(template.New("lookup").Parse(tplLookup))
+
+type lookupResult struct {
+	First   string
+	Last    string
+	ID      uint64
+	Email   string
+	Phone   string
+	Claimed bool
+	Hash    string
+	Event   string
+}
+
+type lookupPage struct {
+	Query string
+	// Event is the slug of the event searched, empty for all
+	Event    string
+	Events   []eventRow
+	Searched bool
+	Results  []lookupResult
+}
+
+// handleLookup lets staff find a registration by ID number, name, email or
+// phone when the attendee cannot show their QR code. Every search is logged.
+func (server *Server) handleLookup(w http.ResponseWriter, r *http.Request) {
+	a := server.requirePermission(w, r, permLookup)
+	if a == nil {
+		return
+	}
+
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	page := lookupPage{Query: q, Event: r.URL.Query().Get("event")}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var err error
+	if page.Events, err = selectEvents(ctx); err != nil {
+		log.Printf("failed to select events: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if len([]rune(q)) >= minLookupLen {
+		results, err := searchUsers(ctx, q, page.Event)
+		if err != nil {
+			log.Printf("failed to search form_info for %q: %s", q, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if _, err := stmtInsertLookupLog.ExecContext(ctx,
+			a.Username, q, len(results),
+			r.RemoteAddr, r.Header.Get("User-Agent"),
+			time.Now()); err != nil {
+			// an unaudited lookup must not hand out personal data
+			log.Printf("failed to store lookup log for %q: %s", q, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		page.Searched = true
+		page.Results = results
+	}
+
+	w.Header().Add("Content-Type", "text/html")
+	if page.Searched {
+		server.audit(r, a.Username, "lookup", "", nil, map[string]int{"results": len(page.Results)})
+	}
+
+	if err := tmplLookup.Execute(w, page); err != nil {
+		log.Printf("failed to execute template for lookup: %s", err)
+	}
+}
+
+func searchUsers(ctx context.Context, q, event string) ([]lookupResult, error) {
+	pattern := escapeLike(foldAccents(strings.ToLower(q)))
+
+	rows, err := stmtSearchUsers.QueryContext(ctx, q, pattern, escapeLike(digitsOnly(q)), pattern, event)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []lookupResult
+	for rows.Next() {
+		var res lookupResult
+		var email, phone sql.NullString
+		if err := rows.Scan(&res.First, &res.Last, &res.ID, &email, &phone, &res.Claimed, &res.Hash, &res.Event); err != nil {
+			return nil, err
+		}
+		res.Email = email.String
+		res.Phone = phone.String
+		results = append(results, res)
+	}
+
+	return results, rows.Err()
+}
+
+var accentFolder = strings.NewReplacer(
+	"á", "a", "à", "a", "ä", "a",
+	"é", "e", "è", "e", "ë", "e",
+	"í", "i", "ì", "i", "ï", "i",
+	"ó", "o", "ò", "o", "ö", "o",
+	"ú", "u", "ù", "u", "ü", "u",
+	"ñ", "n",
+)
+
+// foldAccents mirrors the translate() call in querySearchUsers.
+func foldAccents(s string) string {
+	return accentFolder.Replace(s)
+}
+
+func digitsOnly(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
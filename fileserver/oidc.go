@@ -0,0 +1,304 @@
+package fileserver
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Carbon-X-DAO/CieloVerde.io/oidc"
+	"github.com/lib/pq"
+)
+
+// the browser has this long to come back from the provider
+const oidcLoginTimeout = 10 * time.Minute
+
+const oidcStateCookieName = "cieloverde_oidc_state"
+
+const (
+	queryInsertOIDCLogin = `INSERT INTO
+	oidc_logins(state, nonce, code_verifier, ctime)
+	VALUES( $1, $2, $3, $4 )`
+
+	queryTakeOIDCLogin = `DELETE FROM oidc_logins WHERE state=$1 RETURNING nonce, code_verifier, ctime`
+
+	queryDeleteExpiredOIDCLogins = `DELETE FROM oidc_logins WHERE ctime < $1`
+
+	querySelectExternalAdmin = `SELECT id, username FROM admins WHERE external_provider=$1 AND external_subject=$2`
+
+	// external accounts get a password hash no password can match
+	queryInsertExternalAdmin = `INSERT INTO
+	admins(username, password_hash, role, email, external_provider, external_subject, disabled, ctime, mtime)
+	VALUES( $1, '!', $2, $3, $4, $5, FALSE, $6, $6 )`
+
+	queryUpdateExternalAdmin = `UPDATE admins SET role = $2, email = $3, mtime = $4 WHERE id=$1`
+)
+
+var stmtInsertOIDCLogin *sql.Stmt
+var stmtTakeOIDCLogin *sql.Stmt
+var stmtDeleteExpiredOIDCLogins *sql.Stmt
+var stmtSelectExternalAdmin *sql.Stmt
+var stmtInsertExternalAdmin *sql.Stmt
+var stmtUpdateExternalAdmin *sql.Stmt
+
+// OIDCConfig enables staff login through an OpenID Connect provider.
+type OIDCConfig struct {
+	Provider *oidc.Provider
+	// RolesClaim names the ID token claim listing the user's groups
+	RolesClaim string
+	// RoleMap maps values of RolesClaim to roles. Users matching no entry
+	// can't log in; users matching several get the most privileged role.
+	RoleMap map[string]Role
+}
+
+// roleRank orders roles from most to least privileged.
+var roleRank = []Role{RoleOwner, RoleAdmin, RoleScanner, RoleViewer}
+
+// mapRole returns the most privileged role any of groups maps to.
+func mapRole(roleMap map[string]Role, groups []string) (Role, bool) {
+	granted := make(map[Role]bool)
+	for _, g := range groups {
+		if r, ok := roleMap[g]; ok {
+			granted[r] = true
+		}
+	}
+
+	for _, r := range roleRank {
+		if granted[r] {
+			return r, true
+		}
+	}
+
+	return "", false
+}
+
+var errNoExternalRole = errors.New("identity maps to no role")
+
+// maxUsernameSuffix bounds the numbers tried after a username that's taken
+const maxUsernameSuffix = 100
+
+// errExternalAdminExists is returned by insertExternalAdmin when the identity
+// got an account in the meantime, from a concurrent login.
+var errExternalAdminExists = errors.New("external admin already exists")
+
+// insertExternalAdmin creates the account of an external identity and
+// returns its username. It's never attached to an existing account just
+// because the usernames happen to match: a username that's taken gets a
+// number instead.
+func insertExternalAdmin(ctx context.Context, provider, subject, username string, email sql.NullString, role Role, now time.Time) (string, error) {
+	name := username
+	for n := 2; ; n++ {
+		_, err := stmtInsertExternalAdmin.ExecContext(ctx, name, role, email, provider, subject, now)
+		var pqErr *pq.Error
+		if !errors.As(err, &pqErr) || pqErr.Code != pqUniqueViolation {
+			return name, err
+		}
+		if pqErr.Constraint != "admins_username_key" {
+			return "", errExternalAdminExists
+		}
+		if n > maxUsernameSuffix {
+			return "", fmt.Errorf("usernames %s to %s are all taken", username, name)
+		}
+		name = fmt.Sprintf("%s-%d", username, n)
+	}
+}
+
+// loginExternal finds or creates the admin account of an identity vouched
+// for by an external provider, keeps its role and email in sync with the
+// provider, and returns it. Accounts are identified by provider and subject,
+// never by username. Disabled accounts stay disabled.
+func loginExternal(ctx context.Context, provider, subject, username, email string, role Role) (*admin, error) {
+	now := time.Now()
+	nullEmail := sql.NullString{String: email, Valid: email != ""}
+
+	var id int64
+	var existing string
+	err := stmtSelectExternalAdmin.QueryRowContext(ctx, provider, subject).Scan(&id, &existing)
+	switch {
+	case err == sql.ErrNoRows:
+		existing, err = insertExternalAdmin(ctx, provider, subject, username, nullEmail, role, now)
+		if err == errExternalAdminExists {
+			return loginExternal(ctx, provider, subject, username, email, role)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to create admin %s for %s identity %s: %w", username, provider, subject, err)
+		}
+		log.Printf("created %s account %s for %s identity %s", role, existing, provider, subject)
+	case err != nil:
+		return nil, fmt.Errorf("failed to select admin for %s identity %s: %w", provider, subject, err)
+	default:
+		if _, err := stmtUpdateExternalAdmin.ExecContext(ctx, id, role, nullEmail, now); err != nil {
+			return nil, fmt.Errorf("failed to update admin %s: %w", existing, err)
+		}
+	}
+
+	a, err := selectAdmin(ctx, existing)
+	if err != nil {
+		return nil, err
+	}
+	if a.Disabled {
+		return nil, errInvalidCredentials
+	}
+
+	return a, nil
+}
+
+// handleOIDCLogin sends the browser to the provider with a fresh state, nonce
+// and PKCE verifier.
+func (server *Server) handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if server.oidc == nil {
+		server.serveNotFound(w)
+		return
+	}
+
+	var values [3]string
+	for i := range values {
+		v, err := oidc.RandomString()
+		if err != nil {
+			writeErr(err, w)
+			return
+		}
+		values[i] = v
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	if _, err := stmtDeleteExpiredOIDCLogins.ExecContext(ctx, now.Add(-oidcLoginTimeout)); err != nil {
+		log.Printf("failed to delete expired OIDC logins: %s", err)
+	}
+
+	if _, err := stmtInsertOIDCLogin.ExecContext(ctx, state, nonce, verifier, now); err != nil {
+		log.Printf("failed to store OIDC login: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	u, err := server.oidc.Provider.AuthCodeURL(ctx, state, nonce, verifier)
+	if err != nil {
+		log.Printf("failed to build OIDC authorization URL: %s", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	// binds the state to this browser, so nobody can log a victim into the
+	// attacker's account by sending them a callback URL
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    state,
+		Path:     "/login/oidc",
+		MaxAge:   int(oidcLoginTimeout.Seconds()),
+		HttpOnly: true,
+		Secure:   !server.insecureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, u, http.StatusFound)
+}
+
+// handleOIDCCallback redeems the authorization code, verifies the ID token
+// and logs the mapped admin in.
+func (server *Server) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if server.oidc == nil {
+		server.serveNotFound(w)
+		return
+	}
+
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		log.Printf("OIDC provider returned error %s: %s", e, q.Get("error_description"))
+		writeUnauthorized(w)
+		return
+	}
+
+	state := q.Get("state")
+	cook, err := r.Cookie(oidcStateCookieName)
+	if err != nil || state == "" || cook.Value != state {
+		log.Printf("rejected OIDC callback with mismatched state from %s", clientIP(r))
+		writeForbidden(w)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var nonce, verifier string
+	var ctime time.Time
+	err = stmtTakeOIDCLogin.QueryRowContext(ctx, state).Scan(&nonce, &verifier, &ctime)
+	if err == sql.ErrNoRows || (err == nil && time.Since(ctime) > oidcLoginTimeout) {
+		log.Printf("rejected OIDC callback with unknown or expired state from %s", clientIP(r))
+		writeForbidden(w)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to select OIDC login: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	claims, err := server.oidc.Provider.Exchange(ctx, q.Get("code"), verifier, nonce)
+	if err != nil {
+		log.Printf("failed OIDC login: %s", err)
+		writeUnauthorized(w)
+		return
+	}
+
+	subject := claims.String("sub")
+	role, ok := mapRole(server.oidc.RoleMap, claims.Strings(server.oidc.RolesClaim))
+	if !ok {
+		log.Printf("rejected OIDC login of %s: %s", subject, errNoExternalRole)
+		writeForbidden(w)
+		return
+	}
+
+	email := claims.String("email")
+	username := claims.String("preferred_username")
+	if username == "" {
+		username = email
+	}
+	if username == "" {
+		username = subject
+	}
+
+	a, err := loginExternal(ctx, "oidc:"+server.oidc.Provider.Issuer, subject, username, email, role)
+	if err == errInvalidCredentials {
+		writeUnauthorized(w)
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if server.needsSecondFactor(a) {
+		if err := server.startSession(ctx, w, r, a, true); err != nil {
+			log.Printf("failed to start session: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{Name: oidcStateCookieName, Path: "/login/oidc", MaxAge: -1})
+		http.Redirect(w, r, "/login/totp", http.StatusSeeOther)
+		return
+	}
+
+	if _, err := stmtInsertLoginAttempt.ExecContext(ctx, a.Username, clientIP(r), r.Header.Get("User-Agent"), true, time.Now()); err != nil {
+		log.Printf("failed to store login attempt: %s", err)
+	}
+	server.audit(r, a.Username, "login", "", nil, map[string]string{"method": "oidc"})
+
+	if err := server.startSession(ctx, w, r, a, false); err != nil {
+		log.Printf("failed to start session: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookieName, Path: "/login/oidc", MaxAge: -1})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
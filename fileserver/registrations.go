@@ -0,0 +1,843 @@
+package fileserver
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const registrationsPageSize = 50
+
+// bogota is the event's time zone, which has no daylight saving time
+var bogota = time.FixedZone("America/Bogota", -5*60*60)
+
+const (
+	querySelectRegistration = `SELECT id, first_name, last_name, country, department, city, neighborhood, street_address,
+		id_no, phone, email, gender, age, daily_qty, weekly_qty, monthly_qty,
+		newsletter, gift_box, authorized, claimed, id_hash, ctime, anonymized_time IS NOT NULL, verified_time,
+		waitlisted_time, promoted_time, answers, event_id, (SELECT name FROM events WHERE events.id = event_id),
+		department_code, city_code, to_char(birth_date, 'YYYY-MM-DD')
+	FROM form_info WHERE id=$1`
+
+	querySelectEmailStatuses = `SELECT email_address, mailgun_msg, mailgun_id, error, ctime, kind
+	FROM email_status WHERE form_id=$1 ORDER BY ctime DESC`
+
+	querySelectClaims = `SELECT admin, remote_addr, ctime FROM claims WHERE id_hash=$1 ORDER BY ctime DESC`
+
+	queryInsertClaim = `INSERT INTO
+	claims(id_hash, admin, remote_addr, useragent, ctime)
+	VALUES( $1, $2, $3, $4, $5 )`
+)
+
+var stmtSelectRegistration *sql.Stmt
+var stmtSelectEmailStatuses *sql.Stmt
+var stmtSelectClaims *sql.Stmt
+var stmtInsertClaim *sql.Stmt
+
+const tplRegistrations = `
+<!DOCTYPE html>
+<html>
+<style>
+   td, th {
+		padding: 4px 10px;
+		text-align: left;
+   }
+   form input, form select {
+		margin: 4px 8px 4px 0;
+   }
+</style>
+<body>
+<h1>Registros ({{.Total}})</h1>
+<form action="/admin/registrations" method="GET">
+<input name="q" value="{{.Filter.Query}}" placeholder="nombre, c&eacute;dula, correo, tel&eacute;fono, lugar" size="40" autofocus />
+<select name="event">
+<option value="">todos los eventos</option>
+{{- range .Events}}
+<option value="{{.Slug}}" {{if eq .Slug $.Filter.Event}}selected{{end}}>{{.Name}}</option>
+{{- end}}
+</select>
+<input name="department" value="{{.Filter.Department}}" placeholder="departamento" />
+<input name="city" value="{{.Filter.City}}" placeholder="ciudad" />
+<input name="gender" value="{{.Filter.Gender}}" placeholder="g&eacute;nero" />
+<br/>
+edad <input name="age_min" value="{{.Filter.AgeMin}}" size="3" /> a <input name="age_max" value="{{.Filter.AgeMax}}" size="3" />
+registrado del <input type="date" name="from" value="{{.Filter.From}}" /> al <input type="date" name="to" value="{{.Filter.To}}" />
+<br/>
+{{- define "yesno"}}
+<option value="" {{if eq .Val ""}}selected{{end}}>{{.Label}}: todos</option>
+<option value="yes" {{if eq .Val "yes"}}selected{{end}}>{{.Label}}: s&iacute;</option>
+<option value="no" {{if eq .Val "no"}}selected{{end}}>{{.Label}}: no</option>
+{{- end}}
+<select name="newsletter">{{template "yesno" (yesno "bolet&iacute;n" .Filter.Newsletter)}}</select>
+<select name="gift_box">{{template "yesno" (yesno "caja de regalo" .Filter.GiftBox)}}</select>
+<select name="claimed">{{template "yesno" (yesno "reclamado" .Filter.Claimed)}}</select>
+<input name="consent" value="{{.Filter.Consent}}" placeholder="versi&oacute;n autorizaci&oacute;n" size="12" />
+<input type="hidden" name="sort" value="{{.Filter.Sort}}" />
+{{- if not .Filter.Desc}}<input type="hidden" name="dir" value="asc" />{{end}}
+<input type="submit" value="filtrar" />
+<a href="/admin/registrations">limpiar</a>
+</form>
+<table>
+	<tr>
+		<th><a href="{{index .SortURLs "ctime"}}">Fecha</a></th>
+		<th>Evento</th>
+		<th><a href="{{index .SortURLs "name"}}">Nombre</a></th>
+		<th><a href="{{index .SortURLs "id_no"}}">C&eacute;dula</a></th>
+		<th>Correo</th>
+		<th>Tel&eacute;fono</th>
+		<th><a href="{{index .SortURLs "department"}}">Departamento</a></th>
+		<th><a href="{{index .SortURLs "city"}}">Ciudad</a></th>
+		<th>G&eacute;nero</th>
+		<th><a href="{{index .SortURLs "age"}}">Edad</a></th>
+		<th>Bolet&iacute;n</th>
+		<th>Caja</th>
+		<th>Reclamado</th>
+		{{- range .Questions}}
+		<th>{{.}}</th>
+		{{- end}}
+	</tr>
+	{{- range .Rows}}
+	<tr>
+		<td>{{.Created.Format "2006-01-02 15:04"}}</td>
+		<td>{{.Event}}</td>
+		<td><a href="/admin/registrations/{{.ID}}">{{.FirstName}} {{.LastName}}</a></td>
+		<td>{{.IDNo}}</td>
+		<td>{{.Email}}</td>
+		<td>{{.Phone}}</td>
+		<td>{{.Department}}</td>
+		<td>{{.City}}</td>
+		<td>{{.Gender}}</td>
+		<td>{{.Age}}</td>
+		<td>{{if .Newsletter}}s&iacute;{{end}}</td>
+		<td>{{if .GiftBox}}s&iacute;{{end}}</td>
+		<td>{{if .Claimed}}s&iacute;{{end}}</td>
+		{{- range .Custom}}
+		<td>{{.Value}}</td>
+		{{- end}}
+	</tr>
+	{{- end}}
+</table>
+<form action="/admin/registrations/export" method="GET">
+{{- range $k, $v := .ExportFilter}}{{range $v}}
+<input type="hidden" name="{{$k}}" value="{{.}}" />
+{{- end}}{{end}}
+<p>Exportar columnas:
+{{- range .Columns}}
+<label><input type="checkbox" name="col" value="{{.Key}}" checked />{{.Header}}</label>
+{{- end}}
+</p>
+{{- if .Masked}}
+<p>Los datos personales (c&eacute;dula, correo, tel&eacute;fono, direcci&oacute;n) se ven y salen enmascarados.</p>
+{{- end}}
+<button type="submit" name="format" value="csv">CSV</button>
+<button type="submit" name="format" value="xlsx">Excel</button>
+</form>
+<p>
+{{- if .PrevURL}}<a href="{{.PrevURL}}">&laquo; anterior</a>{{end}}
+p&aacute;gina {{.Page}} de {{.Pages}}
+{{- if .NextURL}} <a href="{{.NextURL}}">siguiente &raquo;</a>{{end}}
+</p>
+</body>
+</html>
+`
+
+const tplRegistration = `
+<!DOCTYPE html>
+<html>
+<style>
+   td, th {
+		padding: 4px 10px;
+		text-align: left;
+   }
+</style>
+<body>
+<p><a href="/admin/registrations">&laquo; registros</a></p>
+<h1>{{.FirstName}} {{.LastName}}</h1>
+{{- if .Anonymized}}
+<p>Datos personales eliminados a solicitud del titular.</p>
+{{- end}}
+<table>
+	<tr><th>Evento</th><td>{{.Event}}</td></tr>
+	<tr><th>C&eacute;dula</th><td>{{.IDNoText}}</td></tr>
+	<tr><th>Correo</th><td>{{.Email}}</td></tr>
+	<tr><th>Tel&eacute;fono</th><td>{{.Phone}}</td></tr>
+	<tr><th>Pa&iacute;s</th><td>{{.Country}}</td></tr>
+	<tr><th>Departamento</th><td>{{.Department}}{{if .DepartmentCode}} ({{.DepartmentCode}}){{end}}</td></tr>
+	<tr><th>Ciudad</th><td>{{.City}}{{if .CityCode}} ({{.CityCode}}){{end}}</td></tr>
+	<tr><th>Barrio</th><td>{{.Neighborhood}}</td></tr>
+	<tr><th>Direcci&oacute;n</th><td>{{.Street}}</td></tr>
+	<tr><th>G&eacute;nero</th><td>{{.Gender}}</td></tr>
+	<tr><th>Edad</th><td>{{if .Age}}{{.Age}}{{end}}</td></tr>
+	<tr><th>Fecha de nacimiento</th><td>{{.BirthDate}}</td></tr>
+	<tr><th>Consumo diario</th><td>{{.DailyQty}}</td></tr>
+	<tr><th>Consumo semanal</th><td>{{.WeeklyQty}}</td></tr>
+	<tr><th>Consumo mensual</th><td>{{.MonthlyQty}}</td></tr>
+	<tr><th>Bolet&iacute;n</th><td>{{if .Newsletter}}s&iacute;{{else}}no{{end}}</td></tr>
+	<tr><th>Caja de regalo</th><td>{{if .GiftBox}}s&iacute;{{else}}no{{end}}</td></tr>
+	<tr><th>Autoriza datos</th><td>{{if .Authorized}}s&iacute;{{else}}no{{end}}</td></tr>
+	<tr><th>Versi&oacute;n autorizada</th><td>{{with .Consent}}versi&oacute;n {{.Version}}, {{.Accepted.Format "2006-01-02 15:04"}} desde {{.RemoteAddr}}{{if .Withdrawn}}; <b>retirada</b> el {{.Withdrawn.Format "2006-01-02 15:04"}}{{end}}{{else}}no{{end}}</td></tr>
+	<tr><th>Correo confirmado</th><td>{{if .Verified}}{{.Verified.Format "2006-01-02 15:04"}}{{else}}no{{end}}</td></tr>
+	<tr><th>Lista de espera</th><td>{{if .Waitlisted}}desde {{.Waitlisted.Format "2006-01-02 15:04"}}{{else if .Promoted}}promovido {{.Promoted.Format "2006-01-02 15:04"}}{{else}}no{{end}}</td></tr>
+	<tr><th>Reclamado</th><td>{{if .Claimed}}s&iacute;{{else}}no{{end}}</td></tr>
+	<tr><th>Registrado</th><td>{{.Created.Format "2006-01-02 15:04:05"}}</td></tr>
+	<tr><th>Referencia</th><td>{{.Reference}}</td></tr>
+	{{- range .Custom}}
+	<tr><th>{{.Label}}</th><td>{{.Value}}</td></tr>
+	{{- end}}
+	{{- if and .Hash (not .Masked)}}
+	<tr><th>Boleta</th><td><a href="/users/{{.Hash}}">/users/{{.Hash}}</a></td></tr>
+	{{- end}}
+</table>
+<h2>Correos</h2>
+{{- if .Emails}}
+<table>
+	<tr><th>Fecha</th><th>Tipo</th><th>Direcci&oacute;n</th><th>Mailgun</th><th>Error</th></tr>
+	{{- range .Emails}}
+	<tr>
+		<td>{{.When.Format "2006-01-02 15:04:05"}}</td>
+		<td>{{if eq .Kind "verification"}}confirmaci&oacute;n{{else}}boleta{{end}}</td>
+		<td>{{.Address}}</td>
+		<td>{{.Message}} {{.ID}}</td>
+		<td>{{.Error}}</td>
+	</tr>
+	{{- end}}
+</table>
+{{- else}}
+<p>Ning&uacute;n correo enviado</p>
+{{- end}}
+<h2>Reclamos</h2>
+{{- if .Claims}}
+<table>
+	<tr><th>Fecha</th><th>Admin</th><th>IP</th></tr>
+	{{- range .Claims}}
+	<tr>
+		<td>{{.When.Format "2006-01-02 15:04:05"}}</td>
+		<td>{{.Admin}}</td>
+		<td>{{.RemoteAddr}}</td>
+	</tr>
+	{{- end}}
+</table>
+{{- else}}
+<p>Sin reclamos registrados</p>
+{{- end}}
+</body>
+</html>
+`
+
+var (
+	tmplRegistrations = template.Must(template.New("registrations").Funcs(template.FuncMap{
+		"yesno": func(label, val string) interface{} {
+			return struct {
+				Label template.HTML
+				Val   string
+			}{template.HTML(label), val}
+		},
+	}).Parse(tplRegistrations))
+	tmplRegistration = template.Must(template.New("registration").Parse(tplRegistration))
+)
+
+// registrationSortColumns whitelists the columns the list can be sorted by.
+var registrationSortColumns = map[string]string{
+	"ctime":      "ctime",
+	"name":       "last_name, first_name",
+	"id_no":      "id_no",
+	"department": "department",
+	"city":       "city",
+	"age":        "age",
+}
+
+// registrationFilter is the set of filters shared by the registrations list
+// and its exports, parsed from the query string.
+type registrationFilter struct {
+	Query string
+	// Event is the slug of an event
+	Event      string
+	Department string
+	City       string
+	Gender     string
+	AgeMin     string
+	AgeMax     string
+	Newsletter string
+	GiftBox    string
+	Claimed    string
+	// Consent is a consent version; it matches registrations whose
+	// authorization of that version wasn't withdrawn
+	Consent string
+	From    string
+	To      string
+	Sort    string
+	Desc    bool
+	Page    int
+	// Masked limits the search for roles that get personal data masked:
+	// names and places match by prefix, and the ID number, email and phone
+	// only in full. It's set by the handler, never from the query string.
+	Masked bool
+}
+
+func parseRegistrationFilter(v url.Values) registrationFilter {
+	f := registrationFilter{
+		Query:      strings.TrimSpace(v.Get("q")),
+		Event:      v.Get("event"),
+		Department: strings.TrimSpace(v.Get("department")),
+		City:       strings.TrimSpace(v.Get("city")),
+		Gender:     strings.TrimSpace(v.Get("gender")),
+		AgeMin:     v.Get("age_min"),
+		AgeMax:     v.Get("age_max"),
+		Newsletter: v.Get("newsletter"),
+		GiftBox:    v.Get("gift_box"),
+		Claimed:    v.Get("claimed"),
+		Consent:    strings.TrimSpace(v.Get("consent")),
+		From:       v.Get("from"),
+		To:         v.Get("to"),
+		Sort:       v.Get("sort"),
+		Desc:       v.Get("dir") != "asc",
+		Page:       1,
+	}
+
+	if _, ok := registrationSortColumns[f.Sort]; !ok {
+		f.Sort = "ctime"
+	}
+
+	if p, err := strconv.Atoi(v.Get("page")); err == nil && p > 1 {
+		f.Page = p
+	}
+
+	return f
+}
+
+// values encodes the filter back into a query string, for links that keep
+// the current filters.
+func (f registrationFilter) values() url.Values {
+	v := url.Values{}
+	set := func(k, val string) {
+		if val != "" {
+			v.Set(k, val)
+		}
+	}
+	set("q", f.Query)
+	set("event", f.Event)
+	set("department", f.Department)
+	set("city", f.City)
+	set("gender", f.Gender)
+	set("age_min", f.AgeMin)
+	set("age_max", f.AgeMax)
+	set("newsletter", f.Newsletter)
+	set("gift_box", f.GiftBox)
+	set("claimed", f.Claimed)
+	set("consent", f.Consent)
+	set("from", f.From)
+	set("to", f.To)
+	set("sort", f.Sort)
+	if !f.Desc {
+		v.Set("dir", "asc")
+	}
+	if f.Page > 1 {
+		v.Set("page", strconv.Itoa(f.Page))
+	}
+
+	return v
+}
+
+// foldSQL lowercases a SQL expression and strips the accents that
+// foldAccents strips in Go.
+func foldSQL(expr string) string {
+	return fmt.Sprintf(`translate(lower(%s), 'áàäéèëíìïóòöúùüñ', 'aaaeeeiiiooouuun')`, expr)
+}
+
+// tsQuery turns free text into a prefix-matching tsquery over the folded
+// search column.
+func tsQuery(q string) string {
+	words := strings.FieldsFunc(foldAccents(strings.ToLower(q)), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	for i, w := range words {
+		words[i] = w + ":*"
+	}
+
+	return strings.Join(words, " & ")
+}
+
+// where returns the WHERE clause of the filter, appending its arguments.
+func (f registrationFilter) where(args *[]interface{}) string {
+	var conds []string
+	arg := func(v interface{}) string {
+		*args = append(*args, v)
+		return fmt.Sprintf("$%d", len(*args))
+	}
+
+	if f.Masked {
+		if cond := f.maskedSearch(arg); cond != "" {
+			conds = append(conds, cond)
+		}
+	} else if q := tsQuery(f.Query); q != "" {
+		conds = append(conds, "search @@ to_tsquery('simple', "+arg(q)+")")
+	}
+	if f.Event != "" {
+		conds = append(conds, "event_id = (SELECT id FROM events WHERE slug = "+arg(f.Event)+")")
+	}
+	if f.Department != "" {
+		conds = append(conds, foldSQL("department")+" = "+arg(foldAccents(strings.ToLower(f.Department))))
+	}
+	if f.City != "" {
+		conds = append(conds, foldSQL("city")+" = "+arg(foldAccents(strings.ToLower(f.City))))
+	}
+	if f.Gender != "" {
+		conds = append(conds, "lower(gender) = "+arg(strings.ToLower(f.Gender)))
+	}
+	if n, err := strconv.Atoi(f.AgeMin); err == nil {
+		conds = append(conds, "age >= "+arg(n))
+	}
+	if n, err := strconv.Atoi(f.AgeMax); err == nil {
+		conds = append(conds, "age <= "+arg(n))
+	}
+	for _, b := range []struct{ col, val string }{
+		{"newsletter", f.Newsletter},
+		{"gift_box", f.GiftBox},
+		{"claimed", f.Claimed},
+	} {
+		switch b.val {
+		case "yes":
+			conds = append(conds, "COALESCE("+b.col+", FALSE)")
+		case "no":
+			conds = append(conds, "NOT COALESCE("+b.col+", FALSE)")
+		}
+	}
+	if f.Consent != "" {
+		conds = append(conds, "id IN (SELECT form_id FROM consents WHERE withdrawn_time IS NULL AND consent_text_id = (SELECT id FROM consent_texts WHERE version = "+arg(f.Consent)+"))")
+	}
+	if t, err := time.ParseInLocation("2006-01-02", f.From, bogota); err == nil {
+		conds = append(conds, "ctime >= "+arg(t))
+	}
+	if t, err := time.ParseInLocation("2006-01-02", f.To, bogota); err == nil {
+		conds = append(conds, "ctime < "+arg(t.AddDate(0, 0, 1)))
+	}
+
+	if len(conds) == 0 {
+		return ""
+	}
+
+	return "WHERE " + strings.Join(conds, " AND ")
+}
+
+// maskedSearch matches the query against names and places by prefix, or
+// against the ID number, email or phone when it's one of them in full, so
+// masked values can't be found out a digit at a time.
+func (f registrationFilter) maskedSearch(arg func(interface{}) string) string {
+	var conds []string
+	if q := tsQuery(f.Query); q != "" {
+		conds = append(conds, "search_public @@ to_tsquery('simple', "+arg(q)+")")
+	}
+	if n, err := strconv.ParseUint(strings.ReplaceAll(f.Query, ".", ""), 10, 64); err == nil && n >= minIDNo && n <= maxIDNo {
+		conds = append(conds, "id_no = "+arg(n))
+	}
+	if email, ok := normalizeEmail(f.Query); ok {
+		conds = append(conds, "lower(email) = lower("+arg(email)+")")
+	}
+	if phone, ok := normalizePhone(f.Query); ok {
+		withCode, national := phoneDigits(phone)
+		conds = append(conds, `regexp_replace(phone, '\D', '', 'g') IN (`+arg(withCode)+", "+arg(national)+")")
+	}
+
+	if len(conds) == 0 {
+		return ""
+	}
+
+	return "(" + strings.Join(conds, " OR ") + ")"
+}
+
+// auditFilter encodes the filter for the audit log and export_log. The
+// search is usually someone's name or ID number, so only a keyed hash of it
+// is kept, which still tells whether two searches were the same.
+func (server *Server) auditFilter(f registrationFilter) string {
+	if f.Query != "" {
+		mac := server.tokenMAC(searchPurpose, foldAccents(strings.ToLower(f.Query)))
+		f.Query = "hmac:" + base64.RawURLEncoding.EncodeToString(mac[:12])
+	}
+
+	return f.values().Encode()
+}
+
+func (f registrationFilter) orderBy() string {
+	dir := "ASC"
+	if f.Desc {
+		dir = "DESC"
+	}
+
+	var cols []string
+	for _, col := range strings.Split(registrationSortColumns[f.Sort], ", ") {
+		cols = append(cols, col+" "+dir+" NULLS LAST")
+	}
+
+	return "ORDER BY " + strings.Join(cols, ", ") + ", id " + dir
+}
+
+type registrationRow struct {
+	ID         int64
+	Event      string
+	FirstName  string
+	LastName   string
+	IDNo       string
+	Email      string
+	Phone      string
+	Department string
+	City       string
+	Gender     string
+	Age        int64
+	Newsletter bool
+	GiftBox    bool
+	Claimed    bool
+	Created    time.Time
+	Custom     []customAnswer
+}
+
+type registrationsPage struct {
+	Filter   registrationFilter
+	Rows     []registrationRow
+	Total    int
+	Page     int
+	Pages    int
+	PrevURL  string
+	NextURL  string
+	SortURLs map[string]string
+	// ExportFilter carries the current filters into the export form
+	ExportFilter url.Values
+	Columns      []exportColumn
+	Masked       bool
+	// Questions are the labels of the custom questions
+	Questions []string
+	// Events fill the event filter
+	Events []eventRow
+}
+
+// handleRegistrations lists registrations with filters, sorting and
+// pagination done by the DB.
+func (server *Server) handleRegistrations(w http.ResponseWriter, r *http.Request) {
+	a := server.requirePermission(w, r, permBrowse)
+	if a == nil {
+		return
+	}
+
+	f := parseRegistrationFilter(r.URL.Query())
+	f.Masked = !a.Role.can(permExport)
+
+	var args []interface{}
+	query := `SELECT id, (SELECT name FROM events WHERE events.id = event_id), first_name, last_name, id_no, email, phone, department, city, gender, age,
+		newsletter, gift_box, claimed, ctime, answers, count(*) OVER()
+	FROM form_info ` + f.where(&args) + " " + f.orderBy() +
+		fmt.Sprintf(" LIMIT %d OFFSET %d", registrationsPageSize, (f.Page-1)*registrationsPageSize)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	rows, err := server.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		log.Printf("failed to select registrations: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	page := registrationsPage{
+		Filter:   f,
+		Page:     f.Page,
+		SortURLs: make(map[string]string),
+		Columns:  server.schema.exportColumns(),
+		Masked:   f.Masked,
+	}
+	for _, c := range server.schema.formatAnswers(nil, "es") {
+		page.Questions = append(page.Questions, c.Label)
+	}
+	unpaged := f
+	unpaged.Page = 1
+	page.ExportFilter = unpaged.values()
+	for rows.Next() {
+		var row registrationRow
+		var first, last, email, phone, department, city, gender sql.NullString
+		var idNo, age sql.NullInt64
+		var newsletter, giftBox, claimed sql.NullBool
+		var answers []byte
+		if err := rows.Scan(&row.ID, &row.Event, &first, &last, &idNo, &email, &phone, &department, &city, &gender, &age,
+			&newsletter, &giftBox, &claimed, &row.Created, &answers, &page.Total); err != nil {
+			log.Printf("failed to scan registration: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if idNo.Valid {
+			row.IDNo = strconv.FormatInt(idNo.Int64, 10)
+		}
+		row.FirstName, row.LastName, row.Email, row.Phone = first.String, last.String, email.String, phone.String
+		row.Department, row.City, row.Gender, row.Age = department.String, city.String, gender.String, age.Int64
+		row.Newsletter, row.GiftBox, row.Claimed = newsletter.Bool, giftBox.Bool, claimed.Bool
+		row.Created = row.Created.In(bogota)
+		row.Custom = server.schema.formatAnswers(unmarshalAnswers(row.ID, answers), "es")
+		if page.Masked {
+			row.IDNo, row.Email, row.Phone = maskTail(row.IDNo), maskEmail(row.Email), maskTail(row.Phone)
+			maskAnswers(row.Custom)
+		}
+		page.Rows = append(page.Rows, row)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("failed to iterate registrations: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if page.Events, err = selectEvents(ctx); err != nil {
+		log.Printf("failed to select events: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	server.audit(r, a.Username, "list_registrations", "", nil, map[string]string{"filter": server.auditFilter(f)})
+
+	page.Pages = (page.Total + registrationsPageSize - 1) / registrationsPageSize
+	link := func(g registrationFilter) string {
+		return "/admin/registrations?" + g.values().Encode()
+	}
+	if f.Page > 1 {
+		prev := f
+		prev.Page--
+		page.PrevURL = link(prev)
+	}
+	if f.Page < page.Pages {
+		next := f
+		next.Page++
+		page.NextURL = link(next)
+	}
+	for col := range registrationSortColumns {
+		g := f
+		g.Page = 1
+		g.Sort = col
+		g.Desc = !(f.Sort == col && f.Desc)
+		page.SortURLs[col] = link(g)
+	}
+
+	w.Header().Add("Content-Type", "text/html")
+	if err := tmplRegistrations.Execute(w, page); err != nil {
+		log.Printf("failed to execute template for registrations: %s", err)
+	}
+}
+
+// registrationDetail is also what attendees get when they ask for their
+// data, hence the JSON names.
+type registrationDetail struct {
+	ID             int64                  `json:"id"`
+	EventID        int64                  `json:"-"`
+	Event          string                 `json:"event"`
+	FirstName      string                 `json:"first_name"`
+	LastName       string                 `json:"last_name"`
+	Country        string                 `json:"country"`
+	Department     string                 `json:"department"`
+	DepartmentCode string                 `json:"department_code,omitempty"`
+	City           string                 `json:"city"`
+	CityCode       string                 `json:"city_code,omitempty"`
+	Neighborhood   string                 `json:"neighborhood"`
+	Street         string                 `json:"street_address"`
+	IDNo           int64                  `json:"id_no"`
+	Phone          string                 `json:"phone"`
+	Email          string                 `json:"email"`
+	Gender         string                 `json:"gender"`
+	Age            int64                  `json:"age"`
+	BirthDate      string                 `json:"birth_date,omitempty"`
+	DailyQty       string                 `json:"daily_qty"`
+	WeeklyQty      string                 `json:"weekly_qty"`
+	MonthlyQty     string                 `json:"monthly_qty"`
+	Newsletter     bool                   `json:"newsletter"`
+	GiftBox        bool                   `json:"gift_box"`
+	Authorized     bool                   `json:"authorized"`
+	Claimed        bool                   `json:"claimed"`
+	Verified       *time.Time             `json:"verified_time,omitempty"`
+	Waitlisted     *time.Time             `json:"waitlisted_time,omitempty"`
+	Promoted       *time.Time             `json:"promoted_time,omitempty"`
+	Hash           string                 `json:"ticket"`
+	Created        time.Time              `json:"time"`
+	Anonymized     bool                   `json:"-"`
+	Answers        map[string]interface{} `json:"answers,omitempty"`
+	Consent        *consentRecord         `json:"consent,omitempty"`
+	Custom         []customAnswer         `json:"-"`
+	Emails         []emailStatus          `json:"emails"`
+	Claims         []claimEvent           `json:"claims"`
+	// the rest is for the console, which masks personal data for roles
+	// that can't export it
+	IDNoText  string `json:"-"`
+	Reference string `json:"-"`
+	Masked    bool   `json:"-"`
+}
+
+type emailStatus struct {
+	// Kind is emailTicket or emailVerification
+	Kind    string    `json:"kind"`
+	Address string    `json:"address"`
+	Message string    `json:"mailgun_message"`
+	ID      string    `json:"mailgun_id"`
+	Error   string    `json:"error"`
+	When    time.Time `json:"time"`
+}
+
+// claimEvent leaves the staff's details out of the attendee's copy.
+type claimEvent struct {
+	Admin      string    `json:"-"`
+	RemoteAddr string    `json:"-"`
+	When       time.Time `json:"time"`
+}
+
+// handleRegistration shows everything about one registration, including its
+// email delivery and claim history.
+func (server *Server) handleRegistration(w http.ResponseWriter, r *http.Request) {
+	a := server.requirePermission(w, r, permBrowse)
+	if a == nil {
+		return
+	}
+
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/admin/registrations/"), 10, 64)
+	if err != nil {
+		server.serveNotFound(w)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	d, err := selectRegistration(ctx, id)
+	if err == sql.ErrNoRows {
+		server.serveNotFound(w)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to select registration %d: %s", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	server.audit(r, a.Username, "view_registration", fmt.Sprintf("registration:%d", id), nil, nil)
+
+	d.Custom = server.schema.formatAnswers(d.Answers, "es")
+	d.Reference = server.registrationReference(d.ID)
+	if d.IDNo != 0 {
+		d.IDNoText = strconv.FormatInt(d.IDNo, 10)
+	}
+	if !a.Role.can(permExport) {
+		d.mask()
+	}
+
+	w.Header().Add("Content-Type", "text/html")
+	if err := tmplRegistration.Execute(w, d); err != nil {
+		log.Printf("failed to execute template for registration: %s", err)
+	}
+}
+
+// mask hides personal data the way exports do for roles without export
+// rights. The ticket is left out too, since its claim page shows the ID
+// number.
+func (d *registrationDetail) mask() {
+	d.Masked = true
+	d.IDNoText, d.Email, d.Phone = maskTail(d.IDNoText), maskEmail(d.Email), maskTail(d.Phone)
+	d.Neighborhood, d.Street, d.BirthDate = maskAll(d.Neighborhood), maskAll(d.Street), maskAll(d.BirthDate)
+	for i := range d.Emails {
+		d.Emails[i].Address = maskEmail(d.Emails[i].Address)
+	}
+	d.Answers = nil
+	maskAnswers(d.Custom)
+}
+
+// maskAnswers hides the answers to the custom questions, which may hold
+// anything.
+func maskAnswers(answers []customAnswer) {
+	for i := range answers {
+		answers[i].Value = maskAll(answers[i].Value)
+	}
+}
+
+func selectRegistration(ctx context.Context, id int64) (*registrationDetail, error) {
+	var d registrationDetail
+	var s [17]sql.NullString
+	var idNo, age sql.NullInt64
+	var b [4]sql.NullBool
+	var verified, waitlisted, promoted sql.NullTime
+	var answers []byte
+	if err := stmtSelectRegistration.QueryRowContext(ctx, id).Scan(&d.ID,
+		&s[0], &s[1], &s[2], &s[3], &s[4], &s[5], &s[6],
+		&idNo, &s[7], &s[8], &s[9], &age, &s[10], &s[11], &s[12],
+		&b[0], &b[1], &b[2], &b[3], &s[13], &d.Created, &d.Anonymized, &verified,
+		&waitlisted, &promoted, &answers, &d.EventID, &d.Event,
+		&s[14], &s[15], &s[16]); err != nil {
+		return nil, err
+	}
+	d.IDNo = idNo.Int64
+	d.FirstName, d.LastName, d.Country, d.Department, d.City, d.Neighborhood, d.Street = s[0].String, s[1].String, s[2].String, s[3].String, s[4].String, s[5].String, s[6].String
+	d.Phone, d.Email, d.Gender, d.DailyQty, d.WeeklyQty, d.MonthlyQty, d.Hash = s[7].String, s[8].String, s[9].String, s[10].String, s[11].String, s[12].String, s[13].String
+	d.DepartmentCode, d.CityCode, d.BirthDate = s[14].String, s[15].String, s[16].String
+	d.Age = age.Int64
+	d.Newsletter, d.GiftBox, d.Authorized, d.Claimed = b[0].Bool, b[1].Bool, b[2].Bool, b[3].Bool
+	d.Created = d.Created.In(bogota)
+	if verified.Valid {
+		t := verified.Time.In(bogota)
+		d.Verified = &t
+	}
+	d.Answers = unmarshalAnswers(id, answers)
+	if waitlisted.Valid {
+		t := waitlisted.Time.In(bogota)
+		d.Waitlisted = &t
+	}
+	if promoted.Valid {
+		t := promoted.Time.In(bogota)
+		d.Promoted = &t
+	}
+
+	consent, err := selectConsent(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	d.Consent = consent
+
+	// anonymized registrations have no ID number or hash left to join on
+	if d.Anonymized {
+		return &d, nil
+	}
+
+	rows, err := stmtSelectEmailStatuses.QueryContext(ctx, d.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e emailStatus
+		var msg, mgID, errString, kind sql.NullString
+		if err := rows.Scan(&e.Address, &msg, &mgID, &errString, &e.When, &kind); err != nil {
+			return nil, err
+		}
+		e.Message, e.ID, e.Error, e.Kind = msg.String, mgID.String, errString.String, kind.String
+		e.When = e.When.In(bogota)
+		d.Emails = append(d.Emails, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	claims, err := stmtSelectClaims.QueryContext(ctx, d.Hash)
+	if err != nil {
+		return nil, err
+	}
+	defer claims.Close()
+	for claims.Next() {
+		var c claimEvent
+		var addr sql.NullString
+		if err := claims.Scan(&c.Admin, &addr, &c.When); err != nil {
+			return nil, err
+		}
+		c.RemoteAddr = addr.String
+		c.When = c.When.In(bogota)
+		d.Claims = append(d.Claims, c)
+	}
+
+	return &d, claims.Err()
+}
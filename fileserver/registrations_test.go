@@ -0,0 +1,100 @@
+package fileserver
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRegistrationFilterSearch(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		masked   bool
+		want     string
+		wantArgs []interface{}
+	}{
+		{name: "empty", want: ""},
+		{
+			name: "full search", query: "Ana 1020",
+			want: "WHERE search @@ to_tsquery('simple', $1)", wantArgs: []interface{}{"ana:* & 1020:*"},
+		},
+		{
+			name: "masked name", query: "Pérez", masked: true,
+			want: "WHERE (search_public @@ to_tsquery('simple', $1))", wantArgs: []interface{}{"perez:*"},
+		},
+		{
+			name: "masked partial ID number", query: "102", masked: true,
+			want: "WHERE (search_public @@ to_tsquery('simple', $1))", wantArgs: []interface{}{"102:*"},
+		},
+		{
+			name: "masked ID number", query: "1.020.304.050", masked: true,
+			want:     "WHERE (search_public @@ to_tsquery('simple', $1) OR id_no = $2)",
+			wantArgs: []interface{}{"1:* & 020:* & 304:* & 050:*", uint64(1020304050)},
+		},
+		{
+			name: "masked email", query: "Ana@Example.com", masked: true,
+			want:     "WHERE (search_public @@ to_tsquery('simple', $1) OR lower(email) = lower($2))",
+			wantArgs: []interface{}{"ana:* & example:* & com:*", "Ana@example.com"},
+		},
+		{
+			name: "masked phone", query: "300 123 4567", masked: true,
+			want:     `WHERE (search_public @@ to_tsquery('simple', $1) OR regexp_replace(phone, '\D', '', 'g') IN ($2, $3))`,
+			wantArgs: []interface{}{"300:* & 123:* & 4567:*", "573001234567", "3001234567"},
+		},
+		{
+			name: "masked number that may be either", query: "3001234567", masked: true,
+			want:     `WHERE (search_public @@ to_tsquery('simple', $1) OR id_no = $2 OR regexp_replace(phone, '\D', '', 'g') IN ($3, $4))`,
+			wantArgs: []interface{}{"3001234567:*", uint64(3001234567), "573001234567", "3001234567"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := registrationFilter{Query: tt.query, Masked: tt.masked}
+			var args []interface{}
+			if got := f.where(&args); got != tt.want {
+				t.Errorf("where = %q, want %q", got, tt.want)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("args = %#v, want %#v", args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestAuditFilter(t *testing.T) {
+	server := &Server{secret: []byte("0123456789abcdef0123456789abcdef")}
+
+	f := registrationFilter{Query: "Ana Pérez 1020304050", City: "Medellín", Sort: "ctime", Desc: true, Page: 1}
+	got := server.auditFilter(f)
+	for _, leak := range []string{"Ana", "P%C3%A9rez", "Pérez", "1020304050"} {
+		if strings.Contains(got, leak) {
+			t.Errorf("auditFilter = %q, contains %q", got, leak)
+		}
+	}
+
+	v, err := url.ParseQuery(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(v.Get("q"), "hmac:") || v.Get("city") != "Medellín" {
+		t.Errorf("auditFilter = %q, want a hashed q and the city", got)
+	}
+
+	same := f
+	same.Query = "ana perez 1020304050"
+	if server.auditFilter(same) != got {
+		t.Error("the same search with other case and accents hashes differently")
+	}
+	other := f
+	other.Query = "Ana Pérez 1020304051"
+	if server.auditFilter(other) == got {
+		t.Error("different searches hash the same")
+	}
+
+	if got := server.auditFilter(registrationFilter{Sort: "ctime", Desc: true}); got != "sort=ctime" {
+		t.Errorf("auditFilter without a search = %q", got)
+	}
+}
@@ -0,0 +1,326 @@
+package fileserver
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/crewjam/saml"
+)
+
+// the browser has this long to come back from the identity provider
+const samlLoginTimeout = 10 * time.Minute
+
+const samlRequestCookieName = "cieloverde_saml_request"
+
+// samlACSPath receives cross-site POSTs from the identity provider, which are
+// authenticated by the assertion's signature instead of a CSRF token
+const samlACSPath = "/saml/acs"
+
+const (
+	queryInsertSAMLRequest = `INSERT INTO saml_requests(id, ctime) VALUES( $1, $2 )`
+
+	queryTakeSAMLRequest = `DELETE FROM saml_requests WHERE id=$1 RETURNING ctime`
+
+	queryDeleteExpiredSAMLRequests = `DELETE FROM saml_requests WHERE ctime < $1`
+)
+
+var stmtInsertSAMLRequest *sql.Stmt
+var stmtTakeSAMLRequest *sql.Stmt
+var stmtDeleteExpiredSAMLRequests *sql.Stmt
+
+// samlRequestStore holds the IDs of the AuthnRequests sent and not answered
+// yet, so each response is accepted once.
+type samlRequestStore interface {
+	put(ctx context.Context, id string, now time.Time) error
+	// take forgets the request, returning when it was made, or sql.ErrNoRows
+	// if it isn't pending
+	take(ctx context.Context, id string) (time.Time, error)
+}
+
+// dbSAMLRequests keeps the pending requests in saml_requests, which every
+// instance of the server shares.
+type dbSAMLRequests struct{}
+
+func (dbSAMLRequests) put(ctx context.Context, id string, now time.Time) error {
+	if _, err := stmtDeleteExpiredSAMLRequests.ExecContext(ctx, now.Add(-samlLoginTimeout)); err != nil {
+		log.Printf("failed to delete expired SAML requests: %s", err)
+	}
+
+	_, err := stmtInsertSAMLRequest.ExecContext(ctx, id, now)
+	return err
+}
+
+func (dbSAMLRequests) take(ctx context.Context, id string) (time.Time, error) {
+	var ctime time.Time
+	err := stmtTakeSAMLRequest.QueryRowContext(ctx, id).Scan(&ctime)
+	return ctime, err
+}
+
+var (
+	errSAMLUnknownRequest = errors.New("no pending SAML request")
+	errSAMLInvalid        = errors.New("invalid SAML response")
+)
+
+// samlLogin is who a valid SAML response logs in.
+type samlLogin struct {
+	subject  string
+	username string
+	email    string
+	role     Role
+}
+
+// SAMLConfig makes the server a SAML 2.0 service provider for staff login
+// through an institutional identity provider.
+type SAMLConfig struct {
+	ServiceProvider *saml.ServiceProvider
+	// SubjectAttribute, when set, names the attribute that identifies the
+	// account, such as eduPersonTargetedID or subject-id. Otherwise the NameID
+	// does, and has to be persistent.
+	SubjectAttribute string
+	// UsernameAttribute names the attribute used as the admin's username,
+	// falling back to the NameID
+	UsernameAttribute string
+	// EmailAttribute names the attribute holding the admin's email
+	EmailAttribute string
+	// RolesAttribute names the attribute whose values are looked up in
+	// RoleMap, as with OIDCConfig
+	RolesAttribute string
+	RoleMap        map[string]Role
+}
+
+// samlAttribute returns the values of the attribute with the given name or
+// friendly name.
+func samlAttribute(assertion *saml.Assertion, name string) []string {
+	var values []string
+	for _, stmt := range assertion.AttributeStatements {
+		for _, attr := range stmt.Attributes {
+			if attr.Name != name && attr.FriendlyName != name {
+				continue
+			}
+			for _, v := range attr.Values {
+				values = append(values, v.Value)
+			}
+		}
+	}
+
+	return values
+}
+
+// subject returns what identifies the account of an assertion. A transient
+// NameID changes on every login, and other formats aren't guaranteed to be
+// stable or unique, so only a persistent one will do.
+func (c *SAMLConfig) subject(assertion *saml.Assertion) (string, error) {
+	if c.SubjectAttribute != "" {
+		v := samlAttribute(assertion, c.SubjectAttribute)
+		if len(v) != 1 || v[0] == "" {
+			return "", fmt.Errorf("assertion has %d values of %s, not one", len(v), c.SubjectAttribute)
+		}
+		return v[0], nil
+	}
+
+	if assertion.Subject == nil || assertion.Subject.NameID == nil || assertion.Subject.NameID.Value == "" {
+		return "", errors.New("assertion has no NameID")
+	}
+	if f := assertion.Subject.NameID.Format; f != string(saml.PersistentNameIDFormat) {
+		return "", fmt.Errorf("NameID format is %q, not persistent", f)
+	}
+
+	return assertion.Subject.NameID.Value, nil
+}
+
+// handleSAMLMetadata serves the service provider metadata to register with
+// the identity provider.
+func (server *Server) handleSAMLMetadata(w http.ResponseWriter, r *http.Request) {
+	if server.saml == nil {
+		server.serveNotFound(w)
+		return
+	}
+
+	buf, err := xml.MarshalIndent(server.saml.ServiceProvider.Metadata(), "", "  ")
+	if err != nil {
+		writeErr(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.Write(buf)
+}
+
+// handleSAMLLogin sends the browser to the identity provider with a signed
+// AuthnRequest whose ID has to come back in the response.
+func (server *Server) handleSAMLLogin(w http.ResponseWriter, r *http.Request) {
+	if server.saml == nil {
+		server.serveNotFound(w)
+		return
+	}
+
+	sp := server.saml.ServiceProvider
+	req, err := sp.MakeAuthenticationRequest(sp.GetSSOBindingLocation(saml.HTTPRedirectBinding), saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		log.Printf("failed to make SAML AuthnRequest: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	u, err := req.Redirect("", sp)
+	if err != nil {
+		log.Printf("failed to encode SAML AuthnRequest: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	if err := server.samlRequests.put(ctx, req.ID, time.Now()); err != nil {
+		log.Printf("failed to store SAML request: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// the response is POSTed back cross-site, so only a SameSite=None cookie
+	// makes it back with it
+	sameSite := http.SameSiteNoneMode
+	if server.insecureCookies {
+		sameSite = http.SameSiteLaxMode
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     samlRequestCookieName,
+		Value:    req.ID,
+		Path:     samlACSPath,
+		MaxAge:   int(samlLoginTimeout.Seconds()),
+		HttpOnly: true,
+		Secure:   !server.insecureCookies,
+		SameSite: sameSite,
+	})
+
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// verifySAMLResponse checks the identity provider's signed response is the
+// first to one of our pending requests, and maps it to an admin. It returns
+// errSAMLUnknownRequest, errSAMLInvalid or errNoExternalRole when the
+// response is rejected.
+func (server *Server) verifySAMLResponse(ctx context.Context, r *http.Request) (*samlLogin, error) {
+	cook, err := r.Cookie(samlRequestCookieName)
+	if err != nil || cook.Value == "" {
+		log.Printf("rejected SAML response without a pending request from %s", clientIP(r))
+		return nil, errSAMLUnknownRequest
+	}
+
+	ctime, err := server.samlRequests.take(ctx, cook.Value)
+	if err == sql.ErrNoRows || (err == nil && time.Since(ctime) > samlLoginTimeout) {
+		log.Printf("rejected SAML response to an unknown or expired request from %s", clientIP(r))
+		return nil, errSAMLUnknownRequest
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to select SAML request: %w", err)
+	}
+
+	// ParseResponse reads the form but doesn't parse it
+	if err := r.ParseForm(); err != nil {
+		log.Printf("rejected SAML response: %s", err)
+		return nil, errSAMLInvalid
+	}
+
+	assertion, err := server.saml.ServiceProvider.ParseResponse(r, []string{cook.Value})
+	if err != nil {
+		if invalid, ok := err.(*saml.InvalidResponseError); ok {
+			log.Printf("rejected SAML response: %s", invalid.PrivateErr)
+		} else {
+			log.Printf("rejected SAML response: %s", err)
+		}
+		return nil, errSAMLInvalid
+	}
+
+	subject, err := server.saml.subject(assertion)
+	if err != nil {
+		log.Printf("rejected SAML assertion: %s", err)
+		return nil, errSAMLInvalid
+	}
+
+	role, ok := mapRole(server.saml.RoleMap, samlAttribute(assertion, server.saml.RolesAttribute))
+	if !ok {
+		log.Printf("rejected SAML login of %s: %s", subject, errNoExternalRole)
+		return nil, errNoExternalRole
+	}
+
+	login := &samlLogin{subject: subject, username: subject, role: role}
+	if v := samlAttribute(assertion, server.saml.UsernameAttribute); len(v) > 0 && v[0] != "" {
+		login.username = v[0]
+	}
+	if v := samlAttribute(assertion, server.saml.EmailAttribute); len(v) > 0 {
+		login.email = v[0]
+	}
+
+	return login, nil
+}
+
+// handleSAMLACS logs in the admin of a valid response from the identity
+// provider.
+func (server *Server) handleSAMLACS(w http.ResponseWriter, r *http.Request) {
+	if server.saml == nil {
+		server.serveNotFound(w)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	login, err := server.verifySAMLResponse(ctx, r)
+	switch {
+	case err == errSAMLUnknownRequest || err == errNoExternalRole:
+		writeForbidden(w)
+		return
+	case err == errSAMLInvalid:
+		writeUnauthorized(w)
+		return
+	case err != nil:
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	a, err := loginExternal(ctx, "saml:"+server.saml.ServiceProvider.IDPMetadata.EntityID, login.subject, login.username, login.email, login.role)
+	if err == errInvalidCredentials {
+		writeUnauthorized(w)
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if server.needsSecondFactor(a) {
+		if err := server.startSession(ctx, w, r, a, true); err != nil {
+			log.Printf("failed to start session: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{Name: samlRequestCookieName, Path: samlACSPath, MaxAge: -1})
+		http.Redirect(w, r, "/login/totp", http.StatusSeeOther)
+		return
+	}
+
+	if _, err := stmtInsertLoginAttempt.ExecContext(ctx, a.Username, clientIP(r), r.Header.Get("User-Agent"), true, time.Now()); err != nil {
+		log.Printf("failed to store login attempt: %s", err)
+	}
+	server.audit(r, a.Username, "login", "", nil, map[string]string{"method": "saml"})
+
+	if err := server.startSession(ctx, w, r, a, false); err != nil {
+		log.Printf("failed to start session: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: samlRequestCookieName, Path: samlACSPath, MaxAge: -1})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
@@ -0,0 +1,255 @@
+package fileserver
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crewjam/saml"
+)
+
+func TestSAMLSubject(t *testing.T) {
+	withNameID := func(format saml.NameIDFormat, value string) *saml.Assertion {
+		return &saml.Assertion{Subject: &saml.Subject{NameID: &saml.NameID{Format: string(format), Value: value}}}
+	}
+	withAttribute := func(values ...string) *saml.Assertion {
+		a := withNameID(saml.TransientNameIDFormat, "_transient")
+		attr := saml.Attribute{Name: "urn:oasis:names:tc:SAML:attribute:subject-id", FriendlyName: "subject-id"}
+		for _, v := range values {
+			attr.Values = append(attr.Values, saml.AttributeValue{Value: v})
+		}
+		a.AttributeStatements = []saml.AttributeStatement{{Attributes: []saml.Attribute{attr}}}
+		return a
+	}
+
+	tests := []struct {
+		name      string
+		attribute string
+		assertion *saml.Assertion
+		want      string
+	}{
+		{name: "persistent", assertion: withNameID(saml.PersistentNameIDFormat, "abc123"), want: "abc123"},
+		{name: "transient", assertion: withNameID(saml.TransientNameIDFormat, "_a1b2")},
+		{name: "email", assertion: withNameID(saml.EmailAddressNameIDFormat, "alice@example.com")},
+		{name: "unspecified", assertion: withNameID(saml.UnspecifiedNameIDFormat, "alice")},
+		{name: "empty persistent", assertion: withNameID(saml.PersistentNameIDFormat, "")},
+		{name: "no subject", assertion: &saml.Assertion{}},
+		{name: "attribute", attribute: "subject-id", assertion: withAttribute("alice@uni.edu.co"), want: "alice@uni.edu.co"},
+		{name: "attribute by name", attribute: "urn:oasis:names:tc:SAML:attribute:subject-id", assertion: withAttribute("alice@uni.edu.co"), want: "alice@uni.edu.co"},
+		{name: "attribute missing", attribute: "subject-id", assertion: withNameID(saml.PersistentNameIDFormat, "abc123")},
+		{name: "attribute repeated", attribute: "subject-id", assertion: withAttribute("a", "b")},
+		{name: "attribute empty", attribute: "subject-id", assertion: withAttribute("")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &SAMLConfig{SubjectAttribute: tt.attribute}
+			got, err := c.subject(tt.assertion)
+			if tt.want == "" && err == nil {
+				t.Errorf("subject = %q, want an error", got)
+			}
+			if tt.want != "" && (err != nil || got != tt.want) {
+				t.Errorf("subject = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// memorySAMLRequests keeps pending requests in memory for tests.
+type memorySAMLRequests struct {
+	mu      sync.Mutex
+	pending map[string]time.Time
+}
+
+func (m *memorySAMLRequests) put(ctx context.Context, id string, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.pending == nil {
+		m.pending = make(map[string]time.Time)
+	}
+	m.pending[id] = now
+	return nil
+}
+
+func (m *memorySAMLRequests) take(ctx context.Context, id string) (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ctime, ok := m.pending[id]
+	if !ok {
+		return time.Time{}, sql.ErrNoRows
+	}
+	delete(m.pending, id)
+	return ctime, nil
+}
+
+func testKeyPair(t *testing.T, name string) (*rsa.PrivateKey, *x509.Certificate) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key, cert
+}
+
+func mustParseURL(t *testing.T, s string) url.URL {
+	t.Helper()
+
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *u
+}
+
+func TestVerifySAMLResponse(t *testing.T) {
+	idpKey, idpCert := testKeyPair(t, "idp.uni.edu.co")
+	idp := &saml.IdentityProvider{
+		Key:         idpKey,
+		Certificate: idpCert,
+		MetadataURL: mustParseURL(t, "https://idp.uni.edu.co/metadata"),
+		SSOURL:      mustParseURL(t, "https://idp.uni.edu.co/sso"),
+	}
+
+	spKey, spCert := testKeyPair(t, "registro.example.com")
+	sp := &saml.ServiceProvider{
+		Key:         spKey,
+		Certificate: spCert,
+		MetadataURL: mustParseURL(t, "https://registro.example.com/saml/metadata"),
+		AcsURL:      mustParseURL(t, "https://registro.example.com"+samlACSPath),
+		IDPMetadata: idp.Metadata(),
+	}
+
+	store := &memorySAMLRequests{}
+	server := &Server{
+		saml: &SAMLConfig{
+			ServiceProvider:   sp,
+			UsernameAttribute: "urn:oid:0.9.2342.19200300.100.1.1",
+			EmailAttribute:    "eduPersonPrincipalName",
+			RolesAttribute:    "eduPersonAffiliation",
+			RoleMap:           map[string]Role{"staff": RoleViewer, "registro": RoleAdmin},
+		},
+		samlRequests: store,
+	}
+
+	// respond signs an assertion for a request with the given ID, addressed
+	// to the audience in metadata.
+	respond := func(t *testing.T, requestID string, metadata *saml.EntityDescriptor, groups ...string) string {
+		t.Helper()
+
+		req := &saml.IdpAuthnRequest{
+			IDP:                     idp,
+			HTTPRequest:             httptest.NewRequest(http.MethodGet, idp.SSOURL.String(), nil),
+			Request:                 saml.AuthnRequest{ID: requestID, IssueInstant: time.Now()},
+			ServiceProviderMetadata: metadata,
+			SPSSODescriptor:         &metadata.SPSSODescriptors[0],
+			ACSEndpoint:             &metadata.SPSSODescriptors[0].AssertionConsumerServices[0],
+			Now:                     time.Now(),
+		}
+		session := &saml.Session{
+			NameID:       "a1b2c3",
+			NameIDFormat: string(saml.PersistentNameIDFormat),
+			UserName:     "alice",
+			UserEmail:    "alice@uni.edu.co",
+			Groups:       groups,
+		}
+		if err := (saml.DefaultAssertionMaker{}).MakeAssertion(req, session); err != nil {
+			t.Fatal(err)
+		}
+		form, err := req.PostBinding()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return form.SAMLResponse
+	}
+
+	post := func(cookie, response string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, sp.AcsURL.String(), strings.NewReader(url.Values{"SAMLResponse": {response}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != "" {
+			r.AddCookie(&http.Cookie{Name: samlRequestCookieName, Value: cookie})
+		}
+		return r
+	}
+
+	otherAudience := sp.Metadata()
+	otherAudience.EntityID = "https://otro.example.com/saml/metadata"
+
+	tests := []struct {
+		name string
+		// pending is put in the store before posting the response to
+		// requestID with the cookie set to cookie
+		pending, cookie, requestID string
+		metadata                   *saml.EntityDescriptor
+		groups                     []string
+		replay                     bool
+		want                       error
+	}{
+		{name: "valid", pending: "id-valid", cookie: "id-valid", requestID: "id-valid", groups: []string{"staff", "registro"}},
+		{name: "replayed", pending: "id-replayed", cookie: "id-replayed", requestID: "id-replayed", groups: []string{"staff"}, replay: true, want: errSAMLUnknownRequest},
+		{name: "no pending request", cookie: "id-unknown", requestID: "id-unknown", groups: []string{"staff"}, want: errSAMLUnknownRequest},
+		{name: "no cookie", pending: "id-nocookie", requestID: "id-nocookie", groups: []string{"staff"}, want: errSAMLUnknownRequest},
+		{name: "wrong audience", pending: "id-audience", cookie: "id-audience", requestID: "id-audience", metadata: otherAudience, groups: []string{"staff"}, want: errSAMLInvalid},
+		{name: "response to another request", pending: "id-mine", cookie: "id-mine", requestID: "id-theirs", groups: []string{"staff"}, want: errSAMLInvalid},
+		{name: "no role", pending: "id-norole", cookie: "id-norole", requestID: "id-norole", groups: []string{"student"}, want: errNoExternalRole},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.pending != "" {
+				store.put(context.Background(), tt.pending, time.Now())
+			}
+			metadata := tt.metadata
+			if metadata == nil {
+				metadata = sp.Metadata()
+			}
+			response := respond(t, tt.requestID, metadata, tt.groups...)
+
+			login, err := server.verifySAMLResponse(context.Background(), post(tt.cookie, response))
+			if tt.replay {
+				if err != nil {
+					t.Fatalf("first response: %v", err)
+				}
+				login, err = server.verifySAMLResponse(context.Background(), post(tt.cookie, response))
+			}
+			if err != tt.want {
+				t.Fatalf("verifySAMLResponse error = %v, want %v", err, tt.want)
+			}
+			if err != nil {
+				return
+			}
+
+			want := samlLogin{subject: "a1b2c3", username: "alice", email: "alice@uni.edu.co", role: RoleAdmin}
+			if *login != want {
+				t.Errorf("login = %+v, want %+v", *login, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,398 @@
+package fileserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// question types
+const (
+	questionText        = "text"
+	questionNumber      = "number"
+	questionBoolean     = "boolean"
+	questionSelect      = "select"
+	questionMultiSelect = "multiselect"
+)
+
+// custom question names end up in form fields, JSON keys and SQL, so
+// they're kept plain
+var reQuestionName = regexp.MustCompile(`^[a-z][a-z0-9_]{0,39}$`)
+
+// FormSchema lists the questions asked on top of the built-in registration
+// fields. Answers are stored in form_info.answers.
+type FormSchema struct {
+	Questions []Question `json:"questions"`
+}
+
+// Question is a custom question of the registration form. Labels are keyed
+// by language, "es" being the fallback.
+type Question struct {
+	Name     string            `json:"name"`
+	Type     string            `json:"type"`
+	Labels   map[string]string `json:"labels"`
+	Required bool              `json:"required,omitempty"`
+	// MaxLength limits text answers, in characters
+	MaxLength int `json:"max_length,omitempty"`
+	// Min and Max limit number answers
+	Min *int `json:"min,omitempty"`
+	Max *int `json:"max,omitempty"`
+	// Options are the choices of select and multiselect questions
+	Options []Option `json:"options,omitempty"`
+	// Personal is still accepted from schemas written when only personal
+	// answers were masked; any answer may hold personal data, so all are
+	Personal bool `json:"personal,omitempty"`
+}
+
+type Option struct {
+	Value  string            `json:"value"`
+	Labels map[string]string `json:"labels"`
+}
+
+// LoadFormSchema reads a form schema from a JSON file.
+func LoadFormSchema(path string) (*FormSchema, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	var s FormSchema
+	if err := dec.Decode(&s); err != nil {
+		return nil, fmt.Errorf("failed to decode form schema %s: %w", path, err)
+	}
+	if err := s.check(); err != nil {
+		return nil, fmt.Errorf("invalid form schema %s: %w", path, err)
+	}
+
+	return &s, nil
+}
+
+// reservedFieldNames are the form fields custom questions can't take.
+func reservedFieldNames() map[string]bool {
+	reserved := map[string]bool{
+		csrfFieldName: true, honeypotField: true, challengeField: true, powField: true, captchaField: true,
+	}
+	for _, f := range captchaWidgetFields {
+		reserved[f] = true
+	}
+
+	t := reflect.TypeOf(formInfo{})
+	for i := 0; i < t.NumField(); i++ {
+		if tag := t.Field(i).Tag.Get("form"); tag != "" && tag != "-" {
+			reserved[tag] = true
+		}
+	}
+
+	return reserved
+}
+
+func (s *FormSchema) check() error {
+	reserved := reservedFieldNames()
+	seen := make(map[string]bool)
+	for i := range s.Questions {
+		q := &s.Questions[i]
+		switch {
+		case !reQuestionName.MatchString(q.Name):
+			return fmt.Errorf("question name %q must be lowercase letters, digits and underscores", q.Name)
+		case reserved[q.Name]:
+			return fmt.Errorf("question name %q is a built-in field", q.Name)
+		case seen[q.Name]:
+			return fmt.Errorf("question %q is defined twice", q.Name)
+		case q.Labels["es"] == "":
+			return fmt.Errorf("question %q has no Spanish label", q.Name)
+		}
+		seen[q.Name] = true
+
+		switch q.Type {
+		case questionText:
+			if q.MaxLength <= 0 || q.MaxLength > 2000 {
+				q.MaxLength = 2000
+			}
+		case questionNumber:
+			if q.Min != nil && q.Max != nil && *q.Min > *q.Max {
+				return fmt.Errorf("question %q has min above max", q.Name)
+			}
+		case questionBoolean:
+		case questionSelect, questionMultiSelect:
+			if len(q.Options) == 0 {
+				return fmt.Errorf("question %q has no options", q.Name)
+			}
+			values := make(map[string]bool)
+			for _, o := range q.Options {
+				if o.Value == "" || values[o.Value] {
+					return fmt.Errorf("question %q has an empty or repeated option", q.Name)
+				}
+				values[o.Value] = true
+			}
+		default:
+			return fmt.Errorf("question %q has unknown type %q", q.Name, q.Type)
+		}
+	}
+
+	return nil
+}
+
+func label(labels map[string]string, lang, fallback string) string {
+	if l := labels[lang]; l != "" {
+		return l
+	}
+	if l := labels["es"]; l != "" {
+		return l
+	}
+
+	return fallback
+}
+
+func (q *Question) label(lang string) string {
+	return label(q.Labels, lang, q.Name)
+}
+
+func (q *Question) option(value string) *Option {
+	for i := range q.Options {
+		if q.Options[i].Value == value {
+			return &q.Options[i]
+		}
+	}
+
+	return nil
+}
+
+// fieldOrder returns where a field goes when listing errors: the built-in
+// fields first, then the custom questions.
+func (s *FormSchema) fieldOrder(field string) int {
+	if o, ok := fieldOrder[field]; ok {
+		return o
+	}
+	if s != nil {
+		for i, q := range s.Questions {
+			if q.Name == field {
+				return len(fieldOrder) + 1 + i
+			}
+		}
+	}
+
+	return len(fieldOrder) + 1
+}
+
+// labels returns the label of every field, built-in or custom.
+func (s *FormSchema) labels(lang string) map[string]string {
+	labels := make(map[string]string, len(fieldLabels[lang]))
+	for k, v := range fieldLabels[lang] {
+		labels[k] = v
+	}
+	if s != nil {
+		for _, q := range s.Questions {
+			labels[q.Name] = q.label(lang)
+		}
+	}
+
+	return labels
+}
+
+func truthy(s string) bool {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "on", "true", "1", "yes", "si", "sí":
+		return true
+	}
+
+	return false
+}
+
+// decodeAnswers validates the answers to the custom questions. Boolean
+// questions that are required have to be checked, like consent boxes.
+func (s *FormSchema) decodeAnswers(values url.Values, errs *fieldErrors) map[string]interface{} {
+	if s == nil || len(s.Questions) == 0 {
+		return nil
+	}
+
+	answers := make(map[string]interface{})
+	for i := range s.Questions {
+		q := &s.Questions[i]
+		v := strings.Join(strings.Fields(values.Get(q.Name)), " ")
+
+		switch q.Type {
+		case questionText:
+			switch {
+			case v == "":
+			case utf8.RuneCountInString(v) > q.MaxLength:
+				errs.add(q.Name, "too_long", q.MaxLength)
+			default:
+				answers[q.Name] = v
+			}
+		case questionNumber:
+			if v == "" {
+				break
+			}
+			n, err := strconv.Atoi(v)
+			switch {
+			case err != nil:
+				errs.add(q.Name, "invalid_number", 0)
+			case q.Min != nil && n < *q.Min:
+				errs.add(q.Name, "too_small", *q.Min)
+			case q.Max != nil && n > *q.Max:
+				errs.add(q.Name, "too_large", *q.Max)
+			default:
+				answers[q.Name] = n
+			}
+		case questionBoolean:
+			if truthy(v) {
+				answers[q.Name] = true
+			} else if !q.Required {
+				answers[q.Name] = false
+			}
+		case questionSelect:
+			if v == "" {
+				break
+			}
+			if q.option(v) == nil {
+				errs.add(q.Name, "invalid_choice", 0)
+				break
+			}
+			answers[q.Name] = v
+		case questionMultiSelect:
+			var picked []string
+			seen := make(map[string]bool)
+			for _, v := range values[q.Name] {
+				v = strings.TrimSpace(v)
+				if v == "" || seen[v] {
+					continue
+				}
+				if q.option(v) == nil {
+					errs.add(q.Name, "invalid_choice", 0)
+					break
+				}
+				seen[v] = true
+				picked = append(picked, v)
+			}
+			if len(picked) > 0 && !errs.has(q.Name) {
+				answers[q.Name] = picked
+			}
+		}
+
+		if _, ok := answers[q.Name]; !ok && q.Required && !errs.has(q.Name) {
+			errs.add(q.Name, "required", 0)
+		}
+	}
+
+	return answers
+}
+
+// unmarshalAnswers decodes the answers column of registration id, logging
+// rather than failing on a bad value so one row can't break a listing.
+func unmarshalAnswers(id int64, b []byte) map[string]interface{} {
+	if len(b) == 0 {
+		return nil
+	}
+
+	var answers map[string]interface{}
+	if err := json.Unmarshal(b, &answers); err != nil {
+		log.Printf("failed to decode answers of registration %d: %s", id, err)
+		return nil
+	}
+
+	return answers
+}
+
+// formatAnswer renders a stored answer for people, with option labels in
+// lang.
+func (q *Question) formatAnswer(v interface{}, lang string) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case bool:
+		if lang == "en" {
+			if v {
+				return "yes"
+			}
+			return "no"
+		}
+		if v {
+			return "sí"
+		}
+		return "no"
+	case string:
+		if o := q.option(v); o != nil {
+			return label(o.Labels, lang, o.Value)
+		}
+		return v
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, e := range v {
+			parts[i] = q.formatAnswer(e, lang)
+		}
+		return strings.Join(parts, ", ")
+	}
+
+	return fmt.Sprint(v)
+}
+
+// customAnswer is an answer to a custom question, as shown to admins.
+type customAnswer struct {
+	Label string
+	Value string
+}
+
+// formatAnswers lists the answers to the schema's questions, in order.
+func (s *FormSchema) formatAnswers(answers map[string]interface{}, lang string) []customAnswer {
+	if s == nil {
+		return nil
+	}
+
+	out := make([]customAnswer, len(s.Questions))
+	for i := range s.Questions {
+		q := &s.Questions[i]
+		out[i] = customAnswer{Label: q.label(lang), Value: q.formatAnswer(answers[q.Name], lang)}
+	}
+
+	return out
+}
+
+// exportColumns are the columns of the custom questions, after the
+// built-in ones. Multiselect answers are joined with commas. The answers are
+// masked for roles that can't export personal data.
+func (s *FormSchema) exportColumns() []exportColumn {
+	cols := append([]exportColumn(nil), exportColumns...)
+	if s == nil {
+		return cols
+	}
+
+	for _, q := range s.Questions {
+		// the name was checked against reQuestionName, so it's safe to quote
+		expr := "answers->>'" + q.Name + "'"
+		switch q.Type {
+		case questionBoolean:
+			expr = boolExpr("(" + expr + ")::boolean")
+		case questionMultiSelect:
+			expr = "(SELECT string_agg(v, ', ') FROM jsonb_array_elements_text(answers->'" + q.Name + "') v)"
+		}
+
+		cols = append(cols, exportColumn{Key: "answers." + q.Name, Header: q.label("es"), expr: expr, mask: maskAll})
+	}
+
+	return cols
+}
+
+// handleFormSchema hands the frontend the custom questions to render.
+func (server *Server) handleFormSchema(w http.ResponseWriter, r *http.Request) {
+	s := server.schema
+	if s == nil {
+		s = &FormSchema{}
+	}
+	if s.Questions == nil {
+		s = &FormSchema{Questions: []Question{}}
+	}
+
+	w.Header().Set("Cache-Control", "max-age=300")
+	writeJSON(w, http.StatusOK, s)
+}
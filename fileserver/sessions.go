@@ -0,0 +1,261 @@
+package fileserver
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const sessionCookieName = "cieloverde_session"
+
+// sessions are only touched again once this much time has passed, so that
+// every admin request doesn't turn into a write
+const sessionTouchInterval = time.Minute
+
+// a session waiting for its second factor must get it within this long
+const secondFactorTimeout = 5 * time.Minute
+
+const (
+	queryInsertSession = `INSERT INTO
+	sessions(token_hash, admin_id, csrf_token, second_factor_pending, remote_addr, useragent, ctime, last_seen, expires_at)
+	VALUES( $1, $2, $3, $4, $5, $6, $7, $7, $8 )`
+
+	querySelectSession = `SELECT s.csrf_token, s.second_factor_pending, s.ctime, s.last_seen, s.expires_at,
+		a.id, a.username, a.password_hash, a.role, a.disabled, a.totp_secret, a.totp_enabled, a.totp_last_step,
+		a.external_subject IS NOT NULL
+	FROM sessions s JOIN admins a ON a.id = s.admin_id
+	WHERE s.token_hash=$1`
+
+	queryTouchSession = `UPDATE sessions SET last_seen = $2 WHERE token_hash=$1`
+
+	queryCompleteSecondFactor = `UPDATE sessions SET second_factor_pending = FALSE, last_seen = $2 WHERE token_hash=$1`
+
+	queryDeleteSession = `DELETE FROM sessions WHERE token_hash=$1`
+
+	queryDeleteAdminSessions = `DELETE FROM sessions WHERE admin_id=$1`
+
+	queryDeleteAdminSessionsByName = `DELETE FROM sessions WHERE admin_id = (SELECT id FROM admins WHERE username=$1)`
+
+	queryDeleteExpiredSessions = `DELETE FROM sessions WHERE expires_at < $1 OR last_seen < $2`
+)
+
+var stmtInsertSession *sql.Stmt
+var stmtSelectSession *sql.Stmt
+var stmtTouchSession *sql.Stmt
+var stmtCompleteSecondFactor *sql.Stmt
+var stmtDeleteSession *sql.Stmt
+var stmtDeleteAdminSessions *sql.Stmt
+var stmtDeleteExpiredSessions *sql.Stmt
+
+type session struct {
+	tokenHash string
+	csrfToken string
+	// secondFactorPending sessions have passed the password check but not
+	// yet TOTP, and only grant access to the TOTP step of the login
+	secondFactorPending bool
+	ctime               time.Time
+	lastSeen            time.Time
+	expiresAt           time.Time
+	admin               *admin
+}
+
+// hashSessionToken is what gets stored, so a copy of the sessions table
+// can't be replayed as cookies.
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newSessionToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to read random session token: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// startSession stores a new session for a and sets its cookie on w. With
+// secondFactorPending the session is unusable until completeSecondFactor.
+func (server *Server) startSession(ctx context.Context, w http.ResponseWriter, r *http.Request, a *admin, secondFactorPending bool) error {
+	now := time.Now()
+
+	if _, err := stmtDeleteExpiredSessions.ExecContext(ctx, now, now.Add(-server.sessionIdle)); err != nil {
+		log.Printf("failed to delete expired sessions: %s", err)
+	}
+
+	token, err := newSessionToken()
+	if err != nil {
+		return err
+	}
+
+	csrfToken, err := newSessionToken()
+	if err != nil {
+		return err
+	}
+
+	expires := now.Add(server.sessionMax)
+	if _, err := stmtInsertSession.ExecContext(ctx,
+		hashSessionToken(token), a.ID, csrfToken, secondFactorPending,
+		r.RemoteAddr, r.Header.Get("User-Agent"),
+		now, expires); err != nil {
+		return fmt.Errorf("failed to store session for admin %s: %w", a.Username, err)
+	}
+
+	http.SetCookie(w, server.sessionCookie(token, expires))
+	return nil
+}
+
+func (server *Server) sessionCookie(value string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   !server.insecureCookies,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func (server *Server) clearSessionCookie(w http.ResponseWriter) {
+	cook := server.sessionCookie("", time.Unix(0, 0))
+	cook.MaxAge = -1
+	http.SetCookie(w, cook)
+}
+
+// currentSession returns the live, fully authenticated session the request's
+// cookie refers to, or nil.
+func (server *Server) currentSession(r *http.Request) *session {
+	s := server.lookupSession(r)
+	if s == nil || s.secondFactorPending {
+		return nil
+	}
+
+	return s
+}
+
+// pendingSession returns the session waiting for its second factor that the
+// request's cookie refers to, or nil.
+func (server *Server) pendingSession(r *http.Request) *session {
+	s := server.lookupSession(r)
+	if s == nil || !s.secondFactorPending || time.Since(s.ctime) > secondFactorTimeout {
+		return nil
+	}
+
+	return s
+}
+
+// completeSecondFactor turns a pending session into a fully authenticated one.
+func completeSecondFactor(ctx context.Context, s *session) error {
+	if _, err := stmtCompleteSecondFactor.ExecContext(ctx, s.tokenHash, time.Now()); err != nil {
+		return fmt.Errorf("failed to complete second factor of session of admin %s: %w", s.admin.Username, err)
+	}
+
+	s.secondFactorPending = false
+	return nil
+}
+
+// lookupSession returns the session the request's cookie refers to, or nil.
+// Sessions past their idle or absolute expiry, and sessions of disabled
+// admins, are never returned.
+func (server *Server) lookupSession(r *http.Request) *session {
+	cook, err := r.Cookie(sessionCookieName)
+	if err != nil || cook.Value == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s := session{tokenHash: hashSessionToken(cook.Value), admin: &admin{}}
+	a := s.admin
+	var totpSecret sql.NullString
+	err = stmtSelectSession.QueryRowContext(ctx, s.tokenHash).Scan(
+		&s.csrfToken, &s.secondFactorPending, &s.ctime, &s.lastSeen, &s.expiresAt,
+		&a.ID, &a.Username, &a.PasswordHash, &a.Role, &a.Disabled, &totpSecret, &a.TOTPEnabled, &a.TOTPLastStep, &a.External)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		log.Printf("failed to select session: %s", err)
+		return nil
+	}
+
+	a.TOTPSecret = totpSecret.String
+
+	now := time.Now()
+	if a.Disabled || now.After(s.expiresAt) || now.Sub(s.lastSeen) > server.sessionIdle {
+		if _, err := stmtDeleteSession.ExecContext(ctx, s.tokenHash); err != nil {
+			log.Printf("failed to delete stale session of admin %s: %s", a.Username, err)
+		}
+		return nil
+	}
+
+	if now.Sub(s.lastSeen) > sessionTouchInterval {
+		if _, err := stmtTouchSession.ExecContext(ctx, s.tokenHash, now); err != nil {
+			log.Printf("failed to touch session of admin %s: %s", a.Username, err)
+		}
+		s.lastSeen = now
+	}
+
+	return &s
+}
+
+// currentAdmin returns the enabled admin logged in on this request, or nil.
+func (server *Server) currentAdmin(r *http.Request) *admin {
+	s := server.currentSession(r)
+	if s == nil {
+		return nil
+	}
+
+	return s.admin
+}
+
+// handleLogout ends the current session, or with all=1 every session of the
+// logged in admin.
+func (server *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	s := server.lookupSession(r)
+	if s == nil {
+		server.clearSessionCookie(w)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	var err error
+	if r.FormValue("all") == "1" {
+		_, err = stmtDeleteAdminSessions.ExecContext(ctx, s.admin.ID)
+		log.Printf("admin %s logged out of all sessions", s.admin.Username)
+	} else {
+		_, err = stmtDeleteSession.ExecContext(ctx, s.tokenHash)
+	}
+	if err != nil {
+		log.Printf("failed to delete sessions of admin %s: %s", s.admin.Username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	server.audit(r, s.admin.Username, "logout", "", nil, map[string]bool{"all": r.FormValue("all") == "1"})
+
+	server.clearSessionCookie(w)
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// LogoutAdmin ends every session of an admin account.
+func LogoutAdmin(ctx context.Context, db *sql.DB, username string) error {
+	if _, err := db.ExecContext(ctx, queryDeleteAdminSessionsByName, username); err != nil {
+		return fmt.Errorf("failed to delete sessions of admin %s: %w", username, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package fileserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errInvalidToken = errors.New("invalid or expired link")
+
+const (
+	referencePurpose = "registration-reference"
+	// searchPurpose keys the hashes of searches kept in the logs
+	searchPurpose = "search"
+)
+
+// signToken returns a URL-safe token vouching for subject until exp. The
+// purpose is part of the signature, so a token made for one use can't be
+// replayed for another.
+func (server *Server) signToken(purpose, subject string, exp time.Time) string {
+	payload := subject + "." + strconv.FormatInt(exp.Unix(), 10)
+
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(server.tokenMAC(purpose, payload))
+}
+
+// verifyToken returns the subject of a token signed for purpose, if it
+// hasn't expired.
+func (server *Server) verifyToken(purpose, token string, now time.Time) (string, error) {
+	enc, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", errInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(enc)
+	if err != nil {
+		return "", errInvalidToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, server.tokenMAC(purpose, string(payload))) {
+		return "", errInvalidToken
+	}
+
+	i := strings.LastIndexByte(string(payload), '.')
+	exp, err := strconv.ParseInt(string(payload[i+1:]), 10, 64)
+	if err != nil || now.Unix() > exp {
+		return "", errInvalidToken
+	}
+
+	return string(payload[:i]), nil
+}
+
+// registrationReference is what the API tells the frontend a registration
+// is, for attendees to quote to the staff. Unlike the registration's ID it
+// says nothing about how many registrations there are, and it can't be
+// turned back into the ID or used as a ticket.
+func (server *Server) registrationReference(formID int64) string {
+	mac := server.tokenMAC(referencePurpose, strconv.FormatInt(formID, 10))
+
+	return base64.RawURLEncoding.EncodeToString(mac[:12])
+}
+
+func (server *Server) tokenMAC(purpose, payload string) []byte {
+	h := hmac.New(sha256.New, server.secret)
+	h.Write([]byte(purpose))
+	h.Write([]byte{0})
+	h.Write([]byte(payload))
+
+	return h.Sum(nil)
+}
@@ -0,0 +1,68 @@
+package fileserver
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokens(t *testing.T) {
+	server := &Server{secret: []byte("0123456789abcdef0123456789abcdef")}
+	other := &Server{secret: []byte("fedcba9876543210fedcba9876543210")}
+	now := time.Unix(1700000000, 0)
+	valid := server.signToken(verifyPurpose, "42", now.Add(time.Hour))
+
+	// forge re-signs a payload with the right key, to check what
+	// verifyToken makes of payloads signToken never produces
+	forge := func(payload string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+			base64.RawURLEncoding.EncodeToString(server.tokenMAC(verifyPurpose, payload))
+	}
+	enc, sig, _ := strings.Cut(valid, ".")
+	swapped := base64.RawURLEncoding.EncodeToString([]byte("43"+mustDecode(t, enc)[2:])) + "." + sig
+
+	tests := []struct {
+		name  string
+		token string
+		now   time.Time
+		want  string
+	}{
+		{name: "valid", token: valid, now: now, want: "42"},
+		{name: "subject with dots", token: server.signToken(verifyPurpose, "a.b.c", now.Add(time.Hour)), now: now, want: "a.b.c"},
+		{name: "last second", token: valid, now: now.Add(time.Hour), want: "42"},
+		{name: "expired", token: valid, now: now.Add(time.Hour + time.Second)},
+		{name: "other purpose", token: server.signToken(dataRequestPurpose, "42", now.Add(time.Hour)), now: now},
+		{name: "other secret", token: other.signToken(verifyPurpose, "42", now.Add(time.Hour)), now: now},
+		{name: "other subject, same signature", token: swapped, now: now},
+		{name: "truncated signature", token: valid[:len(valid)-2], now: now},
+		{name: "no signature", token: enc, now: now},
+		{name: "empty", token: "", now: now},
+		{name: "not base64", token: "!!!." + sig, now: now},
+		{name: "no expiry", token: forge("42"), now: now},
+		{name: "bad expiry", token: forge("42.soon"), now: now},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := server.verifyToken(verifyPurpose, tt.token, tt.now)
+			if tt.want == "" && err == nil {
+				t.Errorf("verifyToken = %q, want an error", got)
+			}
+			if tt.want != "" && (err != nil || got != tt.want) {
+				t.Errorf("verifyToken = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func mustDecode(t *testing.T, s string) string {
+	t.Helper()
+
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(b)
+}
@@ -0,0 +1,530 @@
+package fileserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"image/png"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/qr"
+)
+
+// RFC 6238 parameters understood by every authenticator app
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// codes from one step either side of the current one are accepted to
+	// allow for clock drift
+	totpSkew = 1
+
+	totpIssuer         = "CieloVerde.io"
+	recoveryCodeCount  = 10
+	recoveryCodeLength = 10
+)
+
+const (
+	querySetTOTPSecret = `UPDATE admins SET totp_secret = $2, mtime = $3 WHERE id=$1 AND NOT totp_enabled`
+
+	queryEnableTOTP = `UPDATE admins SET totp_enabled = TRUE, mtime = $2 WHERE id=$1`
+
+	// only moving the last step forward makes every code single-use
+	queryAdvanceTOTPStep = `UPDATE admins SET totp_last_step = $2 WHERE id=$1 AND totp_last_step < $2`
+
+	queryDeleteRecoveryCodes = `DELETE FROM admin_recovery_codes WHERE admin_id=$1`
+
+	queryInsertRecoveryCode = `INSERT INTO
+	admin_recovery_codes(admin_id, code_hash, ctime)
+	VALUES( $1, $2, $3 )`
+
+	queryUseRecoveryCode = `UPDATE admin_recovery_codes SET used_at = $3
+	WHERE admin_id=$1 AND code_hash=$2 AND used_at IS NULL`
+
+	queryResetTOTP = `UPDATE admins SET totp_secret = NULL, totp_enabled = FALSE, totp_last_step = 0, mtime = $2 WHERE username=$1`
+
+	queryDeleteRecoveryCodesByName = `DELETE FROM admin_recovery_codes WHERE admin_id = (SELECT id FROM admins WHERE username=$1)`
+)
+
+var stmtSetTOTPSecret *sql.Stmt
+var stmtEnableTOTP *sql.Stmt
+var stmtAdvanceTOTPStep *sql.Stmt
+var stmtDeleteRecoveryCodes *sql.Stmt
+var stmtInsertRecoveryCode *sql.Stmt
+var stmtUseRecoveryCode *sql.Stmt
+
+const tplTwoFactor = `
+<!DOCTYPE html>
+<html>
+<style>
+   body {
+		font-size: 32px;
+   }
+   input {
+		font-size: 54px;
+		display: block;
+		margin: 40px 0;
+   }
+</style>
+<body>
+<h1>Verificaci&oacute;n en dos pasos</h1>
+{{- if .Codes}}
+	<p>Verificaci&oacute;n en dos pasos activada. Guarde estos c&oacute;digos de recuperaci&oacute;n;
+	cada uno sirve una sola vez y no se volver&aacute;n a mostrar.</p>
+	<pre>{{range .Codes}}{{.}}
+{{end}}</pre>
+	<p><a href="/login">Continuar</a></p>
+{{- else if .QR}}
+	<p>Escanee este c&oacute;digo con su aplicaci&oacute;n de autenticaci&oacute;n, o ingrese la clave manualmente.</p>
+	<img src="{{.QR}}" alt="{{.URI}}" />
+	<p><code>{{.Secret}}</code></p>
+	<form action="/admin/2fa/confirm" method="POST">
+	<input type="hidden" name="csrf_token" value="{{.CSRFToken}}" />
+	<input name="code" inputmode="numeric" autocomplete="one-time-code" placeholder="c&oacute;digo" />
+	<input type="submit" value="confirmar" />
+	</form>
+{{- else if .Enabled}}
+	<p>La verificaci&oacute;n en dos pasos est&aacute; activa para {{.Username}}.</p>
+{{- else}}
+	{{- if .Required}}
+	<p>Su rol requiere verificaci&oacute;n en dos pasos antes de continuar.</p>
+	{{- end}}
+	<form action="/admin/2fa/enroll" method="POST">
+	<input type="hidden" name="csrf_token" value="{{.CSRFToken}}" />
+	<input type="submit" value="activar" />
+	</form>
+{{- end}}
+{{- if .Error}}
+	<p style="color: red">{{.Error}}</p>
+{{- end}}
+</body>
+</html>
+`
+
+const tplLoginTOTP = `
+<!DOCTYPE html>
+<html>
+<style>
+   input {
+		font-size: 54px;
+		display:block;
+		margin: 40px;
+   }
+</style>
+<body>
+{{- if .Error}}
+<p style="color: red; font-size: 32px">{{.Error}}</p>
+{{- end}}
+<form action="/login/totp" method="POST">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}" />
+<input name="code" inputmode="numeric" autocomplete="one-time-code" placeholder="c&oacute;digo o c&oacute;digo de recuperaci&oacute;n" autofocus />
+<input type="submit" />
+</form>
+</body>
+</html>
+`
+
+var (
+	tmplTwoFactor = template.Must(template.New("twoFactor").Parse(tplTwoFactor))
+	tmplLoginTOTP = template.Must(template.New("loginTOTP").Parse(tplLoginTOTP))
+)
+
+type twoFactorPage struct {
+	Username  string
+	Enabled   bool
+	Required  bool
+	Secret    string
+	URI       string
+	QR        template.URL
+	Codes     []string
+	Error     string
+	CSRFToken string
+}
+
+type loginTOTPPage struct {
+	Error     string
+	CSRFToken string
+}
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func newTOTPSecret() (string, error) {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to read random TOTP secret: %w", err)
+	}
+
+	return base32NoPadding.EncodeToString(buf), nil
+}
+
+// totpCode computes the RFC 6238 code of a base32 secret for a time step.
+func totpCode(secret string, step int64) (string, error) {
+	key, err := base32NoPadding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode TOTP secret: %w", err)
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", totpDigits, bin%mod), nil
+}
+
+// matchTOTP returns the time step at which code is valid for secret, allowing
+// for totpSkew, or zero.
+func matchTOTP(secret, code string, now time.Time) int64 {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0
+		}
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			return step
+		}
+	}
+
+	return 0
+}
+
+func totpURI(username, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("period", fmt.Sprintf("%d", totpPeriod))
+	v.Set("digits", fmt.Sprintf("%d", totpDigits))
+
+	label := url.PathEscape(totpIssuer + ":" + username)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// totpQRCode renders the provisioning URI as a PNG data URI.
+func totpQRCode(uri string) (template.URL, error) {
+	code, err := qr.Encode(uri, qr.M, qr.Auto)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode provisioning URI as QR code: %w", err)
+	}
+
+	code, err = barcode.Scale(code, 240, 240)
+	if err != nil {
+		return "", fmt.Errorf("failed to scale QR code: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, code); err != nil {
+		return "", fmt.Errorf("failed to encode PNG: %w", err)
+	}
+
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())), nil
+}
+
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// newRecoveryCodes replaces the admin's recovery codes and returns the new
+// ones in clear text, for showing exactly once.
+func newRecoveryCodes(ctx context.Context, a *admin) ([]string, error) {
+	if _, err := stmtDeleteRecoveryCodes.ExecContext(ctx, a.ID); err != nil {
+		return nil, fmt.Errorf("failed to delete recovery codes of admin %s: %w", a.Username, err)
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		buf := make([]byte, recoveryCodeLength)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, fmt.Errorf("failed to read random recovery code: %w", err)
+		}
+		raw := strings.ToLower(base32NoPadding.EncodeToString(buf))[:recoveryCodeLength]
+		codes[i] = raw[:recoveryCodeLength/2] + "-" + raw[recoveryCodeLength/2:]
+
+		if _, err := stmtInsertRecoveryCode.ExecContext(ctx, a.ID, hashRecoveryCode(codes[i]), time.Now()); err != nil {
+			return nil, fmt.Errorf("failed to store recovery code of admin %s: %w", a.Username, err)
+		}
+	}
+
+	return codes, nil
+}
+
+// verifySecondFactor accepts a current TOTP code that hasn't been used yet or
+// an unused recovery code, consuming it.
+func verifySecondFactor(ctx context.Context, a *admin, code string, now time.Time) (bool, error) {
+	if step := matchTOTP(a.TOTPSecret, code, now); step != 0 {
+		res, err := stmtAdvanceTOTPStep.ExecContext(ctx, a.ID, step)
+		if err != nil {
+			return false, fmt.Errorf("failed to advance TOTP step of admin %s: %w", a.Username, err)
+		}
+		n, _ := res.RowsAffected()
+		return n == 1, nil
+	}
+
+	res, err := stmtUseRecoveryCode.ExecContext(ctx, a.ID, hashRecoveryCode(code), now)
+	if err != nil {
+		return false, fmt.Errorf("failed to use recovery code of admin %s: %w", a.Username, err)
+	}
+	n, _ := res.RowsAffected()
+	if n == 1 {
+		log.Printf("admin %s logged in with a recovery code", a.Username)
+	}
+
+	return n == 1, nil
+}
+
+func (server *Server) renderTwoFactor(w http.ResponseWriter, r *http.Request, s *session, page twoFactorPage) {
+	page.Username = s.admin.Username
+	page.Enabled = s.admin.TOTPEnabled
+	page.Required = server.enforce2FA && s.admin.Role.requires2FA()
+	page.CSRFToken = s.csrfToken
+
+	w.Header().Add("Content-Type", "text/html")
+	if err := tmplTwoFactor.Execute(w, page); err != nil {
+		log.Printf("failed to execute template for two factor: %s", err)
+	}
+}
+
+// handleTwoFactor shows whether the logged in admin has TOTP enabled.
+func (server *Server) handleTwoFactor(w http.ResponseWriter, r *http.Request) {
+	s := server.currentSession(r)
+	if s == nil {
+		writeUnauthorized(w)
+		return
+	}
+
+	server.renderTwoFactor(w, r, s, twoFactorPage{})
+}
+
+// handleTwoFactorEnroll generates a fresh secret and shows it for scanning.
+// TOTP isn't enabled until a code generated from it is confirmed.
+func (server *Server) handleTwoFactorEnroll(w http.ResponseWriter, r *http.Request) {
+	s := server.currentSession(r)
+	if s == nil {
+		writeUnauthorized(w)
+		return
+	}
+	if s.admin.TOTPEnabled {
+		http.Redirect(w, r, "/admin/2fa", http.StatusSeeOther)
+		return
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		writeErr(err, w)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if _, err := stmtSetTOTPSecret.ExecContext(ctx, s.admin.ID, secret, time.Now()); err != nil {
+		log.Printf("failed to store TOTP secret of admin %s: %s", s.admin.Username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	server.renderTOTPSecret(w, r, s, secret, "")
+}
+
+func (server *Server) renderTOTPSecret(w http.ResponseWriter, r *http.Request, s *session, secret, errMsg string) {
+	uri := totpURI(s.admin.Username, secret)
+	code, err := totpQRCode(uri)
+	if err != nil {
+		writeErr(err, w)
+		return
+	}
+
+	server.renderTwoFactor(w, r, s, twoFactorPage{Secret: secret, URI: uri, QR: code, Error: errMsg})
+}
+
+// handleTwoFactorConfirm enables TOTP once the admin proves their app
+// generates valid codes, and hands out recovery codes.
+func (server *Server) handleTwoFactorConfirm(w http.ResponseWriter, r *http.Request) {
+	s := server.currentSession(r)
+	if s == nil {
+		writeUnauthorized(w)
+		return
+	}
+	a := s.admin
+	if a.TOTPEnabled || a.TOTPSecret == "" {
+		http.Redirect(w, r, "/admin/2fa", http.StatusSeeOther)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	step := matchTOTP(a.TOTPSecret, r.PostForm.Get("code"), now)
+	if step == 0 {
+		server.renderTOTPSecret(w, r, s, a.TOTPSecret, "Código incorrecto, intente de nuevo.")
+		return
+	}
+
+	if _, err := stmtAdvanceTOTPStep.ExecContext(ctx, a.ID, step); err != nil {
+		log.Printf("failed to advance TOTP step of admin %s: %s", a.Username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	codes, err := newRecoveryCodes(ctx, a)
+	if err != nil {
+		writeErr(err, w)
+		return
+	}
+
+	if _, err := stmtEnableTOTP.ExecContext(ctx, a.ID, now); err != nil {
+		log.Printf("failed to enable TOTP of admin %s: %s", a.Username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	a.TOTPEnabled = true
+
+	log.Printf("admin %s enabled two factor authentication", a.Username)
+	server.audit(r, a.Username, "2fa_enable", "admin:"+a.Username, map[string]bool{"totp": false}, map[string]bool{"totp": true})
+	server.renderTwoFactor(w, r, s, twoFactorPage{Codes: codes})
+}
+
+// handleLoginTOTP serves the second step of the login for admins with TOTP.
+func (server *Server) handleLoginTOTP(w http.ResponseWriter, r *http.Request) {
+	if server.pendingSession(r) == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	server.renderLoginTOTP(w, r, http.StatusOK, "")
+}
+
+// needsSecondFactor reports whether a has to enter a TOTP code after the
+// first factor: a password, or the word of an identity provider that isn't
+// trusted with the second factor.
+func (server *Server) needsSecondFactor(a *admin) bool {
+	return a.TOTPEnabled && !(a.External && server.trustIdP2FA)
+}
+
+// renderLoginTOTP asks for the second factor. The CSRF token may set a
+// cookie, so the status is only written once the headers are all set.
+func (server *Server) renderLoginTOTP(w http.ResponseWriter, r *http.Request, status int, errMsg string) {
+	token, err := server.csrfToken(w, r)
+	if err != nil {
+		log.Printf("failed to issue CSRF token: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/html")
+	w.WriteHeader(status)
+	if err := tmplLoginTOTP.Execute(w, loginTOTPPage{errMsg, token}); err != nil {
+		log.Printf("failed to execute template for TOTP login: %s", err)
+	}
+}
+
+// handleLoginTOTPRequest checks the second factor of a pending session. Wrong
+// codes count as failed logins for throttling and lockout.
+func (server *Server) handleLoginTOTPRequest(w http.ResponseWriter, r *http.Request) {
+	s := server.pendingSession(r)
+	if s == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	a := s.admin
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	ip := clientIP(r)
+	now := time.Now()
+	tx, wait, err := beginLoginAttempt(ctx, server.db, a.Username, ip, now)
+	if err != nil {
+		log.Printf("failed to check login throttling: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if wait > 0 {
+		writeTooManyAttempts(w, wait)
+		return
+	}
+
+	ok, err := verifySecondFactor(ctx, a, r.PostForm.Get("code"), now)
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		log.Printf("rejected invalid second factor for %s from %s", a.Username, ip)
+		if err := server.recordLoginFailure(ctx, tx, a.Username, ip, r.Header.Get("User-Agent"), now); err != nil {
+			log.Print(err)
+		}
+		server.audit(r, a.Username, "login_failed", "", nil, map[string]string{"method": "totp"})
+		server.renderLoginTOTP(w, r, http.StatusUnauthorized, "Código incorrecto.")
+		return
+	}
+
+	if err := completeSecondFactor(ctx, s); err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if err := recordLoginSuccess(ctx, tx, a.Username, ip, r.Header.Get("User-Agent"), now); err != nil {
+		log.Print(err)
+	}
+	method := "password+totp"
+	if a.External {
+		method = "sso+totp"
+	}
+	server.audit(r, a.Username, "login", "", nil, map[string]string{"method": method})
+
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// ResetTwoFactor turns TOTP off for an admin who lost their device, and ends
+// their sessions. They can enroll again after logging in.
+func ResetTwoFactor(ctx context.Context, db *sql.DB, username string) error {
+	res, err := db.ExecContext(ctx, queryResetTOTP, username, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to reset two factor authentication of admin %s: %w", username, err)
+	}
+
+	if err := expectOneRow(res); err != nil {
+		return err
+	}
+
+	if _, err := db.ExecContext(ctx, queryDeleteRecoveryCodesByName, username); err != nil {
+		return fmt.Errorf("failed to delete recovery codes of admin %s: %w", username, err)
+	}
+
+	return LogoutAdmin(ctx, db, username)
+}
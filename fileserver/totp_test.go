@@ -0,0 +1,78 @@
+package fileserver
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 key of RFC 6238's test vectors,
+// "12345678901234567890", in base32.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238, appendix B, truncated to our six digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		got, err := totpCode(rfc6238Secret, tt.unix/totpPeriod)
+		if err != nil {
+			t.Fatalf("totpCode at %d: %s", tt.unix, err)
+		}
+		if got != tt.want {
+			t.Errorf("totpCode at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+
+	if _, err := totpCode("not base32!", 1); err == nil {
+		t.Error("totpCode accepted a secret that isn't base32")
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := now.Unix() / totpPeriod
+	code := func(step int64) string {
+		c, err := totpCode(rfc6238Secret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name   string
+		secret string
+		code   string
+		want   int64
+	}{
+		{name: "current", secret: rfc6238Secret, code: "050471", want: step},
+		{name: "previous step", secret: rfc6238Secret, code: code(step - 1), want: step - 1},
+		{name: "next step", secret: rfc6238Secret, code: code(step + 1), want: step + 1},
+		{name: "two steps ago", secret: rfc6238Secret, code: code(step - 2)},
+		{name: "two steps ahead", secret: rfc6238Secret, code: code(step + 2)},
+		{name: "surrounding spaces", secret: rfc6238Secret, code: " 050471 ", want: step},
+		{name: "lower case secret", secret: "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", code: "050471", want: step},
+		{name: "wrong code", secret: rfc6238Secret, code: "050472"},
+		{name: "too short", secret: rfc6238Secret, code: "50471"},
+		{name: "eight digits", secret: rfc6238Secret, code: "14050471"},
+		{name: "bad secret", secret: "not base32!", code: "050471"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchTOTP(tt.secret, tt.code, now); got != tt.want {
+				t.Errorf("matchTOTP = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
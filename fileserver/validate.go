@@ -0,0 +1,401 @@
+package fileserver
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ajg/form"
+)
+
+const (
+	// defaultMinAge is the legal age in Colombia
+	defaultMinAge = 18
+	maxAge        = 120
+
+	// cédulas have between 4 and 10 digits
+	minIDNo = 1000
+	maxIDNo = 9999999999
+)
+
+// maximum lengths, in characters
+const (
+	maxNameLen    = 100
+	maxPlaceLen   = 100
+	maxStreetLen  = 200
+	maxEmailLen   = 254
+	maxPhoneLen   = 30
+	maxQtyLen     = 50
+	maxGenderLen  = 50
+	maxCountryLen = 60
+)
+
+// genders maps the accepted spellings of each gender, folded, to the value
+// stored.
+var genders = map[string]string{
+	"masculino": "masculino", "hombre": "masculino", "male": "masculino", "m": "masculino",
+	"femenino": "femenino", "mujer": "femenino", "female": "femenino", "f": "femenino",
+	"no binario": "no binario", "non-binary": "no binario", "nonbinary": "no binario",
+	"otro": "otro", "other": "otro",
+	"prefiero no decir": "prefiero no decir", "prefer not to say": "prefiero no decir",
+}
+
+var fieldOrder = map[string]int{
+	"fname": 1, "lname": 2, "id_no": 3, "email": 4, "phone": 5, "country": 6, "department": 7,
+	"city": 8, "neighborhood": 9, "street_address": 10, "gender": 11, "age": 12, "birth_date": 12,
+	"daily_qty": 13, "weekly_qty": 14, "monthly_qty": 15, "authorized": 16,
+}
+
+// fieldError is a problem with one form field. Message is filled in by
+// localize.
+type fieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	arg     int
+}
+
+type fieldErrors []fieldError
+
+func (e *fieldErrors) add(field, code string, arg int) {
+	if !e.has(field) {
+		*e = append(*e, fieldError{Field: field, Code: code, arg: arg})
+	}
+}
+
+func (e fieldErrors) has(field string) bool {
+	for _, fe := range e {
+		if fe.Field == field {
+			return true
+		}
+	}
+
+	return false
+}
+
+var fieldErrorMessages = map[string]map[string]string{
+	"es": {
+		"required":                "Este campo es obligatorio.",
+		"too_long":                "Debe tener máximo %d caracteres.",
+		"invalid_email":           "El correo electrónico no es válido.",
+		"invalid_phone":           "El teléfono no es válido. Usa un celular o fijo colombiano, o el número con indicativo, p. ej. +57 300 123 4567.",
+		"invalid_id":              "La cédula debe tener entre 4 y 10 dígitos.",
+		"age_range":               "Debes tener al menos %d años para inscribirte en este evento.",
+		"invalid_birth_date":      "La fecha de nacimiento no es válida. Usa AAAA-MM-DD o DD/MM/AAAA.",
+		"invalid_age":             "La edad no es válida.",
+		"invalid_gender":          "Elige un género de la lista.",
+		"invalid_choice":          "Elige una opción de la lista.",
+		"city_not_in_department":  "La ciudad no pertenece al departamento elegido.",
+		"unknown_consent_version": "Esa versión de la autorización no existe. Recarga el formulario y acéptala de nuevo.",
+		"invalid_number":          "Debe ser un número entero.",
+		"too_small":               "Debe ser al menos %d.",
+		"too_large":               "Debe ser máximo %d.",
+	},
+	"en": {
+		"required":                "This field is required.",
+		"too_long":                "Must be at most %d characters long.",
+		"invalid_email":           "The email address is not valid.",
+		"invalid_phone":           "The phone number is not valid. Use a Colombian mobile or landline, or the number with its country code, e.g. +57 300 123 4567.",
+		"invalid_id":              "The ID number must have between 4 and 10 digits.",
+		"age_range":               "You must be at least %d years old to register for this event.",
+		"invalid_birth_date":      "The date of birth is not valid. Use YYYY-MM-DD or DD/MM/YYYY.",
+		"invalid_age":             "The age is not valid.",
+		"invalid_gender":          "Pick a gender from the list.",
+		"invalid_choice":          "Pick an option from the list.",
+		"city_not_in_department":  "The city is not in the chosen department.",
+		"unknown_consent_version": "That version of the authorization doesn't exist. Reload the form and accept it again.",
+		"invalid_number":          "Must be a whole number.",
+		"too_small":               "Must be at least %d.",
+		"too_large":               "Must be at most %d.",
+	},
+}
+
+// localize fills in the messages in the language the request prefers.
+func (e fieldErrors) localize(r *http.Request) fieldErrors {
+	messages := fieldErrorMessages[preferredLanguage(r)]
+	out := make(fieldErrors, len(e))
+	for i, fe := range e {
+		fe.Message = messages[fe.Code]
+		if strings.Contains(fe.Message, "%d") {
+			fe.Message = strings.Replace(fe.Message, "%d", strconv.Itoa(fe.arg), 1)
+		}
+		out[i] = fe
+	}
+
+	return out
+}
+
+// preferredLanguage picks between Spanish, the default, and English from
+// the Accept-Language header.
+func preferredLanguage(r *http.Request) string {
+	best, bestQ := "es", -1.0
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			if f, err := strconv.ParseFloat(params[2:], 64); err == nil {
+				q = f
+			}
+		}
+
+		lang, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		if _, ok := fieldErrorMessages[lang]; ok && q > bestQ {
+			best, bestQ = lang, q
+		}
+	}
+
+	return best
+}
+
+// decodeFormInfo decodes and validates a registration for e, which takes
+// attendees from minAge, and the answers to the custom questions of schema,
+// which may be nil. Numbers that don't
+// parse are reported like any other invalid field instead of failing the
+// whole form.
+func decodeFormInfo(values url.Values, schema *FormSchema, e *event, minAge int) (formInfo, fieldErrors, error) {
+	var fi formInfo
+	var errs fieldErrors
+
+	clean := make(url.Values, len(values))
+	for k, v := range values {
+		clean[k] = v
+	}
+
+	// people write their cédula as 1.234.567
+	idNo := digitsOnly(values.Get("id_no"))
+	switch {
+	case idNo == "":
+		errs.add("id_no", "required", 0)
+		clean.Del("id_no")
+	case len(idNo) > 10:
+		errs.add("id_no", "invalid_id", 0)
+		clean.Del("id_no")
+	default:
+		clean.Set("id_no", idNo)
+	}
+
+	// the age can come from the date of birth instead
+	age := strings.TrimSpace(values.Get("age"))
+	if _, err := strconv.ParseUint(age, 10, 16); err != nil {
+		switch {
+		case age == "" && strings.TrimSpace(values.Get("birth_date")) != "":
+		case age == "":
+			errs.add("age", "required", 0)
+		default:
+			errs.add("age", "invalid_age", 0)
+		}
+		clean.Del("age")
+	}
+
+	dec := form.NewDecoder(nil)
+	dec.IgnoreUnknownKeys(true)
+	if err := dec.DecodeValues(&fi, clean); err != nil {
+		return fi, nil, err
+	}
+
+	fi.validate(&errs)
+	fi.validateAge(e, minAge, time.Now(), &errs)
+	fi.Answers = schema.decodeAnswers(values, &errs)
+
+	// in the order of the form
+	sort.SliceStable(errs, func(i, j int) bool {
+		return schema.fieldOrder(errs[i].Field) < schema.fieldOrder(errs[j].Field)
+	})
+
+	return fi, errs, nil
+}
+
+// validate normalizes the registration in place and adds what's wrong
+// with it to errs.
+func (fi *formInfo) validate(errs *fieldErrors) {
+	text := func(field string, v *string, max int, required bool) {
+		*v = strings.Join(strings.Fields(*v), " ")
+		switch {
+		case *v == "" && required:
+			errs.add(field, "required", 0)
+		case utf8.RuneCountInString(*v) > max:
+			errs.add(field, "too_long", max)
+		}
+	}
+
+	text("fname", &fi.FirstName, maxNameLen, true)
+	text("lname", &fi.LastName, maxNameLen, true)
+	text("country", &fi.Country, maxCountryLen, true)
+	// the frontend may send just the DIVIPOLA codes
+	text("department", &fi.Department, maxPlaceLen, fi.DepartmentCode == "")
+	text("city", &fi.City, maxPlaceLen, fi.CityCode == "")
+	fi.validatePlace(errs)
+	text("neighborhood", &fi.Neighborhood, maxPlaceLen, false)
+	text("street_address", &fi.Street, maxStreetLen, false)
+	text("daily_qty", &fi.DailyQty, maxQtyLen, false)
+	text("weekly_qty", &fi.WeeklyQty, maxQtyLen, false)
+	text("monthly_qty", &fi.MonthlyQty, maxQtyLen, false)
+
+	// nothing is kept about someone who didn't authorize processing it
+	if !fi.Authorized {
+		errs.add("authorized", "required", 0)
+	}
+	fi.ConsentVersion = strings.TrimSpace(fi.ConsentVersion)
+
+	if !errs.has("id_no") && (fi.ID < minIDNo || fi.ID > maxIDNo) {
+		errs.add("id_no", "invalid_id", 0)
+	}
+
+	text("email", &fi.Email, maxEmailLen, true)
+	if !errs.has("email") {
+		if email, ok := normalizeEmail(fi.Email); ok {
+			fi.Email = email
+		} else {
+			errs.add("email", "invalid_email", 0)
+		}
+	}
+
+	text("phone", &fi.Phone, maxPhoneLen, true)
+	if !errs.has("phone") {
+		if phone, ok := normalizePhone(fi.Phone); ok {
+			fi.Phone = phone
+		} else {
+			errs.add("phone", "invalid_phone", 0)
+		}
+	}
+
+	text("gender", &fi.Gender, maxGenderLen, true)
+	if !errs.has("gender") {
+		if g, ok := genders[foldAccents(strings.ToLower(fi.Gender))]; ok {
+			fi.Gender = g
+		} else {
+			errs.add("gender", "invalid_gender", 0)
+		}
+	}
+}
+
+// normalizeEmail accepts a bare address with a dotted domain, and lower
+// cases the domain.
+func normalizeEmail(s string) (string, bool) {
+	addr, err := mail.ParseAddress(s)
+	if err != nil || addr.Name != "" || addr.Address != s {
+		return "", false
+	}
+
+	at := strings.LastIndexByte(s, '@')
+	domain := strings.ToLower(s[at+1:])
+	if !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+		return "", false
+	}
+
+	return s[:at] + "@" + domain, true
+}
+
+// normalizePhone returns a phone number in E.164. Numbers without a country
+// code are taken as Colombian: ten digits, starting with 3 for mobiles or
+// 60 for landlines.
+func normalizePhone(s string) (string, bool) {
+	var digits strings.Builder
+	international := false
+	for i, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case r == '+' && i == 0:
+			international = true
+		case strings.ContainsRune(" -().", r):
+		default:
+			return "", false
+		}
+	}
+
+	d := digits.String()
+	if !international && strings.HasPrefix(d, "00") {
+		d, international = d[2:], true
+	}
+
+	colombian := func(n string) bool {
+		return len(n) == 10 && (n[0] == '3' || strings.HasPrefix(n, "60"))
+	}
+
+	switch {
+	case international || (len(d) == 12 && strings.HasPrefix(d, "57")):
+		if strings.HasPrefix(d, "57") && !colombian(d[2:]) {
+			return "", false
+		}
+	case colombian(d):
+		d = "57" + d
+	default:
+		return "", false
+	}
+
+	if len(d) < 8 || len(d) > 15 || d[0] == '0' {
+		return "", false
+	}
+
+	return "+" + d, true
+}
+
+const tplFormErrors = `<!DOCTYPE html>
+<html>
+	<body>
+		<h1>{{if eq .Lang "en"}}Please fix the following and submit the form again:{{else}}Por favor corrige lo siguiente y env&iacute;a el formulario de nuevo:{{end}}</h1>
+		<ul>
+		{{- range .Errors}}
+			<li><b>{{index $.Labels .Field}}</b>: {{.Message}}</li>
+		{{- end}}
+		</ul>
+		<p><a href="{{.Back}}">{{if eq .Lang "en"}}Back to the form{{else}}Volver al formulario{{end}}</a></p>
+	</body>
+</html>
+`
+
+var tmplFormErrors = template.Must(template.New("formErrors").Parse(tplFormErrors))
+
+var fieldLabels = map[string]map[string]string{
+	"es": {
+		"fname": "Nombre", "lname": "Apellido", "country": "País", "department": "Departamento",
+		"city": "Ciudad", "neighborhood": "Barrio", "street_address": "Dirección", "id_no": "Cédula",
+		"phone": "Teléfono", "email": "Correo", "gender": "Género", "age": "Edad", "birth_date": "Fecha de nacimiento",
+		"daily_qty": "Consumo diario", "weekly_qty": "Consumo semanal", "monthly_qty": "Consumo mensual",
+		"authorized": "Autorización de datos",
+	},
+	"en": {
+		"fname": "First name", "lname": "Last name", "country": "Country", "department": "Department",
+		"city": "City", "neighborhood": "Neighborhood", "street_address": "Address", "id_no": "ID number",
+		"phone": "Phone", "email": "Email", "gender": "Gender", "age": "Age", "birth_date": "Date of birth",
+		"daily_qty": "Daily use", "weekly_qty": "Weekly use", "monthly_qty": "Monthly use",
+		"authorized": "Data processing authorization",
+	},
+}
+
+type formErrorsPage struct {
+	Back   string
+	Lang   string
+	Labels map[string]string
+	Errors fieldErrors
+}
+
+// writeFieldErrors rejects a form with 422, as JSON for clients that ask
+// for it and as a page listing the errors, linking back to the form,
+// otherwise.
+func (server *Server) writeFieldErrors(w http.ResponseWriter, r *http.Request, errs fieldErrors, back string) {
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		writeFieldErrorsJSON(w, r, errs)
+		return
+	}
+
+	errs = errs.localize(r)
+	lang := preferredLanguage(r)
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	if err := tmplFormErrors.Execute(w, formErrorsPage{back, lang, server.schema.labels(lang), errs}); err != nil {
+		log.Printf("failed to execute template for field errors: %s", err)
+	}
+}
+
+func writeFieldErrorsJSON(w http.ResponseWriter, r *http.Request, errs fieldErrors) {
+	writeJSON(w, http.StatusUnprocessableEntity, map[string]fieldErrors{"errors": errs.localize(r)})
+}
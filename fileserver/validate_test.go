@@ -0,0 +1,151 @@
+package fileserver
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNormalizePhone(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"3001234567", "+573001234567"},
+		{"300 123 4567", "+573001234567"},
+		{"(300) 123-4567", "+573001234567"},
+		{"300.123.4567", "+573001234567"},
+		{"+57 300 1234567", "+573001234567"},
+		{"573001234567", "+573001234567"},
+		{"57 300 123 4567", "+573001234567"},
+		{"00573001234567", "+573001234567"},
+		{"6012345678", "+576012345678"},
+		{"+57 601 2345678", "+576012345678"},
+		{"+1 415 555 0100", "+14155550100"},
+		{"0034 612 345 678", "+34612345678"},
+		{"", ""},
+		{"1234567890", ""},
+		{"5001234567", ""},
+		{"30012345", ""},
+		{"30012345678", ""},
+		{"+57 123", ""},
+		{"+57 500 1234567", ""},
+		{"300-123-456a", ""},
+		{"3001234567+", ""},
+		{"+0123456789", ""},
+		{"+1234567", ""},
+		{"+1234567890123456", ""},
+		{"٣٠٠١٢٣٤٥٦٧", ""},
+	}
+
+	for _, tt := range tests {
+		got, ok := normalizePhone(tt.in)
+		if ok != (tt.want != "") || got != tt.want {
+			t.Errorf("normalizePhone(%q) = %q, %t, want %q", tt.in, got, ok, tt.want)
+		}
+	}
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"ana@example.com", "ana@example.com"},
+		{"Ana@Example.COM", "Ana@example.com"},
+		{"ana.maria+eventos@sub.example.co", "ana.maria+eventos@sub.example.co"},
+		{"", ""},
+		{"ana", ""},
+		{"ana@", ""},
+		{"@example.com", ""},
+		{"ana@@example.com", ""},
+		{"Ana <ana@example.com>", ""},
+		{"<ana@example.com>", ""},
+		{"ana@localhost", ""},
+		{"ana@example.com.", ""},
+		{" ana@example.com", ""},
+		{"ana@example.com ", ""},
+		{"ana@example.com, luis@example.com", ""},
+	}
+
+	for _, tt := range tests {
+		got, ok := normalizeEmail(tt.in)
+		if ok != (tt.want != "") || got != tt.want {
+			t.Errorf("normalizeEmail(%q) = %q, %t, want %q", tt.in, got, ok, tt.want)
+		}
+	}
+}
+
+func TestPreferredLanguage(t *testing.T) {
+	tests := []struct {
+		header, want string
+	}{
+		{"", "es"},
+		{"es-CO,es;q=0.9", "es"},
+		{"en-US,en;q=0.9", "en"},
+		{"EN", "en"},
+		{"es-CO,en;q=0.8", "es"},
+		{"fr-FR, en;q=0.5", "en"},
+		{"en;q=0.2, es;q=0.8", "es"},
+		{"fr, de", "es"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Language", tt.header)
+		if got := preferredLanguage(r); got != tt.want {
+			t.Errorf("preferredLanguage(%q) = %s, want %s", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestLocalize(t *testing.T) {
+	errs := fieldErrors{{Field: "age", Code: "age_range", arg: 21}, {Field: "email", Code: "invalid_email"}}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Language", "en")
+	got := errs.localize(r)
+	if got[0].Message != "You must be at least 21 years old to register for this event." {
+		t.Errorf("age_range message = %q", got[0].Message)
+	}
+	if got[1].Message == "" {
+		t.Error("invalid_email has no English message")
+	}
+	if errs[0].Message != "" {
+		t.Error("localize changed the errors in place")
+	}
+
+	for lang, messages := range fieldErrorMessages {
+		for code := range fieldErrorMessages["es"] {
+			if messages[code] == "" {
+				t.Errorf("%s has no %s message", code, lang)
+			}
+		}
+	}
+}
+
+func TestValidateAuthorized(t *testing.T) {
+	tests := []struct {
+		name       string
+		authorized bool
+		want       bool
+	}{
+		{name: "authorized", authorized: true},
+		{name: "not authorized", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fi := formInfo{
+				FirstName: "Ana", LastName: "Pérez", Country: "Colombia", Department: "Antioquia", City: "Medellín",
+				ID: 1020304050, Email: "ana@example.com", Phone: "3001234567", Gender: "F", Authorized: tt.authorized,
+			}
+
+			var errs fieldErrors
+			fi.validate(&errs)
+			if got := errs.has("authorized"); got != tt.want {
+				t.Errorf("authorized error = %t, want %t (errors %+v)", got, tt.want, errs)
+			}
+			if len(errs) > 1 || (len(errs) == 1 && !tt.want) {
+				t.Errorf("unexpected errors %+v", errs)
+			}
+		})
+	}
+}
@@ -0,0 +1,284 @@
+package fileserver
+
+import (
+	"context"
+	"database/sql"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const verifyPurpose = "verify-email"
+
+// unverifiedSweepInterval is how often registrations that weren't confirmed
+// in time are deleted, besides whenever someone registers
+const unverifiedSweepInterval = 5 * time.Minute
+
+// kinds of emails recorded in email_status
+const (
+	emailTicket       = "ticket"
+	emailVerification = "verification"
+)
+
+const (
+	// expired registrations go with their request headers, conflicts and
+	// consents, like anonymized ones do. It returns the events whose places
+	// were freed.
+	queryDeleteUnverified = `WITH expired AS (
+		DELETE FROM form_info WHERE verified_time IS NULL AND ctime < $1
+		RETURNING id, event_id, waitlisted_time IS NULL AS placed
+	), conflicts AS (
+		DELETE FROM registration_conflicts WHERE form_id IN (SELECT id FROM expired)
+	), consents AS (
+		DELETE FROM consents WHERE form_id IN (SELECT id FROM expired)
+	), requests AS (
+		DELETE FROM request_info WHERE form_id IN (SELECT id FROM expired)
+	)
+	SELECT DISTINCT event_id FROM expired WHERE placed`
+
+	queryVerifyRegistration = `UPDATE form_info SET verified_time = $2
+	WHERE id=$1 AND verified_time IS NULL AND anonymized_time IS NULL
+	RETURNING email, id_no, id_hash, event_id, waitlisted_time IS NOT NULL`
+
+	querySelectVerified = `SELECT verified_time IS NOT NULL, waitlisted_time IS NOT NULL
+	FROM form_info WHERE id=$1 AND anonymized_time IS NULL`
+)
+
+var stmtDeleteUnverified *sql.Stmt
+var stmtVerifyRegistration *sql.Stmt
+var stmtSelectVerified *sql.Stmt
+
+const tplVerify = `<!DOCTYPE html>
+<html>
+	<body>
+		<h1>Confirma tu correo</h1>
+		<p>Para recibir tu boleta, confirma que este es tu correo.</p>
+		<form action="/verify/{{.Token}}" method="POST">
+		<input type="hidden" name="csrf_token" value="{{.CSRFToken}}" />
+		<input type="submit" value="confirmar" />
+		</form>
+	</body>
+</html>
+`
+
+const tplVerified = `<!DOCTYPE html>
+<html>
+	<body>
+		<h1>&iexcl;Listo! Tu correo est&aacute; confirmado.</h1>
+		<p>Te enviamos tu boleta; rev&iacute;sala en tu bandeja de entrada.</p>
+	</body>
+</html>
+`
+
+const tplVerifiedWaitlisted = `<!DOCTYPE html>
+<html>
+	<body>
+		<h1>Tu correo est&aacute; confirmado.</h1>
+		<p>Ya no quedan cupos, as&iacute; que est&aacute;s en la lista de espera. Si se libera
+		un cupo te enviaremos tu boleta a este correo, en el orden en que se registraron.</p>
+	</body>
+</html>
+`
+
+const tplVerifyInvalid = `<!DOCTYPE html>
+<html>
+	<body>
+		<h1>El enlace no es v&aacute;lido o ya venci&oacute;.</h1>
+		<p>Si no confirmaste tu correo a tiempo, tu registro se borr&oacute; y puedes
+		<a href="/form">registrarte de nuevo</a>.</p>
+	</body>
+</html>
+`
+
+var tmplVerify = template.Must(template.New("verify").Parse(tplVerify))
+
+type verifyPage struct {
+	CSRFToken string
+	Token     string
+}
+
+func writeVerifyInvalid(w http.ResponseWriter) {
+	w.Header().Add("Content-Type", "text/html")
+	w.WriteHeader(http.StatusNotFound)
+	w.Write([]byte(tplVerifyInvalid))
+}
+
+// unverifiedCutoff is when registrations still unconfirmed at now were
+// made at the latest to have expired.
+func (server *Server) unverifiedCutoff(now time.Time) time.Time {
+	return now.Add(-server.verifyFor)
+}
+
+// deleteUnverified frees the ID numbers of registrations that weren't
+// confirmed in time, and gives the places they held to the waitlists.
+func (server *Server) deleteUnverified(ctx context.Context, now time.Time) {
+	rows, err := stmtDeleteUnverified.QueryContext(ctx, server.unverifiedCutoff(now))
+	if err != nil {
+		log.Printf("failed to delete unverified registrations: %s", err)
+		return
+	}
+	defer rows.Close()
+
+	var events []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			log.Printf("failed to scan event of unverified registrations: %s", err)
+			return
+		}
+		events = append(events, id)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("failed to delete unverified registrations: %s", err)
+		return
+	}
+	rows.Close()
+
+	for _, id := range events {
+		server.promoteWaitlist(ctx, id)
+	}
+}
+
+// sweepUnverified deletes the registrations that weren't confirmed in time
+// every unverifiedSweepInterval, until stop is closed.
+func (server *Server) sweepUnverified(stop <-chan struct{}) {
+	ticker := time.NewTicker(unverifiedSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			server.deleteUnverified(ctx, now)
+			cancel()
+		}
+	}
+}
+
+// sendVerification emails the link confirming a new registration, and
+// records how that went. The link expires with the registration.
+func (server *Server) sendVerification(formID int64, email string, idNo uint64, now time.Time) {
+	token := server.signToken(verifyPurpose, strconv.FormatInt(formID, 10), now.Add(server.verifyFor))
+	msg, id, err := server.sendVerificationLink(email, siteURL+"/verify/"+token)
+	if err != nil {
+		log.Printf("failed to send verification link for registration %d: %s", formID, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	recordEmailStatus(ctx, emailVerification, formID, email, idNo, msg, id, err)
+}
+
+func recordEmailStatus(ctx context.Context, kind string, formID int64, email string, idNo uint64, msg, id string, err error) {
+	var errString string
+	if err != nil {
+		errString = err.Error()
+	}
+
+	if _, err := stmtInsertEmailStatus.ExecContext(ctx, email, idNo, msg, id, errString, time.Now(), kind, formID); err != nil {
+		log.Printf("failed to store email status of registration %d: %s", formID, err)
+	}
+}
+
+// sendTicket emails the ticket of a registration for an event, identified
+// by its stored hash, and records how that went.
+func (server *Server) sendTicket(formID, eventID int64, email string, idNo uint64, hash string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var msg, id string
+	e, err := selectEvent(ctx, eventID)
+	if err == nil {
+		msg, id, err = server.sendEmail(e, email, hash)
+	}
+
+	recordEmailStatus(ctx, emailTicket, formID, email, idNo, msg, id, err)
+}
+
+// handleVerify confirms an attendee's email and issues the ticket. The link
+// opens a page with a button rather than confirming right away, so mail
+// scanners following links don't confirm addresses nobody checked.
+func (server *Server) handleVerify(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, "/verify/")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+
+	subject, err := server.verifyToken(verifyPurpose, token, time.Now())
+	if err != nil {
+		writeVerifyInvalid(w)
+		return
+	}
+	formID, err := strconv.ParseInt(subject, 10, 64)
+	if err != nil {
+		writeVerifyInvalid(w)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	if r.Method == http.MethodGet {
+		var verified, waitlisted bool
+		err := stmtSelectVerified.QueryRowContext(ctx, formID).Scan(&verified, &waitlisted)
+		if err == sql.ErrNoRows {
+			writeVerifyInvalid(w)
+			return
+		}
+		if err != nil {
+			log.Printf("failed to select registration %d: %s", formID, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if verified {
+			w.Header().Add("Content-Type", "text/html")
+			if waitlisted {
+				w.Write([]byte(tplVerifiedWaitlisted))
+				return
+			}
+			w.Write([]byte(tplVerified))
+			return
+		}
+
+		csrf, err := server.csrfToken(w, r)
+		if err != nil {
+			log.Printf("failed to issue CSRF token: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Add("Content-Type", "text/html")
+		if err := tmplVerify.Execute(w, verifyPage{CSRFToken: csrf, Token: token}); err != nil {
+			log.Printf("failed to execute template for verification: %s", err)
+		}
+		return
+	}
+
+	var email, hash string
+	var idNo uint64
+	var eventID int64
+	var waitlisted bool
+	err = stmtVerifyRegistration.QueryRowContext(ctx, formID, time.Now()).Scan(&email, &idNo, &hash, &eventID, &waitlisted)
+	if err == sql.ErrNoRows {
+		// confirmed already, from another tab or a double click
+		http.Redirect(w, r, "/verify/"+token, http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to verify registration %d: %s", formID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("registration %d verified", formID)
+
+	if waitlisted {
+		// it may take a place freed since it was waitlisted
+		server.promoteWaitlist(ctx, eventID)
+	} else {
+		go server.sendTicket(formID, eventID, email, idNo, hash)
+	}
+
+	http.Redirect(w, r, "/verify/"+token, http.StatusSeeOther)
+}
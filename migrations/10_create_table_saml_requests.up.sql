@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS saml_requests(
+	id TEXT PRIMARY KEY,
+	ctime TIMESTAMP WITH TIME ZONE
+);
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS form_info_ctime;
+DROP INDEX IF EXISTS form_info_search;
+ALTER TABLE form_info DROP COLUMN IF EXISTS search;
+
+DROP TABLE IF EXISTS "claims";
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS claims(
+	id SERIAL,
+	id_hash TEXT,
+	admin TEXT,
+	remote_addr TEXT,
+	useragent TEXT,
+	ctime TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX IF NOT EXISTS claims_id_hash ON claims(id_hash);
+
+ALTER TABLE form_info ADD COLUMN IF NOT EXISTS search tsvector GENERATED ALWAYS AS (to_tsvector('simple', translate(lower(
+	coalesce(first_name, '') || ' ' || coalesce(last_name, '') || ' ' ||
+	coalesce(id_no::text, '') || ' ' || coalesce(email, '') || ' ' || coalesce(phone, '') || ' ' ||
+	coalesce(department, '') || ' ' || coalesce(city, '') || ' ' || coalesce(neighborhood, '')
+), 'áàäéèëíìïóòöúùüñ', 'aaaeeeiiiooouuun'))) STORED;
+CREATE INDEX IF NOT EXISTS form_info_search ON form_info USING GIN(search);
+CREATE INDEX IF NOT EXISTS form_info_ctime ON form_info(ctime);
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS export_log(
+	id SERIAL PRIMARY KEY,
+	admin TEXT,
+	format TEXT,
+	filter TEXT,
+	columns TEXT,
+	masked BOOLEAN,
+	rows INTEGER,
+	remote_addr TEXT,
+	useragent TEXT,
+	ctime TIMESTAMP WITH TIME ZONE
+);
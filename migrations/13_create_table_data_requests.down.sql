@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS request_info_form_id;
+ALTER TABLE request_info DROP COLUMN IF EXISTS form_id;
+ALTER TABLE form_info DROP COLUMN IF EXISTS anonymized_time;
+
+DROP TABLE IF EXISTS "data_requests";
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS data_requests(
+	id SERIAL,
+	form_id INTEGER,
+	kind TEXT,
+	remote_addr TEXT,
+	useragent TEXT,
+	ctime TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX IF NOT EXISTS data_requests_form_id ON data_requests(form_id);
+
+ALTER TABLE form_info ADD COLUMN IF NOT EXISTS anonymized_time TIMESTAMP WITH TIME ZONE;
+ALTER TABLE request_info ADD COLUMN IF NOT EXISTS form_id INTEGER;
+CREATE INDEX IF NOT EXISTS request_info_form_id ON request_info(form_id);
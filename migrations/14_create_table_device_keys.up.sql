@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS device_keys(
+	id SERIAL PRIMARY KEY,
+	station TEXT NOT NULL,
+	key_hash TEXT NOT NULL UNIQUE,
+	key_hint TEXT,
+	created_by TEXT,
+	expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+	revoked_at TIMESTAMP WITH TIME ZONE,
+	revoked_by TEXT,
+	last_used_at TIMESTAMP WITH TIME ZONE,
+	last_used_addr TEXT,
+	ctime TIMESTAMP WITH TIME ZONE
+);
@@ -0,0 +1,3 @@
+-- the triggers go with the table
+DROP TABLE IF EXISTS "audit_log";
+DROP FUNCTION IF EXISTS audit_log_append_only();
@@ -0,0 +1,31 @@
+CREATE TABLE IF NOT EXISTS audit_log(
+	id BIGSERIAL PRIMARY KEY,
+	actor TEXT NOT NULL,
+	action TEXT NOT NULL,
+	target TEXT,
+	remote_addr TEXT,
+	useragent TEXT,
+	request_id TEXT,
+	before_value TEXT,
+	after_value TEXT,
+	ctime TIMESTAMP WITH TIME ZONE NOT NULL,
+	prev_hash TEXT NOT NULL,
+	hash TEXT NOT NULL UNIQUE
+);
+CREATE INDEX IF NOT EXISTS audit_log_actor ON audit_log(actor);
+CREATE INDEX IF NOT EXISTS audit_log_action ON audit_log(action);
+CREATE INDEX IF NOT EXISTS audit_log_ctime ON audit_log(ctime);
+
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_log_no_update ON audit_log;
+CREATE TRIGGER audit_log_no_update BEFORE UPDATE OR DELETE ON audit_log
+	FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
+
+DROP TRIGGER IF EXISTS audit_log_no_truncate ON audit_log;
+CREATE TRIGGER audit_log_no_truncate BEFORE TRUNCATE ON audit_log
+	FOR EACH STATEMENT EXECUTE FUNCTION audit_log_append_only();
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS form_info_unverified;
+ALTER TABLE form_info DROP COLUMN IF EXISTS verified_time;
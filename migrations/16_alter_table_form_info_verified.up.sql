@@ -0,0 +1,4 @@
+ALTER TABLE form_info ADD COLUMN IF NOT EXISTS verified_time TIMESTAMP WITH TIME ZONE;
+-- everyone registered before double opt-in already has their ticket
+UPDATE form_info SET verified_time = ctime WHERE verified_time IS NULL;
+CREATE INDEX IF NOT EXISTS form_info_unverified ON form_info(ctime) WHERE verified_time IS NULL;
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS form_info_phone_digits;
+DROP INDEX IF EXISTS form_info_email;
+ALTER TABLE form_info DROP COLUMN IF EXISTS resent_time;
+
+DROP TABLE IF EXISTS "registration_conflicts";
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS registration_conflicts(
+	id SERIAL,
+	form_id INTEGER,
+	field TEXT,
+	submission TEXT,
+	remote_addr TEXT,
+	useragent TEXT,
+	ctime TIMESTAMP WITH TIME ZONE,
+	resolution TEXT,
+	resolved_by TEXT,
+	resolved_time TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX IF NOT EXISTS registration_conflicts_form_id ON registration_conflicts(form_id);
+CREATE INDEX IF NOT EXISTS registration_conflicts_open ON registration_conflicts(ctime) WHERE resolution IS NULL;
+
+ALTER TABLE form_info ADD COLUMN IF NOT EXISTS resent_time TIMESTAMP WITH TIME ZONE;
+CREATE INDEX IF NOT EXISTS form_info_email ON form_info(lower(email));
+CREATE INDEX IF NOT EXISTS form_info_phone_digits ON form_info(regexp_replace(phone, '\D', '', 'g'));
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS challenge_uses(
+	nonce TEXT PRIMARY KEY,
+	ctime TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX IF NOT EXISTS challenge_uses_ctime ON challenge_uses(ctime);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS form_info_waitlisted_time;
+ALTER TABLE form_info DROP COLUMN IF EXISTS promoted_time;
+ALTER TABLE form_info DROP COLUMN IF EXISTS waitlisted_time;
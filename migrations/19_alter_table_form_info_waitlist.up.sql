@@ -0,0 +1,3 @@
+ALTER TABLE form_info ADD COLUMN IF NOT EXISTS waitlisted_time TIMESTAMP WITH TIME ZONE;
+ALTER TABLE form_info ADD COLUMN IF NOT EXISTS promoted_time TIMESTAMP WITH TIME ZONE;
+CREATE INDEX IF NOT EXISTS form_info_waitlisted_time ON form_info(waitlisted_time) WHERE waitlisted_time IS NOT NULL;
@@ -0,0 +1 @@
+ALTER TABLE form_info DROP COLUMN IF EXISTS answers;
@@ -0,0 +1 @@
+ALTER TABLE form_info ADD COLUMN IF NOT EXISTS answers JSONB;
@@ -0,0 +1,9 @@
+-- fails while a cédula is registered for more than one event, rather than
+-- dropping registrations
+ALTER TABLE form_info DROP CONSTRAINT IF EXISTS form_info_event_id_id_no_key;
+ALTER TABLE form_info ADD CONSTRAINT form_info_id_no_key UNIQUE (id_no);
+
+DROP INDEX IF EXISTS form_info_event_id;
+ALTER TABLE form_info DROP COLUMN IF EXISTS event_id;
+
+DROP TABLE IF EXISTS "events";
@@ -0,0 +1,53 @@
+CREATE TABLE IF NOT EXISTS events(
+	id SERIAL PRIMARY KEY,
+	slug TEXT NOT NULL UNIQUE,
+	name TEXT NOT NULL,
+	starts_at TIMESTAMP WITH TIME ZONE,
+	ends_at TIMESTAMP WITH TIME ZONE,
+	venue TEXT,
+	flyer TEXT,
+	email_subject TEXT,
+	email_body TEXT,
+	capacity INTEGER,
+	gift_box_capacity INTEGER,
+	opens_at TIMESTAMP WITH TIME ZONE,
+	closes_at TIMESTAMP WITH TIME ZONE,
+	ctime TIMESTAMP WITH TIME ZONE
+);
+
+-- everything so far was for the march of 11 December 2021, with its ticket email
+INSERT INTO events(slug, name, starts_at, venue, email_subject, email_body, ctime)
+VALUES (
+	'marcha-2021',
+	'Marcha cannábica 11 de diciembre 2021',
+	'2021-12-11 00:00:00-05',
+	'Parque de las Luces',
+	'Movimiento Cannabico Colombiano Premio 11 de Diciembre 2021',
+	'
+<html>
+<body>
+<h1>Gracias por participar.</h1>
+
+	Te has ganado un premio.
+
+	Que puedes reclamar
+	<ol>
+	<li> En la Carroza durante marcha. </li>
+	<li> En la tarima de el evento después de la marcha en el parque luces. </li>
+	</ol>
+
+	Movimiento Cannabico Colombiano.
+</body>
+</html>
+',
+	now()
+);
+
+ALTER TABLE form_info ADD COLUMN IF NOT EXISTS event_id INTEGER REFERENCES events(id);
+UPDATE form_info SET event_id = (SELECT id FROM events WHERE slug = 'marcha-2021') WHERE event_id IS NULL;
+ALTER TABLE form_info ALTER COLUMN event_id SET NOT NULL;
+CREATE INDEX IF NOT EXISTS form_info_event_id ON form_info(event_id);
+
+-- a cédula can register once per event
+ALTER TABLE form_info DROP CONSTRAINT IF EXISTS form_info_id_no_key;
+ALTER TABLE form_info ADD CONSTRAINT form_info_event_id_id_no_key UNIQUE (event_id, id_no);
@@ -0,0 +1,2 @@
+ALTER TABLE events DROP COLUMN IF EXISTS paused_by;
+ALTER TABLE events DROP COLUMN IF EXISTS paused_time;
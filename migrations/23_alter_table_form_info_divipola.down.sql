@@ -0,0 +1,3 @@
+-- the official names given to earlier rows are kept
+ALTER TABLE form_info DROP COLUMN IF EXISTS city_code;
+ALTER TABLE form_info DROP COLUMN IF EXISTS department_code;
@@ -0,0 +1,4 @@
+ALTER TABLE form_info ADD COLUMN IF NOT EXISTS department_code TEXT;
+ALTER TABLE form_info ADD COLUMN IF NOT EXISTS city_code TEXT;
+-- earlier rows get their codes from `server admin backfill-places`, which
+-- reads DIVIPOLA from fileserver/divipola.csv like the form does
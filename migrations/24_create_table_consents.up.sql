@@ -0,0 +1,34 @@
+CREATE TABLE IF NOT EXISTS consent_texts(
+	id SERIAL PRIMARY KEY,
+	version TEXT NOT NULL UNIQUE,
+	body TEXT NOT NULL,
+	created_by TEXT,
+	ctime TIMESTAMP WITH TIME ZONE
+);
+
+-- the text accepted before texts were versioned wasn't kept
+INSERT INTO consent_texts(version, body, ctime)
+VALUES ('0', 'Autorización de tratamiento de datos personales aceptada antes de que se guardaran las versiones del texto.', now());
+
+CREATE TABLE IF NOT EXISTS consents(
+	id SERIAL,
+	form_id INTEGER NOT NULL UNIQUE,
+	consent_text_id INTEGER NOT NULL REFERENCES consent_texts(id),
+	accepted_time TIMESTAMP WITH TIME ZONE,
+	remote_addr TEXT,
+	useragent TEXT,
+	withdrawn_time TIMESTAMP WITH TIME ZONE,
+	withdrawn_addr TEXT,
+	withdrawn_useragent TEXT
+);
+CREATE INDEX IF NOT EXISTS consents_consent_text_id ON consents(consent_text_id);
+
+-- earlier authorizations count as version 0, from where the registration
+-- was submitted as far as its request headers tell
+INSERT INTO consents(form_id, consent_text_id, accepted_time, remote_addr, useragent)
+SELECT f.id, (SELECT id FROM consent_texts WHERE version = '0'), f.ctime, r.cfconnectingip, r.useragent
+FROM form_info f
+LEFT JOIN LATERAL (
+	SELECT cfconnectingip, useragent FROM request_info WHERE form_id = f.id ORDER BY ctime LIMIT 1
+) r ON TRUE
+WHERE f.authorized AND f.anonymized_time IS NULL;
@@ -0,0 +1,9 @@
+ALTER TABLE events DROP COLUMN IF EXISTS min_age;
+
+ALTER TABLE form_info DROP COLUMN IF EXISTS birth_date;
+
+-- back to a SMALLSERIAL; missing ages take sequence numbers again
+CREATE SEQUENCE IF NOT EXISTS form_info_age_seq AS SMALLINT OWNED BY form_info.age;
+UPDATE form_info SET age = nextval('form_info_age_seq') WHERE age IS NULL;
+ALTER TABLE form_info ALTER COLUMN age SET DEFAULT nextval('form_info_age_seq');
+ALTER TABLE form_info ALTER COLUMN age SET NOT NULL;
@@ -0,0 +1,13 @@
+-- age was a SMALLSERIAL, so a missing age took the next number of a
+-- sequence; it's a plain nullable SMALLINT from now on
+ALTER TABLE form_info ALTER COLUMN age DROP DEFAULT;
+ALTER TABLE form_info ALTER COLUMN age DROP NOT NULL;
+DROP SEQUENCE IF EXISTS form_info_age_seq;
+
+-- sequence numbers can't be told from real ages, except past the oldest
+-- age the form accepts
+UPDATE form_info SET age = NULL WHERE age > 120;
+
+ALTER TABLE form_info ADD COLUMN IF NOT EXISTS birth_date DATE;
+
+ALTER TABLE events ADD COLUMN IF NOT EXISTS min_age INTEGER;
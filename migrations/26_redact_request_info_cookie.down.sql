@@ -0,0 +1 @@
+-- the cookie values are gone for good
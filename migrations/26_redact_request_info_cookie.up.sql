@@ -0,0 +1,3 @@
+-- cookies were stored whole, session and CSRF tokens included; only their
+-- names are kept from now on
+UPDATE request_info SET cookie = regexp_replace(cookie, '=[^;]*', '', 'g') WHERE cookie LIKE '%=%';
@@ -0,0 +1 @@
+-- the deleted consents belonged to registrations that no longer exist
@@ -0,0 +1,3 @@
+-- consents of unverified registrations that expired before they were
+-- deleted along with them
+DELETE FROM consents WHERE form_id NOT IN (SELECT id FROM form_info);
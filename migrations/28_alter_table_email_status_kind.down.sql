@@ -0,0 +1,2 @@
+DELETE FROM email_status WHERE kind <> 'ticket';
+ALTER TABLE email_status DROP COLUMN IF EXISTS kind;
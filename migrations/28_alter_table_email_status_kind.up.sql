@@ -0,0 +1,3 @@
+-- only tickets were recorded before
+ALTER TABLE email_status ADD COLUMN IF NOT EXISTS kind TEXT;
+UPDATE email_status SET kind = 'ticket' WHERE kind IS NULL;
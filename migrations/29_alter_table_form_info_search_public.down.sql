@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS form_info_search_public;
+ALTER TABLE form_info DROP COLUMN IF EXISTS search_public;
@@ -0,0 +1,7 @@
+-- search for roles that get personal data masked: names and places only, so
+-- ID numbers, emails and phones can't be guessed a prefix at a time
+ALTER TABLE form_info ADD COLUMN IF NOT EXISTS search_public tsvector GENERATED ALWAYS AS (to_tsvector('simple', translate(lower(
+	coalesce(first_name, '') || ' ' || coalesce(last_name, '') || ' ' ||
+	coalesce(department, '') || ' ' || coalesce(city, '') || ' ' || coalesce(neighborhood, '')
+), 'áàäéèëíìïóòöúùüñ', 'aaaeeeiiiooouuun'))) STORED;
+CREATE INDEX IF NOT EXISTS form_info_search_public ON form_info USING GIN(search_public);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS email_status_form_id;
+ALTER TABLE email_status DROP COLUMN IF EXISTS form_id;
@@ -0,0 +1,10 @@
+-- emails were only tied to a registration by ID number, which the same
+-- person shares across events; older rows go to the latest registration
+-- made with that number before the email was sent
+ALTER TABLE email_status ADD COLUMN IF NOT EXISTS form_id INTEGER;
+UPDATE email_status SET form_id = (
+	SELECT f.id FROM form_info f
+	WHERE f.id_no::text = email_status.gov_id AND f.ctime <= email_status.ctime
+	ORDER BY f.ctime DESC LIMIT 1
+) WHERE form_id IS NULL AND gov_id IS NOT NULL;
+CREATE INDEX IF NOT EXISTS email_status_form_id ON email_status(form_id);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS lookup_log(
+	id SERIAL,
+	admin TEXT,
+	query TEXT,
+	results INTEGER,
+	remote_addr TEXT,
+	useragent TEXT,
+	ctime TIMESTAMP WITH TIME ZONE
+);
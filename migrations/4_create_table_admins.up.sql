@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS admins(
+	id SERIAL PRIMARY KEY,
+	username TEXT UNIQUE NOT NULL,
+	password_hash TEXT NOT NULL,
+	role TEXT NOT NULL CHECK (role IN ('owner', 'admin', 'scanner', 'viewer')),
+	disabled BOOLEAN NOT NULL DEFAULT FALSE,
+	ctime TIMESTAMP WITH TIME ZONE,
+	mtime TIMESTAMP WITH TIME ZONE
+);
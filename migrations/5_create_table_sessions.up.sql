@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS sessions(
+	token_hash TEXT PRIMARY KEY,
+	admin_id INTEGER NOT NULL REFERENCES admins(id) ON DELETE CASCADE,
+	remote_addr TEXT,
+	useragent TEXT,
+	ctime TIMESTAMP WITH TIME ZONE,
+	last_seen TIMESTAMP WITH TIME ZONE,
+	expires_at TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX IF NOT EXISTS sessions_admin_id ON sessions(admin_id);
@@ -0,0 +1,4 @@
+ALTER TABLE admins DROP COLUMN IF EXISTS locked_until;
+ALTER TABLE admins DROP COLUMN IF EXISTS email;
+
+DROP TABLE IF EXISTS "login_attempts";
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS login_attempts(
+	id SERIAL,
+	username TEXT,
+	remote_addr TEXT,
+	useragent TEXT,
+	success BOOLEAN,
+	ctime TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX IF NOT EXISTS login_attempts_username_ctime ON login_attempts(username, ctime);
+CREATE INDEX IF NOT EXISTS login_attempts_remote_addr_ctime ON login_attempts(remote_addr, ctime);
+
+ALTER TABLE admins ADD COLUMN IF NOT EXISTS email TEXT;
+ALTER TABLE admins ADD COLUMN IF NOT EXISTS locked_until TIMESTAMP WITH TIME ZONE;
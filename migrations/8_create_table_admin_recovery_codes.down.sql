@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS "admin_recovery_codes";
+
+ALTER TABLE sessions DROP COLUMN IF EXISTS second_factor_pending;
+
+ALTER TABLE admins DROP COLUMN IF EXISTS totp_last_step;
+ALTER TABLE admins DROP COLUMN IF EXISTS totp_enabled;
+ALTER TABLE admins DROP COLUMN IF EXISTS totp_secret;
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS admins_external_identity;
+ALTER TABLE admins DROP COLUMN IF EXISTS external_subject;
+ALTER TABLE admins DROP COLUMN IF EXISTS external_provider;
+
+DROP TABLE IF EXISTS "oidc_logins";
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS oidc_logins(
+	state TEXT PRIMARY KEY,
+	nonce TEXT NOT NULL,
+	code_verifier TEXT NOT NULL,
+	ctime TIMESTAMP WITH TIME ZONE
+);
+
+ALTER TABLE admins ADD COLUMN IF NOT EXISTS external_provider TEXT;
+ALTER TABLE admins ADD COLUMN IF NOT EXISTS external_subject TEXT;
+CREATE UNIQUE INDEX IF NOT EXISTS admins_external_identity ON admins(external_provider, external_subject);
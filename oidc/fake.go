@@ -0,0 +1,217 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeCodeTimeout is how long codes of the fake provider can be redeemed
+const fakeCodeTimeout = time.Minute
+
+// FakeProvider is a stand-in OpenID Connect provider, so the server can be
+// run and tested against it locally. Its authorization endpoint logs in
+// whoever comes by as Claims, without asking; its token endpoint checks the
+// client ID, redirect URI and PKCE verifier like a real one.
+type FakeProvider struct {
+	// Issuer is the URL the provider is served at
+	Issuer   string
+	ClientID string
+	// Claims go into every ID token, besides iss, aud, iat, exp and nonce
+	Claims map[string]interface{}
+	// Key signs the ID tokens with RS256, under KeyID
+	Key   *rsa.PrivateKey
+	KeyID string
+
+	mu    sync.Mutex
+	codes map[string]fakeCode
+}
+
+type fakeCode struct {
+	redirectURI string
+	challenge   string
+	nonce       string
+	issued      time.Time
+}
+
+// NewFakeProvider returns a FakeProvider with a fresh signing key.
+func NewFakeProvider(issuer, clientID string, claims map[string]interface{}) (*FakeProvider, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate signing key: %w", err)
+	}
+
+	return &FakeProvider{
+		Issuer:   issuer,
+		ClientID: clientID,
+		Claims:   claims,
+		Key:      key,
+		KeyID:    "fake",
+		codes:    make(map[string]fakeCode),
+	}, nil
+}
+
+// IDClaims are the claims of an ID token issued now for nonce.
+func (f *FakeProvider) IDClaims(nonce string, now time.Time) map[string]interface{} {
+	claims := map[string]interface{}{
+		"iss":   f.Issuer,
+		"aud":   f.ClientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+		"nonce": nonce,
+	}
+	for k, v := range f.Claims {
+		claims[k] = v
+	}
+
+	return claims
+}
+
+// Sign returns an ID token with claims, signed with the provider's key.
+func (f *FakeProvider) Sign(claims map[string]interface{}) (string, error) {
+	return signRS256(f.Key, f.KeyID, claims)
+}
+
+func signRS256(key *rsa.PrivateKey, kid string, claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "kid": kid, "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func (f *FakeProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/.well-known/openid-configuration"):
+		writeFakeJSON(w, http.StatusOK, discovery{
+			Issuer:                f.Issuer,
+			AuthorizationEndpoint: f.Issuer + "/authorize",
+			TokenEndpoint:         f.Issuer + "/token",
+			JWKSURI:               f.Issuer + "/jwks",
+		})
+	case strings.HasSuffix(r.URL.Path, "/jwks"):
+		pub := f.Key.PublicKey
+		writeFakeJSON(w, http.StatusOK, map[string][]jwk{"keys": {{
+			Kty: "RSA",
+			Kid: f.KeyID,
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}}})
+	case strings.HasSuffix(r.URL.Path, "/authorize") && r.Method == http.MethodGet:
+		f.authorize(w, r)
+	case strings.HasSuffix(r.URL.Path, "/token") && r.Method == http.MethodPost:
+		f.token(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *FakeProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	switch {
+	case err != nil || !redirect.IsAbs():
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	case q.Get("response_type") != "code" || q.Get("client_id") != f.ClientID:
+		http.Error(w, "unsupported response_type or unknown client_id", http.StatusBadRequest)
+		return
+	case q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "":
+		http.Error(w, "an S256 code_challenge is required", http.StatusBadRequest)
+		return
+	}
+
+	code, err := RandomString()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	f.mu.Lock()
+	if f.codes == nil {
+		f.codes = make(map[string]fakeCode)
+	}
+	f.codes[code] = fakeCode{redirect.String(), q.Get("code_challenge"), q.Get("nonce"), time.Now()}
+	f.mu.Unlock()
+
+	v := redirect.Query()
+	v.Set("code", code)
+	v.Set("state", q.Get("state"))
+	redirect.RawQuery = v.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (f *FakeProvider) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeFakeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	clientID := r.PostForm.Get("client_id")
+	if id, _, ok := r.BasicAuth(); ok {
+		clientID, _ = url.QueryUnescape(id)
+	}
+
+	// codes can only be redeemed once, right or wrong
+	f.mu.Lock()
+	c, ok := f.codes[r.PostForm.Get("code")]
+	delete(f.codes, r.PostForm.Get("code"))
+	f.mu.Unlock()
+
+	switch {
+	case r.PostForm.Get("grant_type") != "authorization_code":
+		writeFakeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	case clientID != f.ClientID:
+		writeFakeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	case !ok || time.Since(c.issued) > fakeCodeTimeout || r.PostForm.Get("redirect_uri") != c.redirectURI:
+		writeFakeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	case challenge(r.PostForm.Get("code_verifier")) != c.challenge:
+		writeFakeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+		return
+	}
+
+	idToken, err := f.Sign(f.IDClaims(c.nonce, time.Now()))
+	if err != nil {
+		writeFakeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+
+	writeFakeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": "fake",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+func writeFakeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,229 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testClientID = "cieloverde"
+
+func newTestProvider(t *testing.T) (*FakeProvider, *Provider) {
+	t.Helper()
+
+	fake, err := NewFakeProvider("", testClientID, map[string]interface{}{"sub": "alice", "groups": []string{"organizers"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	fake.Issuer = srv.URL
+
+	return fake, &Provider{
+		Issuer:      srv.URL,
+		ClientID:    testClientID,
+		RedirectURL: "https://cieloverde.io/login/oidc/callback",
+		Scopes:      []string{"email"},
+		Client:      srv.Client(),
+	}
+}
+
+// authorize follows the authorization URL to the fake provider and returns
+// the code and state it redirects back with.
+func authorize(t *testing.T, p *Provider, state, nonce, verifier string) (string, string) {
+	t.Helper()
+
+	u, err := p.AuthCodeURL(context.Background(), state, nonce, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := *p.Client
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorization endpoint answered %s", resp.Status)
+	}
+
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(loc.String(), p.RedirectURL+"?") {
+		t.Fatalf("redirected to %s, not the redirect URL", loc)
+	}
+
+	return loc.Query().Get("code"), loc.Query().Get("state")
+}
+
+func TestExchange(t *testing.T) {
+	_, p := newTestProvider(t)
+	ctx := context.Background()
+
+	code, state := authorize(t, p, "the-state", "the-nonce", "the-verifier")
+	if state != "the-state" {
+		t.Errorf("state = %q, want %q", state, "the-state")
+	}
+
+	claims, err := p.Exchange(ctx, code, "the-verifier", "the-nonce")
+	if err != nil {
+		t.Fatalf("Exchange: %s", err)
+	}
+	if sub := claims.String("sub"); sub != "alice" {
+		t.Errorf("sub = %q, want alice", sub)
+	}
+	if groups := claims.Strings("groups"); len(groups) != 1 || groups[0] != "organizers" {
+		t.Errorf("groups = %q, want [organizers]", groups)
+	}
+
+	// codes are single use
+	if _, err := p.Exchange(ctx, code, "the-verifier", "the-nonce"); err == nil {
+		t.Error("Exchange accepted a code twice")
+	}
+}
+
+func TestExchangeRejects(t *testing.T) {
+	tests := []struct {
+		name             string
+		verifier, nonce  string
+		clientID, secret string
+	}{
+		{name: "wrong PKCE verifier", verifier: "another-verifier", nonce: "the-nonce", clientID: testClientID},
+		{name: "nonce mismatch", verifier: "the-verifier", nonce: "another-nonce", clientID: testClientID},
+		{name: "unknown client", verifier: "the-verifier", nonce: "the-nonce", clientID: "someone-else", secret: "s3cret"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, p := newTestProvider(t)
+			code, _ := authorize(t, p, "the-state", "the-nonce", "the-verifier")
+
+			p.ClientID, p.ClientSecret = tt.clientID, tt.secret
+			if _, err := p.Exchange(context.Background(), code, tt.verifier, tt.nonce); err == nil {
+				t.Error("Exchange succeeded")
+			}
+		})
+	}
+}
+
+// token builds an ID token from raw header and claims, with sig as its
+// signature.
+func token(t *testing.T, header, claims map[string]interface{}, sig []byte) string {
+	t.Helper()
+
+	h, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c) + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestVerify(t *testing.T) {
+	fake, p := newTestProvider(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	with := func(changes map[string]interface{}) map[string]interface{} {
+		claims := fake.IDClaims("the-nonce", now)
+		for k, v := range changes {
+			if v == nil {
+				delete(claims, k)
+			} else {
+				claims[k] = v
+			}
+		}
+		return claims
+	}
+	sign := func(claims map[string]interface{}) string {
+		raw, err := fake.Sign(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+
+	valid := sign(with(nil))
+	parts := strings.Split(valid, ".")
+
+	tests := []struct {
+		name  string
+		raw   string
+		valid bool
+	}{
+		{name: "valid", raw: valid, valid: true},
+		{name: "audience list with azp", raw: sign(with(map[string]interface{}{"aud": []string{testClientID, "other"}, "azp": testClientID})), valid: true},
+		{name: "within clock skew", raw: sign(with(map[string]interface{}{"exp": now.Add(-time.Minute).Unix()})), valid: true},
+		{
+			name: "signed with another key",
+			raw: func() string {
+				raw, err := signRS256(otherKey, fake.KeyID, with(nil))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return raw
+			}(),
+		},
+		{
+			name: "claims changed after signing",
+			raw: func() string {
+				c, _ := json.Marshal(with(map[string]interface{}{"sub": "mallory"}))
+				return parts[0] + "." + base64.RawURLEncoding.EncodeToString(c) + "." + parts[2]
+			}(),
+		},
+		{name: "alg none", raw: token(t, map[string]interface{}{"alg": "none", "kid": fake.KeyID}, with(nil), nil)},
+		{name: "alg HS256", raw: token(t, map[string]interface{}{"alg": "HS256", "kid": fake.KeyID}, with(nil), []byte("mac"))},
+		{name: "unknown kid", raw: token(t, map[string]interface{}{"alg": "RS256", "kid": "other"}, with(nil), []byte("sig"))},
+		{name: "wrong issuer", raw: sign(with(map[string]interface{}{"iss": "https://evil.example.com"}))},
+		{name: "wrong audience", raw: sign(with(map[string]interface{}{"aud": "another-client"}))},
+		{name: "audience list without azp", raw: sign(with(map[string]interface{}{"aud": []string{testClientID, "other"}}))},
+		{name: "expired", raw: sign(with(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()}))},
+		{name: "no expiry", raw: sign(with(map[string]interface{}{"exp": nil}))},
+		{name: "issued in the future", raw: sign(with(map[string]interface{}{"iat": now.Add(time.Hour).Unix()}))},
+		{name: "nonce mismatch", raw: sign(with(map[string]interface{}{"nonce": "another-nonce"}))},
+		{name: "no nonce", raw: sign(with(map[string]interface{}{"nonce": nil}))},
+		{name: "no subject", raw: sign(with(map[string]interface{}{"sub": nil}))},
+		{name: "malformed", raw: "not.a-token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := p.Verify(ctx, tt.raw, "the-nonce", now)
+			if tt.valid && err != nil {
+				t.Errorf("Verify: %s", err)
+			}
+			if !tt.valid && err == nil {
+				t.Errorf("Verify accepted the token, with claims %v", claims)
+			}
+		})
+	}
+}
+
+func TestChallenge(t *testing.T) {
+	// RFC 7636, appendix B
+	got := challenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+	if want := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"; got != want {
+		t.Errorf("challenge = %q, want %q", got, want)
+	}
+}
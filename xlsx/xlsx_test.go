@@ -0,0 +1,137 @@
+package xlsx
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// readPart returns the contents of a part of the archive.
+func readPart(t *testing.T, zr *zip.Reader, name string) []byte {
+	t.Helper()
+
+	f, err := zr.Open(name)
+	if err != nil {
+		t.Fatalf("open %s: %s", name, err)
+	}
+	defer f.Close()
+
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("read %s: %s", name, err)
+	}
+
+	return b
+}
+
+func TestWriter(t *testing.T) {
+	tests := []struct {
+		name string
+		rows [][]string
+		want [][]string
+	}{
+		{name: "empty"},
+		{
+			name: "text",
+			rows: [][]string{{"Nombre", "Cédula"}, {"Ana María", "1020304050"}},
+			want: [][]string{{"Nombre", "Cédula"}, {"Ana María", "1020304050"}},
+		},
+		{
+			name: "markup is escaped",
+			rows: [][]string{{"<b>Ana</b> & \"Luis\"", "]]>"}},
+			want: [][]string{{"<b>Ana</b> & \"Luis\"", "]]>"}},
+		},
+		{
+			name: "formulas stay text",
+			rows: [][]string{{"=HYPERLINK(\"http://evil\")", "+573001234567"}},
+			want: [][]string{{"=HYPERLINK(\"http://evil\")", "+573001234567"}},
+		},
+		{
+			name: "spaces and line breaks are kept",
+			rows: [][]string{{"  Calle 1\nApto 2  ", "a\tb"}},
+			want: [][]string{{"  Calle 1\nApto 2  ", "a\tb"}},
+		},
+		{
+			name: "control characters are dropped",
+			rows: [][]string{{"a\x00b\x1bc", "\uFFFE"}},
+			want: [][]string{{"abc", ""}},
+		},
+		{
+			name: "empty cells",
+			rows: [][]string{{"", "x", ""}, {}},
+			want: [][]string{{"", "x", ""}, nil},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := NewWriter(&buf, "Registros & más")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, row := range tt.rows {
+				if err := w.WriteRow(row); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatalf("not a zip archive: %s", err)
+			}
+
+			for _, part := range []string{"[Content_Types].xml", "_rels/.rels", "xl/_rels/workbook.xml.rels"} {
+				var v struct{}
+				if err := xml.Unmarshal(readPart(t, zr, part), &v); err != nil {
+					t.Errorf("%s isn't XML: %s", part, err)
+				}
+			}
+
+			var wb struct {
+				Sheets []struct {
+					Name string `xml:"name,attr"`
+				} `xml:"sheets>sheet"`
+			}
+			if err := xml.Unmarshal(readPart(t, zr, "xl/workbook.xml"), &wb); err != nil {
+				t.Fatalf("workbook isn't XML: %s", err)
+			}
+			if len(wb.Sheets) != 1 || wb.Sheets[0].Name != "Registros & más" {
+				t.Errorf("sheets = %+v, want one named %q", wb.Sheets, "Registros & más")
+			}
+
+			var sheet struct {
+				Rows []struct {
+					Cells []struct {
+						Type string `xml:"t,attr"`
+						Text string `xml:"is>t"`
+					} `xml:"c"`
+				} `xml:"sheetData>row"`
+			}
+			if err := xml.Unmarshal(readPart(t, zr, "xl/worksheets/sheet1.xml"), &sheet); err != nil {
+				t.Fatalf("sheet isn't XML: %s", err)
+			}
+
+			var got [][]string
+			for _, row := range sheet.Rows {
+				var cells []string
+				for _, c := range row.Cells {
+					if c.Type != "inlineStr" {
+						t.Errorf("cell %q has type %q, want inlineStr", c.Text, c.Type)
+					}
+					cells = append(cells, c.Text)
+				}
+				got = append(got, cells)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rows = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}